@@ -0,0 +1,136 @@
+package dvara
+
+import (
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReusePort(t *testing.T) {
+	t.Parallel()
+	if !socketOptionsSupported {
+		t.Skip("SO_REUSEPORT is not supported on this platform")
+	}
+	r := &ReplicaSet{ReusePort: true}
+	first, err := r.listen("127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer first.Close()
+	second, err := r.listen(first.Addr().String())
+	ensure.Nil(t, err)
+	defer second.Close()
+
+	_, err = (&ReplicaSet{}).listen(first.Addr().String())
+	ensure.NotNil(t, err)
+}
+
+func TestProxyListen(t *testing.T) {
+	t.Parallel()
+	p := newLoopbackProxy(t)
+	p.ReplicaSet.MaxConnections = 1
+	p.ReplicaSet.MaxPerClientConnections = 1
+	p.ReplicaSet.ServerIdleTimeout = time.Hour
+	p.ReplicaSet.ServerClosePoolSize = 1
+	p.ReplicaSet.ClientIdleTimeout = time.Minute
+	p.ProxyAddr = "127.0.0.1:0"
+	if socketOptionsSupported {
+		p.ReplicaSet.ListenBacklog = 16
+	}
+	ensure.Nil(t, p.Listen())
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.Addr().String())
+	ensure.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write(queryMessage(t, 1, "test.foo", bson.M{"a": "b"}))
+	ensure.Nil(t, err)
+	ensure.Nil(t, copyMessage(ioutil.Discard, c))
+}
+
+func newAcceptProxy(t testing.TB, acceptors uint) *Proxy {
+	return startLoopbackProxy(t, func(p *Proxy) {
+		p.ReplicaSet.MaxConnections = 4
+		p.ReplicaSet.MaxPerClientConnections = 1000
+		p.ReplicaSet.AcceptGoroutines = acceptors
+	})
+}
+
+func TestAcceptGoroutines(t *testing.T) {
+	t.Parallel()
+	p := newAcceptProxy(t, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id int32) {
+			defer wg.Done()
+			c, err := net.Dial("tcp", p.Addr().String())
+			ensure.Nil(t, err)
+			defer c.Close()
+			_, err = c.Write(queryMessage(t, id, "test.foo", bson.M{"a": "b"}))
+			ensure.Nil(t, err)
+			ensure.Nil(t, copyMessage(ioutil.Discard, c))
+		}(int32(i))
+	}
+	wg.Wait()
+	ensure.Nil(t, p.Stop())
+}
+
+// benchmarkAccept measures how fast clients are accepted, each connecting and
+// going away right after.
+func benchmarkAccept(b *testing.B, acceptors uint) {
+	p := newAcceptProxy(b, acceptors)
+	defer p.Stop()
+	addr := p.Addr().String()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			c.Close()
+		}
+	})
+}
+
+func BenchmarkAccept1(b *testing.B) { benchmarkAccept(b, 1) }
+func BenchmarkAccept8(b *testing.B) { benchmarkAccept(b, 8) }
+
+// BenchmarkIdleClients measures the memory each client connection takes once
+// it made a query and sits idle, as during a connection storm. Run it with
+// -benchtime=10000x to hold 10k clients at once.
+func BenchmarkIdleClients(b *testing.B) {
+	p := newAcceptProxy(b, 1)
+	p.ReplicaSet.ReadBufferSize = 16 * 1024
+	p.ReplicaSet.MaxPerClientConnections = uint(b.N) + 1
+	p.maxPerClientConnections.setMax(uint(b.N) + 1)
+	defer p.Stop()
+	addr := p.Addr().String()
+	msg := queryMessage(b, 1, "test.foo", bson.M{"a": "b"})
+	clients := make([]net.Conn, 0, b.N)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		clients = append(clients, c)
+		if _, err := c.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if err := copyMessage(ioutil.Discard, c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/facebookgo/stats"
+)
+
+var errOpCodeNotAllowed = errors.New("dvara: opcode not allowed")
+
+// requestOpCodes are the opcodes clients can send.
+var requestOpCodes = []OpCode{
+	OpMessage, OpUpdate, OpInsert, OpQuery, OpGetMore, OpDelete, OpKillCursors, OpCompressed, OpMsg,
+}
+
+// opCodeByName returns the request opcode with the given name, as returned by
+// OpCode.String.
+func opCodeByName(name string) (OpCode, bool) {
+	for _, c := range requestOpCodes {
+		if c.String() == name {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// newAllowedOpCodes returns the set of the named opcodes, or nil if all are
+// allowed. Unknown names are left out, validate reports them.
+func newAllowedOpCodes(names []string) map[OpCode]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	allowed := make(map[OpCode]bool, len(names))
+	for _, name := range names {
+		if c, ok := opCodeByName(name); ok {
+			allowed[c] = true
+		}
+	}
+	return allowed
+}
+
+// opCodeAllowed returns true if clients may send the message, given its body
+// if it is an OP_QUERY. The isMaster handshake is always allowed, as drivers
+// send it as an OP_QUERY whichever protocol they use afterwards.
+func (p *Proxy) opCodeAllowed(h *messageHeader, query []byte) bool {
+	if p.allowedOpCodes == nil || p.allowedOpCodes[h.OpCode] {
+		return true
+	}
+	if h.OpCode == OpQuery {
+		name, ok := p.ReplicaSet.namespaces().queryCommand(query)
+		return ok && isMasterCommands[name]
+	}
+	return false
+}
+
+// inspectsOpCodes returns true if the body of queries is needed to tell
+// whether they are allowed.
+func (p *Proxy) inspectsOpCodes() bool {
+	return p.allowedOpCodes != nil && !p.allowedOpCodes[OpQuery]
+}
+
+// rejectOpCode rejects a message whose opcode is not allowed. Clients
+// expecting a response get an error, the others are disconnected as they
+// would otherwise never find out, for instance that their writes were dropped.
+func (p *Proxy) rejectOpCode(h *messageHeader, client net.Conn) error {
+	stats.BumpSum(p.stats, "client.rejected.opcode", 1)
+	hasResponse := h.OpCode.HasResponse()
+	if h.OpCode == OpMsg {
+		var err error
+		if client, hasResponse, err = readMsgFlags(h, client); err != nil {
+			return err
+		}
+	}
+	if !hasResponse {
+		return errOpCodeNotAllowed
+	}
+	return rejectMessage(h, client, ErrorCodeOpCodeNotAllowed,
+		fmt.Sprintf("dvara: %s messages are not allowed", h.OpCode))
+}
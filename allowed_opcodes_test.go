@@ -0,0 +1,65 @@
+package dvara
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOpCodeAllowed(t *testing.T) {
+	t.Parallel()
+	legacy := &Proxy{allowedOpCodes: newAllowedOpCodes([]string{"QUERY", "GET_MORE", "INSERT"})}
+	msgOnly := &Proxy{allowedOpCodes: newAllowedOpCodes([]string{"MSG"})}
+	all := &Proxy{}
+	find := queryBody(t, "test.foo", bson.M{"a": 1})
+	isMaster := queryBody(t, "admin.$cmd", bson.M{"isMaster": 1})
+	cases := []struct {
+		Proxy   *Proxy
+		OpCode  OpCode
+		Query   []byte
+		Allowed bool
+	}{
+		{legacy, OpQuery, find, true},
+		{legacy, OpInsert, nil, true},
+		{legacy, OpMsg, nil, false},
+		{legacy, OpDelete, nil, false},
+		{msgOnly, OpMsg, nil, true},
+		{msgOnly, OpQuery, isMaster, true},
+		{msgOnly, OpQuery, find, false},
+		{msgOnly, OpQuery, queryBody(t, "test.$cmd", bson.M{"insert": "foo"}), false},
+		{msgOnly, OpInsert, nil, false},
+		{all, OpMsg, nil, true},
+		{all, OpInsert, nil, true},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, c.Proxy.opCodeAllowed(&messageHeader{OpCode: c.OpCode}, c.Query), c.Allowed, c)
+	}
+	ensure.True(t, msgOnly.inspectsOpCodes())
+	ensure.False(t, legacy.inspectsOpCodes())
+	ensure.False(t, all.inspectsOpCodes())
+}
+
+func TestRejectOpCode(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{}
+	body := getMoreBody("test.foo", 5)
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpGetMore}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	ensure.Nil(t, p.rejectOpCode(h, client))
+	ensure.DeepEqual(t, errorReplyCode(t, client.w.Bytes()), ErrorCodeOpCodeNotAllowed)
+
+	insert := legacyWriteMessage(t, OpInsert, "test.foo")
+	h.FromWire(insert)
+	client = &bufferConn{r: bytes.NewReader(insert[headerLen:])}
+	ensure.DeepEqual(t, p.rejectOpCode(h, client), errOpCodeNotAllowed)
+	ensure.DeepEqual(t, client.w.Len(), 0)
+
+	// An OP_MSG with moreToCome expects no response either.
+	body = msgBody(t, opMsgMoreToCome, msgSection{Documents: []interface{}{bson.M{"ping": 1}}})
+	h = &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpMsg}
+	client = &bufferConn{r: bytes.NewReader(body)}
+	ensure.DeepEqual(t, p.rejectOpCode(h, client), errOpCodeNotAllowed)
+	ensure.DeepEqual(t, client.w.Len(), 0)
+}
@@ -0,0 +1,107 @@
+package dvara
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultCaptureBufferBytes is how many bytes each client connection may have
+// waiting to be captured or teed unless CaptureBufferBytes says otherwise.
+const defaultCaptureBufferBytes = 1 << 20
+
+// asyncWriterQueue is how many writes an asyncWriter holds at most, whatever
+// their size.
+const asyncWriterQueue = 1024
+
+// asyncWriter writes to a file or stdout from its own goroutine, so a slow
+// writer doesn't hold up the client connections whose traffic is written.
+// Each connection queues through an asyncBuffer bounding how much of its
+// traffic may be waiting, and what doesn't fit is dropped.
+type asyncWriter struct {
+	w      io.Writer
+	queue  chan asyncWrite
+	done   chan struct{}
+	mutex  sync.RWMutex
+	closed bool // guarded by mutex
+}
+
+type asyncWrite struct {
+	b    []byte
+	from *asyncBuffer
+}
+
+// asyncBuffer is the share of an asyncWriter of one client connection.
+type asyncBuffer struct {
+	writer   *asyncWriter
+	buffered int64 // atomic, bytes queued and not yet written
+	max      int64
+
+	// written is called from the writer goroutine once a write of the
+	// connection was done, with its error.
+	written func(err error)
+}
+
+func newAsyncWriter(w io.Writer) *asyncWriter {
+	a := &asyncWriter{
+		w:     w,
+		queue: make(chan asyncWrite, asyncWriterQueue),
+		done:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncWriter) run() {
+	defer close(a.done)
+	for w := range a.queue {
+		_, err := a.w.Write(w.b)
+		atomic.AddInt64(&w.from.buffered, -int64(len(w.b)))
+		if w.from.written != nil {
+			w.from.written(err)
+		}
+	}
+}
+
+// buffer returns the share of the writer of a connection, which may have up
+// to max bytes waiting to be written.
+func (a *asyncWriter) buffer(max int, written func(err error)) *asyncBuffer {
+	if max <= 0 {
+		max = defaultCaptureBufferBytes
+	}
+	return &asyncBuffer{writer: a, max: int64(max), written: written}
+}
+
+// close waits for the queued writes to be done. Later writes are dropped.
+func (a *asyncWriter) close() {
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.queue)
+	a.mutex.Unlock()
+	<-a.done
+}
+
+// write queues b to be written, which the caller must no longer modify. It
+// returns false if b was dropped, because the connection has too much waiting
+// already, the writer is full or it was closed.
+func (b *asyncBuffer) write(p []byte) bool {
+	if atomic.AddInt64(&b.buffered, int64(len(p))) > b.max {
+		atomic.AddInt64(&b.buffered, -int64(len(p)))
+		return false
+	}
+	b.writer.mutex.RLock()
+	defer b.writer.mutex.RUnlock()
+	if !b.writer.closed {
+		select {
+		case b.writer.queue <- asyncWrite{b: p, from: b}:
+			return true
+		default:
+		}
+	}
+	atomic.AddInt64(&b.buffered, -int64(len(p)))
+	return false
+}
@@ -0,0 +1,86 @@
+package dvara
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// blockedWriter holds writes until unblocked.
+type blockedWriter struct {
+	bytes.Buffer
+	unblock chan struct{}
+}
+
+func (w *blockedWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	return w.Buffer.Write(b)
+}
+
+func TestAsyncWriter(t *testing.T) {
+	t.Parallel()
+	out := &blockedWriter{unblock: make(chan struct{})}
+	a := newAsyncWriter(out)
+	var written int32
+	first := a.buffer(10, func(err error) {
+		ensure.Nil(t, err)
+		atomic.AddInt32(&written, 1)
+	})
+	second := a.buffer(10, nil)
+
+	// each connection has its own allowance while the writer is stuck
+	ensure.True(t, first.write([]byte("aaaaaa")))
+	ensure.False(t, first.write([]byte("bbbbbb")))
+	ensure.True(t, first.write([]byte("cccc")))
+	ensure.True(t, second.write([]byte("dddddddddd")))
+	ensure.DeepEqual(t, atomic.LoadInt64(&first.buffered), int64(10))
+
+	close(out.unblock)
+	a.close()
+	ensure.DeepEqual(t, out.String(), "aaaaaaccccdddddddddd")
+	ensure.DeepEqual(t, atomic.LoadInt32(&written), int32(2))
+	ensure.DeepEqual(t, atomic.LoadInt64(&first.buffered), int64(0))
+	ensure.DeepEqual(t, atomic.LoadInt64(&second.buffered), int64(0))
+
+	// writes after closing are dropped
+	ensure.False(t, first.write([]byte("e")))
+	a.close()
+}
+
+func TestAsyncWriterDefaultBuffer(t *testing.T) {
+	t.Parallel()
+	a := newAsyncWriter(&bytes.Buffer{})
+	defer a.close()
+	ensure.DeepEqual(t, a.buffer(0, nil).max, int64(defaultCaptureBufferBytes))
+}
+
+// failingWriteCloser fails every write.
+type failingWriteCloser struct{}
+
+func (failingWriteCloser) Write(b []byte) (int, error) { return 0, errors.New("disk full") }
+func (failingWriteCloser) Close() error                { return nil }
+
+func TestCaptureDroppedAndFailed(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			capture:            newCaptureWriter(failingWriteCloser{}, false),
+			CaptureBufferBytes: 1,
+		},
+		Clock: clock.NewMock(),
+		stats: &rec,
+	}
+	msg := queryMessage(t, 1, "test.foo", bson.M{})
+	big := p.ReplicaSet.capture.async.buffer(len(msg)+captureFrameHeaderLen, p.captureWritten)
+	p.capture(big, msg)
+	p.capture(p.ReplicaSet.capture.async.buffer(p.ReplicaSet.CaptureBufferBytes, p.captureWritten), msg)
+	ensure.Nil(t, p.ReplicaSet.capture.Close())
+	ensure.DeepEqual(t, rec.sum("capture.dropped"), float64(1))
+	ensure.DeepEqual(t, rec.sum("capture.error"), float64(1))
+}
@@ -35,6 +35,10 @@ import (
 	"gopkg.in/mgo.v2-unstable/bson"
 )
 
+// defaultAuthSource is the database users are defined in unless an auth source
+// is configured.
+const defaultAuthSource = "admin"
+
 // Credential holds details to authenticate with a MongoDB server.
 type Credential struct {
 	// Username and Password hold the basic details for authentication.
@@ -146,5 +150,8 @@ func (socket *mongoSocket) Login(cred Credential) error {
 	if err != nil {
 		return err
 	}
-	return err
+	if !res.Ok {
+		return fmt.Errorf("authentication failed: %s", res.ErrMsg)
+	}
+	return nil
 }
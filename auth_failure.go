@@ -0,0 +1,33 @@
+package dvara
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// authFailed counts a new server connection failing to authenticate. When
+// AuthFailureFlushThreshold of them fail in a row the pools are flushed of
+// their idle connections, once until a connection authenticates again, so
+// that the stale credentials show up as a clear failure rather than only some
+// messages failing.
+func (p *Proxy) authFailed() {
+	threshold := p.ReplicaSet.AuthFailureFlushThreshold
+	if threshold == 0 || atomic.AddUint32(&p.authFailures, 1) != uint32(threshold) {
+		return
+	}
+	stats.BumpSum(p.stats, "server.auth.mass.failure", 1)
+	corelog.LogErrorMessage(fmt.Sprintf(
+		"%d server connections in a row failed to authenticate for %s, credentials may be stale, closing idle server connections",
+		threshold, p))
+	p.eachPool(func(addr string, pool ConnPool) {
+		pool.CloseIdle()
+	})
+}
+
+// authSucceeded resets the count of authentication failures in a row.
+func (p *Proxy) authSucceeded() {
+	atomic.StoreUint32(&p.authFailures, 0)
+}
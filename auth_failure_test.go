@@ -0,0 +1,84 @@
+package dvara
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// idleClosingPool is a ConnPool counting the calls to CloseIdle.
+type idleClosingPool struct {
+	ConnPool
+	closedIdle int
+}
+
+func (c *idleClosingPool) CloseIdle() {
+	c.closedIdle++
+}
+
+func TestAuthFailedFlushesPools(t *testing.T) {
+	t.Parallel()
+	hc := &statsRecorder{}
+	pool := &idleClosingPool{}
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{AuthFailureFlushThreshold: 2},
+		serverPool: pool,
+		stats:      hc,
+	}
+	p.authFailed()
+	p.authSucceeded()
+	p.authFailed()
+	ensure.DeepEqual(t, pool.closedIdle, 0)
+	p.authFailed()
+	ensure.DeepEqual(t, pool.closedIdle, 1)
+	ensure.DeepEqual(t, hc.sum("server.auth.mass.failure"), float64(1))
+
+	// The pools are flushed once until a connection authenticates again.
+	p.authFailed()
+	ensure.DeepEqual(t, pool.closedIdle, 1)
+	p.UpdateCredentials("u", "new", false)
+	p.authFailed()
+	p.authFailed()
+	ensure.DeepEqual(t, pool.closedIdle, 2)
+	ensure.DeepEqual(t, hc.sum("server.auth.mass.failure"), float64(2))
+}
+
+func TestAuthFailedDisabled(t *testing.T) {
+	t.Parallel()
+	pool := &idleClosingPool{}
+	p := &Proxy{ReplicaSet: &ReplicaSet{}, serverPool: pool}
+	for i := 0; i < 10; i++ {
+		p.authFailed()
+	}
+	ensure.DeepEqual(t, pool.closedIdle, 0)
+}
+
+func TestDialServerConnAuthFailure(t *testing.T) {
+	t.Parallel()
+	pool := &idleClosingPool{}
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{AuthFailureFlushThreshold: 1},
+		Username:   "u",
+		Password:   "stale",
+		Clock:      clock.NewMock(),
+		serverPool: pool,
+	}
+	client, server := net.Pipe()
+	p.ServerDialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return client, nil
+	}
+	go func() {
+		defer server.Close()
+		h, _ := readQuery(t, server)
+		replyDoc(t, server, h, bson.M{"nonce": "abc", "ok": 1})
+		h, _ = readQuery(t, server)
+		replyDoc(t, server, h, bson.M{"ok": 0, "errmsg": "auth failed", "code": 18})
+	}()
+	_, err := p.dialServerConn("a:1", nil)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, pool.closedIdle, 1)
+}
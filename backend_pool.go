@@ -0,0 +1,112 @@
+package dvara
+
+import (
+	"io"
+
+	"github.com/facebookgo/stats"
+)
+
+// BackendLimits are the connection limits for the pool of connections to one
+// backend. Zero values fall back to the ReplicaSet settings.
+type BackendLimits struct {
+	MaxConnections     uint
+	MinIdleConnections uint
+}
+
+// backendLimits returns the connection limits for the given backend.
+func (r *ReplicaSet) backendLimits(addr string) BackendLimits {
+	limits := BackendLimits{
+		MaxConnections:     r.MaxConnections,
+		MinIdleConnections: r.MinIdleConnections,
+	}
+	if l, ok := r.BackendLimits[addr]; ok {
+		if l.MaxConnections != 0 {
+			limits.MaxConnections = l.MaxConnections
+		}
+		if l.MinIdleConnections != 0 {
+			limits.MinIdleConnections = l.MinIdleConnections
+		}
+	}
+	return limits
+}
+
+// newPool creates the pool of connections to the given backend, with the
+// ReplicaSet's NewPool if set or else as a Pool.
+func (p *Proxy) newPool(addr string, dial func() (io.Closer, error)) ConnPool {
+	if p.ReplicaSet.NewPool != nil {
+		return p.ReplicaSet.NewPool(addr, p.ReplicaSet.backendLimits(addr), dial)
+	}
+	pool := &Pool{New: dial}
+	p.configurePool(pool, addr)
+	return pool
+}
+
+// configurePool sets up a Pool of connections to the given backend. The
+// caller sets New.
+func (p *Proxy) configurePool(pool *Pool, addr string) {
+	limits := p.ReplicaSet.backendLimits(addr)
+	pool.CloseErrorHandler = p.serverCloseErrorHandler
+	pool.Max = limits.MaxConnections
+	pool.MinIdle = limits.MinIdleConnections
+	pool.IdleTimeout = p.ReplicaSet.ServerIdleTimeout
+	pool.ClosePoolSize = p.ReplicaSet.ServerClosePoolSize
+	pool.MaxQueueAge = p.ReplicaSet.MaxQueueAge
+	if age := p.ReplicaSet.MaxServerConnectionAge; age > 0 {
+		pool.Retire = p.retireServerConn
+		pool.RetireInterval = age / serverConnRetireChecks
+	}
+	if interval := p.ReplicaSet.ServerConnProbeInterval; interval > 0 {
+		pool.Probe = p.probeServerConn
+		pool.ProbeInterval = interval
+	}
+
+	// The pool of the proxied server keeps reporting under the unqualified
+	// prefix, in addition to the per backend one.
+	if p.ReplicaSet.Stats != nil {
+		prefixes := []string{"mongoproxy.server.pool." + addr + "."}
+		if addr == p.MongoAddr {
+			prefixes = append(prefixes, "mongoproxy.server.pool.")
+		}
+		pool.Stats = stats.PrefixClient(prefixes, p.ReplicaSet.Stats)
+	}
+}
+
+// backendPool returns the pool of connections to the given backend, creating
+// it if needed. The pool for MongoAddr, or an empty address, is the server
+// pool. Connections to other backends are established without retries.
+func (p *Proxy) backendPool(addr string) ConnPool {
+	if addr == "" || addr == p.MongoAddr {
+		return p.serverPool
+	}
+
+	p.backendPoolsMutex.Lock()
+	defer p.backendPoolsMutex.Unlock()
+	if pool, ok := p.backendPools[addr]; ok {
+		return pool
+	}
+	if p.backendPools == nil {
+		p.backendPools = make(map[string]ConnPool)
+	}
+	var pool ConnPool
+	pool = p.newPool(addr, func() (io.Closer, error) {
+		return p.dialServerConn(addr, pool)
+	})
+	p.backendPools[addr] = pool
+	return pool
+}
+
+// eachPool calls f with the server pool, the database pools and every backend
+// pool.
+func (p *Proxy) eachPool(f func(addr string, pool ConnPool)) {
+	if p.serverPool != nil {
+		f(p.MongoAddr, p.serverPool)
+	}
+	for _, pool := range p.databasePools {
+		f(p.MongoAddr, pool)
+	}
+	p.backendPoolsMutex.Lock()
+	defer p.backendPoolsMutex.Unlock()
+	for addr, pool := range p.backendPools {
+		f(addr, pool)
+	}
+}
@@ -0,0 +1,130 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBackendLimits(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		MaxConnections:     10,
+		MinIdleConnections: 2,
+		BackendLimits: map[string]BackendLimits{
+			"a:1": {MaxConnections: 5},
+			"b:1": {MinIdleConnections: 1},
+		},
+	}
+	ensure.DeepEqual(t, r.backendLimits("a:1"), BackendLimits{MaxConnections: 5, MinIdleConnections: 2})
+	ensure.DeepEqual(t, r.backendLimits("b:1"), BackendLimits{MaxConnections: 10, MinIdleConnections: 1})
+	ensure.DeepEqual(t, r.backendLimits("c:1"), BackendLimits{MaxConnections: 10, MinIdleConnections: 2})
+}
+
+func TestBackendPool(t *testing.T) {
+	t.Parallel()
+	hc := &statsRecorder{}
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			Stats:               hc,
+			MaxConnections:      3,
+			ServerIdleTimeout:   time.Hour,
+			ServerClosePoolSize: 1,
+			BackendLimits: map[string]BackendLimits{
+				"other:1": {MaxConnections: 1},
+			},
+		},
+		MongoAddr: "mongo:1",
+	}
+	server := &Pool{}
+	p.serverPool = server
+	ensure.True(t, p.backendPool("") == p.serverPool)
+	ensure.True(t, p.backendPool("mongo:1") == p.serverPool)
+
+	other := p.backendPool("other:1").(*Pool)
+	ensure.True(t, other == p.backendPool("other:1"))
+	ensure.DeepEqual(t, other.Max, uint(1))
+	ensure.DeepEqual(t, p.backendPool("another:1").(*Pool).Max, uint(3))
+
+	other.Stats.BumpSum("acquire", 1)
+	p.configurePool(server, p.MongoAddr)
+	server.Stats.BumpSum("acquire", 1)
+	ensure.DeepEqual(t, hc.log(), []string{
+		"sum mongoproxy.server.pool.other:1.acquire 1",
+		"sum mongoproxy.server.pool.mongo:1.acquire 1",
+		"sum mongoproxy.server.pool.acquire 1",
+	})
+
+	var pools []string
+	p.eachPool(func(addr string, pool ConnPool) {
+		pools = append(pools, addr)
+	})
+	ensure.DeepEqual(t, len(pools), 3)
+	ensure.DeepEqual(t, pools[0], "mongo:1")
+}
+
+// countingPool is a custom ConnPool counting the connections acquired.
+type countingPool struct {
+	*Pool
+	acquired int32
+}
+
+func (c *countingPool) Acquire() (io.Closer, error) {
+	atomic.AddInt32(&c.acquired, 1)
+	return c.Pool.Acquire()
+}
+
+func TestCustomPool(t *testing.T) {
+	t.Parallel()
+	pools := make(map[string]*countingPool)
+	var mu sync.Mutex
+	p := newLoopbackProxy(t)
+	p.ReplicaSet.MaxConnections = 2
+	p.ReplicaSet.MaxPerClientConnections = 10
+	p.ReplicaSet.ServerIdleTimeout = time.Hour
+	p.ReplicaSet.ServerClosePoolSize = 1
+	p.ReplicaSet.ClientIdleTimeout = time.Minute
+	p.ReplicaSet.BackendLimits = map[string]BackendLimits{"other:1": {MaxConnections: 1}}
+	p.ReplicaSet.NewPool = func(addr string, limits BackendLimits, dial func() (io.Closer, error)) ConnPool {
+		pool := &countingPool{Pool: &Pool{
+			New:           dial,
+			Max:           limits.MaxConnections,
+			IdleTimeout:   time.Hour,
+			ClosePoolSize: 1,
+		}}
+		mu.Lock()
+		pools[addr] = pool
+		mu.Unlock()
+		return pool
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p.ClientListener = l
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write(queryMessage(t, 1, "test.foo", bson.M{"a": "b"}))
+	ensure.Nil(t, err)
+	ensure.Nil(t, copyMessage(ioutil.Discard, c))
+
+	mu.Lock()
+	server := pools[p.MongoAddr]
+	mu.Unlock()
+	ensure.DeepEqual(t, atomic.LoadInt32(&server.acquired), int32(1))
+	ensure.DeepEqual(t, server.Max, uint(2))
+
+	p.backendPool("other:1")
+	mu.Lock()
+	ensure.DeepEqual(t, pools["other:1"].Max, uint(1))
+	mu.Unlock()
+}
@@ -0,0 +1,51 @@
+package dvara
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/stats"
+)
+
+// backpressureInterval is how often a paused accept loop checks whether the
+// server pool is still saturated.
+const backpressureInterval = 100 * time.Millisecond
+
+// saturated returns true if enough clients are waiting for a server connection
+// that new clients should be held back, see ReplicaSet.BackpressureWaiting.
+func (p *Proxy) saturated() bool {
+	threshold := p.ReplicaSet.BackpressureWaiting
+	return threshold > 0 && atomic.LoadInt64(&p.acquiring) >= int64(threshold)
+}
+
+// applyBackpressure is called with each accepted client before it is served.
+// While the server pool is saturated it either waits, so that no more clients
+// are accepted and they queue up in the listen backlog instead, or rejects the
+// client if BackpressureReject is set. It returns false if the client is not to
+// be served, in which case it took care of closing it.
+func (p *Proxy) applyBackpressure(c net.Conn) bool {
+	if !p.saturated() {
+		return true
+	}
+	stats.BumpSum(p.stats, "client.shed.backpressure", 1)
+
+	if p.ReplicaSet.BackpressureReject {
+		go func() {
+			defer p.wg.Done()
+			p.rejectClient(c, ErrorCodeBackpressure, "dvara: server connection pool saturated")
+		}()
+		return false
+	}
+
+	for p.saturated() {
+		select {
+		case <-p.closed:
+			c.Close()
+			p.wg.Done()
+			return false
+		case <-p.Clock.After(backpressureInterval):
+		}
+	}
+	return true
+}
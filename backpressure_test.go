@@ -0,0 +1,96 @@
+package dvara
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSaturated(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}}
+	p.acquiring = 10
+	ensure.False(t, p.saturated())
+
+	p.ReplicaSet.BackpressureWaiting = 2
+	p.acquiring = 1
+	ensure.False(t, p.saturated())
+	p.acquiring = 2
+	ensure.True(t, p.saturated())
+}
+
+func TestApplyBackpressureNotSaturated(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{BackpressureWaiting: 1}}
+	ensure.True(t, p.applyBackpressure(&pipeConn{}))
+}
+
+func TestApplyBackpressureReject(t *testing.T) {
+	t.Parallel()
+	hc := &statsRecorder{}
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{BackpressureWaiting: 1, BackpressureReject: true},
+		Clock:      clock.New(),
+		stats:      hc,
+		acquiring:  1,
+	}
+	client, server := net.Pipe()
+	p.wg.Add(1)
+	ensure.False(t, p.applyBackpressure(server))
+	ensure.DeepEqual(t, hc.sum("client.shed.backpressure"), float64(1))
+
+	_, err := client.Write(queryMessage(t, 5, "test.foo", bson.M{}))
+	ensure.Nil(t, err)
+	var doc bson.M
+	_, _, _, err = (&ReplyRW{}).ReadOne(client, &doc)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, doc["code"], ErrorCodeBackpressure)
+	p.wg.Wait()
+}
+
+func TestApplyBackpressurePause(t *testing.T) {
+	t.Parallel()
+	mock := clock.NewMock()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{BackpressureWaiting: 1},
+		Clock:      mock,
+		closed:     make(chan struct{}),
+		acquiring:  1,
+	}
+	served := make(chan bool)
+	go func() {
+		served <- p.applyBackpressure(&pipeConn{})
+	}()
+
+	atomic.StoreInt64(&p.acquiring, 0)
+	for {
+		select {
+		case ok := <-served:
+			ensure.True(t, ok)
+			return
+		default:
+			mock.Add(backpressureInterval)
+		}
+	}
+}
+
+func TestApplyBackpressurePauseStopped(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{BackpressureWaiting: 1},
+		Clock:      clock.NewMock(),
+		closed:     make(chan struct{}),
+		acquiring:  1,
+	}
+	client, server := net.Pipe()
+	p.wg.Add(1)
+	close(p.closed)
+	ensure.False(t, p.applyBackpressure(server))
+	p.wg.Wait()
+	_, err := client.Read(make([]byte, 1))
+	ensure.NotNil(t, err)
+}
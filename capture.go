@@ -0,0 +1,243 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+var errMalformedCapture = errors.New("dvara: malformed capture frame")
+
+// captureFrameHeaderLen is the length of the fields preceding each message in
+// a capture: int64 capture time in nanoseconds since the epoch, int32 message
+// length. Both are little endian like the wire protocol.
+const captureFrameHeaderLen = 12
+
+// mutatingCommands are the commands which modify data. They are left out of
+// captures along with the mutation opcodes unless CaptureMutations is set.
+var mutatingCommands = []string{
+	"insert", "update", "delete", "findAndModify", "findandmodify", "mapReduce",
+	"create", "drop", "dropDatabase", "createIndexes", "dropIndexes",
+	"renameCollection",
+}
+
+// captureWriter writes the messages clients send to a capture file. It is
+// shared by all the proxies of a ReplicaSet. Client messages are written in the
+// background, see CaptureBufferBytes.
+type captureWriter struct {
+	mutex     sync.Mutex
+	w         io.WriteCloser
+	async     *asyncWriter
+	mutations bool
+}
+
+func openCaptureWriter(path string, mutations bool) (*captureWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return newCaptureWriter(f, mutations), nil
+}
+
+func newCaptureWriter(w io.WriteCloser, mutations bool) *captureWriter {
+	c := &captureWriter{w: w, mutations: mutations}
+	c.async = newAsyncWriter(c)
+	return c
+}
+
+// captures returns true if the message should be written to the capture.
+func (c *captureWriter) captures(msg []byte, ns namespaces) bool {
+	if c.mutations {
+		return true
+	}
+	var h messageHeader
+	h.FromWire(msg)
+	if h.OpCode.IsMutation() {
+		return false
+	}
+	if h.OpCode != OpQuery && h.OpCode != OpMsg {
+		return true
+	}
+	name, ok := ns.messageCommand(h.OpCode, msg[headerLen:])
+	return !ok || !isMutatingCommand(name)
+}
+
+// record writes a frame holding the message, captured at the given time.
+func (c *captureWriter) record(t time.Time, msg []byte) error {
+	_, err := c.Write(captureFrame(t, msg))
+	return err
+}
+
+// captureFrame returns the frame holding the message, captured at the given
+// time.
+func captureFrame(t time.Time, msg []byte) []byte {
+	frame := make([]byte, 0, captureFrameHeaderLen+len(msg))
+	frame = addInt64(frame, t.UnixNano())
+	frame = addInt32(frame, int32(len(msg)))
+	return append(frame, msg...)
+}
+
+// Write writes whole frames to the capture.
+func (c *captureWriter) Write(frame []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.w.Write(frame)
+}
+
+// Close writes the frames still queued and closes the capture.
+func (c *captureWriter) Close() error {
+	if c.async != nil {
+		c.async.close()
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.w.Close()
+}
+
+func isMutatingCommand(name string) bool {
+	for _, c := range mutatingCommands {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// captureConn records the messages read from a client connection as they are
+// read, once they are complete.
+type captureConn struct {
+	net.Conn
+	proxy   *Proxy
+	buffer  *asyncBuffer
+	pending []byte
+	broken  bool
+}
+
+// captureIf wraps the client connection to capture its messages if the
+// ReplicaSet has a CaptureFile.
+func (p *Proxy) captureIf(c net.Conn) net.Conn {
+	capture := p.ReplicaSet.capture
+	if capture == nil {
+		return c
+	}
+	return &captureConn{
+		Conn:   c,
+		proxy:  p,
+		buffer: capture.async.buffer(p.ReplicaSet.CaptureBufferBytes, p.captureWritten),
+	}
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n == 0 || c.broken {
+		return n, err
+	}
+	c.pending = append(c.pending, b[:n]...)
+	for len(c.pending) >= headerLen {
+		length := int(getInt32(c.pending, 0))
+		if length < headerLen || length > maxMessageLength {
+			// The proxy fails reading the message too, stop capturing.
+			c.broken = true
+			c.pending = nil
+			break
+		}
+		if len(c.pending) < length {
+			break
+		}
+		c.proxy.capture(c.buffer, c.pending[:length])
+		c.pending = c.pending[length:]
+	}
+	if len(c.pending) == 0 {
+		c.pending = c.pending[:0]
+	}
+	return n, err
+}
+
+// capture queues the message to be written to the capture. It is dropped
+// rather than holding up the client if the capture falls behind.
+func (p *Proxy) capture(buffer *asyncBuffer, msg []byte) {
+	if !p.ReplicaSet.capture.captures(msg, p.ReplicaSet.namespaces()) {
+		stats.BumpSum(p.stats, "capture.filtered", 1)
+		return
+	}
+	if !buffer.write(captureFrame(p.Clock.Now(), msg)) {
+		stats.BumpSum(p.stats, "capture.dropped", 1)
+	}
+}
+
+// captureWritten counts a message written to the capture.
+func (p *Proxy) captureWritten(err error) {
+	if err != nil {
+		corelog.LogErrorMessage(fmt.Sprintf("Capturing message failed: %s", err))
+		stats.BumpSum(p.stats, "capture.error", 1)
+		return
+	}
+	stats.BumpSum(p.stats, "capture.recorded", 1)
+}
+
+// readCaptureFrame reads the next message of a capture along with the time it
+// was captured at. It returns io.EOF at the end of the capture.
+func readCaptureFrame(r io.Reader) (time.Time, []byte, error) {
+	var fields [captureFrameHeaderLen]byte
+	if _, err := io.ReadFull(r, fields[:]); err != nil {
+		return time.Time{}, nil, err
+	}
+	t := time.Unix(0, getInt64(fields[:], 0))
+	length := getInt32(fields[:], 8)
+	if length < headerLen || length > maxMessageLength {
+		return time.Time{}, nil, errMalformedCapture
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return time.Time{}, nil, err
+	}
+	if getInt32(msg, 0) != length {
+		return time.Time{}, nil, errMalformedCapture
+	}
+	return t, msg, nil
+}
+
+// Replay sends the messages of a capture read from r over c, typically a
+// connection to a proxy, reading and discarding their responses. Messages are
+// sent with the same spacing as they were captured with, as measured by the
+// clock, so the original load is reproduced as long as the server keeps up.
+// Messages captured from concurrent clients are sent one after another.
+func Replay(r io.Reader, c io.ReadWriter, clk clock.Clock) error {
+	var first, start time.Time
+	for {
+		t, msg, err := readCaptureFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if start.IsZero() {
+			first, start = t, clk.Now()
+		} else if wait := t.Sub(first) - clk.Now().Sub(start); wait > 0 {
+			clk.Sleep(wait)
+		}
+
+		if _, err := c.Write(msg); err != nil {
+			return err
+		}
+		if expectsResponse(msg) {
+			if err := copyMessage(ioutil.Discard, c); err != nil {
+				return err
+			}
+		}
+	}
+}
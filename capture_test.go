@@ -0,0 +1,179 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// nopWriteCloser records captured frames in memory.
+type nopWriteCloser struct {
+	bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestCaptureWriterCaptures(t *testing.T) {
+	t.Parallel()
+	insert := queryMessage(t, 1, "test.foo", bson.M{})
+	setInt32(insert, 12, int32(OpInsert))
+	cases := []struct {
+		Message   []byte
+		Mutations bool
+		Expected  bool
+	}{
+		{queryMessage(t, 1, "test.foo", bson.M{"a": 1}), false, true},
+		{queryMessage(t, 1, "test.$cmd", bson.M{"count": "foo"}), false, true},
+		{queryMessage(t, 1, "test.$cmd", bson.M{"isMaster": 1}), false, true},
+		{queryMessage(t, 1, "test.$cmd", bson.M{"insert": "foo"}), false, false},
+		{queryMessage(t, 1, "test.$cmd", bson.M{"findAndModify": "foo"}), false, false},
+		{queryMessage(t, 1, "test.$cmd", bson.M{"insert": "foo"}), true, true},
+		{insert, false, false},
+		{insert, true, true},
+		{msgMessage(t, 1, bulkInsert()...), false, false},
+		{msgMessage(t, 1, bulkInsert()...), true, true},
+		{msgMessage(t, 1, msgSection{Documents: []interface{}{bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}}}}), false, true},
+	}
+	for i, c := range cases {
+		w := &captureWriter{mutations: c.Mutations}
+		if actual := w.captures(c.Message, defaultNamespaces); actual != c.Expected {
+			t.Fatalf("case %d: expected %v got %v", i, c.Expected, actual)
+		}
+	}
+}
+
+func TestCaptureConn(t *testing.T) {
+	t.Parallel()
+	query := queryMessage(t, 1, "test.foo", bson.M{"a": 1})
+	insert := queryMessage(t, 2, "test.$cmd", bson.M{"insert": "foo"})
+	count := queryMessage(t, 3, "test.$cmd", bson.M{"count": "foo"})
+	var all []byte
+	for _, m := range [][]byte{query, insert, count} {
+		all = append(all, m...)
+	}
+
+	out := &nopWriteCloser{}
+	mock := clock.NewMock()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{capture: newCaptureWriter(out, false)},
+		Clock:      mock,
+	}
+	c := p.captureIf(&pipeConn{r: iotest.OneByteReader(bytes.NewReader(all))})
+	read, err := ioutil.ReadAll(c)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, read, all)
+	ensure.Nil(t, p.ReplicaSet.capture.Close())
+
+	for _, expected := range [][]byte{query, count} {
+		ts, msg, err := readCaptureFrame(out)
+		ensure.Nil(t, err)
+		ensure.True(t, ts.Equal(mock.Now()))
+		ensure.DeepEqual(t, msg, expected)
+	}
+	_, _, err = readCaptureFrame(out)
+	ensure.DeepEqual(t, err, io.EOF)
+}
+
+func TestCaptureIfDisabled(t *testing.T) {
+	t.Parallel()
+	c := &pipeConn{}
+	p := &Proxy{ReplicaSet: &ReplicaSet{}}
+	ensure.True(t, p.captureIf(c) == c)
+}
+
+func TestReadCaptureFrameErrors(t *testing.T) {
+	t.Parallel()
+	var w captureWriter
+	out := &nopWriteCloser{}
+	w.w = out
+	ensure.Nil(t, w.record(time.Now(), queryMessage(t, 1, "test.foo", bson.M{})))
+	frame := out.Bytes()
+	mismatched := append([]byte(nil), frame...)
+	setInt32(mismatched, captureFrameHeaderLen, 20)
+	short := append([]byte(nil), frame...)
+	setInt32(short, 8, 4)
+
+	cases := []struct {
+		Frame []byte
+		Error error
+	}{
+		{frame[:5], io.ErrUnexpectedEOF},
+		{frame[:captureFrameHeaderLen], io.ErrUnexpectedEOF},
+		{frame[:len(frame)-1], io.ErrUnexpectedEOF},
+		{mismatched, errMalformedCapture},
+		{short, errMalformedCapture},
+	}
+	for _, c := range cases {
+		_, _, err := readCaptureFrame(bytes.NewReader(c.Frame))
+		ensure.DeepEqual(t, err, c.Error)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+	query := queryMessage(t, 1, "test.foo", bson.M{"a": 1})
+	insert := queryMessage(t, 2, "test.foo", bson.M{})
+	setInt32(insert, 12, int32(OpInsert))
+
+	capture := &nopWriteCloser{}
+	w := &captureWriter{w: capture, mutations: true}
+	start := time.Unix(100, 0)
+	ensure.Nil(t, w.record(start, query))
+	ensure.Nil(t, w.record(start.Add(time.Second), insert))
+
+	// Only the query gets a response.
+	proxy := &pipeConn{r: bytes.NewReader(replyMessage(0, 0))}
+	mock := clock.NewMock()
+	done := make(chan error)
+	go func() {
+		done <- Replay(capture, proxy, mock)
+	}()
+	for {
+		select {
+		case err := <-done:
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, proxy.w.Bytes(), append(append([]byte(nil), query...), insert...))
+			return
+		default:
+			mock.Add(100 * time.Millisecond)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestReplicaSetCaptureFile(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "dvara-capture")
+	ensure.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture")
+
+	r := &ReplicaSet{Addrs: "localhost:27017", CaptureFile: path}
+	ensure.Nil(t, r.Start())
+	msg := queryMessage(t, 1, "test.foo", bson.M{})
+	ensure.Nil(t, r.capture.record(time.Unix(1, 0), msg))
+	ensure.Nil(t, r.Stop())
+
+	f, err := os.Open(path)
+	ensure.Nil(t, err)
+	defer f.Close()
+	ts, actual, err := readCaptureFrame(f)
+	ensure.Nil(t, err)
+	ensure.True(t, ts.Equal(time.Unix(1, 0)))
+	ensure.DeepEqual(t, actual, msg)
+}
+
+func TestReplicaSetCaptureFileError(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{Addrs: "localhost:27017", CaptureFile: "/does/not/exist/capture"}
+	ensure.NotNil(t, r.Start())
+}
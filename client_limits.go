@@ -0,0 +1,32 @@
+package dvara
+
+// ClientLimits are the limits for the connections from one client IP. Zero
+// values fall back to the ReplicaSet settings.
+type ClientLimits struct {
+	MaxConnections    uint
+	MaxBytesPerSecond uint
+}
+
+// clientConnectionLimits returns the MaxConnections overrides of the
+// ClientLimits, keyed by client IP.
+func (r *ReplicaSet) clientConnectionLimits() map[string]uint {
+	limits := make(map[string]uint)
+	for ip, l := range r.ClientLimits {
+		if l.MaxConnections != 0 {
+			limits[ip] = l.MaxConnections
+		}
+	}
+	return limits
+}
+
+// clientByteRates returns the MaxBytesPerSecond overrides of the ClientLimits,
+// keyed by client IP.
+func (r *ReplicaSet) clientByteRates() map[string]float64 {
+	rates := make(map[string]float64)
+	for ip, l := range r.ClientLimits {
+		if l.MaxBytesPerSecond != 0 {
+			rates[ip] = float64(l.MaxBytesPerSecond)
+		}
+	}
+	return rates
+}
@@ -0,0 +1,55 @@
+package dvara
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestClientLimitsConnections(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		MaxPerClientConnections: 1,
+		ClientLimits: map[string]ClientLimits{
+			"10.0.0.1": {MaxConnections: 3},
+			"10.0.0.2": {MaxBytesPerSecond: 100},
+		},
+	}
+	m := newMaxPerClientConnections(r.MaxPerClientConnections)
+	m.overrides = r.clientConnectionLimits()
+	for i := 0; i < 3; i++ {
+		ensure.False(t, m.inc("10.0.0.1"))
+	}
+	ensure.True(t, m.inc("10.0.0.1"))
+	// Clients without a connection limit of their own get the default one.
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+		ensure.False(t, m.inc(ip))
+		ensure.True(t, m.inc(ip))
+	}
+	// The default limit still changes with Reconfigure, the overrides don't.
+	m.setMax(2)
+	ensure.False(t, m.inc("10.0.0.3"))
+	ensure.True(t, m.inc("10.0.0.1"))
+}
+
+func TestClientLimitsByteRate(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}}
+	p.byteRateLimiter = newByteRateLimiter(0)
+	p.byteRateLimiter.rates = (&ReplicaSet{
+		ClientLimits: map[string]ClientLimits{
+			"10.0.0.1": {MaxBytesPerSecond: 100},
+			"10.0.0.2": {MaxConnections: 3},
+		},
+	}).clientByteRates()
+
+	raw := &pipeConn{}
+	c, release := p.throttleIf(raw, "10.0.0.1")
+	ensure.DeepEqual(t, c.(*throttledConn).bucket.rate, float64(100))
+	release()
+
+	// Without a default rate other clients aren't throttled.
+	c, release = p.throttleIf(raw, "10.0.0.2")
+	ensure.True(t, c == raw)
+	release()
+}
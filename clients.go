@@ -0,0 +1,241 @@
+package dvara
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// The states a client connection can be in, as reported in ConnInfo.
+const (
+	ClientStateIdle      = "idle"
+	ClientStateAcquiring = "acquiring"
+	ClientStateProxying  = "proxying"
+)
+
+// ConnInfo describes a live client connection.
+type ConnInfo struct {
+	ID         uint64        `json:"id"`
+	Proxy      string        `json:"proxy"`
+	RemoteIP   string        `json:"remote_ip"`
+	RemoteAddr string        `json:"remote_addr"`
+	Connected  time.Time     `json:"connected"`
+	Duration   time.Duration `json:"duration"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	State      string        `json:"state"`
+
+	// Backend is the address of the server the client is talking to, while it
+	// holds a server connection.
+	Backend string `json:"backend,omitempty"`
+}
+
+// trackedClient is a client connection in the registry. Its state is updated
+// by the goroutine serving the client and read by others.
+type trackedClient struct {
+	info    ConnInfo
+	conn    net.Conn
+	counter *countingConn
+	state   atomic.Value // string
+	backend atomic.Value // string
+	closed  int32        // atomic, set when closed by an admin
+}
+
+func (c *trackedClient) setState(state, backend string) {
+	c.state.Store(state)
+	c.backend.Store(backend)
+}
+
+// clientRegistry keeps track of the live client connections of a proxy.
+type clientRegistry struct {
+	mutex   sync.Mutex
+	nextID  uint64
+	clients map[uint64]*trackedClient
+}
+
+// close closes the client connection on behalf of an admin, which unblocks the
+// goroutine serving it.
+func (c *trackedClient) close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.conn.Close()
+}
+
+func (c *trackedClient) closedByAdmin() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+func (r *clientRegistry) add(info ConnInfo, conn net.Conn, counter *countingConn) *trackedClient {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.clients == nil {
+		r.clients = make(map[uint64]*trackedClient)
+	}
+	r.nextID++
+	info.ID = r.nextID
+	c := &trackedClient{info: info, conn: conn, counter: counter}
+	c.setState(ClientStateIdle, "")
+	r.clients[info.ID] = c
+	return c
+}
+
+func (r *clientRegistry) remove(c *trackedClient) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.clients, c.info.ID)
+}
+
+func (r *clientRegistry) len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.clients)
+}
+
+// snapshot returns the live client connections ordered by ID, that is by the
+// time they connected.
+func (r *clientRegistry) snapshot(now time.Time) []ConnInfo {
+	r.mutex.Lock()
+	infos := make([]ConnInfo, 0, len(r.clients))
+	for _, c := range r.clients {
+		info := c.info
+		info.Duration = now.Sub(info.Connected)
+		info.BytesIn, info.BytesOut = c.counter.counts()
+		info.State = c.state.Load().(string)
+		info.Backend = c.backend.Load().(string)
+		infos = append(infos, info)
+	}
+	r.mutex.Unlock()
+	sort.Sort(connInfosByID(infos))
+	return infos
+}
+
+// closeMatching closes the client connections matching f and returns them.
+func (r *clientRegistry) closeMatching(f func(ConnInfo) bool) []*trackedClient {
+	var matching []*trackedClient
+	r.mutex.Lock()
+	for _, c := range r.clients {
+		if f(c.info) {
+			matching = append(matching, c)
+		}
+	}
+	r.mutex.Unlock()
+	for _, c := range matching {
+		c.close()
+	}
+	return matching
+}
+
+type connInfosByID []ConnInfo
+
+func (c connInfosByID) Len() int           { return len(c) }
+func (c connInfosByID) Less(i, j int) bool { return c[i].ID < c[j].ID }
+func (c connInfosByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// trackClient adds the client connection to the registry.
+func (p *Proxy) trackClient(c net.Conn, remoteIP string, counter *countingConn, connected time.Time) *trackedClient {
+	return p.clients.add(ConnInfo{
+		Proxy:      p.ProxyAddr,
+		RemoteIP:   remoteIP,
+		RemoteAddr: c.RemoteAddr().String(),
+		Connected:  connected,
+	}, c, counter)
+}
+
+// closeClients closes the client connections matching f, and returns how many
+// were closed.
+func (p *Proxy) closeClients(f func(ConnInfo) bool) int {
+	closed := p.clients.closeMatching(f)
+	for _, c := range closed {
+		stats.BumpSum(p.stats, "client.admin.closed", 1)
+		corelog.LogInfoMessage("client closed by admin",
+			"client", c.info.RemoteAddr, "id", c.info.ID, "proxy", p.String())
+	}
+	return len(closed)
+}
+
+// CloseClient closes all the connections from the given client IP, for
+// example to get rid of a misbehaving client. It returns how many were closed.
+// Clients are free to reconnect.
+func (p *Proxy) CloseClient(remoteIP string) int {
+	return p.closeClients(func(info ConnInfo) bool { return info.RemoteIP == remoteIP })
+}
+
+// CloseConnection closes the client connection with the given ID, as listed by
+// Connections. It returns false if there is no such connection.
+func (p *Proxy) CloseConnection(id uint64) bool {
+	return p.closeClients(func(info ConnInfo) bool { return info.ID == id }) > 0
+}
+
+// Connections returns the client connections currently served by the proxy.
+func (p *Proxy) Connections() []ConnInfo {
+	return p.clients.snapshot(p.clock().Now())
+}
+
+// ClientConnectionCounts returns the number of connections from each client
+// IP, as counted against MaxPerClientConnections. Connections through extra
+// listeners with their own MaxPerClientConnections are not included.
+func (p *Proxy) ClientConnectionCounts() map[string]uint {
+	return p.maxPerClientConnections.snapshot()
+}
+
+type connInfosByProxy []ConnInfo
+
+func (c connInfosByProxy) Len() int      { return len(c) }
+func (c connInfosByProxy) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c connInfosByProxy) Less(i, j int) bool {
+	if c[i].Proxy != c[j].Proxy {
+		return c[i].Proxy < c[j].Proxy
+	}
+	return c[i].ID < c[j].ID
+}
+
+// CloseClient closes the connections from the given client IP on all the
+// proxies, and returns how many were closed.
+func (manager *StateManager) CloseClient(remoteIP string) int {
+	manager.RLock()
+	defer manager.RUnlock()
+	closed := 0
+	for _, proxy := range manager.proxies {
+		closed += proxy.CloseClient(remoteIP)
+	}
+	return closed
+}
+
+// CloseConnection closes the client connection with the given ID on the proxy
+// with the given address. It returns false if there is no such connection.
+func (manager *StateManager) CloseConnection(proxyAddr string, id uint64) bool {
+	manager.RLock()
+	defer manager.RUnlock()
+	proxy, ok := manager.proxies[proxyAddr]
+	return ok && proxy.CloseConnection(id)
+}
+
+// Connections returns the client connections of all the proxies, ordered by
+// proxy.
+func (manager *StateManager) Connections() []ConnInfo {
+	manager.RLock()
+	defer manager.RUnlock()
+	now := time.Now()
+	var infos []ConnInfo
+	for _, proxy := range manager.proxies {
+		infos = append(infos, proxy.clients.snapshot(now)...)
+	}
+	sort.Sort(connInfosByProxy(infos))
+	return infos
+}
+
+// ClientConnectionCounts returns the number of connections from each client
+// IP, keyed by proxy.
+func (manager *StateManager) ClientConnectionCounts() map[string]map[string]uint {
+	manager.RLock()
+	defer manager.RUnlock()
+	counts := make(map[string]map[string]uint)
+	for _, proxy := range manager.proxies {
+		counts[proxy.ProxyAddr] = proxy.ClientConnectionCounts()
+	}
+	return counts
+}
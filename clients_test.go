@@ -0,0 +1,159 @@
+package dvara
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestClientRegistry(t *testing.T) {
+	t.Parallel()
+	var r clientRegistry
+	start := time.Unix(0, 0)
+	first := r.add(ConnInfo{RemoteIP: "1.1.1.1", Connected: start}, nil, &countingConn{in: 10, out: 20})
+	second := r.add(ConnInfo{RemoteIP: "2.2.2.2", Connected: start.Add(time.Second)}, nil, &countingConn{})
+	second.setState(ClientStateProxying, "mongo:27017")
+
+	ensure.DeepEqual(t, r.snapshot(start.Add(time.Minute)), []ConnInfo{
+		{ID: 1, RemoteIP: "1.1.1.1", Connected: start, Duration: time.Minute, BytesIn: 10, BytesOut: 20, State: ClientStateIdle},
+		{ID: 2, RemoteIP: "2.2.2.2", Connected: start.Add(time.Second), Duration: time.Minute - time.Second, State: ClientStateProxying, Backend: "mongo:27017"},
+	})
+	r.remove(first)
+	r.remove(second)
+	ensure.DeepEqual(t, len(r.snapshot(start)), 0)
+}
+
+func TestProxyConnections(t *testing.T) {
+	t.Parallel()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer backend.Close()
+	received := make(chan struct{})
+	reply := make(chan struct{})
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for copyMessage(ioutil.Discard, c) == nil {
+			received <- struct{}{}
+			<-reply
+			c.Write(replyMessage(0, 0))
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			ClientIdleTimeout:       time.Hour,
+			MessageTimeout:          time.Second,
+			ProxyQuery:              &ProxyQuery{},
+		},
+		ClientListener: l,
+		ProxyAddr:      "proxy:6000",
+		MongoAddr:      backend.Addr().String(),
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	query := queryMessage(t, 1, "test.foo", bson.M{})
+	_, err = c.Write(query)
+	ensure.Nil(t, err)
+	<-received
+
+	conns := p.Connections()
+	ensure.DeepEqual(t, len(conns), 1)
+	ensure.DeepEqual(t, conns[0].Proxy, "proxy:6000")
+	ensure.DeepEqual(t, conns[0].RemoteIP, "127.0.0.1")
+	ensure.DeepEqual(t, conns[0].RemoteAddr, c.LocalAddr().String())
+	ensure.DeepEqual(t, conns[0].State, ClientStateProxying)
+	ensure.DeepEqual(t, conns[0].Backend, backend.Addr().String())
+	ensure.DeepEqual(t, conns[0].BytesIn, int64(len(query)))
+
+	reply <- struct{}{}
+	ensure.Nil(t, copyMessage(ioutil.Discard, c))
+	ensure.Nil(t, c.Close())
+	for len(p.Connections()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCloseClient(t *testing.T) {
+	t.Parallel()
+	keys := make(chan string, 10)
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if strings.Contains(key, "admin") {
+				keys <- key
+			}
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			Stats:                   hc,
+			MaxConnections:          1,
+			MaxPerClientConnections: 2,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			ClientIdleTimeout:       time.Hour,
+			MessageTimeout:          time.Second,
+		},
+		ClientListener: l,
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		ensure.Nil(t, err)
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	for len(p.Connections()) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ensure.False(t, p.CloseConnection(42))
+	ensure.True(t, p.CloseConnection(p.Connections()[0].ID))
+	_, err = clients[0].Read(make([]byte, 1))
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, receiveKeys(keys, 2), map[string]bool{
+		"mongoproxy.client.admin.closed":     true,
+		"mongoproxy.client.disconnect.admin": true,
+	})
+
+	ensure.DeepEqual(t, p.CloseClient("10.0.0.1"), 0)
+	ensure.DeepEqual(t, p.CloseClient("127.0.0.1"), 1)
+	_, err = clients[1].Read(make([]byte, 1))
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, receiveKeys(keys, 2), map[string]bool{
+		"mongoproxy.client.admin.closed":     true,
+		"mongoproxy.client.disconnect.admin": true,
+	})
+}
+
+// receiveKeys returns the next n keys, which may be bumped in any order.
+func receiveKeys(keys chan string, n int) map[string]bool {
+	received := make(map[string]bool)
+	for i := 0; i < n; i++ {
+		received[<-keys] = true
+	}
+	return received
+}
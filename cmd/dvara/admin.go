@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/intercom/dvara"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// serveAdmin serves the admin endpoints on the given address. /connections
+// lists the client connections of all proxies as JSON. /connections/close
+// closes the connections from a client given its remote_ip, or a single one
+// given its proxy and id, and replies with the number closed. /backends/drain
+// and /backends/resume stop and resume using the backend given its addr.
+// /server/errors lists the most recent server connection errors as JSON, and
+// /server/pool/flush closes all server connections so they are reopened.
+// /quiesce stops accepting new clients, and /connections/active replies with
+// the number of clients still connected. /connections/peaks lists the most
+// client and server connections each proxy had at once as JSON, and
+// /connections/peaks/reset starts a new window for them. /connections/clients
+// lists the number of connections from each client IP on each proxy as JSON,
+// to see which clients are near max_per_client_connections. /health replies
+// with the state of the proxies, with a 503 unless they are all running, so
+// load balancers stop sending clients once they are quiescing or draining.
+func serveAdmin(addr string, manager *dvara.StateManager) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(manager.Connections()); err != nil {
+			corelog.LogError("error", err)
+		}
+	})
+	mux.HandleFunc("/connections/close", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		closed := 0
+		if remoteIP := r.FormValue("remote_ip"); remoteIP != "" {
+			closed = manager.CloseClient(remoteIP)
+		} else {
+			id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "remote_ip or proxy and id required", http.StatusBadRequest)
+				return
+			}
+			if manager.CloseConnection(r.FormValue("proxy"), id) {
+				closed = 1
+			}
+		}
+		fmt.Fprintf(w, "%d\n", closed)
+	})
+	mux.HandleFunc("/server/errors", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(manager.ServerConnErrors()); err != nil {
+			corelog.LogError("error", err)
+		}
+	})
+	mux.HandleFunc("/server/pool/flush", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		manager.FlushServerPool()
+	})
+	mux.HandleFunc("/backends/drain", func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := backendParam(w, r); ok {
+			manager.DrainBackend(addr)
+		}
+	})
+	mux.HandleFunc("/backends/resume", func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := backendParam(w, r); ok {
+			manager.ResumeBackend(addr)
+		}
+	})
+	mux.HandleFunc("/quiesce", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := manager.Quiesce(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%d\n", manager.ActiveConnections())
+	})
+	mux.HandleFunc("/connections/active", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d\n", manager.ActiveConnections())
+	})
+	mux.HandleFunc("/connections/clients", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(manager.ClientConnectionCounts()); err != nil {
+			corelog.LogError("error", err)
+		}
+	})
+	mux.HandleFunc("/connections/peaks", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(manager.ConnPeaks()); err != nil {
+			corelog.LogError("error", err)
+		}
+	})
+	mux.HandleFunc("/connections/peaks/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		manager.ResetConnPeaks()
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if state := manager.State(); state != dvara.ProxyRunning {
+			http.Error(w, state.String(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, dvara.ProxyRunning)
+	})
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			corelog.LogError("error", err)
+		}
+	}()
+	return nil
+}
+
+// backendParam returns the addr of the backend a POST request is for, or
+// replies with an error.
+func backendParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	addr := r.FormValue("addr")
+	if addr == "" {
+		http.Error(w, "addr required", http.StatusBadRequest)
+		return "", false
+	}
+	return addr, true
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -22,46 +24,176 @@ func main() {
 }
 
 func Main() error {
+	adminAddr := flag.String("admin_addr", "", "if set the address to serve admin endpoints such as /connections on, e.g. 127.0.0.1:6100")
 	addrs := flag.String("addrs", "localhost:27017", "comma separated list of mongo addresses")
+	acceptGoroutines := flag.Uint("accept_goroutines", 1, "number of goroutines accepting clients on each port")
+	adminDatabase := flag.String("admin_database", "admin", "database admin commands such as replSetGetStatus run in")
+	allowedOpCodes := flag.String("allowed_opcodes", "", "if set comma separated list of the only opcodes clients may send, e.g. QUERY,GET_MORE,KILL_CURSORS")
+	advertisedSetName := flag.String("advertised_set_name", "", "if set the replica set name given to clients in isMaster and hello responses in place of the real one")
+	authFailureFlushThreshold := flag.Uint("auth_failure_flush_threshold", 0, "if set the number of new server connections failing to authenticate in a row after which idle server connections are closed as the credentials are likely stale")
+	authSource := flag.String("auth_source", "admin", "database the mongo db username is defined in")
+	backpressureReject := flag.Bool("backpressure_reject", false, "if true clients are rejected with an error when the server pool is saturated, instead of no longer being accepted")
+	backpressureWaiting := flag.Uint("backpressure_waiting", 0, "if set the number of clients waiting for a server connection at which new clients are held back")
+	cacheIsMaster := flag.Duration("cache_ismaster", 0, "if set isMaster responses are cached for this long and used to answer clients")
+	captureBufferBytes := flag.Int("capture_buffer_bytes", 1<<20, "bytes of each client connection's messages which may be waiting to be captured or teed, more are dropped")
+	captureFile := flag.String("capture_file", "", "if set client messages are appended to this file so they can be replayed for load testing")
+	captureMutations := flag.Bool("capture_mutations", false, "if true messages which modify data are captured too")
+	clientHandshakeTimeout := flag.Duration("client_handshake_timeout", 0, "if set how long new client connections have to send their first message, otherwise client_idle_timeout applies")
 	clientIdleTimeout := flag.Duration("client_idle_timeout", 60*time.Minute, "idle timeout for client connections")
+	clientKeepAlive := flag.Duration("client_keep_alive", 2*time.Minute, "TCP keep-alive period of client connections, negative to disable")
+	clientMaxLifetime := flag.Duration("client_max_lifetime", 0, "if set client connections are closed after being used for this long, between messages")
+	commandCollection := flag.String("command_collection", "$cmd", "collection commands are sent to as queries, used to recognize them")
+	commandTimeouts := flag.String("command_timeouts", "", "comma separated list of command=timeout pairs overriding message_timeout for those commands, e.g. find=1s,aggregate=10m")
+	compressors := flag.String("compressors", "", "comma separated list of compressors offered to clients, zlib is supported")
+	databaseConnections := flag.String("database_connections", "", "comma separated list of database=max pairs giving those databases their own pools of server connections, e.g. reports=10")
+	disableGetLastError := flag.Bool("disable_get_last_error", false, "if true server connections are released right after legacy writes instead of waiting for getLastError, only safe if clients use acknowledged writes")
 	getLastErrorTimeout := flag.Duration("get_last_error_timeout", time.Minute, "timeout for getLastError pinning")
+	hedgeReads := flag.Duration("hedge_reads", 0, "if set read queries without a response after this long are sent again over a second server connection")
+	injectTraceComment := flag.Bool("inject_trace_comment", false, "if true a trace ID which is also logged is added to the comment of queries and find commands, to match server profiler entries to proxy logs")
 	listenAddr := flag.String("listen", "127.0.0.1", "address for listening, for example, 127.0.0.1 for reachable only from the same machine, or 0.0.0.0 for reachable from other machines")
+	listenBacklog := flag.Int("listen_backlog", 0, "if set the length of the queue of client connections waiting to be accepted, otherwise the system maximum, which also caps it. Linux only")
+	localCommands := flag.String("local_commands", "", "if set comma separated list of commands answered by the proxy without going to the server, only ping and endSessions are supported. Pings then succeed even when mongo is unreachable")
+	maxBytesPerSecondPerClient := flag.Uint("max_bytes_per_second_per_client", 0, "if set the rate in bytes per second above which the connections of a single client are slowed down")
 	maxConnections := flag.Uint("max_connections", 100, "maximum number of connections per mongo")
+	maxCursorsPerClient := flag.Uint("max_cursors_per_client", 0, "if set the most cursors a client connection may have open, beyond which its queries get an error")
 	maxPerClientConnections := flag.Uint("max_per_client_connections", 100, "maximum number of connections from a single client")
+	maxQueueAge := flag.Duration("max_queue_age", 0, "if set clients waiting longer than this for a server connection get an error once one is available, as their driver likely gave up")
+	maxResponseBytes := flag.Uint("max_response_bytes", 0, "if set the most bytes returned to a client for a single query across all of its batches, beyond which it gets an error")
+	maxServerConnectionAge := flag.Duration("max_server_connection_age", 0, "if set server connections older than this, randomized by up to 20%, are closed and replaced")
+	maxTimeMSGrace := flag.Duration("max_time_ms_grace", 0, "if set queries and commands with a maxTimeMS time out after it plus this grace when that is shorter than message_timeout, as the client gives up by then")
+	minIdleConnections := flag.Uint("min_idle_connections", 0, "number of idle server connections kept around, see warm_pool_timeout to establish them on start")
+	minWriteConcern := flag.Int("min_write_concern", 0, "minimum numeric w for write commands, e.g. 1 to turn unacknowledged writes into acknowledged ones")
 	messageTimeout := flag.Duration("message_timeout", 2*time.Minute, "timeout for one message to be proxied")
+	namespaceRewrites := flag.String("namespace_rewrites", "", "comma separated list of old=new namespace pairs, messages for the old db.collection are sent for the new one instead, e.g. test.users=test.accounts")
 	password := flag.String("password", "", "mongodb password")
 	portEnd := flag.Int("port_end", 6010, "end of port range")
 	portStart := flag.Int("port_start", 6000, "start of port range")
+	readBufferSize := flag.Int("read_buffer_size", 16*1024, "size of the read buffer for client and server connections, 0 disables buffering")
+	replyErrorStats := flag.Bool("reply_error_stats", false, "if true error replies from the servers are counted by code as server.reply.error.<code>")
+	requestLogCommandSampling := flag.String("request_log_command_sampling", "", "comma separated list of command=n pairs overriding request_log_sampling for those commands, 0 to never log them, e.g. getMore=0,dropIndexes=1")
+	requestLogSampling := flag.Uint("request_log_sampling", 0, "if set one in every that many proxied requests is logged")
+	retryableErrorThreshold := flag.Uint("retryable_error_threshold", 0, "if set the number of replies in a row with retryable errors, such as RetryableWriteError labelled ones, after which a backend is handled as stepped down")
+	reuseAddr := flag.Bool("reuse_addr", true, "set SO_REUSEADDR on the listeners so a restarted dvara can listen again right away, can only be turned off on Linux")
+	secondaryMongoAddr := flag.String("secondary_mongo_addr", "", "address of a secondary to send queries with a secondary or secondaryPreferred read preference to")
 	serverClosePoolSize := flag.Uint("server_close_pool_size", 1, "number of goroutines that will handle closing server connections.")
+	serverConnErrorHistory := flag.Uint("server_conn_error_history", 50, "number of recent server connection errors each proxy keeps for the admin /server/errors endpoint")
+	serverConnProbeInterval := flag.Duration("server_conn_probe_interval", 0, "if set idle server connections are probed with an isMaster this often, and closed if the server does not answer")
+	serverConnectJitter := flag.Float64("server_connect_jitter", 0.5, "fraction by which server connect retry sleeps are randomized, negative to disable")
 	serverIdleTimeout := flag.Duration("server_idle_timeout", 60*time.Minute, "duration after which a server connection will be considered idle")
+	shadowMongoAddr := flag.String("shadow_mongo_addr", "", "address of a mongo server to mirror read only queries to, responses from it are discarded")
+	slowRequestThreshold := flag.Duration("slow_request_threshold", 0, "if set requests taking at least this long to be proxied are always logged")
+	tcpNoDelay := flag.Bool("tcp_no_delay", true, "set TCP_NODELAY on client and server connections")
+	timeoutResetGrace := flag.Duration("timeout_reset_grace", 0, "if set server connections whose message timed out get this long to finish their response and go back to the pool instead of being closed")
+	transactionTimeout := flag.Duration("transaction_timeout", time.Minute, "how long a transaction may go without a statement before the server connection pinned to it is returned to the pool")
 	username := flag.String("username", "", "mongo db username")
+	validateOnStart := flag.Bool("validate_on_start", false, "if true proxies fail to start unless a server connection can be established and authenticated")
+	warmPoolTimeout := flag.Duration("warm_pool_timeout", 0, "if set min_idle_connections server connections are established before accepting clients, waiting up to this long")
 	metricsAddress := flag.String("metrics", "127.0.0.1:8125", "UDP address to send metrics to datadog, default is 127.0.0.1:8125")
 	replicaName := flag.String("replica_name", "", "Replica name, used in metrics and logging, default is empty")
 	replicaSetName := flag.String("replica_set_name", "", "Replica set name, used to filter hosts runnning other replica sets")
 	healthCheckInterval := flag.Duration("healthcheckinterval", 5*time.Second, "How often to run the health check")
+	reusePort := flag.Bool("reuse_port", false, "if true listen with SO_REUSEPORT so several dvara processes can share the ports, Linux only")
+	reloadFlagsFile := flag.String("reload_flags_file", "", "file with max_connections, max_per_client_connections, client_idle_timeout, get_last_error_timeout and message_timeout flags to apply on SIGHUP")
 	failedHealthCheckThreshold := flag.Uint("failedhealthcheckthreshold", 3, "How many failed checks before a restart")
 
 	flag.Parse()
+	commandTimeoutsMap, err := parseDurations(*commandTimeouts)
+	if err != nil {
+		return err
+	}
+	databaseConnectionsMap, err := parseCounts(*databaseConnections)
+	if err != nil {
+		return err
+	}
+	namespaceRewritesMap, err := parsePairs(*namespaceRewrites)
+	if err != nil {
+		return err
+	}
+	requestLogCommandSamplingMap, err := parseCounts(*requestLogCommandSampling)
+	if err != nil {
+		return err
+	}
 	statsClient := NewDataDogStatsDClient(*metricsAddress, "replica:"+*replicaName)
 
 	replicaSet := dvara.ReplicaSet{
+		AcceptGoroutines:        *acceptGoroutines,
 		Addrs:                   *addrs,
+		AdminDatabase:           *adminDatabase,
+		AdvertisedSetName:       *advertisedSetName,
+		AllowedOpCodes:          splitList(*allowedOpCodes),
+		AuthFailureFlushThreshold: *authFailureFlushThreshold,
+		AuthSource:              *authSource,
+		BackpressureReject:      *backpressureReject,
+		BackpressureWaiting:     *backpressureWaiting,
+		CacheIsMaster:           *cacheIsMaster,
+		CaptureBufferBytes:      *captureBufferBytes,
+		CaptureFile:             *captureFile,
+		CaptureMutations:        *captureMutations,
+		ClientHandshakeTimeout:  *clientHandshakeTimeout,
 		ClientIdleTimeout:       *clientIdleTimeout,
+		ClientKeepAlive:         *clientKeepAlive,
+		ClientMaxLifetime:       *clientMaxLifetime,
+		CommandCollection:       *commandCollection,
+		CommandTimeouts:         commandTimeoutsMap,
+		Compressors:             splitList(*compressors),
+		DatabaseConnections:     databaseConnectionsMap,
+		DisableGetLastError:     *disableGetLastError,
 		GetLastErrorTimeout:     *getLastErrorTimeout,
+		HedgeReads:              *hedgeReads,
+		InjectTraceComment:      *injectTraceComment,
 		ListenAddr:              *listenAddr,
+		ListenBacklog:           *listenBacklog,
+		LocalCommands:           splitList(*localCommands),
+		MaxBytesPerSecondPerClient: *maxBytesPerSecondPerClient,
 		MaxConnections:          *maxConnections,
+		MaxCursorsPerClient:     *maxCursorsPerClient,
 		MaxPerClientConnections: *maxPerClientConnections,
+		MaxQueueAge:             *maxQueueAge,
+		MaxResponseBytes:        *maxResponseBytes,
+		MaxServerConnectionAge:  *maxServerConnectionAge,
+		MaxTimeMSGrace:          *maxTimeMSGrace,
 		MessageTimeout:          *messageTimeout,
+		MinIdleConnections:      *minIdleConnections,
+		MinWriteConcern:         *minWriteConcern,
+		NamespaceRewrites:       namespaceRewritesMap,
 		Password:                *password,
 		PortEnd:                 *portEnd,
 		PortStart:               *portStart,
+		ReadBufferSize:          *readBufferSize,
+		ReplyErrorStats:         *replyErrorStats,
+		RequestLogCommandSampling: requestLogCommandSamplingMap,
+		RequestLogSampling:      *requestLogSampling,
+		RetryableErrorThreshold: *retryableErrorThreshold,
+		ReuseAddr:               reuseAddr,
+		ReusePort:               *reusePort,
+		SecondaryMongoAddr:      *secondaryMongoAddr,
 		ServerClosePoolSize:     *serverClosePoolSize,
+		ServerConnErrorHistory:  *serverConnErrorHistory,
+		ServerConnProbeInterval: *serverConnProbeInterval,
+		ServerConnectJitter:     *serverConnectJitter,
 		ServerIdleTimeout:       *serverIdleTimeout,
+		ShadowMongoAddr:         *shadowMongoAddr,
+		SlowRequestThreshold:    *slowRequestThreshold,
+		TCPNoDelay:              tcpNoDelay,
+		TimeoutResetGrace:       *timeoutResetGrace,
+		TransactionTimeout:      *transactionTimeout,
 		Username:                *username,
+		ValidateOnStart:         *validateOnStart,
+		WarmPoolTimeout:         *warmPoolTimeout,
 		Name:                    *replicaSetName,
 	}
 	stateManager := dvara.NewStateManager(&replicaSet)
 
+	// A primary stepping down triggers a sync like a failed health check does,
+	// unless one is already under way.
+	syncChan := make(chan struct{})
+	replicaSet.OnPrimaryStepdown = func(addr string) {
+		select {
+		case syncChan <- struct{}{}:
+		default:
+		}
+	}
+
 	// Actual logger
 	corelog.SetupLogFmtLoggerTo(os.Stderr)
 	corelog.SetStandardFields("replicaset", *replicaName)
@@ -80,7 +212,7 @@ func Main() error {
 	log := Logger{}
 
 	var graph inject.Graph
-	err := graph.Provide(
+	err = graph.Provide(
 		&inject.Object{Value: &replicaSet},
 		&inject.Object{Value: &statsClient},
 		&inject.Object{Value: stateManager},
@@ -103,13 +235,82 @@ func Main() error {
 	}
 	defer startstop.Stop(objects, &log)
 
-	syncChan := make(chan struct{})
 	go stateManager.KeepSynchronized(syncChan)
+	if *adminAddr != "" {
+		if err := serveAdmin(*adminAddr, stateManager); err != nil {
+			return err
+		}
+	}
 	go hc.HealthCheck(&replicaSet, syncChan)
 
 	ch := make(chan os.Signal, 2)
-	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
-	<-ch
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if err := reloadLimits(*reloadFlagsFile, &replicaSet, stateManager); err != nil {
+			corelog.LogError("error", err)
+			continue
+		}
+		corelog.LogInfoMessage("reloaded limits from " + *reloadFlagsFile)
+	}
 	signal.Stop(ch)
 	return nil
 }
+
+// splitList splits a comma separated flag value, an empty value is an empty
+// list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// parseDurations parses a comma separated list of name=duration pairs.
+func parseDurations(s string) (map[string]time.Duration, error) {
+	m := make(map[string]time.Duration)
+	for _, pair := range splitList(s) {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid name=duration pair: %q", pair)
+		}
+		d, err := time.ParseDuration(pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		m[pair[:i]] = d
+	}
+	return m, nil
+}
+
+// parseCounts parses a comma separated list of name=count pairs.
+func parseCounts(s string) (map[string]uint, error) {
+	m := make(map[string]uint)
+	for _, pair := range splitList(s) {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid name=count pair: %q", pair)
+		}
+		n, err := strconv.ParseUint(pair[i+1:], 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		m[pair[:i]] = uint(n)
+	}
+	return m, nil
+}
+
+// parsePairs parses a comma separated list of name=value pairs.
+func parsePairs(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range splitList(s) {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid name=value pair: %q", pair)
+		}
+		m[pair[:i]] = pair[i+1:]
+	}
+	return m, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"strings"
+
+	"github.com/intercom/dvara"
+)
+
+var errNoReloadFile = errors.New("no reload_flags_file given, ignoring SIGHUP")
+
+// reloadLimits re-reads the settings that can be changed live from the flags
+// in the given file, and applies them to the running proxies. Flags missing
+// from the file keep their current value.
+func reloadLimits(path string, current *dvara.ReplicaSet, manager *dvara.StateManager) error {
+	if path == "" {
+		return errNoReloadFile
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	r := dvara.ReplicaSet{}
+	flags := flag.NewFlagSet("reload", flag.ContinueOnError)
+	flags.UintVar(&r.MaxConnections, "max_connections", current.MaxConnections, "")
+	flags.UintVar(&r.MaxPerClientConnections, "max_per_client_connections", current.MaxPerClientConnections, "")
+	flags.DurationVar(&r.ClientIdleTimeout, "client_idle_timeout", current.ClientIdleTimeout, "")
+	flags.DurationVar(&r.GetLastErrorTimeout, "get_last_error_timeout", current.GetLastErrorTimeout, "")
+	flags.DurationVar(&r.MessageTimeout, "message_timeout", current.MessageTimeout, "")
+	if err := flags.Parse(strings.Fields(string(contents))); err != nil {
+		return err
+	}
+	return manager.Reconfigure(&r)
+}
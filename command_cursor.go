@@ -0,0 +1,299 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// maxCommandName bounds how much of the command name of a query is read to
+// tell getMore and killCursors from other commands.
+const maxCommandName = 64
+
+// cursorCommand is the part of getMore and killCursors commands naming the
+// cursors they refer to.
+type cursorCommand struct {
+	GetMore int64   `bson:"getMore"`
+	Cursors []int64 `bson:"cursors"`
+}
+
+// readCommandCursorIDs reads the start of an OP_QUERY, up to the name of the
+// command it runs, to find the cursors getMore and killCursors commands refer
+// to. Those are read in full, other queries only up to the command name. The
+// returned conn replays what was read.
+func readCommandCursorIDs(h *messageHeader, c net.Conn, ns namespaces) (net.Conn, []int64, error) {
+	if h.MessageLength < headerLen {
+		return nil, nil, errMalformedCursorMessage
+	}
+	r := io.LimitReader(c, int64(h.MessageLength-headerLen))
+	var read []byte
+	replay := func() net.Conn {
+		return &replayConn{
+			Conn:   c,
+			reader: io.MultiReader(bytes.NewReader(read), c),
+		}
+	}
+
+	// int32 flags, cstring fullCollectionName
+	var flags [4]byte
+	if _, err := io.ReadFull(r, flags[:]); err != nil {
+		return nil, nil, err
+	}
+	fullCollectionName, err := readCString(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	read = append(append(read, flags[:]...), fullCollectionName...)
+	if collection, _, ok := queryCollection(read); !ok || collection != ns.command {
+		return replay(), nil, nil
+	}
+
+	// int32 numberToSkip, int32 numberToReturn, then the query document: int32
+	// length, byte element type, cstring element name.
+	var fixed [13]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, nil, err
+	}
+	read = append(read, fixed[:]...)
+	nameStart := len(read)
+	for {
+		if len(read)-nameStart == maxCommandName {
+			return replay(), nil, nil
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, nil, err
+		}
+		read = append(read, b[0])
+		if b[0] == x00 {
+			break
+		}
+	}
+	if command := string(read[nameStart : len(read)-1]); command != "getMore" && command != "killCursors" {
+		return replay(), nil, nil
+	}
+
+	rest, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	read = append(read, rest...)
+	docStart := len(flags) + len(fullCollectionName) + 8
+	var cmd cursorCommand
+	if err := bson.Unmarshal(read[docStart:], &cmd); err != nil {
+		return nil, nil, errMalformedCursorMessage
+	}
+	if cmd.GetMore != 0 {
+		return replay(), []int64{cmd.GetMore}, nil
+	}
+	return replay(), cmd.Cursors, nil
+}
+
+// readMsgCursorIDs reads the body of an OP_MSG to find the cursors a getMore
+// or killCursors command refers to. The returned conn replays the body.
+func readMsgCursorIDs(h *messageHeader, c net.Conn) (net.Conn, []int64, error) {
+	if h.MessageLength < headerLen {
+		return nil, nil, errMalformedCursorMessage
+	}
+	body := make([]byte, h.MessageLength-headerLen)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, nil, err
+	}
+	replay := &replayConn{
+		Conn:   c,
+		reader: io.MultiReader(bytes.NewReader(body), c),
+	}
+	name, _, ok := msgCommand(body)
+	if !ok || (name != "getMore" && name != "killCursors") {
+		return replay, nil, nil
+	}
+	m, err := parseOpMsg(body)
+	if err != nil {
+		return nil, nil, errMalformedCursorMessage
+	}
+	var cmd cursorCommand
+	if err := bson.Unmarshal(m.Body, &cmd); err != nil {
+		return nil, nil, errMalformedCursorMessage
+	}
+	if cmd.GetMore != 0 {
+		return replay, []int64{cmd.GetMore}, nil
+	}
+	return replay, cmd.Cursors, nil
+}
+
+// commandCursorScanner finds the cursor.id of a command reply as the reply is
+// read, without keeping it: the first batch of a find or aggregate comes before
+// the id and may be large. Only the first document of an OP_REPLY, or the body
+// section of an OP_MSG, is looked at. The BSON is walked element by element,
+// skipping over the values which are not of interest.
+type commandCursorScanner struct {
+	skip  int    // bytes to pass over before the next token
+	need  int    // length of the next token, 0 for a cstring
+	token []byte // the part of the next token read so far
+	next  func(token []byte)
+
+	inCursor bool // walking the cursor document rather than the reply
+	typ      byte // type of the current element
+	id       int64
+	found    bool
+	done     bool
+}
+
+func newCommandCursorScanner() *commandCursorScanner {
+	s := &commandCursorScanner{}
+	s.expect(headerLen, func(b []byte) {
+		switch OpCode(getInt32(b, 12)) {
+		case OpReply:
+			// int32 responseFlags, int64 cursorID, int32 startingFrom, int32
+			// numberReturned.
+			s.expect(20, func(b []byte) {
+				if getInt32(b, 0)&replyQueryFailure != 0 || getInt32(b, 16) < 1 {
+					s.done = true
+					return
+				}
+				s.expect(4, func([]byte) { s.element() })
+			})
+		case OpMsg:
+			// uint32 flagBits, then the kind of the first section, which servers
+			// send as the body.
+			s.expect(5, func(b []byte) {
+				if b[4] != opMsgBodySection {
+					s.done = true
+					return
+				}
+				s.expect(4, func([]byte) { s.element() })
+			})
+		default:
+			s.done = true
+		}
+	})
+	return s
+}
+
+// cursorID returns the id of the cursor of the reply, if it has one.
+func (s *commandCursorScanner) cursorID() (int64, bool) {
+	return s.id, s.found
+}
+
+func (s *commandCursorScanner) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 && !s.done {
+		if s.skip > 0 {
+			k := s.skip
+			if k > len(b) {
+				k = len(b)
+			}
+			s.skip -= k
+			b = b[k:]
+			if s.skip == 0 && s.need == 0 && s.next == nil {
+				s.element()
+			}
+			continue
+		}
+		if s.need > 0 {
+			k := s.need - len(s.token)
+			if k > len(b) {
+				k = len(b)
+			}
+			s.token = append(s.token, b[:k]...)
+			b = b[k:]
+			if len(s.token) < s.need {
+				continue
+			}
+		} else {
+			i := bytes.IndexByte(b, x00)
+			if i < 0 {
+				s.token = append(s.token, b...)
+				b = nil
+				if len(s.token) > maxInspectedDocument {
+					s.done = true
+				}
+				continue
+			}
+			s.token = append(s.token, b[:i]...)
+			b = b[i+1:]
+		}
+		token, next := s.token, s.next
+		s.token, s.next = s.token[:0], nil
+		next(token)
+	}
+	return n, nil
+}
+
+// expect has the next n bytes handed to next, or the next cstring if n is 0.
+func (s *commandCursorScanner) expect(n int, next func(token []byte)) {
+	s.need, s.next = n, next
+}
+
+// pass skips over n bytes before the next element.
+func (s *commandCursorScanner) pass(n int) {
+	if n < 0 {
+		s.done = true
+		return
+	}
+	if n == 0 {
+		s.element()
+		return
+	}
+	s.skip, s.need, s.next = n, 0, nil
+}
+
+// element reads the type and name of the next element of the document.
+func (s *commandCursorScanner) element() {
+	s.expect(1, func(b []byte) {
+		if b[0] == 0 {
+			// The end of the reply, or of its cursor without an id.
+			s.done = true
+			return
+		}
+		s.typ = b[0]
+		s.expect(0, s.value)
+	})
+}
+
+// value handles the value of the element with the given name: the cursor
+// document is walked into, its id read and other values skipped.
+func (s *commandCursorScanner) value(name []byte) {
+	switch {
+	case !s.inCursor && s.typ == 0x03 && string(name) == "cursor":
+		s.inCursor = true
+		s.expect(4, func([]byte) { s.element() })
+		return
+	case s.inCursor && s.typ == 0x12 && string(name) == "id":
+		s.expect(8, func(b []byte) {
+			s.id = getInt64(b, 0)
+			s.found = true
+			s.done = true
+		})
+		return
+	}
+	switch s.typ {
+	case 0x01, 0x09, 0x11, 0x12: // double, datetime, timestamp, int64
+		s.pass(8)
+	case 0x07: // ObjectId
+		s.pass(12)
+	case 0x08: // bool
+		s.pass(1)
+	case 0x06, 0x0A, 0x7F, 0xFF: // undefined, null, max key, min key
+		s.pass(0)
+	case 0x10: // int32
+		s.pass(4)
+	case 0x13: // decimal128
+		s.pass(16)
+	case 0x02, 0x0D, 0x0E: // string, JavaScript, symbol
+		s.expect(4, func(b []byte) { s.pass(int(getInt32(b, 0))) })
+	case 0x03, 0x04, 0x0F: // document, array, JavaScript with scope
+		s.expect(4, func(b []byte) { s.pass(int(getInt32(b, 0)) - 4) })
+	case 0x05: // binary
+		s.expect(4, func(b []byte) { s.pass(int(getInt32(b, 0)) + 1) })
+	case 0x0C: // DBPointer
+		s.expect(4, func(b []byte) { s.pass(int(getInt32(b, 0)) + 12) })
+	case 0x0B: // regular expression
+		s.expect(0, func([]byte) { s.expect(0, func([]byte) { s.element() }) })
+	default:
+		s.done = true
+	}
+}
@@ -0,0 +1,236 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// cursorReply returns a reply to a command opening the cursor, with its first
+// batch before the id as servers send it.
+func cursorReply(t testing.TB, cursorID int64, batch []bson.D) []byte {
+	doc, err := bson.Marshal(bson.D{
+		{Name: "cursor", Value: bson.D{
+			{Name: "firstBatch", Value: batch},
+			{Name: "id", Value: cursorID},
+			{Name: "ns", Value: "test.foo"},
+		}},
+		{Name: "ok", Value: 1.0},
+	})
+	ensure.Nil(t, err)
+	return replyDocumentMessage(0, 0, doc)
+}
+
+func TestReadCommandCursorIDs(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		NS       string
+		Query    bson.D
+		Expected []int64
+	}{
+		{"test.$cmd", bson.D{{Name: "getMore", Value: int64(42)}, {Name: "collection", Value: "foo"}}, []int64{42}},
+		{"test.$cmd", bson.D{{Name: "killCursors", Value: "foo"}, {Name: "cursors", Value: []int64{1, 2}}}, []int64{1, 2}},
+		{"test.$cmd", bson.D{{Name: "find", Value: "foo"}}, nil},
+		{"test.$cmd", bson.D{{Name: strings.Repeat("a", maxCommandName+1), Value: 1}}, nil},
+		{"test.foo", bson.D{{Name: "getMore", Value: int64(42)}}, nil},
+	}
+	for _, c := range cases {
+		body := queryBody(t, c.NS, c.Query)
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+		replay, ids, err := readCursorIDs(h, &bufferConn{r: bytes.NewReader(body)}, defaultNamespaces)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, ids, c.Expected)
+		replayed, err := ioutil.ReadAll(replay)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, replayed, body)
+	}
+}
+
+func TestCommandCursorScanner(t *testing.T) {
+	t.Parallel()
+	batch := []bson.D{
+		{{Name: "_id", Value: bson.NewObjectId()}, {Name: "s", Value: strings.Repeat("x", 100)}},
+		{{Name: "id", Value: int64(7)}, {Name: "re", Value: bson.RegEx{Pattern: "a.b", Options: "i"}}},
+		{{Name: "n", Value: nil}, {Name: "b", Value: []byte{1, 2}}, {Name: "t", Value: time.Unix(0, 0)}},
+	}
+	reply := cursorReply(t, 42, batch)
+	// The id is found however the reply is read.
+	for _, size := range []int{1, 7, len(reply)} {
+		s := newCommandCursorScanner()
+		for b := reply; len(b) > 0; {
+			n := size
+			if n > len(b) {
+				n = len(b)
+			}
+			s.Write(b[:n])
+			b = b[n:]
+		}
+		id, ok := s.cursorID()
+		ensure.True(t, ok)
+		ensure.DeepEqual(t, id, int64(42))
+	}
+
+	doc, err := bson.Marshal(bson.M{"ok": 1, "id": int64(5)})
+	ensure.Nil(t, err)
+	failed := cursorReply(t, 42, nil)
+	setInt32(failed, headerLen, replyQueryFailure)
+	for _, r := range [][]byte{replyDocumentMessage(0, 0, doc), failed, replyMessage(0, 0)} {
+		s := newCommandCursorScanner()
+		s.Write(r)
+		_, ok := s.cursorID()
+		ensure.False(t, ok)
+	}
+}
+
+func TestProxyCommandCursorOwnership(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Second},
+		Clock:      clock.NewMock(),
+	}
+	a := newCursorAffinity(&p.cursorOwners)
+	b := newCursorAffinity(&p.cursorOwners)
+	proxy := func(ns string, q bson.D, reply []byte) {
+		body := queryBody(t, ns, q)
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+		client, ids, err := readCursorIDs(h, &bufferConn{r: bytes.NewReader(body)}, defaultNamespaces)
+		ensure.Nil(t, err)
+		server := &bufferConn{r: bytes.NewReader(reply)}
+		ensure.Nil(t, p.proxyCursorMessage(h, nil, client, server, &LastError{}, ids, a))
+	}
+
+	proxy("test.$cmd", bson.D{{Name: "find", Value: "foo"}}, cursorReply(t, 42, nil))
+	ensure.True(t, p.cursorOwners.foreign([]int64{42}, b))
+	ensure.False(t, p.cursorOwners.foreign([]int64{42}, a))
+	// The cursor isn't pinned to the server connection.
+	ensure.DeepEqual(t, a.open(), 0)
+
+	// A user document looking like a cursor is not one.
+	proxy("test.foo", bson.D{{Name: "a", Value: 1}}, cursorReply(t, 43, nil))
+	ensure.False(t, p.cursorOwners.foreign([]int64{43}, b))
+
+	// The cursor is kept while a getMore returns more, and released once it is
+	// exhausted.
+	getMore := bson.D{{Name: "getMore", Value: int64(42)}, {Name: "collection", Value: "foo"}}
+	proxy("test.$cmd", getMore, cursorReply(t, 42, nil))
+	ensure.True(t, p.cursorOwners.foreign([]int64{42}, b))
+	proxy("test.$cmd", getMore, cursorReply(t, 0, nil))
+	ensure.False(t, p.cursorOwners.foreign([]int64{42}, b))
+
+	proxy("test.$cmd", bson.D{{Name: "aggregate", Value: "foo"}}, cursorReply(t, 44, nil))
+	ensure.True(t, p.cursorOwners.foreign([]int64{44}, b))
+	doc, err := bson.Marshal(bson.M{"cursorsKilled": []int64{44}, "ok": 1})
+	ensure.Nil(t, err)
+	kill := bson.D{{Name: "killCursors", Value: "foo"}, {Name: "cursors", Value: []int64{44}}}
+	proxy("test.$cmd", kill, replyDocumentMessage(0, 0, doc))
+	ensure.False(t, p.cursorOwners.foreign([]int64{44}, b))
+}
+
+// msgCursorReply returns an OP_MSG reply to a command opening the cursor.
+func msgCursorReply(t testing.TB, cursorID int64) []byte {
+	return msgReply(t, 0, bson.D{
+		{Name: "cursor", Value: bson.D{
+			{Name: "firstBatch", Value: []bson.D{}},
+			{Name: "id", Value: cursorID},
+			{Name: "ns", Value: "test.foo"},
+		}},
+		{Name: "ok", Value: 1.0},
+	})
+}
+
+func TestReadMsgCursorIDs(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Command  bson.D
+		Expected []int64
+	}{
+		{bson.D{{Name: "getMore", Value: int64(42)}, {Name: "collection", Value: "foo"}, {Name: "$db", Value: "test"}}, []int64{42}},
+		{bson.D{{Name: "killCursors", Value: "foo"}, {Name: "cursors", Value: []int64{1, 2}}, {Name: "$db", Value: "test"}}, []int64{1, 2}},
+		{bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}}, nil},
+		{bson.D{{Name: "insert", Value: "foo"}, {Name: "getMore", Value: int64(42)}}, nil},
+	}
+	for _, c := range cases {
+		body := msgBody(t, 0, msgSection{Documents: []interface{}{c.Command}})
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpMsg}
+		replay, ids, err := readCursorIDs(h, &bufferConn{r: bytes.NewReader(body)}, defaultNamespaces)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, ids, c.Expected)
+		replayed, err := ioutil.ReadAll(replay)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, replayed, body)
+	}
+}
+
+func TestCommandCursorScannerMsg(t *testing.T) {
+	t.Parallel()
+	s := newCommandCursorScanner()
+	s.Write(msgCursorReply(t, 42))
+	id, ok := s.cursorID()
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, id, int64(42))
+
+	s = newCommandCursorScanner()
+	s.Write(msgReply(t, 0, bson.M{"ok": 1, "id": int64(5)}))
+	_, ok = s.cursorID()
+	ensure.False(t, ok)
+}
+
+func TestProxyMsgCursorOwnership(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Second},
+		Clock:      clock.NewMock(),
+	}
+	p.messageChain = p.newMessageChain()
+	a := newCursorAffinity(&p.cursorOwners)
+	b := newCursorAffinity(&p.cursorOwners)
+	// proxy proxies the command for the client if it is admitted, and returns
+	// what the client got back.
+	proxy := func(cursors *cursorAffinity, command bson.D, reply []byte) []byte {
+		body := msgBody(t, 0, msgSection{Documents: []interface{}{command}})
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), RequestID: 3, OpCode: OpMsg}
+		client := &bufferConn{r: bytes.NewReader(body)}
+		replay, ids, err := readCursorIDs(h, client, defaultNamespaces)
+		ensure.Nil(t, err)
+		admitted, err := p.admit(&Message{
+			OpCode:    h.OpCode,
+			RequestID: h.RequestID,
+			RemoteIP:  "10.0.0.1",
+			h:         h,
+			client:    replay,
+			listener:  &clientListener{},
+			cursorIDs: ids,
+			cursors:   cursors,
+		})
+		ensure.Nil(t, err)
+		if admitted {
+			server := &bufferConn{r: bytes.NewReader(reply)}
+			ensure.Nil(t, p.proxyCursorMessage(h, nil, replay, server, &LastError{}, ids, cursors))
+		}
+		return client.w.Bytes()
+	}
+
+	find := bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}}
+	proxy(a, find, msgCursorReply(t, 42))
+	ensure.True(t, p.cursorOwners.foreign([]int64{42}, b))
+
+	// Client B can't read from the cursor of client A.
+	getMore := bson.D{{Name: "getMore", Value: int64(42)}, {Name: "collection", Value: "foo"}, {Name: "$db", Value: "test"}}
+	rejected := proxy(b, getMore, msgCursorReply(t, 42))
+	ensure.DeepEqual(t, OpCode(getInt32(rejected, 12)), OpMsg)
+	doc := bson.M{}
+	ensure.Nil(t, bson.Unmarshal(rejected[headerLen+5:], &doc))
+	ensure.DeepEqual(t, doc["code"], ErrorCodeCursorNotFound)
+
+	// Client A can, until the cursor is exhausted.
+	proxy(a, getMore, msgCursorReply(t, 42))
+	ensure.True(t, p.cursorOwners.foreign([]int64{42}, b))
+	proxy(a, getMore, msgCursorReply(t, 0))
+	ensure.False(t, p.cursorOwners.foreign([]int64{42}, b))
+}
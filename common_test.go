@@ -1,6 +1,8 @@
 package dvara
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -119,3 +121,87 @@ func (h *Harness) Dial(u string) *mgo.Session {
 	session.SetSocketTimeout(time.Minute)
 	return session
 }
+
+// statsRecorder is a stats.Client recording the stats bumped on it, for tests
+// to check. The zero value is ready to use, and it is safe for concurrent use.
+type statsRecorder struct {
+	mu     sync.Mutex
+	bumped []string // "kind key value", in the order bumped
+	sums   map[string]float64
+	avgs   map[string]float64
+}
+
+func (r *statsRecorder) record(kind, key string, val float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bumped = append(r.bumped, fmt.Sprintf("%s %s %v", kind, key, val))
+	switch kind {
+	case "sum":
+		if r.sums == nil {
+			r.sums = make(map[string]float64)
+		}
+		r.sums[key] += val
+	case "avg":
+		if r.avgs == nil {
+			r.avgs = make(map[string]float64)
+		}
+		r.avgs[key] = val
+	}
+}
+
+func (r *statsRecorder) BumpAvg(key string, val float64) {
+	r.record("avg", key, val)
+}
+
+func (r *statsRecorder) BumpSum(key string, val float64) {
+	r.record("sum", key, val)
+}
+
+func (r *statsRecorder) BumpHistogram(key string, val float64) {
+	r.record("histogram", key, val)
+}
+
+func (r *statsRecorder) BumpTime(key string) interface {
+	End()
+} {
+	r.record("time", key, 0)
+	return endFunc(func() { r.record("end", key, 0) })
+}
+
+// sum returns the total bumped for the key.
+func (r *statsRecorder) sum(key string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sums[key]
+}
+
+// avg returns the last average bumped for the key.
+func (r *statsRecorder) avg(key string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.avgs[key]
+}
+
+// summed returns the totals of all the keys bumped.
+func (r *statsRecorder) summed() map[string]float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sums := make(map[string]float64, len(r.sums))
+	for k, v := range r.sums {
+		sums[k] = v
+	}
+	return sums
+}
+
+// log returns the stats bumped, in order.
+func (r *statsRecorder) log() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.bumped...)
+}
+
+type endFunc func()
+
+func (f endFunc) End() {
+	f()
+}
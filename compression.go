@@ -0,0 +1,303 @@
+package dvara
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OpCompressed wraps another message compressed with the compressor the client
+// and server negotiated in the isMaster handshake.
+const OpCompressed = OpCode(2012)
+
+var (
+	errMalformedCompressedMessage = errors.New("dvara: malformed compressed message")
+	errUnsupportedCompressor      = errors.New("dvara: unsupported compressor")
+)
+
+// compressor IDs used in OP_COMPRESSED messages.
+const (
+	noopCompressorID = 0
+	zlibCompressorID = 2
+)
+
+// compressedHeaderLen is the length of the OP_COMPRESSED fields following the
+// header: int32 originalOpcode, int32 uncompressedSize, uint8 compressorId.
+const compressedHeaderLen = 9
+
+// compressorIDs maps the compressors the proxy supports to their ID.
+var compressorIDs = map[string]byte{
+	"zlib": zlibCompressorID,
+}
+
+// SupportedCompressors returns the names of the compressors the proxy can
+// negotiate with clients. Compressors not in this list, like snappy, are
+// ignored in the handshake so clients fall back to another one or to
+// uncompressed messages.
+func SupportedCompressors() []string {
+	return []string{"zlib"}
+}
+
+// negotiateCompression picks the compressors to agree on from the ones the
+// client offered in its isMaster, in the client's order of preference. Only
+// the compressors enabled on the ReplicaSet are considered.
+func (r *ReplicaSet) negotiateCompression(offered []string) []string {
+	var agreed []string
+	if r == nil {
+		return agreed
+	}
+	for _, o := range offered {
+		if _, ok := compressorIDs[o]; !ok {
+			continue
+		}
+		for _, c := range r.Compressors {
+			if c == o {
+				agreed = append(agreed, o)
+				break
+			}
+		}
+	}
+	return agreed
+}
+
+// stripCompression removes the compression field from an isMaster query,
+// returning the compressors the client offered. The server connections are
+// shared between clients, so compression can't be negotiated with the server
+// on their behalf and the proxy negotiates with the client instead.
+func stripCompression(q bson.D) (bson.D, []string, bool) {
+	for i, e := range q {
+		if e.Name != "compression" {
+			continue
+		}
+		var offered []string
+		if list, ok := e.Value.([]interface{}); ok {
+			for _, v := range list {
+				if s, ok := v.(string); ok {
+					offered = append(offered, s)
+				}
+			}
+		}
+		newQ := make(bson.D, 0, len(q)-1)
+		newQ = append(newQ, q[:i]...)
+		newQ = append(newQ, q[i+1:]...)
+		return newQ, offered, true
+	}
+	return q, nil, false
+}
+
+// compressedConn decompresses OP_COMPRESSED messages read from the client, so
+// the rest of the proxy only sees uncompressed messages, handshakes included,
+// and inspects and rewrites them as usual. Responses to a compressed message
+// are compressed with the same compressor, as the client expects. Messages
+// which aren't compressed are passed through as is. Messages compressed with a
+// compressor the proxy doesn't support get an uncompressed error response.
+type compressedConn struct {
+	net.Conn
+
+	// pending holds the rest of the message being read, if it was decompressed
+	// or once its header was read.
+	pending bytes.Reader
+
+	// passthrough is the number of bytes of an uncompressed message left to be
+	// read from the connection.
+	passthrough int64
+
+	// compressorID is the compressor to use for the response, or -1 if it
+	// should not be compressed.
+	compressorID int
+
+	// written holds the response being written until it is complete, so it can
+	// be compressed.
+	written bytes.Buffer
+}
+
+func newCompressedConn(c net.Conn) *compressedConn {
+	return &compressedConn{Conn: c, compressorID: -1}
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	if c.pending.Len() > 0 {
+		return c.pending.Read(b)
+	}
+	if c.passthrough > 0 {
+		if int64(len(b)) > c.passthrough {
+			b = b[:c.passthrough]
+		}
+		n, err := c.Conn.Read(b)
+		c.passthrough -= int64(n)
+		return n, err
+	}
+
+	// At the start of a new message.
+	h, err := readHeader(c.Conn)
+	if err != nil {
+		return 0, err
+	}
+	if h.OpCode != OpCompressed {
+		c.compressorID = -1
+		c.pending.Reset(h.ToWire())
+		c.passthrough = int64(h.MessageLength - headerLen)
+		return c.pending.Read(b)
+	}
+
+	msg, compressorID, err := decompressMessage(h, c.Conn)
+	if unsupported, ok := err.(*unsupportedCompressorError); ok {
+		if err := c.rejectCompressor(h, unsupported); err != nil {
+			return 0, err
+		}
+		return c.Read(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	c.compressorID = int(compressorID)
+	c.pending.Reset(msg)
+	return c.pending.Read(b)
+}
+
+// rejectCompressor replies with an error to a message compressed with an
+// unsupported compressor, which was drained from the connection. The reply is
+// not compressed, clients accept uncompressed responses whatever they sent.
+func (c *compressedConn) rejectCompressor(h *messageHeader, err *unsupportedCompressorError) error {
+	c.compressorID = -1
+	original := &messageHeader{RequestID: h.RequestID, OpCode: err.originalOpCode}
+	if !original.OpCode.HasResponse() {
+		return nil
+	}
+	return writeErrorResponse(c.Conn, original, ErrorCodeCompressorNotSupported, err.Error())
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	if c.compressorID < 0 && c.written.Len() == 0 {
+		return c.Conn.Write(b)
+	}
+
+	c.written.Write(b)
+	for c.written.Len() >= headerLen {
+		length := int(getInt32(c.written.Bytes(), 0))
+		if length < headerLen {
+			return 0, errInvalidMessageLength
+		}
+		if c.written.Len() < length {
+			break
+		}
+		msg, err := compressMessage(c.written.Next(length), byte(c.compressorID))
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.Conn.Write(msg); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decompressMessage reads the body of an OP_COMPRESSED message and returns the
+// original message.
+func decompressMessage(h *messageHeader, r io.Reader) ([]byte, byte, error) {
+	if h.MessageLength < headerLen+compressedHeaderLen {
+		return nil, 0, errMalformedCompressedMessage
+	}
+	var fields [compressedHeaderLen]byte
+	if _, err := io.ReadFull(r, fields[:]); err != nil {
+		return nil, 0, err
+	}
+	originalOpCode := getInt32(fields[:], 0)
+	size := getInt32(fields[:], 4)
+	compressorID := fields[8]
+	if size < 0 || size > maxMessageLength-headerLen {
+		return nil, 0, errMalformedCompressedMessage
+	}
+
+	compressed := io.LimitReader(r, int64(h.MessageLength-headerLen-compressedHeaderLen))
+	var body io.Reader
+	switch compressorID {
+	case noopCompressorID:
+		body = compressed
+	case zlibCompressorID:
+		zr, err := zlib.NewReader(compressed)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		// Drain the message so the error can be reported without misframing.
+		if _, err := io.Copy(ioutil.Discard, compressed); err != nil {
+			return nil, 0, err
+		}
+		return nil, 0, &unsupportedCompressorError{
+			compressorID:   compressorID,
+			originalOpCode: OpCode(originalOpCode),
+		}
+	}
+
+	original := messageHeader{
+		MessageLength: headerLen + size,
+		RequestID:     h.RequestID,
+		ResponseTo:    h.ResponseTo,
+		OpCode:        OpCode(originalOpCode),
+	}
+	msg := make([]byte, headerLen+int(size))
+	copy(msg, original.ToWire())
+	if _, err := io.ReadFull(body, msg[headerLen:]); err != nil {
+		return nil, 0, errMalformedCompressedMessage
+	}
+	// Whatever is left of the compressed data must be consumed to stay framed.
+	if n, _ := io.Copy(ioutil.Discard, compressed); n != 0 {
+		return nil, 0, errMalformedCompressedMessage
+	}
+	return msg, compressorID, nil
+}
+
+// unsupportedCompressorError is returned for a message compressed with a
+// compressor the proxy doesn't support, like snappy.
+type unsupportedCompressorError struct {
+	compressorID   byte
+	originalOpCode OpCode
+}
+
+func (e *unsupportedCompressorError) Error() string {
+	return fmt.Sprintf("%s: %d", errUnsupportedCompressor, e.compressorID)
+}
+
+// compressMessage wraps a complete message into an OP_COMPRESSED one.
+func compressMessage(msg []byte, compressorID byte) ([]byte, error) {
+	var h messageHeader
+	h.FromWire(msg)
+	body := msg[headerLen:]
+
+	var compressed bytes.Buffer
+	switch compressorID {
+	case noopCompressorID:
+		compressed.Write(body)
+	case zlibCompressorID:
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: %d", errUnsupportedCompressor, compressorID)
+	}
+
+	wrapper := messageHeader{
+		MessageLength: int32(headerLen + compressedHeaderLen + compressed.Len()),
+		RequestID:     h.RequestID,
+		ResponseTo:    h.ResponseTo,
+		OpCode:        OpCompressed,
+	}
+	out := wrapper.ToWire()
+	out = addInt32(out, int32(h.OpCode))
+	out = addInt32(out, int32(len(body)))
+	out = append(out, compressorID)
+	return append(out, compressed.Bytes()...), nil
+}
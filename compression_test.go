@@ -0,0 +1,250 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// pipeConn reads from and writes to in memory buffers.
+type pipeConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (p *pipeConn) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *pipeConn) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+func queryMessage(t testing.TB, requestID int32, ns string, q interface{}) []byte {
+	body := queryBody(t, ns, q)
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     requestID,
+		OpCode:        OpQuery,
+	}
+	return append(h.ToWire(), body...)
+}
+
+func TestCompressMessageRoundTrip(t *testing.T) {
+	t.Parallel()
+	msg := queryMessage(t, 42, "test.foo", bson.M{"a": 1})
+	for _, id := range []byte{noopCompressorID, zlibCompressorID} {
+		compressed, err := compressMessage(msg, id)
+		ensure.Nil(t, err)
+		h, err := readHeader(bytes.NewReader(compressed))
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, h.OpCode, OpCompressed)
+		ensure.DeepEqual(t, h.RequestID, int32(42))
+		ensure.DeepEqual(t, int(h.MessageLength), len(compressed))
+
+		original, compressorID, err := decompressMessage(h, bytes.NewReader(compressed[headerLen:]))
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, compressorID, id)
+		ensure.DeepEqual(t, original, msg)
+	}
+}
+
+func TestDecompressMessageErrors(t *testing.T) {
+	t.Parallel()
+	msg := queryMessage(t, 1, "test.foo", bson.M{})
+	compressed, err := compressMessage(msg, zlibCompressorID)
+	ensure.Nil(t, err)
+
+	snappy := append([]byte(nil), compressed...)
+	snappy[headerLen+8] = 1
+	corrupt := append([]byte(nil), compressed...)
+	setInt32(corrupt, headerLen+4, int32(len(msg)+10))
+
+	cases := []struct {
+		Message []byte
+		Error   string
+	}{
+		{snappy, "dvara: unsupported compressor: 1"},
+		{corrupt, errMalformedCompressedMessage.Error()},
+		{compressed[:headerLen+4], "unexpected EOF"},
+	}
+	for _, c := range cases {
+		var h messageHeader
+		h.FromWire(c.Message)
+		_, _, err := decompressMessage(&h, bytes.NewReader(c.Message[headerLen:]))
+		ensure.NotNil(t, err)
+		ensure.DeepEqual(t, err.Error(), c.Error)
+	}
+}
+
+func TestCompressedConn(t *testing.T) {
+	t.Parallel()
+	plain := queryMessage(t, 1, "test.foo", bson.M{"a": 1})
+	query := queryMessage(t, 2, "test.foo", bson.M{"b": 1})
+	compressed, err := compressMessage(query, zlibCompressorID)
+	ensure.Nil(t, err)
+
+	raw := &pipeConn{r: bytes.NewReader(append(append([]byte(nil), plain...), compressed...))}
+	c := newCompressedConn(raw)
+
+	// An uncompressed message and its response pass through.
+	var read bytes.Buffer
+	ensure.Nil(t, copyMessage(&read, c))
+	ensure.DeepEqual(t, read.Bytes(), plain)
+	reply := replyMessage(0, 0)
+	_, err = c.Write(reply)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, raw.w.Bytes(), reply)
+	raw.w.Reset()
+
+	// A compressed message is decompressed, and its response compressed even if
+	// written in pieces.
+	read.Reset()
+	ensure.Nil(t, copyMessage(&read, c))
+	ensure.DeepEqual(t, read.Bytes(), query)
+	_, err = c.Write(reply[:5])
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, raw.w.Len(), 0)
+	_, err = c.Write(reply[5:])
+	ensure.Nil(t, err)
+
+	h, err := readHeader(&raw.w)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.OpCode, OpCompressed)
+	response, compressorID, err := decompressMessage(h, &raw.w)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, compressorID, byte(zlibCompressorID))
+	ensure.DeepEqual(t, response, reply)
+
+	_, err = ioutil.ReadAll(c)
+	ensure.Nil(t, err)
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{Compressors: []string{"zlib"}}
+	ensure.DeepEqual(t, r.negotiateCompression([]string{"snappy", "zlib"}), []string{"zlib"})
+	ensure.DeepEqual(t, len(r.negotiateCompression([]string{"snappy"})), 0)
+	ensure.DeepEqual(t, len((&ReplicaSet{}).negotiateCompression([]string{"zlib"})), 0)
+	ensure.DeepEqual(t, len((*ReplicaSet)(nil).negotiateCompression([]string{"zlib"})), 0)
+	ensure.DeepEqual(t, len((&ReplicaSet{Compressors: []string{"snappy"}}).negotiateCompression([]string{"snappy"})), 0)
+}
+
+func TestStripCompression(t *testing.T) {
+	t.Parallel()
+	q := bson.D{
+		{Name: "isMaster", Value: 1},
+		{Name: "compression", Value: []interface{}{"snappy", "zlib"}},
+		{Name: "client", Value: "driver"},
+	}
+	newQ, offered, ok := stripCompression(q)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, offered, []string{"snappy", "zlib"})
+	ensure.DeepEqual(t, newQ, bson.D{
+		{Name: "isMaster", Value: 1},
+		{Name: "client", Value: "driver"},
+	})
+
+	_, _, ok = stripCompression(bson.D{{Name: "isMaster", Value: 1}})
+	ensure.False(t, ok)
+}
+
+func TestHandshakeResponseRewriterCompression(t *testing.T) {
+	t.Parallel()
+	r := &handshakeResponseRewriter{
+		IsMasterResponseRewriter: &IsMasterResponseRewriter{
+			ProxyMapper: fakeProxyMapper{m: map[string]string{"a": "1"}},
+			ReplyRW:     &ReplyRW{},
+		},
+		Compression: []string{"zlib"},
+	}
+	var client bytes.Buffer
+	ensure.Nil(t, r.Rewrite(&client, fakeSingleDocReply(bson.M{"me": "a"})))
+	actual := bson.M{}
+	ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &actual))
+	ensure.DeepEqual(t, actual, bson.M{"me": "1", "compression": []interface{}{"zlib"}})
+}
+
+// snappyCompressed returns the message as an OP_COMPRESSED claiming to use
+// snappy, which the proxy doesn't support. The payload isn't actually
+// compressed, it is only there to be skipped.
+func snappyCompressed(t testing.TB, msg []byte) []byte {
+	compressed, err := compressMessage(msg, noopCompressorID)
+	ensure.Nil(t, err)
+	compressed[headerLen+8] = 1
+	return compressed
+}
+
+func TestCompressedHandshake(t *testing.T) {
+	t.Parallel()
+	p := startLoopbackProxy(t, func(p *Proxy) {
+		p.ReplicaSet.Compressors = []string{"zlib"}
+	})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.Addr().String())
+	ensure.Nil(t, err)
+	defer c.Close()
+	hello := func(id int32) []byte {
+		return queryMessage(t, id, "admin.$cmd", bson.D{
+			{Name: "hello", Value: 1},
+			{Name: "compression", Value: []string{"snappy", "zlib"}},
+		})
+	}
+	readReply := func() (*messageHeader, bson.M) {
+		var b bytes.Buffer
+		ensure.Nil(t, copyMessage(&b, c))
+		msg := b.Bytes()
+		h, err := readHeader(bytes.NewReader(msg))
+		ensure.Nil(t, err)
+		if h.OpCode == OpCompressed {
+			msg, _, err = decompressMessage(h, bytes.NewReader(msg[headerLen:]))
+			ensure.Nil(t, err)
+		}
+		var doc bson.M
+		ensure.Nil(t, bson.Unmarshal(msg[headerLen+len(emptyPrefix):], &doc))
+		return h, doc
+	}
+
+	// A zlib compressed hello is decompressed before the response is rewritten,
+	// and the response compressed.
+	msg, err := compressMessage(hello(1), zlibCompressorID)
+	ensure.Nil(t, err)
+	_, err = c.Write(msg)
+	ensure.Nil(t, err)
+	h, doc := readReply()
+	ensure.DeepEqual(t, h.OpCode, OpCompressed)
+	ensure.DeepEqual(t, doc["me"], "127.0.0.1:6000")
+	ensure.DeepEqual(t, doc["compression"], []interface{}{"zlib"})
+
+	// A snappy compressed hello gets an uncompressed error.
+	_, err = c.Write(snappyCompressed(t, hello(2)))
+	ensure.Nil(t, err)
+	h, doc = readReply()
+	ensure.DeepEqual(t, h.OpCode, OpReply)
+	ensure.DeepEqual(t, h.ResponseTo, int32(2))
+	ensure.DeepEqual(t, doc["code"], ErrorCodeCompressorNotSupported)
+
+	// And the client can carry on.
+	_, err = c.Write(hello(3))
+	ensure.Nil(t, err)
+	h, doc = readReply()
+	ensure.DeepEqual(t, h.OpCode, OpReply)
+	ensure.DeepEqual(t, doc["me"], "127.0.0.1:6000")
+}
+
+func TestCompressedConnUnsupportedCompressor(t *testing.T) {
+	t.Parallel()
+	insert := legacyWriteMessage(t, OpInsert, "test.foo")
+	query := queryMessage(t, 2, "test.foo", bson.M{})
+	raw := &pipeConn{r: bytes.NewReader(append(append(snappyCompressed(t, insert), snappyCompressed(t, query)...), query...))}
+	c := newCompressedConn(raw)
+
+	// Both snappy messages are skipped, only the query expecting a response
+	// gets an error.
+	var read bytes.Buffer
+	ensure.Nil(t, copyMessage(&read, c))
+	ensure.DeepEqual(t, read.Bytes(), query)
+	ensure.DeepEqual(t, errorReplyCode(t, raw.w.Bytes()), ErrorCodeCompressorNotSupported)
+}
@@ -0,0 +1,145 @@
+package dvara
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigError is an invalid ReplicaSet setting.
+type ConfigError struct {
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s is %v, %s", e.Field, e.Value, e.Reason)
+}
+
+// ConfigErrors lists all the invalid settings of a ReplicaSet, so they can be
+// fixed at once.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	problems := make([]string, len(e))
+	for i, c := range e {
+		problems[i] = c.Error()
+	}
+	return "dvara: invalid configuration: " + strings.Join(problems, "; ")
+}
+
+func (e ConfigErrors) check(invalid bool, field string, value interface{}, reason string) ConfigErrors {
+	if invalid {
+		return append(e, ConfigError{Field: field, Value: value, Reason: reason})
+	}
+	return e
+}
+
+func (e ConfigErrors) checkDuration(field string, d time.Duration) ConfigErrors {
+	return e.check(d < 0, field, d, "cannot be negative")
+}
+
+// err returns the errors, or nil if there are none.
+func (e ConfigErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validateLive checks the settings which Proxy.Reconfigure applies.
+func (r *ReplicaSet) validateLive() ConfigErrors {
+	var e ConfigErrors
+	e = e.check(r.MaxConnections == 0, "MaxConnections", r.MaxConnections, "must be at least 1")
+	e = e.check(r.MaxPerClientConnections == 0, "MaxPerClientConnections", r.MaxPerClientConnections, "must be at least 1")
+	e = e.checkDuration("ClientIdleTimeout", r.ClientIdleTimeout)
+	e = e.checkDuration("GetLastErrorTimeout", r.GetLastErrorTimeout)
+	e = e.checkDuration("MessageTimeout", r.MessageTimeout)
+	return e
+}
+
+// validate checks the settings a Proxy needs to start.
+func (r *ReplicaSet) validate() ConfigErrors {
+	e := r.validateLive()
+	e = e.check(r.MinIdleConnections > r.MaxConnections, "MinIdleConnections", r.MinIdleConnections,
+		fmt.Sprintf("cannot exceed MaxConnections %d", r.MaxConnections))
+	e = e.check(r.ServerClosePoolSize == 0, "ServerClosePoolSize", r.ServerClosePoolSize, "must be at least 1")
+	e = e.checkDuration("ServerIdleTimeout", r.ServerIdleTimeout)
+	e = e.checkDuration("MaxServerConnectionAge", r.MaxServerConnectionAge)
+	e = e.checkDuration("ServerConnProbeInterval", r.ServerConnProbeInterval)
+	e = e.checkDuration("WarmPoolTimeout", r.WarmPoolTimeout)
+	e = e.check(r.CaptureBufferBytes < 0, "CaptureBufferBytes", r.CaptureBufferBytes, "cannot be negative")
+	e = e.checkDuration("ClientHandshakeTimeout", r.ClientHandshakeTimeout)
+	e = e.checkDuration("ClientMaxLifetime", r.ClientMaxLifetime)
+	e = e.checkDuration("HedgeReads", r.HedgeReads)
+	e = e.checkDuration("MaxQueueAge", r.MaxQueueAge)
+	e = e.checkDuration("TimeoutResetGrace", r.TimeoutResetGrace)
+	e = e.checkDuration("MaxTimeMSGrace", r.MaxTimeMSGrace)
+	e = e.checkDuration("SlowRequestThreshold", r.SlowRequestThreshold)
+	e = e.checkDuration("TransactionTimeout", r.TransactionTimeout)
+	e = e.check(r.ReusePort && !socketOptionsSupported, "ReusePort", r.ReusePort, "is not supported on this platform")
+	e = e.check(!r.listenOptions().reuseAddr && !socketOptionsSupported, "ReuseAddr", false,
+		"can only be turned off on Linux")
+	e = e.check(r.ListenBacklog < 0, "ListenBacklog", r.ListenBacklog, "cannot be negative")
+	e = e.check(r.ListenBacklog > 0 && !socketOptionsSupported, "ListenBacklog", r.ListenBacklog,
+		"is not supported on this platform")
+	for _, name := range r.LocalCommands {
+		e = e.check(!localCommands[name], "LocalCommands", name, "cannot be answered by the proxy")
+	}
+	for _, name := range r.AllowedOpCodes {
+		_, ok := opCodeByName(name)
+		e = e.check(!ok, "AllowedOpCodes", name, "is not a request opcode")
+	}
+
+	var commands []string
+	for command := range r.CommandTimeouts {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		e = e.checkDuration(fmt.Sprintf("CommandTimeouts[%s]", command), r.CommandTimeouts[command])
+	}
+
+	var dbs []string
+	for db := range r.DatabaseConnections {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	for _, db := range dbs {
+		e = e.check(r.DatabaseConnections[db] == 0, fmt.Sprintf("DatabaseConnections[%s]", db),
+			r.DatabaseConnections[db], "must be at least 1")
+	}
+
+	var rewrites []string
+	for ns := range r.NamespaceRewrites {
+		rewrites = append(rewrites, ns)
+	}
+	sort.Strings(rewrites)
+	for _, ns := range rewrites {
+		e = e.check(!isFullCollectionName(ns), "NamespaceRewrites", ns, "is not a db.collection namespace")
+		target := r.NamespaceRewrites[ns]
+		e = e.check(!isFullCollectionName(target), fmt.Sprintf("NamespaceRewrites[%s]", ns), target,
+			"is not a db.collection namespace")
+	}
+
+	var addrs []string
+	for addr := range r.BackendLimits {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		l := r.backendLimits(addr)
+		e = e.check(l.MinIdleConnections > l.MaxConnections, fmt.Sprintf("BackendLimits[%s].MinIdleConnections", addr),
+			l.MinIdleConnections, fmt.Sprintf("cannot exceed MaxConnections %d", l.MaxConnections))
+	}
+	return e
+}
+
+// isFullCollectionName returns true if the namespace has a database and a
+// collection, as in "db.collection".
+func isFullCollectionName(ns string) bool {
+	dot := strings.IndexByte(ns, '.')
+	return dot > 0 && dot < len(ns)-1
+}
@@ -0,0 +1,63 @@
+package dvara
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	valid := ReplicaSet{
+		MaxConnections:          2,
+		MaxPerClientConnections: 1,
+		MinIdleConnections:      2,
+		ServerClosePoolSize:     1,
+		MessageTimeout:          time.Second,
+	}
+	ensure.Nil(t, valid.validate().err())
+
+	invalid := ReplicaSet{
+		MinIdleConnections:  1,
+		MessageTimeout:      -time.Second,
+		CommandTimeouts:     map[string]time.Duration{"find": -time.Second, "count": time.Second},
+		AllowedOpCodes:      []string{"QUERY", "OP_MSG"},
+		LocalCommands:       []string{"ping", "hello"},
+		ListenBacklog:       -1,
+		DatabaseConnections: map[string]uint{"b": 0, "a": 2},
+		NamespaceRewrites:   map[string]string{"test.foo": "test", "foo.": "test.bar", "test.baz": "other.baz"},
+		BackendLimits: map[string]BackendLimits{
+			"b:1": {MaxConnections: 1, MinIdleConnections: 2},
+			"a:1": {MaxConnections: 3},
+		},
+	}
+	errs := invalid.validate()
+	ensure.DeepEqual(t, errs, ConfigErrors{
+		{Field: "MaxConnections", Value: uint(0), Reason: "must be at least 1"},
+		{Field: "MaxPerClientConnections", Value: uint(0), Reason: "must be at least 1"},
+		{Field: "MessageTimeout", Value: -time.Second, Reason: "cannot be negative"},
+		{Field: "MinIdleConnections", Value: uint(1), Reason: "cannot exceed MaxConnections 0"},
+		{Field: "ServerClosePoolSize", Value: uint(0), Reason: "must be at least 1"},
+		{Field: "ListenBacklog", Value: -1, Reason: "cannot be negative"},
+		{Field: "LocalCommands", Value: "hello", Reason: "cannot be answered by the proxy"},
+		{Field: "AllowedOpCodes", Value: "OP_MSG", Reason: "is not a request opcode"},
+		{Field: "CommandTimeouts[find]", Value: -time.Second, Reason: "cannot be negative"},
+		{Field: "DatabaseConnections[b]", Value: uint(0), Reason: "must be at least 1"},
+		{Field: "NamespaceRewrites", Value: "foo.", Reason: "is not a db.collection namespace"},
+		{Field: "NamespaceRewrites[test.foo]", Value: "test", Reason: "is not a db.collection namespace"},
+		{Field: "BackendLimits[b:1].MinIdleConnections", Value: uint(2), Reason: "cannot exceed MaxConnections 1"},
+	})
+	ensure.DeepEqual(t, errs[:2].Error(),
+		"dvara: invalid configuration: MaxConnections is 0, must be at least 1; MaxPerClientConnections is 0, must be at least 1")
+}
+
+func TestStartInvalidConfig(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{MaxConnections: 1, ClientIdleTimeout: -time.Minute}}
+	ensure.DeepEqual(t, p.Start(), ConfigErrors{
+		{Field: "MaxPerClientConnections", Value: uint(0), Reason: "must be at least 1"},
+		{Field: "ClientIdleTimeout", Value: -time.Minute, Reason: "cannot be negative"},
+		{Field: "ServerClosePoolSize", Value: uint(0), Reason: "must be at least 1"},
+	})
+}
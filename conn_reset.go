@@ -0,0 +1,140 @@
+package dvara
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// isConnReset returns true if the error is the peer resetting the connection,
+// or a write after it did.
+func isConnReset(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.ECONNRESET || err == syscall.EPIPE
+}
+
+// proxyRetryingReset proxies the first message of an exchange, and if the
+// server reset the connection before anything was forwarded to the client
+// retries it once on a fresh connection. This happens when mongo closed a
+// pooled connection, on a restart or a rollover, and the client shouldn't have
+// to find out. Writes are only retried if none of their bytes made it to the
+// server, and reads only if their body fits in the buffer kept to replay it.
+// The returned connection is the one the message ended up on.
+func (p *Proxy) proxyRetryingReset(
+	h *messageHeader,
+	query []byte,
+	client net.Conn,
+	server net.Conn,
+	lastError *LastError,
+	cursorIDs []int64,
+	cursors *cursorAffinity,
+) (net.Conn, error) {
+	sc, ok := server.(*serverConn)
+	if !ok {
+		return server, p.proxyCursorMessage(h, query, client, server, lastError, cursorIDs, cursors)
+	}
+	recorder := newReplayRecorder(client)
+	defer recorder.free()
+	written := sc.written
+	err := p.proxyCursorMessage(h, query, recorder, server, lastError, cursorIDs, cursors)
+	if err == nil || !sc.reset || !recorder.replayable() {
+		return server, err
+	}
+	if sc.written > written && !p.retryableRead(h, recorder.body()) {
+		return server, err
+	}
+
+	corelog.LogInfoMessage(fmt.Sprintf("Retrying message after server connection reset for backend %s: %s", sc.backend, err))
+	stats.BumpSum(p.stats, "server.conn.reset.retried", 1)
+	cursors.drop(server)
+	pool := p.poolFor(server)
+	pool.Discard(server)
+	// The other idle connections most likely went away along with this one.
+	pool.CloseIdle()
+	if p.isDraining(sc.backend) {
+		return nil, errBackendDraining
+	}
+	c, err := pool.Acquire()
+	if err != nil {
+		return nil, err
+	}
+	fresh := c.(net.Conn)
+	return fresh, p.proxyCursorMessage(h, query, recorder.replay(), fresh, lastError, cursorIDs, cursors)
+}
+
+// retryableRead returns true if the message only reads data, given its body,
+// so sending it to the server twice is harmless.
+func (p *Proxy) retryableRead(h *messageHeader, body []byte) bool {
+	switch h.OpCode {
+	case OpQuery:
+		return p.ReplicaSet.namespaces().isReadQuery(body)
+	case OpGetMore:
+		return true
+	}
+	return false
+}
+
+// replayRecorder keeps the body of a message read from the client so it can be
+// sent again, and whether anything was written back to the client. Only bodies
+// fitting in a copy buffer are kept.
+type replayRecorder struct {
+	net.Conn
+	buf      *[]byte
+	n        int
+	overflow bool
+	wrote    bool
+}
+
+func newReplayRecorder(c net.Conn) *replayRecorder {
+	return &replayRecorder{Conn: c, buf: copyBuffers.Get().(*[]byte)}
+}
+
+func (r *replayRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if !r.overflow {
+		k := copy((*r.buf)[r.n:], b[:n])
+		r.n += k
+		r.overflow = k < n
+	}
+	return n, err
+}
+
+func (r *replayRecorder) Write(b []byte) (int, error) {
+	r.wrote = true
+	return r.Conn.Write(b)
+}
+
+// replayable returns true if the whole body read so far was kept and nothing
+// was written to the client.
+func (r *replayRecorder) replayable() bool {
+	return !r.overflow && !r.wrote
+}
+
+// body returns the body read so far.
+func (r *replayRecorder) body() []byte {
+	return (*r.buf)[:r.n]
+}
+
+// replay returns the client connection, reading the kept body again first.
+func (r *replayRecorder) replay() net.Conn {
+	return &replayConn{
+		Conn:   r.Conn,
+		reader: io.MultiReader(bytes.NewReader(r.body()), r.Conn),
+	}
+}
+
+// free returns the buffer, once the body is no longer needed.
+func (r *replayRecorder) free() {
+	copyBuffers.Put(r.buf)
+}
@@ -0,0 +1,123 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsConnReset(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Err   error
+		Reset bool
+	}{
+		{syscall.ECONNRESET, true},
+		{&net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, true},
+		{&net.OpError{Op: "write", Err: &os.SyscallError{Syscall: "write", Err: syscall.EPIPE}}, true},
+		{&net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ETIMEDOUT}}, false},
+		{io.EOF, false},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, isConnReset(c.Err), c.Reset, c.Err)
+	}
+}
+
+// resettingConn is a server connection which was reset by the peer, failing
+// writes if writeErr is set and otherwise reads.
+type resettingConn struct {
+	net.Conn
+	writeErr error
+	written  bytes.Buffer
+}
+
+func (r *resettingConn) Read([]byte) (int, error) {
+	return 0, &net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}
+}
+
+func (r *resettingConn) Write(b []byte) (int, error) {
+	if r.writeErr != nil {
+		return 0, r.writeErr
+	}
+	return r.written.Write(b)
+}
+
+func (r *resettingConn) SetDeadline(time.Time) error { return nil }
+func (r *resettingConn) Close() error                { return nil }
+
+func newResetProxy(hc stats.Client, conns ...net.Conn) *Proxy {
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Second,
+			ProxyQuery:     &ProxyQuery{},
+		},
+		Clock: clock.New(),
+		stats: hc,
+	}
+	p.serverPool = &Pool{
+		New: func() (io.Closer, error) {
+			c := conns[0]
+			conns = conns[1:]
+			return &serverConn{Conn: c, backend: "mongo"}, nil
+		},
+		Max:           1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	return p
+}
+
+func TestProxyRetryingReset(t *testing.T) {
+	t.Parallel()
+	epipe := &net.OpError{Op: "write", Err: &os.SyscallError{Syscall: "write", Err: syscall.EPIPE}}
+	insert := legacyWriteMessage(t, OpInsert, "test.foo")
+	cases := []struct {
+		Name    string
+		Message []byte
+		First   *resettingConn
+		Retried bool
+	}{
+		{"read reset on response", queryMessage(t, 1, "test.foo", bson.M{"a": 1}), &resettingConn{}, true},
+		{"read reset on write", queryMessage(t, 1, "test.foo", bson.M{"a": 1}), &resettingConn{writeErr: epipe}, true},
+		{"write reset before sending", insert, &resettingConn{writeErr: epipe}, true},
+		{"write command sent", queryMessage(t, 1, "test.$cmd", bson.M{"insert": "foo"}), &resettingConn{}, false},
+		{"other error", queryMessage(t, 1, "test.foo", bson.M{"a": 1}), &resettingConn{writeErr: io.ErrClosedPipe}, false},
+	}
+	for _, c := range cases {
+		fresh := &bufferConn{r: bytes.NewReader(replyMessage(0, 0))}
+		hc := &statsRecorder{}
+		p := newResetProxy(hc, c.First, fresh)
+		server, err := p.getServerConn(p.MongoAddr)
+		ensure.Nil(t, err)
+
+		var h messageHeader
+		h.FromWire(c.Message)
+		client := &bufferConn{r: bytes.NewReader(c.Message[headerLen:])}
+		server, err = p.proxyRetryingReset(&h, nil, client, server, &LastError{}, nil, newCursorAffinity(nil))
+		if !c.Retried {
+			ensure.NotNil(t, err, c.Name)
+			ensure.DeepEqual(t, hc.sum("server.conn.reset.retried"), float64(0), c.Name)
+			continue
+		}
+		ensure.Nil(t, err, c.Name)
+		ensure.DeepEqual(t, hc.sum("server.conn.reset.retried"), float64(1), c.Name)
+		ensure.True(t, server.(*serverConn).Conn == fresh, c.Name)
+		sent, err := readHeader(&fresh.w)
+		ensure.Nil(t, err, c.Name)
+		ensure.DeepEqual(t, sent.MessageLength, h.MessageLength, c.Name)
+		ensure.DeepEqual(t, fresh.w.Bytes(), c.Message[headerLen:], c.Name)
+		if h.OpCode.HasResponse() {
+			ensure.DeepEqual(t, client.w.Len(), len(replyMessage(0, 0)), c.Name)
+		}
+		p.serverPool.Release(server)
+	}
+}
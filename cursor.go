@@ -0,0 +1,337 @@
+package dvara
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var errMalformedCursorMessage = errors.New("dvara: malformed cursor message")
+
+// replyCursorNotFound is the OP_REPLY responseFlags bit set when a getMore
+// refers to a cursor the server does not know about.
+const replyCursorNotFound = 1
+
+// cursorAffinity tracks which server connection holds each cursor a client has
+// open, so that OP_GET_MORE and OP_KILL_CURSORS are sent over the connection
+// where the cursor was created rather than over any pooled connection.
+// Connections holding cursors are kept out of the pool until all of their
+// cursors are closed. The bytes returned for each cursor are kept too, to
+// enforce MaxResponseBytes. The cursors opened by commands are only tracked
+// for their ownership, they are not pinned. It belongs to a single
+// clientServeLoop and is not safe for concurrent use.
+type cursorAffinity struct {
+	cursors  map[int64]net.Conn
+	counts   map[net.Conn]int
+	bytes    map[int64]int
+	commands map[int64]bool
+	owners   *cursorOwners
+}
+
+// newCursorAffinity returns the cursor affinity for a client. The cursors are
+// registered with the owners if they are not nil.
+func newCursorAffinity(owners *cursorOwners) *cursorAffinity {
+	return &cursorAffinity{
+		cursors:  make(map[int64]net.Conn),
+		counts:   make(map[net.Conn]int),
+		bytes:    make(map[int64]int),
+		commands: make(map[int64]bool),
+		owners:   owners,
+	}
+}
+
+// pin records that the cursor lives on the given server connection.
+func (a *cursorAffinity) pin(cursorID int64, server net.Conn) {
+	if _, ok := a.cursors[cursorID]; ok {
+		return
+	}
+	a.cursors[cursorID] = server
+	a.counts[server]++
+	a.owners.claim(cursorID, a)
+}
+
+// claim records that the client opened the cursor with a command.
+func (a *cursorAffinity) claim(cursorID int64) {
+	if a.commands[cursorID] {
+		return
+	}
+	a.commands[cursorID] = true
+	a.owners.claim(cursorID, a)
+}
+
+// unpin forgets the cursor, if it is known.
+func (a *cursorAffinity) unpin(cursorID int64) {
+	if a.commands[cursorID] {
+		delete(a.commands, cursorID)
+		a.owners.release(cursorID, a)
+	}
+	server, ok := a.cursors[cursorID]
+	if !ok {
+		return
+	}
+	delete(a.cursors, cursorID)
+	delete(a.bytes, cursorID)
+	a.owners.release(cursorID, a)
+	if a.counts[server] == 1 {
+		delete(a.counts, server)
+	} else {
+		a.counts[server]--
+	}
+}
+
+// addReturned records bytes returned to the client for a known cursor.
+func (a *cursorAffinity) addReturned(cursorID int64, n int) {
+	if _, ok := a.cursors[cursorID]; ok {
+		a.bytes[cursorID] += n
+	}
+}
+
+// returned returns the bytes returned to the client for the cursor so far.
+func (a *cursorAffinity) returned(cursorID int64) int {
+	return a.bytes[cursorID]
+}
+
+// owner returns the server connection holding the first known cursor.
+func (a *cursorAffinity) owner(cursorIDs []int64) (net.Conn, bool) {
+	for _, id := range cursorIDs {
+		if server, ok := a.cursors[id]; ok {
+			return server, true
+		}
+	}
+	return nil, false
+}
+
+// open returns the number of cursors the client has open.
+func (a *cursorAffinity) open() int {
+	return len(a.cursors)
+}
+
+// pinned returns true if the server connection holds any cursors.
+func (a *cursorAffinity) pinned(server net.Conn) bool {
+	return a.counts[server] > 0
+}
+
+// drop forgets all cursors held by the server connection. This is used when
+// the connection is discarded.
+func (a *cursorAffinity) drop(server net.Conn) {
+	for id, s := range a.cursors {
+		if s == server {
+			delete(a.cursors, id)
+			delete(a.bytes, id)
+			a.owners.release(id, a)
+		}
+	}
+	delete(a.counts, server)
+}
+
+// releaseAll gives up the ownership of all cursors, once the client is gone.
+func (a *cursorAffinity) releaseAll() {
+	for id := range a.cursors {
+		a.owners.release(id, a)
+	}
+	for id := range a.commands {
+		a.owners.release(id, a)
+	}
+}
+
+// conns returns all the server connections holding cursors.
+func (a *cursorAffinity) conns() []net.Conn {
+	conns := make([]net.Conn, 0, len(a.counts))
+	for c := range a.counts {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// cursorOwners tracks which client opened each cursor across all the clients
+// of a proxy. Since clients share server connections, a client could otherwise
+// guess the ID of another client's cursor and read from it. Both the cursors
+// of OP_QUERY replies and those of command replies, found in their cursor.id,
+// are tracked, and checked for OP_GET_MORE, OP_KILL_CURSORS and the getMore
+// and killCursors commands, whether sent as OP_QUERY or OP_MSG. Cursors the
+// proxy did not see opened have no owner and are not checked. A nil
+// cursorOwners tracks nothing.
+type cursorOwners struct {
+	mu     sync.Mutex
+	owners map[int64]*cursorAffinity
+}
+
+// claim records that the client opened the cursor.
+func (o *cursorOwners) claim(cursorID int64, a *cursorAffinity) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.owners == nil {
+		o.owners = make(map[int64]*cursorAffinity)
+	}
+	o.owners[cursorID] = a
+}
+
+// release forgets the cursor, if the client owns it.
+func (o *cursorOwners) release(cursorID int64, a *cursorAffinity) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.owners[cursorID] == a {
+		delete(o.owners, cursorID)
+	}
+}
+
+// foreign returns true if any of the cursors belongs to another client.
+func (o *cursorOwners) foreign(cursorIDs []int64, a *cursorAffinity) bool {
+	if o == nil || len(cursorIDs) == 0 {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, id := range cursorIDs {
+		if owner, ok := o.owners[id]; ok && owner != a {
+			return true
+		}
+	}
+	return false
+}
+
+// readCursorIDs reads the body of OP_GET_MORE and OP_KILL_CURSORS messages, or
+// of getMore and killCursors commands sent as OP_QUERY or OP_MSG, to find the
+// cursors they refer to. The returned conn replays the body, so the message can
+// still be proxied as is. Other messages are left untouched.
+func readCursorIDs(h *messageHeader, c net.Conn, ns namespaces) (net.Conn, []int64, error) {
+	switch h.OpCode {
+	case OpQuery:
+		return readCommandCursorIDs(h, c, ns)
+	case OpMsg:
+		return readMsgCursorIDs(h, c)
+	}
+	if h.OpCode != OpGetMore && h.OpCode != OpKillCursors {
+		return c, nil, nil
+	}
+	if h.MessageLength < headerLen {
+		return nil, nil, errMalformedCursorMessage
+	}
+	body := make([]byte, h.MessageLength-headerLen)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, nil, err
+	}
+	ids, err := parseCursorIDs(h.OpCode, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	replay := &replayConn{
+		Conn:   c,
+		reader: io.MultiReader(bytes.NewReader(body), c),
+	}
+	return replay, ids, nil
+}
+
+// parseCursorIDs extracts the cursor IDs from the body of an OP_GET_MORE or
+// OP_KILL_CURSORS message.
+func parseCursorIDs(op OpCode, body []byte) ([]int64, error) {
+	switch op {
+	case OpGetMore:
+		// int32 ZERO, cstring fullCollectionName, int32 numberToReturn,
+		// int64 cursorID
+		if len(body) < 4 {
+			return nil, errMalformedCursorMessage
+		}
+		end := bytes.IndexByte(body[4:], x00)
+		if end < 0 {
+			return nil, errMalformedCursorMessage
+		}
+		pos := 4 + end + 1 + 4
+		if len(body) < pos+8 {
+			return nil, errMalformedCursorMessage
+		}
+		return []int64{getInt64(body, pos)}, nil
+	case OpKillCursors:
+		// int32 ZERO, int32 numberOfCursorIDs, int64* cursorIDs
+		if len(body) < 8 {
+			return nil, errMalformedCursorMessage
+		}
+		n := int(getInt32(body, 4))
+		if n < 0 || len(body) < 8+n*8 {
+			return nil, errMalformedCursorMessage
+		}
+		ids := make([]int64, n)
+		for i := range ids {
+			ids[i] = getInt64(body, 8+i*8)
+		}
+		return ids, nil
+	}
+	return nil, nil
+}
+
+// replayConn replays already consumed bytes before reading from the
+// underlying connection.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (r *replayConn) Read(b []byte) (int, error) {
+	return r.reader.Read(b)
+}
+
+// replyWatcher watches the first reply read from the server connection to
+// find the cursor it returned. Replies to queries with a negative or small
+// numberToReturn come back with a zero cursor since the server closes it
+// after the first batch. The first document of the reply is scanned for the
+// cursor of a command if the command scanner is set.
+type replyWatcher struct {
+	net.Conn
+	prefix  [headerLen + 20]byte
+	n       int
+	command *commandCursorScanner
+}
+
+func (r *replyWatcher) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	if r.n < len(r.prefix) {
+		r.n += copy(r.prefix[r.n:], b[:n])
+	}
+	if r.command != nil {
+		r.command.Write(b[:n])
+	}
+	return n, err
+}
+
+// cursorID returns the cursor ID in the reply, if a reply was read.
+func (r *replyWatcher) cursorID() (int64, bool) {
+	if r.n < len(r.prefix) || OpCode(getInt32(r.prefix[:], 12)) != OpReply {
+		return 0, false
+	}
+	return getInt64(r.prefix[:], headerLen+4), true
+}
+
+// cursorNotFound returns true if the reply indicates the cursor is unknown to
+// the server.
+func (r *replyWatcher) cursorNotFound() bool {
+	return r.n == len(r.prefix) && getInt32(r.prefix[:], headerLen)&replyCursorNotFound != 0
+}
+
+// commandCursorID returns the cursor.id of a command reply, if it has one.
+func (r *replyWatcher) commandCursorID() (int64, bool) {
+	if r.command == nil {
+		return 0, false
+	}
+	return r.command.cursorID()
+}
+
+// requestWatcher keeps the start of the request read from the client, to tell
+// commands from queries once the message was proxied.
+type requestWatcher struct {
+	net.Conn
+	request requestPrefix
+}
+
+func (r *requestWatcher) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.request.record(b[:n])
+	return n, err
+}
@@ -0,0 +1,29 @@
+package dvara
+
+import (
+	"fmt"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// opensCursor returns true if the OP_QUERY body is a plain query, which leaves
+// a cursor open on the server when its results do not fit in the first batch.
+func (n namespaces) opensCursor(body []byte) bool {
+	collection, _, ok := queryCollection(body)
+	return ok && collection != n.command
+}
+
+// checkCursorLimit rejects queries which could open another cursor once the
+// client has MaxCursorsPerClient open.
+func (p *Proxy) checkCursorLimit(m *Message, next MessageHandler) error {
+	max := p.ReplicaSet.MaxCursorsPerClient
+	if max == 0 || m.OpCode != OpQuery || uint(m.cursors.open()) < max ||
+		!p.ReplicaSet.namespaces().opensCursor(m.Query) {
+		return next(m)
+	}
+	stats.BumpSum(p.stats, "client.cursor.limit", 1)
+	corelog.LogInfoMessage("rejected query over the cursor limit",
+		"client", m.RemoteIP, "proxy", p.String(), "cursors", m.cursors.open())
+	return m.Reply(ErrorCodeCursorLimit, fmt.Sprintf("dvara: too many open cursors, at most %d are allowed", max))
+}
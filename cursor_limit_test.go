@@ -0,0 +1,61 @@
+package dvara
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestOpensCursor(t *testing.T) {
+	t.Parallel()
+	ensure.True(t, defaultNamespaces.opensCursor(queryBody(t, "test.foo", bson.M{"a": 1})))
+	ensure.True(t, defaultNamespaces.opensCursor(queryBody(t, "test.system.indexes", bson.M{})))
+	ensure.False(t, defaultNamespaces.opensCursor(queryBody(t, "test.$cmd", bson.M{"count": "foo"})))
+	ensure.False(t, defaultNamespaces.opensCursor(nil))
+}
+
+func TestCheckCursorLimit(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MaxCursorsPerClient: 2},
+		stats:      &rec,
+	}
+	p.messageChain = p.newMessageChain()
+	ensure.True(t, p.inspectsQueries())
+	find := queryMessage(t, 9, "test.foo", bson.M{"a": 1})
+	count := queryMessage(t, 10, "test.$cmd", bson.M{"count": "foo"})
+
+	m, _ := newTestMessage(p, find, find[headerLen:])
+	cursors := m.cursors
+	cursors.pin(1, &bufferConn{})
+	admitted, err := p.admit(m)
+	ensure.Nil(t, err)
+	ensure.True(t, admitted)
+
+	cursors.pin(2, &bufferConn{})
+	m, client := newTestMessage(p, find, find[headerLen:])
+	m.cursors = cursors
+	admitted, err = p.admit(m)
+	ensure.Nil(t, err)
+	ensure.False(t, admitted)
+	ensure.DeepEqual(t, errorReplyCode(t, client.w.Bytes()), ErrorCodeCursorLimit)
+	ensure.DeepEqual(t, getInt32(client.w.Bytes(), 8), int32(9))
+	ensure.DeepEqual(t, rec.sum("client.cursor.limit"), float64(1))
+
+	// Commands do not open cursors and still go through.
+	m, _ = newTestMessage(p, count, count[headerLen:])
+	m.cursors = cursors
+	admitted, err = p.admit(m)
+	ensure.Nil(t, err)
+	ensure.True(t, admitted)
+
+	cursors.unpin(1)
+	m, _ = newTestMessage(p, find, find[headerLen:])
+	m.cursors = cursors
+	admitted, err = p.admit(m)
+	ensure.Nil(t, err)
+	ensure.True(t, admitted)
+	ensure.DeepEqual(t, rec.sum("client.cursor.limit"), float64(1))
+}
@@ -0,0 +1,263 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+)
+
+// bufferConn is a net.Conn reading from and writing to in memory buffers.
+type bufferConn struct {
+	net.Conn
+	r *bytes.Reader
+	w bytes.Buffer
+}
+
+func (b *bufferConn) Read(p []byte) (int, error)  { return b.r.Read(p) }
+func (b *bufferConn) Write(p []byte) (int, error) { return b.w.Write(p) }
+func (b *bufferConn) SetDeadline(time.Time) error { return nil }
+func (b *bufferConn) Close() error                { return nil }
+
+func getMoreBody(collection string, cursorID int64) []byte {
+	b := addInt32(nil, 0)
+	b = addCString(b, collection)
+	b = addInt32(b, 0)
+	return addInt64(b, cursorID)
+}
+
+func killCursorsBody(cursorIDs ...int64) []byte {
+	b := addInt32(nil, 0)
+	b = addInt32(b, int32(len(cursorIDs)))
+	for _, id := range cursorIDs {
+		b = addInt64(b, id)
+	}
+	return b
+}
+
+func replyMessage(flags int32, cursorID int64) []byte {
+	reply := messageHeader{MessageLength: headerLen + 20, OpCode: OpReply}
+	msg := append(reply.ToWire(), addInt32(nil, flags)...)
+	msg = addInt64(msg, cursorID)
+	msg = addInt32(msg, 0)
+	return addInt32(msg, 0)
+}
+
+func TestCursorAffinity(t *testing.T) {
+	t.Parallel()
+	a := newCursorAffinity(nil)
+	s1 := &bufferConn{}
+	s2 := &bufferConn{}
+
+	a.pin(1, s1)
+	a.pin(2, s1)
+	a.pin(3, s2)
+	ensure.True(t, a.pinned(s1))
+	ensure.True(t, a.pinned(s2))
+	ensure.DeepEqual(t, len(a.conns()), 2)
+
+	owner, ok := a.owner([]int64{4, 3})
+	ensure.True(t, ok)
+	ensure.True(t, owner == s2)
+	_, ok = a.owner([]int64{4})
+	ensure.False(t, ok)
+
+	a.unpin(1)
+	ensure.True(t, a.pinned(s1))
+	a.unpin(2)
+	ensure.False(t, a.pinned(s1))
+	a.unpin(2)
+
+	a.drop(s2)
+	ensure.False(t, a.pinned(s2))
+	_, ok = a.owner([]int64{3})
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, len(a.conns()), 0)
+}
+
+func TestParseCursorIDs(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		OpCode   OpCode
+		Body     []byte
+		Expected []int64
+		Error    error
+	}{
+		{OpGetMore, getMoreBody("test.foo", 42), []int64{42}, nil},
+		{OpGetMore, getMoreBody("test.foo", 42)[:10], nil, errMalformedCursorMessage},
+		{OpGetMore, []byte{0, 0, 0, 0, 1}, nil, errMalformedCursorMessage},
+		{OpKillCursors, killCursorsBody(1, 2, 3), []int64{1, 2, 3}, nil},
+		{OpKillCursors, killCursorsBody(1, 2, 3)[:20], nil, errMalformedCursorMessage},
+		{OpKillCursors, killCursorsBody(), []int64{}, nil},
+		{OpInsert, []byte{1, 2}, nil, nil},
+	}
+	for _, c := range cases {
+		ids, err := parseCursorIDs(c.OpCode, c.Body)
+		ensure.DeepEqual(t, err, c.Error)
+		ensure.DeepEqual(t, ids, c.Expected)
+	}
+}
+
+func TestReadCursorIDsReplaysBody(t *testing.T) {
+	t.Parallel()
+	body := getMoreBody("test.foo", 7)
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpGetMore}
+	c := &bufferConn{r: bytes.NewReader(body)}
+
+	replay, ids, err := readCursorIDs(h, c, defaultNamespaces)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, ids, []int64{7})
+	replayed, err := ioutil.ReadAll(replay)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, replayed, body)
+}
+
+func TestReadCursorIDsIgnoresOtherOps(t *testing.T) {
+	t.Parallel()
+	h := &messageHeader{MessageLength: 100, OpCode: OpInsert}
+	c := &bufferConn{r: bytes.NewReader(nil)}
+	replay, ids, err := readCursorIDs(h, c, defaultNamespaces)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(ids), 0)
+	ensure.True(t, replay == c)
+}
+
+func TestReplyWatcherCursorID(t *testing.T) {
+	t.Parallel()
+	w := &replyWatcher{Conn: &bufferConn{r: bytes.NewReader(replyMessage(0, 99))}}
+	_, ok := w.cursorID()
+	ensure.False(t, ok)
+
+	var out bytes.Buffer
+	ensure.Nil(t, copyMessage(&out, w))
+	id, ok := w.cursorID()
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, id, int64(99))
+}
+
+func TestGetMoreReleasesExhaustedCursor(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Flags    int32
+		CursorID int64
+		Pinned   bool
+	}{
+		{0, 5, true},
+		{0, 0, false},
+		{replyCursorNotFound, 5, false},
+	}
+	for _, c := range cases {
+		p := &Proxy{
+			ReplicaSet: &ReplicaSet{MessageTimeout: time.Second},
+			Clock:      clock.NewMock(),
+		}
+		body := getMoreBody("test.foo", 5)
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpGetMore}
+		client := &bufferConn{r: bytes.NewReader(body)}
+		server := &bufferConn{r: bytes.NewReader(replyMessage(c.Flags, c.CursorID))}
+		cursors := newCursorAffinity(nil)
+		cursors.pin(5, server)
+
+		var lastError LastError
+		ensure.Nil(t, p.proxyCursorMessage(h, nil, client, server, &lastError, []int64{5}, cursors))
+		ensure.DeepEqual(t, cursors.pinned(server), c.Pinned)
+		ensure.DeepEqual(t, client.w.Bytes(), replyMessage(c.Flags, c.CursorID))
+	}
+}
+
+func TestQueryPinsReturnedCursor(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Second,
+			ProxyQuery:     &ProxyQuery{},
+		},
+		Clock: clock.NewMock(),
+	}
+	body := addInt32(nil, 0)
+	body = addCString(body, "test.foo")
+	body = addInt32(body, 0)
+	body = addInt32(body, 0)
+	body, err := addBSON(body, nil)
+	ensure.Nil(t, err)
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	server := &bufferConn{r: bytes.NewReader(replyMessage(0, 8))}
+	cursors := newCursorAffinity(nil)
+
+	var lastError LastError
+	ensure.Nil(t, p.proxyCursorMessage(h, nil, client, server, &lastError, nil, cursors))
+	owner, ok := cursors.owner([]int64{8})
+	ensure.True(t, ok)
+	ensure.True(t, owner == server)
+}
+
+func TestCursorOwners(t *testing.T) {
+	t.Parallel()
+	var owners cursorOwners
+	a := newCursorAffinity(&owners)
+	b := newCursorAffinity(&owners)
+	server := &bufferConn{}
+
+	a.pin(1, server)
+	a.pin(2, server)
+	ensure.False(t, owners.foreign([]int64{1, 2}, a))
+	ensure.True(t, owners.foreign([]int64{1}, b))
+	ensure.True(t, owners.foreign([]int64{3, 2}, b))
+	ensure.False(t, owners.foreign([]int64{3}, b))
+	ensure.False(t, owners.foreign(nil, b))
+
+	a.unpin(1)
+	ensure.False(t, owners.foreign([]int64{1}, b))
+	a.releaseAll()
+	ensure.False(t, owners.foreign([]int64{2}, b))
+
+	// Releasing a cursor claimed since by another client keeps the new claim.
+	a.pin(4, server)
+	b.pin(4, server)
+	a.drop(server)
+	ensure.True(t, owners.foreign([]int64{4}, a))
+
+	var none *cursorOwners
+	ensure.False(t, none.foreign([]int64{4}, a))
+}
+
+func TestRejectForeignCursors(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := &Proxy{stats: &rec}
+	body := getMoreBody("test.foo", 5)
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpGetMore, RequestID: 3}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	ensure.Nil(t, p.rejectForeignCursors(h, client, "127.0.0.1"))
+	ensure.DeepEqual(t, client.r.Len(), 0)
+	ensure.DeepEqual(t, errorReplyCode(t, client.w.Bytes()), ErrorCodeCursorNotFound)
+	ensure.DeepEqual(t, rec.log(), []string{"sum cursor.cross.client.rejected 1"})
+
+	body = killCursorsBody(5)
+	h = &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpKillCursors}
+	client = &bufferConn{r: bytes.NewReader(body)}
+	ensure.Nil(t, p.rejectForeignCursors(h, client, "127.0.0.1"))
+	ensure.DeepEqual(t, client.w.Len(), 0)
+}
+
+func TestProxyKillCursorsWithoutResponse(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Second},
+		Clock:      clock.NewMock(),
+	}
+	body := killCursorsBody(5, 6)
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpKillCursors}
+	client := &bufferConn{r: bytes.NewReader(body)}
+
+	// The server never responds, reading from it fails with io.EOF.
+	server := &bufferConn{r: bytes.NewReader(nil)}
+	ensure.Nil(t, p.proxyMessage(h, nil, client, server, &LastError{}))
+	ensure.DeepEqual(t, server.w.Bytes()[headerLen:], body)
+	ensure.DeepEqual(t, client.w.Len(), 0)
+}
@@ -0,0 +1,89 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	"github.com/facebookgo/stats"
+)
+
+// startDatabasePools creates the pools of the DatabaseConnections partitions.
+func (p *Proxy) startDatabasePools() {
+	if len(p.ReplicaSet.DatabaseConnections) == 0 {
+		return
+	}
+	p.databasePools = make(map[string]ConnPool, len(p.ReplicaSet.DatabaseConnections))
+	for db, max := range p.ReplicaSet.DatabaseConnections {
+		p.databasePools[db] = p.newDatabasePool(db, max)
+	}
+}
+
+// newDatabasePool creates the pool of connections to MongoAddr reserved for
+// the database. Connections are established with retries like those of the
+// server pool, and belong to the database pool. Idle connections are not kept
+// around ahead of time, as MinIdleConnections is for the server pool.
+func (p *Proxy) newDatabasePool(db string, max uint) ConnPool {
+	var pool ConnPool
+	dial := func() (io.Closer, error) {
+		c, err := p.newServerConn()
+		if err != nil {
+			return nil, err
+		}
+		c.(*serverConn).pool = pool
+		return c, nil
+	}
+	if p.ReplicaSet.NewPool != nil {
+		pool = p.ReplicaSet.NewPool(p.MongoAddr, BackendLimits{MaxConnections: max}, dial)
+		return pool
+	}
+	pooled := &Pool{New: dial}
+	p.configurePool(pooled, p.MongoAddr)
+	pooled.Max = max
+	pooled.MinIdle = 0
+	if p.ReplicaSet.Stats != nil {
+		pooled.Stats = stats.PrefixClient(
+			[]string{"mongoproxy.server.pool.database." + db + "."},
+			p.ReplicaSet.Stats,
+		)
+	}
+	pool = pooled
+	return pool
+}
+
+// isDatabasePool returns true if the pool is one of the DatabaseConnections
+// partitions.
+func (p *Proxy) isDatabasePool(pool ConnPool) bool {
+	for _, dbPool := range p.databasePools {
+		if dbPool == pool {
+			return true
+		}
+	}
+	return false
+}
+
+// getPrimaryConn gets a connection to MongoAddr for the query, from the pool
+// of its database if it has one and otherwise from the server pool.
+func (p *Proxy) getPrimaryConn(body []byte) (net.Conn, error) {
+	pool, ok := p.databasePools[queryDatabase(body)]
+	if !ok {
+		return p.getServerConn(p.MongoAddr)
+	}
+	if p.isDraining(p.MongoAddr) {
+		return nil, errBackendDraining
+	}
+	return p.acquire(pool)
+}
+
+// queryDatabase returns the database an OP_QUERY body is for, or an empty
+// string if there is no body.
+func queryDatabase(body []byte) string {
+	if len(body) < 4 {
+		return ""
+	}
+	end := bytes.IndexByte(body[4:], x00)
+	if end < 0 {
+		return ""
+	}
+	return databaseName(body[4 : 4+end])
+}
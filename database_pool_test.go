@@ -0,0 +1,69 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestQueryDatabase(t *testing.T) {
+	t.Parallel()
+	ensure.DeepEqual(t, queryDatabase(queryBody(t, "tenant.foo", bson.M{})), "tenant")
+	ensure.DeepEqual(t, queryDatabase(queryBody(t, "tenant.$cmd", bson.M{"count": "foo"})), "tenant")
+	ensure.DeepEqual(t, queryDatabase(queryBody(t, "tenant", bson.M{})), "tenant")
+	ensure.DeepEqual(t, queryDatabase(nil), "")
+	ensure.DeepEqual(t, queryDatabase([]byte{0, 0, 0, 0, 'a'}), "")
+}
+
+func TestDatabasePools(t *testing.T) {
+	t.Parallel()
+	var pools []*countingPool
+	p := newLoopbackProxy(t)
+	p.ReplicaSet.MaxConnections = 2
+	p.ReplicaSet.MaxPerClientConnections = 10
+	p.ReplicaSet.ServerIdleTimeout = time.Hour
+	p.ReplicaSet.ServerClosePoolSize = 1
+	p.ReplicaSet.ClientIdleTimeout = time.Minute
+	p.ReplicaSet.DatabaseConnections = map[string]uint{"tenant": 1}
+	p.ReplicaSet.NewPool = func(addr string, limits BackendLimits, dial func() (io.Closer, error)) ConnPool {
+		pool := &countingPool{Pool: &Pool{
+			New:           dial,
+			Max:           limits.MaxConnections,
+			IdleTimeout:   time.Hour,
+			ClosePoolSize: 1,
+		}}
+		pools = append(pools, pool)
+		return pool
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p.ClientListener = l
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+	ensure.DeepEqual(t, len(pools), 2)
+	server, tenant := pools[0], pools[1]
+	ensure.DeepEqual(t, tenant.Max, uint(1))
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer c.Close()
+	for i, ns := range []string{"tenant.foo", "tenant.$cmd", "test.foo"} {
+		_, err = c.Write(queryMessage(t, int32(i+1), ns, bson.M{"count": "foo"}))
+		ensure.Nil(t, err)
+		ensure.Nil(t, copyMessage(ioutil.Discard, c))
+	}
+	ensure.DeepEqual(t, atomic.LoadInt32(&tenant.acquired), int32(2))
+	ensure.DeepEqual(t, atomic.LoadInt32(&server.acquired), int32(1))
+	ensure.DeepEqual(t, tenant.Snapshot().Idle, uint(1))
+
+	// The partition keeps its own limit when the proxy is reconfigured.
+	ensure.Nil(t, p.Reconfigure(&ReplicaSet{MaxConnections: 3, MaxPerClientConnections: 10}))
+	ensure.DeepEqual(t, tenant.Max, uint(1))
+	ensure.DeepEqual(t, server.Max, uint(3))
+}
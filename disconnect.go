@@ -0,0 +1,54 @@
+package dvara
+
+import (
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// The reasons a client connection is closed for. Each has a
+// "client.disconnect.<reason>" stat and is logged as the reason field.
+const (
+	disconnectNormal        = "normal"
+	disconnectStopped       = "stopped"
+	disconnectIdleTimeout   = "idle.timeout"
+	disconnectHandshake     = "handshake.timeout"
+	disconnectProtocolError = "protocol.error"
+	disconnectReadError     = "read.error"
+	disconnectProxyError    = "proxy.error"
+	disconnectServerPool    = "server.pool.error"
+	disconnectRecycled      = "recycled"
+	disconnectAdmin         = "admin"
+)
+
+// readDisconnectReason returns the reason to close a client connection for
+// after failing to read a message from it.
+func (p *Proxy) readDisconnectReason(err error) string {
+	switch err {
+	case errNormalClose:
+		if isClosed(p.closed) {
+			return disconnectStopped
+		}
+		return disconnectNormal
+	case errClientReadTimeout:
+		return disconnectIdleTimeout
+	case errClientHandshakeTimeout:
+		return disconnectHandshake
+	case errInvalidMessageLength, errShortHeader, errMalformedCursorMessage, errOpCodeNotAllowed:
+		return disconnectProtocolError
+	}
+	return disconnectReadError
+}
+
+// clientDisconnected records why a client connection was closed. Clients going
+// away on their own are only counted, anything else is logged too.
+func (p *Proxy) clientDisconnected(remoteIP, reason string, err error) {
+	stats.BumpSum(p.stats, "client.disconnect."+reason, 1)
+	if reason == disconnectNormal {
+		return
+	}
+	keyvals := []interface{}{"reason", reason, "client", remoteIP, "proxy", p.String()}
+	if err != nil {
+		keyvals = append(keyvals, "error", err)
+	}
+	corelog.LogInfoMessage("client disconnected", keyvals...)
+}
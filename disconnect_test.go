@@ -0,0 +1,85 @@
+package dvara
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+)
+
+func TestReadDisconnectReason(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{closed: make(chan struct{})}
+	cases := []struct {
+		Error  error
+		Reason string
+	}{
+		{errNormalClose, disconnectNormal},
+		{errClientReadTimeout, disconnectIdleTimeout},
+		{errClientHandshakeTimeout, disconnectHandshake},
+		{errInvalidMessageLength, disconnectProtocolError},
+		{errMalformedCursorMessage, disconnectProtocolError},
+		{errShortHeader, disconnectProtocolError},
+		{errOpCodeNotAllowed, disconnectProtocolError},
+		{errors.New("connection reset"), disconnectReadError},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, p.readDisconnectReason(c.Error), c.Reason)
+	}
+
+	close(p.closed)
+	ensure.DeepEqual(t, p.readDisconnectReason(errNormalClose), disconnectStopped)
+}
+
+func TestClientDisconnectReasons(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Send             []byte
+		HandshakeTimeout time.Duration
+		Reason           string
+	}{
+		{nil, 0, "mongoproxy.client.disconnect.idle.timeout"},
+		{nil, 10 * time.Millisecond, "mongoproxy.client.disconnect.handshake.timeout"},
+		{messageHeader{MessageLength: 3, OpCode: OpQuery}.ToWire(), 0, "mongoproxy.client.disconnect.protocol.error"},
+		{messageHeader{MessageLength: 100, OpCode: OpQuery}.ToWire()[:10], 0, "mongoproxy.client.disconnect.protocol.error"},
+	}
+	for _, c := range cases {
+		reasons := make(chan string, 1)
+		hc := &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if strings.HasPrefix(key, "mongoproxy.client.disconnect.") {
+					reasons <- key
+				}
+			},
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		ensure.Nil(t, err)
+		p := &Proxy{
+			ReplicaSet: &ReplicaSet{
+				Stats:                   hc,
+				MaxConnections:          1,
+				MaxPerClientConnections: 1,
+				ServerIdleTimeout:       time.Hour,
+				ServerClosePoolSize:     1,
+				ClientIdleTimeout:       10 * time.Millisecond,
+				ClientHandshakeTimeout:  c.HandshakeTimeout,
+			},
+			ClientListener: l,
+		}
+		ensure.Nil(t, p.Start())
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		ensure.Nil(t, err)
+		if c.Send != nil {
+			_, err = conn.Write(c.Send)
+			ensure.Nil(t, err)
+		}
+		ensure.DeepEqual(t, <-reasons, c.Reason)
+		conn.Close()
+		ensure.Nil(t, p.Stop())
+	}
+}
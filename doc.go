@@ -1,3 +1,37 @@
 // Package dvara provides a library to enable setting up a proxy server
 // for mongo.
+//
+// Clients don't own a server connection. One is taken from the pool for each
+// message and its response, and returned as soon as the exchange is over, so
+// idle clients hold none and MaxConnections can be much smaller than the
+// number of clients. A server connection is held beyond a single exchange in
+// three cases only:
+//
+//   - After a legacy write, until the client's next message or the
+//     GetLastErrorTimeout, since a getLastError must run on the connection
+//     the write went over. DisableGetLastError skips this wait.
+//   - While the client has cursors open on it, since getMore and killCursors
+//     must go to the connection which created the cursor.
+//   - While a multi-statement transaction runs on it, from startTransaction
+//     until commitTransaction or abortTransaction, since all its statements
+//     must go to the same connection. They may come from any client
+//     connection of the session. Transactions without a statement for the
+//     TransactionTimeout are taken as leaked and their connection reclaimed.
+//
+// Clients may pipeline, sending further requests before reading the responses
+// to earlier ones. Like mongod, the proxy serves the messages of a connection
+// one at a time, in the order they were sent, so the responses come back in
+// that order too. Pipelined messages wait in the socket buffers, or the read
+// buffer, until the messages before them were proxied, and the message framing
+// never depends on how the bytes arrived. A client must read responses while
+// it writes though: one which writes more than the buffers hold before reading
+// anything blocks the proxy writing it a response, until the MessageTimeout
+// closes the connection.
+//
+// OP_MSG messages are proxied like the legacy opcodes, and their replies
+// relayed to the client, including the further replies servers stream for
+// requests with the exhaustAllowed flag. Messages with the moreToCome flag get
+// no reply. Replies are relayed as they are: unlike isMaster replies to
+// OP_QUERY, hello replies sent as OP_MSG list the members of the replica set
+// rather than the proxies.
 package dvara
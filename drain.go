@@ -0,0 +1,77 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+var errBackendDraining = errors.New("dvara: backend is draining")
+
+// DrainBackend stops using the backend at the given address, for example
+// ahead of restarting it during rolling maintenance. New connections to it
+// can't be acquired and its idle connections are closed. Connections in use
+// are left to finish the message they are on and are closed when released.
+// Messages which would need a connection to it fail until ResumeBackend is
+// called, except reads preferring a secondary which fall back to MongoAddr.
+func (p *Proxy) DrainBackend(addr string) {
+	p.drainingMutex.Lock()
+	if p.draining == nil {
+		p.draining = make(map[string]bool)
+	}
+	p.draining[addr] = true
+	p.drainingMutex.Unlock()
+
+	stats.BumpSum(p.stats, "server.backend.draining", 1)
+	corelog.LogInfoMessage(fmt.Sprintf("draining backend %s for %s", addr, p))
+	p.eachPool(func(poolAddr string, pool ConnPool) {
+		if poolAddr == addr {
+			pool.CloseIdle()
+		}
+	})
+}
+
+// ResumeBackend starts using a backend drained with DrainBackend again.
+func (p *Proxy) ResumeBackend(addr string) {
+	p.drainingMutex.Lock()
+	delete(p.draining, addr)
+	p.drainingMutex.Unlock()
+	corelog.LogInfoMessage(fmt.Sprintf("resumed backend %s for %s", addr, p))
+}
+
+// isDraining returns true if the backend is being drained.
+func (p *Proxy) isDraining(addr string) bool {
+	p.drainingMutex.RLock()
+	defer p.drainingMutex.RUnlock()
+	return p.draining[addr]
+}
+
+// drained returns true if the server connection is to a backend being drained,
+// so it should be closed rather than go back to the pool.
+func (p *Proxy) drained(c net.Conn) bool {
+	sc, ok := c.(*serverConn)
+	return ok && p.isDraining(sc.backend)
+}
+
+// DrainBackend drains the backend at the given address on all the proxies,
+// see Proxy.DrainBackend.
+func (manager *StateManager) DrainBackend(addr string) {
+	manager.RLock()
+	defer manager.RUnlock()
+	for _, proxy := range manager.proxies {
+		proxy.DrainBackend(addr)
+	}
+}
+
+// ResumeBackend resumes using the backend at the given address on all the
+// proxies.
+func (manager *StateManager) ResumeBackend(addr string) {
+	manager.RLock()
+	defer manager.RUnlock()
+	for _, proxy := range manager.proxies {
+		proxy.ResumeBackend(addr)
+	}
+}
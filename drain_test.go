@@ -0,0 +1,48 @@
+package dvara
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestDrainBackend(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := &Proxy{
+		MongoAddr: "mongo:1",
+		stats:     &rec,
+	}
+	pool := &Pool{
+		New: func() (io.Closer, error) {
+			return &serverConn{Conn: &bufferConn{}, backend: "mongo:1"}, nil
+		},
+		Max:           2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	p.serverPool = pool
+	defer pool.Close()
+
+	idle, err := p.getServerConn("mongo:1")
+	ensure.Nil(t, err)
+	inUse, err := p.getServerConn("mongo:1")
+	ensure.Nil(t, err)
+	p.returnServerConn(idle)
+
+	p.DrainBackend("mongo:1")
+	ensure.DeepEqual(t, rec.sum("server.backend.draining"), float64(1))
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{Total: 1, InUse: 1})
+	_, err = p.getServerConn("mongo:1")
+	ensure.DeepEqual(t, err, errBackendDraining)
+	p.returnServerConn(inUse)
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{})
+
+	p.ResumeBackend("mongo:1")
+	c, err := p.getServerConn("mongo:1")
+	ensure.Nil(t, err)
+	p.returnServerConn(c)
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{Total: 1, Idle: 1})
+}
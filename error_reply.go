@@ -0,0 +1,149 @@
+package dvara
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Error codes used in the replies the proxy synthesizes when it rejects a
+// request. Where mongo has an equivalent error its code is used so drivers
+// handle it as they usually would, the others are specific to dvara.
+const (
+	ErrorCodeHostUnreachable         = 6
+	ErrorCodeUnauthorized            = 13
+	ErrorCodeCursorNotFound          = 43
+	ErrorCodeExceededTimeLimit       = 50
+	ErrorCodeMaxPerClientConnections = 20001
+	ErrorCodeBackpressure            = 20002
+	ErrorCodeResponseCapped          = 20003
+	ErrorCodeOpCodeNotAllowed        = 20004
+	ErrorCodeCompressorNotSupported  = 20006
+	ErrorCodeCursorLimit             = 20007
+)
+
+// replyQueryFailure is the OP_REPLY responseFlags bit set when the query
+// failed and the single returned document holds the error.
+const replyQueryFailure = 2
+
+// rejectReadTimeout bounds how long a rejected client has to send its first
+// request before its connection is closed without a reply.
+const rejectReadTimeout = time.Second
+
+// errorDocument returns the error document for the code and message. It has
+// both the query failure and the command error fields so the error is
+// surfaced whether the request was a query or a command.
+func errorDocument(code int, msg string) ([]byte, error) {
+	return bson.Marshal(bson.D{
+		{Name: "$err", Value: msg},
+		{Name: "errmsg", Value: msg},
+		{Name: "code", Value: code},
+		{Name: "ok", Value: 0},
+	})
+}
+
+// writeErrorResponse writes an error in response to the request, in the format
+// the client expects given the request's opcode: an OP_MSG for an OP_MSG and an
+// OP_REPLY otherwise.
+func writeErrorResponse(w io.Writer, h *messageHeader, code int, msg string) error {
+	if h.OpCode != OpMsg {
+		return writeErrorReply(w, h.RequestID, code, msg)
+	}
+	doc, err := errorDocument(code, msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msgDocumentMessage(h.RequestID, doc))
+	return err
+}
+
+// writeErrorReply writes an OP_REPLY in response to the request with the given
+// ID, carrying an error document with the code and message.
+func writeErrorReply(w io.Writer, requestID int32, code int, msg string) error {
+	doc, err := errorDocument(code, msg)
+	if err != nil {
+		return err
+	}
+	return writeReply(w, requestID, replyQueryFailure, doc)
+}
+
+// writeReply writes an OP_REPLY with a single document in response to the
+// request with the given ID.
+func writeReply(w io.Writer, requestID int32, flags int32, doc []byte) error {
+	_, err := w.Write(replyDocumentMessage(requestID, flags, doc))
+	return err
+}
+
+// replyDocumentMessage returns an OP_REPLY with a single document in response to the
+// request with the given ID: the header, int32 responseFlags, int64 cursorID,
+// int32 startingFrom, int32 numberReturned and the document.
+func replyDocumentMessage(requestID int32, flags int32, doc []byte) []byte {
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(emptyPrefix) + len(doc)),
+		ResponseTo:    requestID,
+		OpCode:        OpReply,
+	}
+	b := h.ToWire()
+	b = addInt32(b, flags)
+	b = addInt64(b, 0)
+	b = addInt32(b, 0)
+	b = addInt32(b, 1)
+	return append(b, doc...)
+}
+
+// msgDocumentMessage returns an OP_MSG with the document as its body in response to
+// the request with the given ID: the header, uint32 flagBits, and a kind 0
+// section with the document. There is no checksum.
+func msgDocumentMessage(requestID int32, doc []byte) []byte {
+	h := messageHeader{
+		MessageLength: int32(headerLen + 4 + 1 + len(doc)),
+		ResponseTo:    requestID,
+		OpCode:        OpMsg,
+	}
+	b := h.ToWire()
+	b = addInt32(b, 0)
+	b = append(b, opMsgBodySection)
+	return append(b, doc...)
+}
+
+// rejectMessage consumes the rest of a message whose header was read and, if
+// the client expects a response, replies with an error rather than leaving the
+// client to find out from a closed connection. Clients expect a response to
+// an OP_MSG unless it has the moreToCome flag.
+func rejectMessage(h *messageHeader, c io.ReadWriter, code int, msg string) error {
+	rest := int64(h.MessageLength - headerLen)
+	var flags [4]byte
+	if h.OpCode == OpMsg && rest >= int64(len(flags)) {
+		if _, err := io.ReadFull(c, flags[:]); err != nil {
+			return err
+		}
+		rest -= int64(len(flags))
+	}
+	if _, err := io.CopyN(ioutil.Discard, c, rest); err != nil {
+		return err
+	}
+	switch {
+	case h.OpCode == OpMsg:
+		if uint32(getInt32(flags[:], 0))&opMsgMoreToCome != 0 {
+			return nil
+		}
+	case !h.OpCode.HasResponse():
+		return nil
+	}
+	return writeErrorResponse(c, h, code, msg)
+}
+
+// rejectClient replies to the first request of a client being turned away
+// with an error, then closes its connection.
+func (p *Proxy) rejectClient(c net.Conn, code int, msg string) {
+	defer c.Close()
+	c.SetDeadline(p.Clock.Now().Add(rejectReadTimeout))
+	h, err := readHeader(c)
+	if err != nil {
+		return
+	}
+	rejectMessage(h, c, code, msg)
+}
@@ -0,0 +1,148 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestWriteErrorReply(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	ensure.Nil(t, writeErrorReply(&b, 42, ErrorCodeHostUnreachable, "no backend"))
+
+	var doc bson.M
+	h, prefix, _, err := (&ReplyRW{}).ReadOne(&b, &doc)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.ResponseTo, int32(42))
+	ensure.DeepEqual(t, getInt32(prefix[:], 0), int32(replyQueryFailure))
+	ensure.DeepEqual(t, doc, bson.M{
+		"$err":   "no backend",
+		"errmsg": "no backend",
+		"code":   ErrorCodeHostUnreachable,
+		"ok":     0,
+	})
+	ensure.DeepEqual(t, b.Len(), 0)
+}
+
+func TestReplyDocumentMessage(t *testing.T) {
+	t.Parallel()
+	doc, err := bson.Marshal(bson.M{"ok": 1})
+	ensure.Nil(t, err)
+	b := replyDocumentMessage(42, replyQueryFailure, doc)
+
+	// header, responseFlags, cursorID, startingFrom, numberReturned, document
+	ensure.DeepEqual(t, len(b), 16+4+8+4+4+len(doc))
+	ensure.DeepEqual(t, getInt32(b, 0), int32(len(b)))
+	ensure.DeepEqual(t, getInt32(b, 4), int32(0))
+	ensure.DeepEqual(t, getInt32(b, 8), int32(42))
+	ensure.DeepEqual(t, getInt32(b, 12), int32(OpReply))
+	ensure.DeepEqual(t, getInt32(b, 16), int32(replyQueryFailure))
+	ensure.DeepEqual(t, getInt64(b, 20), int64(0))
+	ensure.DeepEqual(t, getInt32(b, 28), int32(0))
+	ensure.DeepEqual(t, getInt32(b, 32), int32(1))
+	ensure.DeepEqual(t, b[36:], doc)
+}
+
+func TestMsgDocumentMessage(t *testing.T) {
+	t.Parallel()
+	doc, err := bson.Marshal(bson.M{"ok": 1})
+	ensure.Nil(t, err)
+	b := msgDocumentMessage(42, doc)
+
+	// header, flagBits, section kind 0, document
+	ensure.DeepEqual(t, len(b), 16+4+1+len(doc))
+	ensure.DeepEqual(t, getInt32(b, 0), int32(len(b)))
+	ensure.DeepEqual(t, getInt32(b, 4), int32(0))
+	ensure.DeepEqual(t, getInt32(b, 8), int32(42))
+	ensure.DeepEqual(t, getInt32(b, 12), int32(OpMsg))
+	ensure.DeepEqual(t, getInt32(b, 16), int32(0))
+	ensure.DeepEqual(t, b[20], byte(opMsgBodySection))
+	ensure.DeepEqual(t, b[21:], doc)
+
+	m, err := parseOpMsg(b[headerLen:])
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, m.Body, doc)
+}
+
+func TestWriteErrorResponse(t *testing.T) {
+	t.Parallel()
+	var b bytes.Buffer
+	h := &messageHeader{RequestID: 9, OpCode: OpMsg}
+	ensure.Nil(t, writeErrorResponse(&b, h, ErrorCodeUnauthorized, "denied"))
+	reply, err := readHeader(&b)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, reply.OpCode, OpMsg)
+	ensure.DeepEqual(t, reply.ResponseTo, int32(9))
+	m, err := parseOpMsg(b.Bytes())
+	ensure.Nil(t, err)
+	var doc bson.M
+	ensure.Nil(t, bson.Unmarshal(m.Body, &doc))
+	ensure.DeepEqual(t, doc["code"], ErrorCodeUnauthorized)
+	ensure.DeepEqual(t, doc["errmsg"], "denied")
+	ensure.DeepEqual(t, doc["ok"], 0)
+
+	b.Reset()
+	h.OpCode = OpQuery
+	ensure.Nil(t, writeErrorResponse(&b, h, ErrorCodeUnauthorized, "denied"))
+	ensure.DeepEqual(t, errorReplyCode(t, b.Bytes()), ErrorCodeUnauthorized)
+}
+
+func TestRejectMessage(t *testing.T) {
+	t.Parallel()
+	query := queryMessage(t, 7, "test.foo", bson.M{"a": 1})
+	insert := append([]byte(nil), query...)
+	setInt32(insert, 12, int32(OpInsert))
+
+	ping := msgSection{Documents: []interface{}{bson.M{"ping": 1, "$db": "admin"}}}
+	msg := msgMessage(t, 7, ping)
+	moreToCome := msgMessage(t, 7, ping)
+	setInt32(moreToCome, headerLen, opMsgMoreToCome)
+
+	cases := []struct {
+		Message []byte
+		Reply   bool
+	}{
+		{query, true},
+		{insert, false},
+		{msg, true},
+		{moreToCome, false},
+	}
+	for _, c := range cases {
+		next := queryMessage(t, 8, "test.foo", bson.M{})
+		conn := &pipeConn{r: bytes.NewReader(append(append([]byte(nil), c.Message...), next...))}
+		h, err := readHeader(conn)
+		ensure.Nil(t, err)
+		ensure.Nil(t, rejectMessage(h, conn, ErrorCodeHostUnreachable, "no backend"))
+		ensure.DeepEqual(t, conn.w.Len() > 0, c.Reply)
+
+		// The rejected message was consumed entirely.
+		h, err = readHeader(conn)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, h.RequestID, int32(8))
+	}
+}
+
+func TestRejectClient(t *testing.T) {
+	t.Parallel()
+	client, server := net.Pipe()
+	p := &Proxy{Clock: clock.New()}
+	go p.rejectClient(server, ErrorCodeMaxPerClientConnections, "too many")
+
+	_, err := client.Write(queryMessage(t, 3, "test.$cmd", bson.M{"isMaster": 1}))
+	ensure.Nil(t, err)
+	var doc bson.M
+	h, _, _, err := (&ReplyRW{}).ReadOne(client, &doc)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, h.ResponseTo, int32(3))
+	ensure.DeepEqual(t, doc["code"], ErrorCodeMaxPerClientConnections)
+	ensure.DeepEqual(t, doc["$err"], "too many")
+
+	// The connection is closed once the error was sent.
+	_, err = client.Read(make([]byte, 1))
+	ensure.NotNil(t, err)
+}
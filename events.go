@@ -0,0 +1,79 @@
+package dvara
+
+import (
+	"time"
+
+	"github.com/facebookgo/stats"
+)
+
+// Event is sent on the Events channel of a proxy. It is one of
+// ClientConnected, ClientDisconnected, MessageProxied or MessageFailed.
+//
+// The events of one client connection are sent in the order they happened,
+// from the goroutine serving the client. There is no ordering between the
+// events of different clients, or of different proxies sharing a channel.
+// Events are dropped rather than blocking the client when the channel is full,
+// so a consumer falling behind sees gaps, counted by the events.dropped stat.
+type Event interface {
+	isEvent()
+}
+
+// ClientConnected is sent when a client connection is accepted.
+type ClientConnected struct {
+	Time     time.Time
+	Proxy    string
+	RemoteIP string
+}
+
+// ClientDisconnected is sent when a client connection is closed, with why it
+// was closed, see the client.disconnect stats, and how long it was open. Err
+// is nil when the client went away on its own.
+type ClientDisconnected struct {
+	Time     time.Time
+	Proxy    string
+	RemoteIP string
+	Reason   string
+	Err      error
+	Duration time.Duration
+}
+
+// MessageProxied is sent when a message and its response, if it has one, were
+// proxied to a backend.
+type MessageProxied struct {
+	Time     time.Time
+	Proxy    string
+	RemoteIP string
+	Backend  string
+	OpCode   OpCode
+	Duration time.Duration
+}
+
+// MessageFailed is sent when proxying a message to a backend failed. The
+// client connection is closed after it.
+type MessageFailed struct {
+	Time     time.Time
+	Proxy    string
+	RemoteIP string
+	Backend  string
+	OpCode   OpCode
+	Err      error
+}
+
+func (ClientConnected) isEvent()    {}
+func (ClientDisconnected) isEvent() {}
+func (MessageProxied) isEvent()     {}
+func (MessageFailed) isEvent()      {}
+
+// emit sends the event on the Events channel, unless it is full. Callers on
+// the path of every message check Events is set first, to not allocate the
+// event for nothing.
+func (p *Proxy) emit(e Event) {
+	if p.Events == nil {
+		return
+	}
+	select {
+	case p.Events <- e:
+	default:
+		stats.BumpSum(p.stats, "events.dropped", 1)
+	}
+}
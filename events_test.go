@@ -0,0 +1,60 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+	events := make(chan Event, 10)
+	p := startLoopbackProxy(t, func(p *Proxy) {
+		p.ProxyAddr = "127.0.0.1:6000"
+		p.Events = events
+	})
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", p.Addr().String())
+	ensure.Nil(t, err)
+	_, err = c.Write(queryMessage(t, 1, "test.foo", bson.M{"a": "b"}))
+	ensure.Nil(t, err)
+	var reply bytes.Buffer
+	ensure.Nil(t, copyMessage(&reply, c))
+	ensure.Nil(t, c.Close())
+
+	connected := (<-events).(ClientConnected)
+	ensure.DeepEqual(t, connected.Proxy, "127.0.0.1:6000")
+	ensure.DeepEqual(t, connected.RemoteIP, "127.0.0.1")
+
+	proxied := (<-events).(MessageProxied)
+	ensure.DeepEqual(t, proxied.RemoteIP, "127.0.0.1")
+	ensure.DeepEqual(t, proxied.Backend, "loopback:27017")
+	ensure.DeepEqual(t, proxied.OpCode, OpQuery)
+
+	disconnected := (<-events).(ClientDisconnected)
+	ensure.DeepEqual(t, disconnected.Reason, disconnectNormal)
+	ensure.Nil(t, disconnected.Err)
+	ensure.False(t, disconnected.Time.Before(connected.Time))
+}
+
+func TestEventsDropped(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	events := make(chan Event, 1)
+	p := &Proxy{
+		Events: events,
+		stats:  &rec,
+	}
+	p.emit(ClientConnected{RemoteIP: "10.0.0.1"})
+	p.emit(ClientConnected{RemoteIP: "10.0.0.2"})
+	ensure.DeepEqual(t, rec.sum("events.dropped"), float64(1))
+	ensure.DeepEqual(t, <-events, Event(ClientConnected{RemoteIP: "10.0.0.1"}))
+
+	// Without a channel nothing is sent, or counted.
+	(&Proxy{stats: p.stats}).emit(ClientConnected{})
+	ensure.DeepEqual(t, rec.sum("events.dropped"), float64(1))
+}
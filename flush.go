@@ -0,0 +1,39 @@
+package dvara
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// FlushServerPool closes all the server connections so the pools are rebuilt
+// with new ones, for recovering from network blips, failovers or credential
+// changes. Idle connections are closed right away, and those in use once they
+// are released.
+func (p *Proxy) FlushServerPool() {
+	atomic.AddInt64(&p.poolGeneration, 1)
+	p.eachPool(func(addr string, pool ConnPool) {
+		pool.CloseIdle()
+	})
+	stats.BumpSum(p.stats, "server.pool.flushed", 1)
+	corelog.LogInfoMessage("flushed server pool", "proxy", p.String())
+}
+
+// flushed returns true if the server connection was opened before the last
+// FlushServerPool.
+func (p *Proxy) flushed(c net.Conn) bool {
+	sc, ok := c.(*serverConn)
+	return ok && sc.generation != atomic.LoadInt64(&p.poolGeneration)
+}
+
+// FlushServerPool flushes the server pools of all the proxies, see
+// Proxy.FlushServerPool.
+func (manager *StateManager) FlushServerPool() {
+	manager.RLock()
+	defer manager.RUnlock()
+	for _, proxy := range manager.proxies {
+		proxy.FlushServerPool()
+	}
+}
@@ -0,0 +1,54 @@
+package dvara
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestFlushServerPool(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := &Proxy{
+		MongoAddr: "mongo:1",
+		stats:     &rec,
+	}
+	pool := &Pool{
+		New: func() (io.Closer, error) {
+			return &serverConn{
+				Conn:       &bufferConn{},
+				backend:    "mongo:1",
+				generation: atomic.LoadInt64(&p.poolGeneration),
+			}, nil
+		},
+		Max:           2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	p.serverPool = pool
+	defer pool.Close()
+
+	idle, err := p.getServerConn("mongo:1")
+	ensure.Nil(t, err)
+	inUse, err := p.getServerConn("mongo:1")
+	ensure.Nil(t, err)
+	p.returnServerConn(idle)
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{Total: 2, Idle: 1, InUse: 1})
+
+	p.FlushServerPool()
+	ensure.DeepEqual(t, rec.sum("server.pool.flushed"), float64(1))
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{Total: 1, InUse: 1})
+	ensure.True(t, p.flushed(inUse))
+	p.returnServerConn(inUse)
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{})
+
+	// connections opened after the flush are kept
+	c, err := p.getServerConn("mongo:1")
+	ensure.Nil(t, err)
+	ensure.False(t, p.flushed(c))
+	p.returnServerConn(c)
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{Total: 1, Idle: 1})
+}
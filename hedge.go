@@ -0,0 +1,188 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// hedgeClient stands in for the client in each of the sends of a hedged read.
+// The query is read from a copy of its body, and what is written for the
+// client kept until it is known which send answers first. The cursors opened
+// are tracked apart from those of the client, as the sends run concurrently.
+type hedgeClient struct {
+	net.Conn
+	r       *bytes.Reader
+	w       bytes.Buffer
+	cursors *cursorAffinity
+}
+
+func (c *hedgeClient) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *hedgeClient) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *hedgeClient) SetDeadline(time.Time) error { return nil }
+
+// hedgeResponse is the outcome of sending a hedged read over one of the
+// connections.
+type hedgeResponse struct {
+	conn   net.Conn
+	client *hedgeClient
+	err    error
+}
+
+// hedgeable returns true if the message is a read which may be hedged: an
+// OP_QUERY which is a plain query or one of the readCommands, and which isn't
+// bound to the connection holding a cursor.
+func (p *Proxy) hedgeable(h *messageHeader, query []byte, pinned bool) bool {
+	return p.ReplicaSet.HedgeReads > 0 && !pinned && h.OpCode == OpQuery &&
+		query != nil && p.ReplicaSet.namespaces().isReadQuery(query)
+}
+
+// proxyHedged proxies a read query and, if the server hasn't responded after
+// the HedgeReads delay, sends it again over an idle connection from the same
+// pool. Both are proxied like any other message, see proxyCursorMessage. The
+// client gets whichever response comes first, the other one is discarded in
+// the background and any cursor it opened is killed. It returns the
+// connection which answered, which the caller releases as usual, or a
+// connection to discard along with the error if both failed.
+func (p *Proxy) proxyHedged(
+	h *messageHeader,
+	query []byte,
+	client net.Conn,
+	server net.Conn,
+	lastError *LastError,
+	cursors *cursorAffinity,
+) (net.Conn, error) {
+	// Plain reads reset the lastError like ProxyQuery would, each send has its
+	// own as they run concurrently.
+	if lastError.Exists() {
+		corelog.LogInfoMessage("reset getLastError cache")
+		lastError.Reset()
+	}
+
+	// The body was read ahead and is replayed by the client conn.
+	if _, err := io.CopyN(ioutil.Discard, client, int64(len(query))); err != nil {
+		return server, err
+	}
+	client.SetDeadline(p.Clock.Now().Add(p.messageTimeout(query)))
+
+	responses := make(chan hedgeResponse, 2)
+	send := func(c net.Conn) {
+		hc := &hedgeClient{
+			Conn:    client,
+			r:       bytes.NewReader(query),
+			cursors: newCursorAffinity(nil),
+		}
+		// The header is rewritten along with the query, so each send has its
+		// own.
+		header := *h
+		go func() {
+			err := p.proxyCursorMessage(&header, query, hc, c, &LastError{}, nil, hc.cursors)
+			responses <- hedgeResponse{conn: c, client: hc, err: err}
+		}()
+	}
+
+	send(server)
+	select {
+	case r := <-responses:
+		return r.conn, p.writeHedgeResponse(r, client, cursors)
+	case <-p.Clock.After(p.ReplicaSet.HedgeReads):
+	}
+
+	// Hedging should never wait for or open a connection, so it only happens if
+	// an idle one is available.
+	hedge := p.tryAcquire(p.poolFor(server), backendAddr(server))
+	if hedge == nil {
+		stats.BumpSum(p.stats, "hedge.skipped", 1)
+		r := <-responses
+		return r.conn, p.writeHedgeResponse(r, client, cursors)
+	}
+	send(hedge)
+	stats.BumpSum(p.stats, "hedge.sent", 1)
+
+	r := <-responses
+	if r.err != nil {
+		stats.BumpSum(p.stats, "hedge.error", 1)
+		other := <-responses
+		if other.err != nil {
+			p.poolFor(other.conn).Discard(other.conn)
+			return r.conn, p.writeHedgeResponse(r, client, cursors)
+		}
+		p.poolFor(r.conn).Discard(r.conn)
+		r = other
+	} else {
+		go p.cancelHedge(responses)
+	}
+
+	if r.conn == hedge {
+		stats.BumpSum(p.stats, "hedge.won", 1)
+	} else {
+		stats.BumpSum(p.stats, "hedge.lost", 1)
+	}
+	return r.conn, p.writeHedgeResponse(r, client, cursors)
+}
+
+// writeHedgeResponse sends the client what was written for it by the send
+// which answered, and takes over the cursors it opened. A failed send may
+// still have written an error reply.
+func (p *Proxy) writeHedgeResponse(r hedgeResponse, client net.Conn, cursors *cursorAffinity) error {
+	if r.err == nil {
+		for id := range r.client.cursors.cursors {
+			cursors.pin(id, r.conn)
+			cursors.addReturned(id, r.client.cursors.returned(id))
+		}
+		for id := range r.client.cursors.commands {
+			cursors.claim(id)
+		}
+	}
+	if r.client.w.Len() > 0 {
+		if _, err := client.Write(r.client.w.Bytes()); err != nil && r.err == nil {
+			return err
+		}
+	}
+	return r.err
+}
+
+// cancelHedge waits for the response the client didn't get, kills the cursors
+// it may have opened and returns its connection to the pool.
+func (p *Proxy) cancelHedge(responses <-chan hedgeResponse) {
+	r := <-responses
+	if r.err != nil {
+		p.poolFor(r.conn).Discard(r.conn)
+		return
+	}
+	var ids []int64
+	for id := range r.client.cursors.cursors {
+		ids = append(ids, id)
+	}
+	for id := range r.client.cursors.commands {
+		ids = append(ids, id)
+	}
+	if len(ids) > 0 {
+		if _, err := r.conn.Write(killCursorsMessage(ids...)); err != nil {
+			p.poolFor(r.conn).Discard(r.conn)
+			return
+		}
+		stats.BumpSum(p.stats, "hedge.cursor.killed", 1)
+	}
+	p.returnServerConn(r.conn)
+}
+
+// killCursorsMessage returns an OP_KILL_CURSORS message for the cursors.
+func killCursorsMessage(cursorIDs ...int64) []byte {
+	h := messageHeader{
+		MessageLength: int32(headerLen + 8 + 8*len(cursorIDs)),
+		OpCode:        OpKillCursors,
+	}
+	b := h.ToWire()
+	b = addInt32(b, 0)
+	b = addInt32(b, int32(len(cursorIDs)))
+	for _, id := range cursorIDs {
+		b = addInt64(b, id)
+	}
+	return b
+}
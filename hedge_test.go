@@ -0,0 +1,224 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// hedgeBackend serves connections which reply to queries with a cursor. The
+// first query it gets is answered after a delay, the others right away. The
+// opcodes of the messages following a reply are sent on followups, and the
+// query bodies on bodies if it is set.
+type hedgeBackend struct {
+	delay     time.Duration
+	queries   int32
+	followups chan OpCode
+	bodies    chan []byte
+}
+
+func (b *hedgeBackend) New() (io.Closer, error) {
+	proxySide, backendSide := net.Pipe()
+	go b.serve(backendSide)
+	return &serverConn{Conn: proxySide, backend: "mongo:27017"}, nil
+}
+
+func (b *hedgeBackend) serve(c net.Conn) {
+	defer c.Close()
+	for {
+		h, err := readHeader(c)
+		if err != nil {
+			return
+		}
+		body := make([]byte, h.MessageLength-headerLen)
+		if _, err := io.ReadFull(c, body); err != nil {
+			return
+		}
+		if h.OpCode != OpQuery {
+			b.followups <- h.OpCode
+			continue
+		}
+		if b.bodies != nil {
+			b.bodies <- body
+		}
+		n := atomic.AddInt32(&b.queries, 1)
+		if n == 1 {
+			time.Sleep(b.delay)
+		}
+		if _, err := c.Write(replyMessage(0, int64(n))); err != nil {
+			return
+		}
+	}
+}
+
+func newHedgeProxy(backend *hedgeBackend, hc stats.Client) *Proxy {
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			HedgeReads:     10 * time.Millisecond,
+			MessageTimeout: time.Second,
+		},
+		Clock: clock.New(),
+		stats: hc,
+	}
+	p.serverPool = &Pool{
+		New:           backend.New,
+		Max:           2,
+		MinIdle:       2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	return p
+}
+
+func TestHedgeable(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{HedgeReads: time.Millisecond}}
+	query := &messageHeader{OpCode: OpQuery}
+	read := queryBody(t, "test.foo", bson.M{})
+	ensure.True(t, p.hedgeable(query, read, false))
+	ensure.False(t, p.hedgeable(query, read, true))
+	ensure.False(t, p.hedgeable(query, queryBody(t, "test.$cmd", bson.M{"insert": "foo"}), false))
+	ensure.False(t, p.hedgeable(&messageHeader{OpCode: OpGetMore}, read, false))
+	ensure.False(t, p.hedgeable(query, nil, false))
+	ensure.False(t, (&Proxy{ReplicaSet: &ReplicaSet{}}).hedgeable(query, read, false))
+}
+
+func TestProxyHedgedWins(t *testing.T) {
+	t.Parallel()
+	backend := &hedgeBackend{delay: 200 * time.Millisecond, followups: make(chan OpCode, 1)}
+	hc := &statsRecorder{}
+	p := newHedgeProxy(backend, hc)
+
+	// Make an idle connection available for the hedge.
+	c1, err := p.serverPool.Acquire()
+	ensure.Nil(t, err)
+	c2, err := p.serverPool.Acquire()
+	ensure.Nil(t, err)
+	p.serverPool.Release(c2)
+	server := c1.(net.Conn)
+
+	body := queryBody(t, "test.foo", bson.M{"a": 1})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), RequestID: 3, OpCode: OpQuery}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	cursors := newCursorAffinity(nil)
+	winner, err := p.proxyHedged(h, body, client, server, &LastError{}, cursors)
+	ensure.Nil(t, err)
+
+	// The client got the response of the hedge, which opened cursor 2.
+	ensure.True(t, winner != server)
+	ensure.DeepEqual(t, hc.sum("hedge.won"), float64(1))
+	ensure.DeepEqual(t, client.w.Bytes(), responseTo(replyMessage(0, 2), 3))
+	owner, ok := cursors.owner([]int64{2})
+	ensure.True(t, ok)
+	ensure.True(t, owner == winner)
+
+	// The slow response opened cursor 1, which gets killed.
+	ensure.DeepEqual(t, <-backend.followups, OpKillCursors)
+	cursors.unpin(2)
+	p.releaseServerConn(winner, cursors)
+	ensure.Nil(t, p.serverPool.Close())
+}
+
+func TestProxyHedgedNotNeeded(t *testing.T) {
+	t.Parallel()
+	backend := &hedgeBackend{followups: make(chan OpCode, 1)}
+	hc := &statsRecorder{}
+	p := newHedgeProxy(backend, hc)
+	p.ReplicaSet.HedgeReads = time.Hour
+	c, err := p.serverPool.Acquire()
+	ensure.Nil(t, err)
+	server := c.(net.Conn)
+
+	body := queryBody(t, "test.foo", bson.M{"a": 1})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	winner, err := p.proxyHedged(h, body, client, server, &LastError{}, newCursorAffinity(nil))
+	ensure.Nil(t, err)
+	ensure.True(t, winner == server)
+	ensure.DeepEqual(t, client.w.Bytes(), replyMessage(0, 1))
+	ensure.DeepEqual(t, hc.sum("hedge.sent"), float64(0))
+	p.serverPool.Release(server)
+	ensure.Nil(t, p.serverPool.Close())
+}
+
+func TestProxyHedgedRewritesBoth(t *testing.T) {
+	t.Parallel()
+	backend := &hedgeBackend{
+		delay:     200 * time.Millisecond,
+		followups: make(chan OpCode, 1),
+		bodies:    make(chan []byte, 2),
+	}
+	p := newHedgeProxy(backend, nil)
+	p.ReplicaSet.InjectTraceComment = true
+	c1, err := p.serverPool.Acquire()
+	ensure.Nil(t, err)
+	c2, err := p.serverPool.Acquire()
+	ensure.Nil(t, err)
+	p.serverPool.Release(c2)
+
+	body := queryBody(t, "test.foo", bson.M{"a": 1})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	cursors := newCursorAffinity(nil)
+	winner, err := p.proxyHedged(h, body, client, c1.(net.Conn), &LastError{}, cursors)
+	ensure.Nil(t, err)
+
+	// Both sends went through ProxyQuery, which added the trace comment.
+	for i := 0; i < 2; i++ {
+		sent := <-backend.bodies
+		_, end, ok := queryCollection(sent)
+		ensure.True(t, ok)
+		var q bson.D
+		ensure.Nil(t, bson.Unmarshal(sent[end+8:], &q))
+		ensure.DeepEqual(t, q[len(q)-1].Name, "$comment")
+	}
+	ensure.DeepEqual(t, <-backend.followups, OpKillCursors)
+	cursors.unpin(2)
+	p.releaseServerConn(winner, cursors)
+	ensure.Nil(t, p.serverPool.Close())
+}
+
+func TestProxyHedgedSkipsDrainingBackend(t *testing.T) {
+	t.Parallel()
+	backend := &hedgeBackend{delay: 50 * time.Millisecond, followups: make(chan OpCode, 1)}
+	hc := &statsRecorder{}
+	p := newHedgeProxy(backend, hc)
+	p.draining = map[string]bool{"mongo:27017": true}
+	c1, err := p.serverPool.Acquire()
+	ensure.Nil(t, err)
+	c2, err := p.serverPool.Acquire()
+	ensure.Nil(t, err)
+	p.serverPool.Release(c2)
+	server := c1.(net.Conn)
+
+	body := queryBody(t, "test.foo", bson.M{"a": 1})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	winner, err := p.proxyHedged(h, body, client, server, &LastError{}, newCursorAffinity(nil))
+	ensure.Nil(t, err)
+	ensure.True(t, winner == server)
+	ensure.DeepEqual(t, hc.sum("hedge.skipped"), float64(1))
+	ensure.DeepEqual(t, p.serverPool.Snapshot().Idle, uint(1))
+	p.serverPool.Release(server)
+	ensure.Nil(t, p.serverPool.Close())
+}
+
+func TestKillCursorsMessage(t *testing.T) {
+	t.Parallel()
+	msg := killCursorsMessage(5, 6)
+	var h messageHeader
+	h.FromWire(msg)
+	ensure.DeepEqual(t, h.OpCode, OpKillCursors)
+	ensure.DeepEqual(t, int(h.MessageLength), len(msg))
+	ids, err := parseCursorIDs(OpKillCursors, msg[headerLen:])
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, ids, []int64{5, 6})
+}
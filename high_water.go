@@ -0,0 +1,131 @@
+package dvara
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/facebookgo/stats"
+)
+
+// highWaterMark counts something concurrent, such as connections, and keeps
+// the most there were at once since it was last reset.
+type highWaterMark struct {
+	current int64 // atomic
+	peak    int64 // atomic
+}
+
+// inc counts one more and returns the peak if it was raised, or 0.
+func (h *highWaterMark) inc() int64 {
+	n := atomic.AddInt64(&h.current, 1)
+	for {
+		peak := atomic.LoadInt64(&h.peak)
+		if n <= peak {
+			return 0
+		}
+		if atomic.CompareAndSwapInt64(&h.peak, peak, n) {
+			return n
+		}
+	}
+}
+
+func (h *highWaterMark) dec() {
+	atomic.AddInt64(&h.current, -1)
+}
+
+func (h *highWaterMark) get() int64 {
+	return atomic.LoadInt64(&h.peak)
+}
+
+// reset starts a new window, whose peak is the current count.
+func (h *highWaterMark) reset() int64 {
+	n := atomic.LoadInt64(&h.current)
+	atomic.StoreInt64(&h.peak, n)
+	return n
+}
+
+// ConnPeaks are the most connections a proxy had at once since it started or
+// its peaks were last reset.
+type ConnPeaks struct {
+	Proxy string    `json:"proxy"`
+	Since time.Time `json:"since"`
+
+	// Clients is the peak of client connections.
+	Clients int64 `json:"clients"`
+
+	// ServerConns is the peak of connections to mongo servers, idle or in use,
+	// across all the pools.
+	ServerConns int64 `json:"server_conns"`
+}
+
+// connPeaks tracks the connection peaks of a proxy.
+type connPeaks struct {
+	clients     highWaterMark
+	serverConns highWaterMark
+	since       atomic.Value // time.Time
+}
+
+// countClient counts a client connection until the returned function is
+// called.
+func (p *Proxy) countClient() func() {
+	if peak := p.peaks.clients.inc(); peak > 0 {
+		stats.BumpAvg(p.stats, "client.connections.peak", float64(peak))
+	}
+	return p.peaks.clients.dec
+}
+
+// serverConnOpened counts a server connection until it is closed.
+func (p *Proxy) serverConnOpened(sc *serverConn) {
+	sc.peak = &p.peaks.serverConns
+	if peak := sc.peak.inc(); peak > 0 {
+		stats.BumpAvg(p.stats, "server.connections.peak", float64(peak))
+	}
+}
+
+// ConnPeaks returns the most client and server connections the proxy had at
+// once.
+func (p *Proxy) ConnPeaks() ConnPeaks {
+	since, _ := p.peaks.since.Load().(time.Time)
+	return ConnPeaks{
+		Proxy:       p.ProxyAddr,
+		Since:       since,
+		Clients:     p.peaks.clients.get(),
+		ServerConns: p.peaks.serverConns.get(),
+	}
+}
+
+// ResetConnPeaks starts a new window for ConnPeaks, from the connections the
+// proxy has now.
+func (p *Proxy) ResetConnPeaks() {
+	p.peaks.since.Store(p.clock().Now())
+	stats.BumpAvg(p.stats, "client.connections.peak", float64(p.peaks.clients.reset()))
+	stats.BumpAvg(p.stats, "server.connections.peak", float64(p.peaks.serverConns.reset()))
+}
+
+// ConnPeaks returns the connection peaks of all the proxies, ordered by proxy.
+func (manager *StateManager) ConnPeaks() []ConnPeaks {
+	manager.RLock()
+	defer manager.RUnlock()
+	var peaks []ConnPeaks
+	for _, proxy := range manager.proxies {
+		peaks = append(peaks, proxy.ConnPeaks())
+	}
+	sort.Sort(connPeaksByProxy(peaks))
+	return peaks
+}
+
+// ResetConnPeaks starts a new window for the connection peaks of all the
+// proxies.
+func (manager *StateManager) ResetConnPeaks() {
+	manager.RLock()
+	defer manager.RUnlock()
+	for _, proxy := range manager.proxies {
+		proxy.ResetConnPeaks()
+	}
+}
+
+type connPeaksByProxy []ConnPeaks
+
+func (c connPeaksByProxy) Len() int           { return len(c) }
+func (c connPeaksByProxy) Less(i, j int) bool { return c[i].Proxy < c[j].Proxy }
+func (c connPeaksByProxy) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,69 @@
+package dvara
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+)
+
+func TestHighWaterMark(t *testing.T) {
+	t.Parallel()
+	var h highWaterMark
+	ensure.DeepEqual(t, h.inc(), int64(1))
+	ensure.DeepEqual(t, h.inc(), int64(2))
+	h.dec()
+	ensure.DeepEqual(t, h.inc(), int64(0))
+	h.dec()
+	h.dec()
+	ensure.DeepEqual(t, h.get(), int64(2))
+	h.inc()
+	ensure.DeepEqual(t, h.reset(), int64(1))
+	ensure.DeepEqual(t, h.get(), int64(1))
+	ensure.DeepEqual(t, h.inc(), int64(2))
+}
+
+func TestHighWaterMarkConcurrent(t *testing.T) {
+	t.Parallel()
+	var h highWaterMark
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.inc()
+		}()
+	}
+	wg.Wait()
+	ensure.DeepEqual(t, h.get(), int64(10))
+}
+
+func TestConnPeaks(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	mock := clock.NewMock()
+	p := &Proxy{
+		ProxyAddr: "proxy:1",
+		Clock:     mock,
+		stats:     &rec,
+	}
+	p.peaks.since.Store(mock.Now())
+
+	first, second := p.countClient(), p.countClient()
+	sc := &serverConn{Conn: &bufferConn{}}
+	p.serverConnOpened(sc)
+	second()
+	ensure.DeepEqual(t, p.ConnPeaks(), ConnPeaks{Proxy: "proxy:1", Since: mock.Now(), Clients: 2, ServerConns: 1})
+	ensure.DeepEqual(t, rec.avg("client.connections.peak"), float64(2))
+	ensure.DeepEqual(t, rec.avg("server.connections.peak"), float64(1))
+
+	sc.Close()
+	mock.Add(time.Minute)
+	p.ResetConnPeaks()
+	ensure.DeepEqual(t, p.ConnPeaks(), ConnPeaks{Proxy: "proxy:1", Since: mock.Now(), Clients: 1, ServerConns: 0})
+	ensure.DeepEqual(t, rec.avg("client.connections.peak"), float64(1))
+	ensure.DeepEqual(t, rec.avg("server.connections.peak"), float64(0))
+	first()
+}
@@ -0,0 +1,161 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// isMasterCommands are the handshake commands whose responses can be cached.
+var isMasterCommands = map[string]bool{
+	"isMaster": true,
+	"ismaster": true,
+	"hello":    true,
+}
+
+// cacheableIsMasterFields are the fields besides the command an isMaster may
+// have and still get the cached response. Others, like compression or
+// saslSupportedMechs, change the response.
+var cacheableIsMasterFields = map[string]bool{
+	"client": true,
+	"$db":    true,
+}
+
+// isMasterCache holds the responses to the handshake commands for a short
+// while, so the isMaster calls drivers make on every new connection and for
+// monitoring don't all need a server connection.
+type isMasterCache struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	replies map[string]cachedIsMaster
+}
+
+type cachedIsMaster struct {
+	reply   bson.D
+	expires time.Time
+}
+
+func newIsMasterCache(ttl time.Duration) *isMasterCache {
+	return &isMasterCache{ttl: ttl, replies: make(map[string]cachedIsMaster)}
+}
+
+func (c *isMasterCache) get(command string, now time.Time) (bson.D, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, ok := c.replies[command]
+	if !ok || !now.Before(cached.expires) {
+		return nil, false
+	}
+	return cached.reply, true
+}
+
+// put caches the reply document if it is a successful one.
+func (c *isMasterCache) put(command string, doc []byte, now time.Time) {
+	var reply bson.D
+	if doc == nil || bson.Unmarshal(doc, &reply) != nil || !isOK(reply) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.replies[command] = cachedIsMaster{reply: reply, expires: now.Add(c.ttl)}
+}
+
+func (c *isMasterCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.replies = make(map[string]cachedIsMaster)
+}
+
+func isOK(reply bson.D) bool {
+	for _, e := range reply {
+		if e.Name == "ok" {
+			switch ok := e.Value.(type) {
+			case float64:
+				return ok == 1
+			case int:
+				return ok == 1
+			}
+		}
+	}
+	return false
+}
+
+// cacheableIsMaster returns the handshake command the OP_QUERY body runs, if
+// its response can be cached.
+func (p *Proxy) cacheableIsMaster(body []byte) (string, bool) {
+	if p.isMasterCache == nil {
+		return "", false
+	}
+	command, ok := p.ReplicaSet.namespaces().queryCommand(body)
+	if !ok || !isMasterCommands[command] {
+		return "", false
+	}
+	_, pos, _ := queryCollection(body)
+	doc, err := readDocument(bytes.NewReader(body[pos+8:]))
+	if err != nil {
+		return "", false
+	}
+	var q bson.D
+	if err := bson.Unmarshal(doc, &q); err != nil || len(q) == 0 || q[0].Name != command {
+		return "", false
+	}
+	for _, e := range q[1:] {
+		if !cacheableIsMasterFields[e.Name] {
+			return "", false
+		}
+	}
+	return command, true
+}
+
+// replyFromIsMasterCache answers the OP_QUERY from the cache if it is a
+// handshake command with a fresh cached response. Fields specific to the
+// server connection the response was cached from are rewritten: localTime is
+// the current time and connectionId is left out, as the client isn't tied to
+// a server connection anyway.
+func (p *Proxy) replyFromIsMasterCache(h *messageHeader, query []byte, client io.Writer) (bool, error) {
+	command, ok := p.cacheableIsMaster(query)
+	if !ok {
+		return false, nil
+	}
+	cached, ok := p.isMasterCache.get(command, p.Clock.Now())
+	if !ok {
+		stats.BumpSum(p.stats, "ismaster.cache.miss", 1)
+		return false, nil
+	}
+	stats.BumpSum(p.stats, "ismaster.cache.hit", 1)
+	reply := make(bson.D, 0, len(cached))
+	for _, e := range cached {
+		switch e.Name {
+		case "connectionId":
+			continue
+		case "localTime":
+			e.Value = p.Clock.Now()
+		}
+		reply = append(reply, e)
+	}
+	doc, err := bson.Marshal(reply)
+	if err != nil {
+		return true, err
+	}
+	return true, writeReply(client, h.RequestID, 0, doc)
+}
+
+// cacheIsMaster caches the reply to a handshake command, see
+// cacheableIsMaster.
+func (p *Proxy) cacheIsMaster(query, doc []byte) {
+	if command, ok := p.cacheableIsMaster(query); ok {
+		p.isMasterCache.put(command, doc, p.Clock.Now())
+	}
+}
+
+// InvalidateIsMasterCache drops the cached handshake responses, for example
+// because the replica set topology changed.
+func (p *Proxy) InvalidateIsMasterCache() {
+	if p.isMasterCache != nil {
+		p.isMasterCache.invalidate()
+	}
+}
@@ -0,0 +1,122 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestCacheableIsMaster(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{isMasterCache: newIsMasterCache(time.Second)}
+	cases := []struct {
+		Query   []byte
+		Command string
+	}{
+		{queryBody(t, "admin.$cmd", bson.M{"isMaster": 1}), "isMaster"},
+		{queryBody(t, "test.$cmd", bson.D{{Name: "ismaster", Value: 1}, {Name: "client", Value: bson.M{}}}), "ismaster"},
+		{queryBody(t, "admin.$cmd", bson.M{"hello": 1}), "hello"},
+		{queryBody(t, "admin.$cmd", bson.D{{Name: "isMaster", Value: 1}, {Name: "compression", Value: []string{"zlib"}}}), ""},
+		{queryBody(t, "admin.$cmd", bson.M{"ping": 1}), ""},
+		{queryBody(t, "test.foo", bson.M{"isMaster": 1}), ""},
+	}
+	for _, c := range cases {
+		command, ok := p.cacheableIsMaster(c.Query)
+		ensure.DeepEqual(t, command, c.Command)
+		ensure.DeepEqual(t, ok, c.Command != "")
+	}
+
+	_, ok := (&Proxy{}).cacheableIsMaster(cases[0].Query)
+	ensure.False(t, ok)
+}
+
+func TestIsMasterCache(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(0, 0)
+	c := newIsMasterCache(time.Second)
+	ok, err := bson.Marshal(bson.D{{Name: "ismaster", Value: true}, {Name: "ok", Value: 1.0}})
+	ensure.Nil(t, err)
+	failed, err := bson.Marshal(bson.M{"ok": 0})
+	ensure.Nil(t, err)
+
+	c.put("isMaster", failed, now)
+	_, found := c.get("isMaster", now)
+	ensure.False(t, found)
+
+	c.put("isMaster", ok, now)
+	reply, found := c.get("isMaster", now.Add(time.Second-1))
+	ensure.True(t, found)
+	ensure.DeepEqual(t, reply, bson.D{{Name: "ismaster", Value: true}, {Name: "ok", Value: 1.0}})
+	_, found = c.get("hello", now)
+	ensure.False(t, found)
+	_, found = c.get("isMaster", now.Add(time.Second))
+	ensure.False(t, found)
+
+	c.put("isMaster", ok, now)
+	c.invalidate()
+	_, found = c.get("isMaster", now)
+	ensure.False(t, found)
+}
+
+func TestReplyFromIsMasterCache(t *testing.T) {
+	t.Parallel()
+	hc := &statsRecorder{}
+	m := newLoopbackMongo(t)
+	isMaster := loopbackIsMaster("loopback:27017")
+	isMaster["connectionId"] = 42
+	isMaster["localTime"] = time.Unix(1, 0)
+	m.isMaster = loopbackReply(t, isMaster)
+	p := newLoopbackProxy(t)
+	p.ServerDialer = m.Dial
+	p.stats = hc
+	p.isMasterCache = newIsMasterCache(time.Second)
+	server, err := p.newServerConn()
+	ensure.Nil(t, err)
+	defer server.Close()
+
+	msg := queryMessage(t, 7, "admin.$cmd", bson.M{"isMaster": 1})
+	var h messageHeader
+	h.FromWire(msg)
+	query := msg[headerLen:]
+
+	// The first isMaster goes to the server and its response is cached.
+	client := &bufferConn{r: bytes.NewReader(nil)}
+	cached, err := p.replyFromIsMasterCache(&h, query, client)
+	ensure.Nil(t, err)
+	ensure.False(t, cached)
+	client.r.Reset(query)
+	var lastError LastError
+	ensure.Nil(t, p.proxyMessage(&h, query, client, server.(net.Conn), &lastError))
+	proxied := client.w.Bytes()
+
+	// The next one is answered from the cache, with the same rewritten hosts.
+	client = &bufferConn{}
+	cached, err = p.replyFromIsMasterCache(&h, query, client)
+	ensure.Nil(t, err)
+	ensure.True(t, cached)
+	reply, err := readHeader(&client.w)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, reply.ResponseTo, int32(7))
+	var fromServer, fromCache bson.M
+	ensure.Nil(t, bson.Unmarshal(proxied[headerLen+len(emptyPrefix):], &fromServer))
+	ensure.Nil(t, bson.Unmarshal(client.w.Bytes()[len(emptyPrefix):], &fromCache))
+	ensure.DeepEqual(t, fromCache["hosts"], []interface{}{"127.0.0.1:6000"})
+	ensure.True(t, fromCache["localTime"].(time.Time).After(time.Unix(1, 0)))
+	_, hasConnectionID := fromCache["connectionId"]
+	ensure.False(t, hasConnectionID)
+	delete(fromServer, "connectionId")
+	delete(fromServer, "localTime")
+	delete(fromCache, "localTime")
+	ensure.DeepEqual(t, fromCache, fromServer)
+
+	p.InvalidateIsMasterCache()
+	cached, err = p.replyFromIsMasterCache(&h, query, &bufferConn{})
+	ensure.Nil(t, err)
+	ensure.False(t, cached)
+	ensure.DeepEqual(t, hc.sum("ismaster.cache.hit"), float64(1))
+	ensure.DeepEqual(t, hc.sum("ismaster.cache.miss"), float64(2))
+}
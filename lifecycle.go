@@ -0,0 +1,65 @@
+package dvara
+
+// ProxyState is where a proxy is in its lifecycle, see Proxy.State.
+type ProxyState int
+
+// The states of a proxy, from the most to the least available.
+const (
+	// ProxyRunning accepts and serves clients.
+	ProxyRunning ProxyState = iota
+	// ProxyQuiescing serves the connected clients but accepts no new ones, see
+	// Quiesce.
+	ProxyQuiescing
+	// ProxyDraining is stopping, waiting for the connected clients to go.
+	ProxyDraining
+	// ProxyStopped was not started, or was stopped.
+	ProxyStopped
+)
+
+func (s ProxyState) String() string {
+	switch s {
+	case ProxyRunning:
+		return "running"
+	case ProxyQuiescing:
+		return "quiescing"
+	case ProxyDraining:
+		return "draining"
+	case ProxyStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// State returns where the proxy is in its lifecycle, for example so a load
+// balancer health check takes it out of rotation during a controlled
+// shutdown.
+func (p *Proxy) State() ProxyState {
+	p.stopMutex.Lock()
+	defer p.stopMutex.Unlock()
+	switch {
+	case p.closed == nil || p.stopped:
+		return ProxyStopped
+	case isClosed(p.closed):
+		return ProxyDraining
+	case p.quiesced:
+		return ProxyQuiescing
+	}
+	return ProxyRunning
+}
+
+// State returns the least available state of the proxies, ProxyStopped if
+// there are none.
+func (manager *StateManager) State() ProxyState {
+	manager.RLock()
+	defer manager.RUnlock()
+	if len(manager.proxies) == 0 {
+		return ProxyStopped
+	}
+	state := ProxyRunning
+	for _, proxy := range manager.proxies {
+		if s := proxy.State(); s > state {
+			state = s
+		}
+	}
+	return state
+}
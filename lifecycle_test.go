@@ -0,0 +1,55 @@
+package dvara
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestProxyState(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := newLoopbackProxy(t)
+	p.ReplicaSet.MaxConnections = 1
+	p.ReplicaSet.MaxPerClientConnections = 1
+	p.ReplicaSet.ServerIdleTimeout = time.Hour
+	p.ReplicaSet.ServerClosePoolSize = 1
+	p.ReplicaSet.ClientIdleTimeout = time.Minute
+	p.ClientListener = l
+	ensure.DeepEqual(t, p.State(), ProxyStopped)
+	ensure.Nil(t, p.Start())
+	ensure.DeepEqual(t, p.State(), ProxyRunning)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	for p.ActiveConnections() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ensure.Nil(t, p.Quiesce())
+	ensure.DeepEqual(t, p.State(), ProxyQuiescing)
+
+	c.Close()
+	ensure.Nil(t, p.Stop())
+	ensure.DeepEqual(t, p.State(), ProxyStopped)
+	ensure.DeepEqual(t, p.State().String(), "stopped")
+
+	// Draining is only seen while Stop waits for the clients to go.
+	draining := &Proxy{closed: make(chan struct{})}
+	close(draining.closed)
+	ensure.DeepEqual(t, draining.State(), ProxyDraining)
+}
+
+func TestStateManagerState(t *testing.T) {
+	t.Parallel()
+	manager := NewStateManager(&ReplicaSet{})
+	ensure.DeepEqual(t, manager.State(), ProxyStopped)
+	running := &Proxy{closed: make(chan struct{})}
+	quiescing := &Proxy{closed: make(chan struct{}), quiesced: true}
+	manager.proxies["a"] = running
+	ensure.DeepEqual(t, manager.State(), ProxyRunning)
+	manager.proxies["b"] = quiescing
+	ensure.DeepEqual(t, manager.State(), ProxyQuiescing)
+}
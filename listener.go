@@ -0,0 +1,108 @@
+package dvara
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// ListenerPolicy restricts what the clients of a PolicyListener may do, for
+// example to expose a locked down port to ops tooling next to the one apps use.
+type ListenerPolicy struct {
+	// Name identifies the listener in logs.
+	Name string
+
+	// MaxPerClientConnections if set is how many connections a single client
+	// may have on this listener, counted separately from the other listeners.
+	// Otherwise they count towards the ReplicaSet's MaxPerClientConnections
+	// along with the connections on the ClientListener.
+	MaxPerClientConnections uint
+
+	// ReadOnly if true rejects legacy writes and commands which modify data.
+	ReadOnly bool
+
+	// AllowedCommands if set are the only commands clients may run, besides the
+	// isMaster handshake which drivers need to connect. Plain queries and legacy
+	// writes are not commands and are unaffected.
+	AllowedCommands []string
+}
+
+// PolicyListener is an additional listener for a Proxy, whose clients are
+// subject to the policy. It shares the server connection pool with the
+// ClientListener.
+type PolicyListener struct {
+	Listener net.Listener
+	Policy   ListenerPolicy
+}
+
+// clientListener is a listener the proxy accepts clients on. The policy is
+// nil for the ClientListener.
+type clientListener struct {
+	net.Listener
+	policy                  *ListenerPolicy
+	maxPerClientConnections *maxPerClientConnections
+}
+
+// startListeners sets up the ClientListener and the ExtraListeners.
+func (p *Proxy) startListeners() {
+	p.listeners = []*clientListener{{
+		Listener:                p.ClientListener,
+		maxPerClientConnections: p.maxPerClientConnections,
+	}}
+	for i := range p.ExtraListeners {
+		extra := &p.ExtraListeners[i]
+		l := &clientListener{
+			Listener:                extra.Listener,
+			policy:                  &extra.Policy,
+			maxPerClientConnections: p.maxPerClientConnections,
+		}
+		if extra.Policy.MaxPerClientConnections > 0 {
+			l.maxPerClientConnections = newMaxPerClientConnections(extra.Policy.MaxPerClientConnections)
+		}
+		p.listeners = append(p.listeners, l)
+	}
+}
+
+// inspectsQueries returns true if the policy needs the body of queries.
+func (l *clientListener) inspectsQueries() bool {
+	return l.policy != nil && (l.policy.ReadOnly || len(l.policy.AllowedCommands) > 0)
+}
+
+// forbids returns the reason the policy rejects the message, if it does. The
+// query is the body of the message if it is an OP_QUERY.
+func (l *clientListener) forbids(ns namespaces, h *messageHeader, query []byte) (string, bool) {
+	if !l.inspectsQueries() {
+		return "", false
+	}
+	if l.policy.ReadOnly && h.OpCode.IsMutation() {
+		return "writes are not allowed", true
+	}
+	name, ok := ns.queryCommand(query)
+	if !ok || isMasterCommands[name] {
+		return "", false
+	}
+	if l.policy.ReadOnly && isMutatingCommand(name) {
+		return fmt.Sprintf("command %s is not allowed on a read only listener", name), true
+	}
+	if len(l.policy.AllowedCommands) == 0 {
+		return "", false
+	}
+	for _, allowed := range l.policy.AllowedCommands {
+		if allowed == name {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("command %s is not allowed", name), true
+}
+
+// rejectForbidden rejects a message the listener's policy forbids, replying
+// with an error if the client expects a response.
+func (p *Proxy) rejectForbidden(h *messageHeader, client io.ReadWriter, l *clientListener, reason string) error {
+	stats.BumpSum(p.stats, "client.rejected.policy", 1)
+	corelog.LogInfoMessage("message rejected by listener policy",
+		"listener", l.policy.Name, "proxy", p.String(), "reason", reason)
+	return rejectMessage(h, client, ErrorCodeUnauthorized, "dvara: "+reason)
+}
@@ -0,0 +1,83 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestListenerPolicyForbids(t *testing.T) {
+	t.Parallel()
+	readOnly := &clientListener{policy: &ListenerPolicy{ReadOnly: true}}
+	allowed := &clientListener{policy: &ListenerPolicy{AllowedCommands: []string{"count"}}}
+	open := &clientListener{policy: &ListenerPolicy{}}
+	query := &messageHeader{OpCode: OpQuery}
+	cases := []struct {
+		Listener  *clientListener
+		Header    *messageHeader
+		Query     []byte
+		Forbidden bool
+	}{
+		{readOnly, query, queryBody(t, "test.foo", bson.M{"a": 1}), false},
+		{readOnly, query, queryBody(t, "test.$cmd", bson.M{"count": "foo"}), false},
+		{readOnly, query, queryBody(t, "test.$cmd", bson.M{"insert": "foo"}), true},
+		{readOnly, &messageHeader{OpCode: OpInsert}, nil, true},
+		{readOnly, &messageHeader{OpCode: OpGetMore}, nil, false},
+		{allowed, query, queryBody(t, "test.$cmd", bson.M{"count": "foo"}), false},
+		{allowed, query, queryBody(t, "test.$cmd", bson.M{"dropDatabase": 1}), true},
+		{allowed, query, queryBody(t, "admin.$cmd", bson.M{"isMaster": 1}), false},
+		{allowed, query, queryBody(t, "test.foo", bson.M{"a": 1}), false},
+		{allowed, &messageHeader{OpCode: OpInsert}, nil, false},
+		{open, query, queryBody(t, "test.$cmd", bson.M{"insert": "foo"}), false},
+		{&clientListener{}, &messageHeader{OpCode: OpInsert}, nil, false},
+	}
+	for _, c := range cases {
+		_, forbidden := c.Listener.forbids(defaultNamespaces, c.Header, c.Query)
+		ensure.DeepEqual(t, forbidden, c.Forbidden, c)
+	}
+}
+
+func TestExtraListenerPolicy(t *testing.T) {
+	t.Parallel()
+	main, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	extra, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := newLoopbackProxy(t)
+	p.ReplicaSet.MaxConnections = 2
+	p.ReplicaSet.MaxPerClientConnections = 10
+	p.ReplicaSet.ServerIdleTimeout = time.Hour
+	p.ReplicaSet.ServerClosePoolSize = 1
+	p.ReplicaSet.ClientIdleTimeout = time.Minute
+	p.ReplicaSet.GetLastErrorTimeout = time.Minute
+	p.ClientListener = main
+	p.ExtraListeners = []PolicyListener{{
+		Listener: extra,
+		Policy:   ListenerPolicy{Name: "ops", ReadOnly: true},
+	}}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	insert := queryMessage(t, 1, "test.$cmd", bson.M{"insert": "foo"})
+	roundTrip := func(addr string, msg []byte) []byte {
+		c, err := net.Dial("tcp", addr)
+		ensure.Nil(t, err)
+		defer c.Close()
+		_, err = c.Write(msg)
+		ensure.Nil(t, err)
+		var reply bytes.Buffer
+		ensure.Nil(t, copyMessage(&reply, c))
+		return reply.Bytes()
+	}
+
+	ensure.DeepEqual(t, errorReplyCode(t, roundTrip(extra.Addr().String(), insert)), ErrorCodeUnauthorized)
+	reply := roundTrip(main.Addr().String(), insert)
+	ensure.DeepEqual(t, getInt32(reply, headerLen)&replyQueryFailure, int32(0))
+	find := queryMessage(t, 2, "test.foo", bson.M{"a": "b"})
+	reply = roundTrip(extra.Addr().String(), find)
+	ensure.DeepEqual(t, getInt32(reply, headerLen)&replyQueryFailure, int32(0))
+}
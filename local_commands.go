@@ -0,0 +1,43 @@
+package dvara
+
+import (
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// localCommands are the commands which may be answered by the proxy, see
+// LocalCommands. They have no side effects the client could rely on: ping
+// only checks connectivity, and endSessions merely lets the server clean up
+// early sessions it would expire anyway.
+var localCommands = map[string]bool{
+	"ping":        true,
+	"endSessions": true,
+}
+
+// answerLocally replies to the LocalCommands with an ok of 1 in place of the
+// server.
+func (p *Proxy) answerLocally(m *Message, next MessageHandler) error {
+	if len(p.ReplicaSet.LocalCommands) == 0 || m.OpCode != OpQuery {
+		return next(m)
+	}
+	name, ok := p.ReplicaSet.namespaces().queryCommand(m.Query)
+	if !ok || !p.ReplicaSet.answersLocally(name) {
+		return next(m)
+	}
+	stats.BumpSum(p.stats, "command.local."+name, 1)
+	doc, err := bson.Marshal(bson.M{"ok": 1})
+	if err != nil {
+		return err
+	}
+	return writeReply(m.client, m.RequestID, 0, doc)
+}
+
+// answersLocally returns true if the command is one of the LocalCommands.
+func (r *ReplicaSet) answersLocally(name string) bool {
+	for _, c := range r.LocalCommands {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package dvara
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestAnswerLocally(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{LocalCommands: []string{"ping"}}}
+	p.messageChain = p.newMessageChain()
+	ensure.True(t, p.inspectsQueries())
+
+	ping := queryMessage(t, 5, "admin.$cmd", bson.M{"ping": 1})
+	m, client := newTestMessage(p, ping, ping[headerLen:])
+	admitted, err := p.admit(m)
+	ensure.Nil(t, err)
+	ensure.False(t, admitted)
+	ensure.DeepEqual(t, getInt32(client.w.Bytes(), 8), int32(5))
+	ensure.DeepEqual(t, getInt32(client.w.Bytes(), headerLen), int32(0))
+	doc := bson.M{}
+	ensure.Nil(t, bson.Unmarshal(client.w.Bytes()[headerLen+len(emptyPrefix):], &doc))
+	ensure.DeepEqual(t, doc, bson.M{"ok": 1})
+
+	// Commands which are not listed, and queries, go to the server.
+	for _, msg := range [][]byte{
+		queryMessage(t, 6, "admin.$cmd", bson.M{"endSessions": []interface{}{}}),
+		queryMessage(t, 7, "test.ping", bson.M{"ping": 1}),
+	} {
+		m, client = newTestMessage(p, msg, msg[headerLen:])
+		admitted, err = p.admit(m)
+		ensure.Nil(t, err)
+		ensure.True(t, admitted)
+		ensure.DeepEqual(t, client.w.Len(), 0)
+	}
+}
@@ -0,0 +1,215 @@
+package dvara
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// loopbackMongo is an in memory mongo server speaking just enough of the wire
+// protocol for benchmarks: isMaster gets a single member primary response, other
+// queries get a single canned document, OP_MSG commands get an ok reply with
+// the connectionId of the server connection they came over, and the rest gets
+// no response.
+type loopbackMongo struct {
+	isMaster []byte
+	find     []byte
+	conns    int32 // atomic
+}
+
+func newLoopbackMongo(t testing.TB) *loopbackMongo {
+	return &loopbackMongo{
+		isMaster: loopbackReply(t, loopbackIsMaster("loopback:27017")),
+		find:     loopbackReply(t, bson.M{"_id": 1, "a": "b"}),
+	}
+}
+
+func loopbackIsMaster(addr string) bson.M {
+	return bson.M{
+		"ismaster":       true,
+		"hosts":          []interface{}{addr},
+		"primary":        addr,
+		"me":             addr,
+		"maxWireVersion": 2,
+		"ok":             1,
+	}
+}
+
+func loopbackReply(t testing.TB, doc interface{}) []byte {
+	b := addInt32(nil, 0)
+	b = addInt64(b, 0)
+	b = addInt32(b, 0)
+	b = addInt32(b, 1)
+	b, err := addBSON(b, doc)
+	ensure.Nil(t, err)
+	h := messageHeader{MessageLength: int32(headerLen + len(b)), OpCode: OpReply}
+	return append(h.ToWire(), b...)
+}
+
+// Dial is a ServerDialer handing out in memory connections to the server.
+func (m *loopbackMongo) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go m.serve(server)
+	return client, nil
+}
+
+func (m *loopbackMongo) serve(c net.Conn) {
+	defer c.Close()
+	connectionID := atomic.AddInt32(&m.conns, 1)
+	for {
+		h, err := readHeader(c)
+		if err != nil {
+			return
+		}
+		body := make([]byte, h.MessageLength-headerLen)
+		if _, err := io.ReadFull(c, body); err != nil {
+			return
+		}
+		if !expectsResponse(append(h.ToWire(), body...)) {
+			continue
+		}
+		reply := m.find
+		switch {
+		case h.OpCode == OpQuery && m.queriesIsMaster(body):
+			reply = m.isMaster
+		case h.OpCode == OpMsg:
+			doc, err := bson.Marshal(bson.M{"connectionId": connectionID, "ok": 1})
+			if err != nil {
+				return
+			}
+			reply = msgDocumentMessage(0, doc)
+		}
+		reply = append([]byte(nil), reply...)
+		setInt32(reply, 8, h.RequestID)
+		if _, err := c.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+func (m *loopbackMongo) queriesIsMaster(body []byte) bool {
+	r := bytes.NewReader(body[4:])
+	if _, err := readCString(r); err != nil {
+		return false
+	}
+	if _, err := r.Seek(8, io.SeekCurrent); err != nil {
+		return false
+	}
+	doc, err := readDocument(r)
+	if err != nil {
+		return false
+	}
+	var q bson.D
+	return bson.Unmarshal(doc, &q) == nil && (hasKey(q, "isMaster") || hasKey(q, "hello"))
+}
+
+func newLoopbackProxy(t testing.TB) *Proxy {
+	return &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Minute,
+			ProxyQuery: &ProxyQuery{
+				GetLastErrorRewriter: &GetLastErrorRewriter{},
+				IsMasterResponseRewriter: &IsMasterResponseRewriter{
+					ProxyMapper: fakeProxyMapper{m: map[string]string{"loopback:27017": "127.0.0.1:6000"}},
+					ReplyRW:     &ReplyRW{},
+				},
+			},
+		},
+		MongoAddr:    "loopback:27017",
+		Clock:        clock.New(),
+		ServerDialer: newLoopbackMongo(t).Dial,
+	}
+}
+
+// startLoopbackProxy starts a loopback proxy listening on a port of its own,
+// with room for a single client and server connection. The settings of tests
+// needing others are made by configure, if given, before the proxy starts.
+func startLoopbackProxy(t testing.TB, configure func(p *Proxy)) *Proxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := newLoopbackProxy(t)
+	p.ReplicaSet.MaxConnections = 1
+	p.ReplicaSet.MaxPerClientConnections = 1
+	p.ReplicaSet.ServerIdleTimeout = time.Hour
+	p.ReplicaSet.ServerClosePoolSize = 1
+	p.ReplicaSet.ClientIdleTimeout = time.Minute
+	p.ReplicaSet.GetLastErrorTimeout = time.Minute
+	p.ClientListener = l
+	if configure != nil {
+		configure(p)
+	}
+	ensure.Nil(t, p.Start())
+	return p
+}
+
+func TestLoopbackMongo(t *testing.T) {
+	t.Parallel()
+	m := newLoopbackMongo(t)
+	c, err := m.Dial(context.Background(), "tcp", "loopback:27017")
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	cases := []struct {
+		Query    []byte
+		Expected bson.M
+	}{
+		{queryMessage(t, 1, "admin.$cmd", bson.M{"isMaster": 1}), loopbackIsMaster("loopback:27017")},
+		{queryMessage(t, 2, "test.foo", bson.M{"a": "b"}), bson.M{"_id": 1, "a": "b"}},
+	}
+	for _, k := range cases {
+		_, err := c.Write(k.Query)
+		ensure.Nil(t, err)
+		var reply bytes.Buffer
+		ensure.Nil(t, copyMessage(&reply, c))
+		h, err := readHeader(&reply)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, h.ResponseTo, getInt32(k.Query, 4))
+		actual := bson.M{}
+		ensure.Nil(t, bson.Unmarshal(reply.Bytes()[len(emptyPrefix):], &actual))
+		ensure.DeepEqual(t, actual, k.Expected)
+	}
+}
+
+// benchmarkProxyMessage measures the messages per second proxyMessage gets
+// through to the loopback server.
+func benchmarkProxyMessage(b *testing.B, msg []byte) {
+	p := newLoopbackProxy(b)
+	server, err := p.newServerConn()
+	ensure.Nil(b, err)
+	defer server.Close()
+
+	var h messageHeader
+	h.FromWire(msg)
+	client := &bufferConn{r: bytes.NewReader(nil)}
+	var lastError LastError
+	b.SetBytes(int64(len(msg)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client.r.Reset(msg[headerLen:])
+		client.w.Reset()
+		if err := p.proxyMessage(&h, nil, client, server.(net.Conn), &lastError); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkProxyMessageFind(b *testing.B) {
+	benchmarkProxyMessage(b, queryMessage(b, 1, "test.foo", bson.M{"a": "b"}))
+}
+
+func BenchmarkProxyMessageIsMaster(b *testing.B) {
+	benchmarkProxyMessage(b, queryMessage(b, 1, "admin.$cmd", bson.M{"isMaster": 1}))
+}
+
+func BenchmarkProxyMessageInsert(b *testing.B) {
+	benchmarkProxyMessage(b, legacyWriteMessage(b, OpInsert, "test.foo"))
+}
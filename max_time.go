@@ -0,0 +1,72 @@
+package dvara
+
+import (
+	"bytes"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// queryMaxTime returns the time limit an OP_QUERY body asks the server for,
+// from the maxTimeMS of a command or the $maxTimeMS modifier of a query. Both
+// are also looked for inside a $query wrapper.
+func queryMaxTime(body []byte) (time.Duration, bool) {
+	_, pos, ok := queryCollection(body)
+	if !ok || len(body) < pos+8 {
+		return 0, false
+	}
+	// Skip numberToSkip and numberToReturn.
+	doc, err := readDocument(bytes.NewReader(body[pos+8:]))
+	if err != nil {
+		return 0, false
+	}
+	var q bson.D
+	if err := bson.Unmarshal(doc, &q); err != nil {
+		return 0, false
+	}
+	return maxTime(q)
+}
+
+func maxTime(q bson.D) (time.Duration, bool) {
+	for _, e := range q {
+		switch e.Name {
+		case "maxTimeMS", "$maxTimeMS":
+			var ms int64
+			switch n := e.Value.(type) {
+			case int:
+				ms = int64(n)
+			case int32:
+				ms = int64(n)
+			case int64:
+				ms = n
+			case float64:
+				ms = int64(n)
+			}
+			// A maxTimeMS of 0 means no limit.
+			if ms > 0 {
+				return time.Duration(ms) * time.Millisecond, true
+			}
+		case "$query":
+			if wrapped, ok := e.Value.(bson.D); ok {
+				if d, ok := maxTime(wrapped); ok {
+					return d, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// capToMaxTime lowers the timeout of a message which carries a maxTimeMS to
+// it plus the MaxTimeMSGrace, as the client will not wait much longer than
+// that for the server's response.
+func (p *Proxy) capToMaxTime(timeout time.Duration, query []byte) time.Duration {
+	grace := p.ReplicaSet.MaxTimeMSGrace
+	if grace <= 0 || query == nil {
+		return timeout
+	}
+	if d, ok := queryMaxTime(query); ok && d+grace < timeout {
+		return d + grace
+	}
+	return timeout
+}
@@ -0,0 +1,57 @@
+package dvara
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestQueryMaxTime(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Query    []byte
+		MaxTime  time.Duration
+		HasLimit bool
+	}{
+		{queryBody(t, "test.$cmd", bson.D{{Name: "find", Value: "foo"}, {Name: "maxTimeMS", Value: 500}}), 500 * time.Millisecond, true},
+		{queryBody(t, "test.$cmd", bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: int64(2000)}}), 2 * time.Second, true},
+		{queryBody(t, "test.$cmd", bson.D{{Name: "count", Value: "foo"}, {Name: "maxTimeMS", Value: 1.5e3}}), 1500 * time.Millisecond, true},
+		{queryBody(t, "test.foo", bson.D{{Name: "$query", Value: bson.M{"a": 1}}, {Name: "$maxTimeMS", Value: 100}}), 100 * time.Millisecond, true},
+		{queryBody(t, "test.$cmd", bson.D{
+			{Name: "$query", Value: bson.D{{Name: "find", Value: "foo"}, {Name: "maxTimeMS", Value: 300}}},
+			{Name: "$readPreference", Value: bson.M{"mode": "secondary"}},
+		}), 300 * time.Millisecond, true},
+		{queryBody(t, "test.$cmd", bson.D{{Name: "find", Value: "foo"}, {Name: "maxTimeMS", Value: 0}}), 0, false},
+		{queryBody(t, "test.foo", bson.M{"maxTimeMS": "soon"}), 0, false},
+		{queryBody(t, "test.foo", bson.M{"a": 1}), 0, false},
+		{[]byte("\x00\x00\x00\x00test.foo\x00"), 0, false},
+	}
+	for i, c := range cases {
+		maxTime, ok := queryMaxTime(c.Query)
+		ensure.DeepEqual(t, ok, c.HasLimit, i)
+		ensure.DeepEqual(t, maxTime, c.MaxTime, i)
+	}
+}
+
+func TestMessageTimeoutMaxTime(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{
+		MessageTimeout:  time.Minute,
+		CommandTimeouts: map[string]time.Duration{"aggregate": time.Hour},
+		MaxTimeMSGrace:  time.Second,
+	}}
+	ensure.True(t, p.inspectsQueries())
+	withMaxTime := func(command string, ms int) []byte {
+		return queryBody(t, "test.$cmd", bson.D{{Name: command, Value: "foo"}, {Name: "maxTimeMS", Value: ms}})
+	}
+	ensure.DeepEqual(t, p.messageTimeout(withMaxTime("count", 500)), 1500*time.Millisecond)
+	ensure.DeepEqual(t, p.messageTimeout(withMaxTime("aggregate", 600000)), 601*time.Second)
+	// A maxTimeMS beyond the timeout does not extend it.
+	ensure.DeepEqual(t, p.messageTimeout(withMaxTime("count", 120000)), time.Minute)
+	ensure.DeepEqual(t, p.messageTimeout(queryBody(t, "test.$cmd", bson.M{"count": "foo"})), time.Minute)
+
+	p.ReplicaSet.MaxTimeMSGrace = 0
+	ensure.DeepEqual(t, p.messageTimeout(withMaxTime("count", 500)), time.Minute)
+}
@@ -0,0 +1,99 @@
+package dvara
+
+import "net"
+
+// MessageHandler handles a client message, see MessageMiddleware.
+type MessageHandler func(m *Message) error
+
+// MessageMiddleware looks at a client message before it is proxied. It passes
+// the message on by calling next, or answers it in place of the server with
+// Message.Reply. Returning an error closes the client connection.
+type MessageMiddleware func(m *Message, next MessageHandler) error
+
+// Message is a client message on its way to the server, as seen by the
+// MessageMiddleware. Its body has not been read yet, except for the Query.
+type Message struct {
+	OpCode    OpCode
+	RequestID int32
+
+	// Query is the body of an OP_QUERY, nil for other messages.
+	Query []byte
+
+	// RemoteIP is the IP of the client which sent the message.
+	RemoteIP string
+
+	h         *messageHeader
+	client    net.Conn
+	listener  *clientListener
+	cursorIDs []int64
+	cursors   *cursorAffinity
+	admitted  bool
+}
+
+// Reply answers the message with an error in place of the server. The body of
+// the message is skipped, and messages which get no response are dropped.
+func (m *Message) Reply(code int, errmsg string) error {
+	return rejectMessage(m.h, m.client, code, errmsg)
+}
+
+// newMessageChain composes the checks every message goes through with the
+// configured Middleware and the LocalCommands, in that order, ending with the
+// message being admitted to be proxied.
+func (p *Proxy) newMessageChain() MessageHandler {
+	chain := []MessageMiddleware{
+		p.checkOpCode,
+		p.checkListenerPolicy,
+		p.checkCursorOwners,
+		p.checkCursorLimit,
+	}
+	chain = append(chain, p.ReplicaSet.Middleware...)
+	chain = append(chain, p.answerLocally)
+	handler := func(m *Message) error {
+		m.admitted = true
+		return nil
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		middleware, next := chain[i], handler
+		handler = func(m *Message) error {
+			return middleware(m, next)
+		}
+	}
+	return handler
+}
+
+// admit runs the message through the message chain. It returns true if the
+// message should be proxied, and false if it was answered already.
+func (p *Proxy) admit(m *Message) (bool, error) {
+	err := p.messageChain(m)
+	return m.admitted && err == nil, err
+}
+
+// admitDisconnectReason returns why the client is disconnected when admitting
+// its message failed.
+func admitDisconnectReason(err error) string {
+	if err == errOpCodeNotAllowed {
+		return disconnectProtocolError
+	}
+	return disconnectProxyError
+}
+
+func (p *Proxy) checkOpCode(m *Message, next MessageHandler) error {
+	if !p.opCodeAllowed(m.h, m.Query) {
+		return p.rejectOpCode(m.h, m.client)
+	}
+	return next(m)
+}
+
+func (p *Proxy) checkListenerPolicy(m *Message, next MessageHandler) error {
+	if why, forbidden := m.listener.forbids(p.ReplicaSet.namespaces(), m.h, m.Query); forbidden {
+		return p.rejectForbidden(m.h, m.client, m.listener, why)
+	}
+	return next(m)
+}
+
+func (p *Proxy) checkCursorOwners(m *Message, next MessageHandler) error {
+	if m.cursors.owners.foreign(m.cursorIDs, m.cursors) {
+		return p.rejectForeignCursors(m.h, m.client, m.RemoteIP)
+	}
+	return next(m)
+}
@@ -0,0 +1,106 @@
+package dvara
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func newTestMessage(p *Proxy, msg []byte, query []byte) (*Message, *bufferConn) {
+	var h messageHeader
+	h.FromWire(msg)
+	client := &bufferConn{r: bytes.NewReader(msg[headerLen:])}
+	return &Message{
+		OpCode:    h.OpCode,
+		RequestID: h.RequestID,
+		Query:     query,
+		RemoteIP:  "10.0.0.1",
+		h:         &h,
+		client:    client,
+		listener:  &clientListener{},
+		cursors:   newCursorAffinity(&p.cursorOwners),
+	}, client
+}
+
+func TestMessageChain(t *testing.T) {
+	t.Parallel()
+	var order []string
+	record := func(name string) MessageMiddleware {
+		return func(m *Message, next MessageHandler) error {
+			order = append(order, name)
+			return next(m)
+		}
+	}
+	denyFoo := func(m *Message, next MessageHandler) error {
+		if m.Query != nil && bytes.Contains(m.Query, []byte("test.foo")) {
+			return m.Reply(ErrorCodeUnauthorized, "foo is off limits")
+		}
+		return next(m)
+	}
+	p := &Proxy{ReplicaSet: &ReplicaSet{
+		Middleware: []MessageMiddleware{record("first"), denyFoo, record("second")},
+	}}
+	p.messageChain = p.newMessageChain()
+	ensure.True(t, p.inspectsQueries())
+
+	msg := queryMessage(t, 3, "test.bar", bson.M{"a": 1})
+	m, client := newTestMessage(p, msg, msg[headerLen:])
+	admitted, err := p.admit(m)
+	ensure.Nil(t, err)
+	ensure.True(t, admitted)
+	ensure.DeepEqual(t, order, []string{"first", "second"})
+	ensure.DeepEqual(t, client.w.Len(), 0)
+
+	order = nil
+	msg = queryMessage(t, 4, "test.foo", bson.M{"a": 1})
+	m, client = newTestMessage(p, msg, msg[headerLen:])
+	admitted, err = p.admit(m)
+	ensure.Nil(t, err)
+	ensure.False(t, admitted)
+	ensure.DeepEqual(t, order, []string{"first"})
+	ensure.DeepEqual(t, errorReplyCode(t, client.w.Bytes()), ErrorCodeUnauthorized)
+	ensure.DeepEqual(t, getInt32(client.w.Bytes(), 8), int32(4))
+}
+
+func TestMessageChainBuiltinsFirst(t *testing.T) {
+	t.Parallel()
+	var called bool
+	p := &Proxy{ReplicaSet: &ReplicaSet{
+		Middleware: []MessageMiddleware{func(m *Message, next MessageHandler) error {
+			called = true
+			return next(m)
+		}},
+	}}
+	p.allowedOpCodes = newAllowedOpCodes([]string{"QUERY"})
+	p.messageChain = p.newMessageChain()
+
+	m, client := newTestMessage(p, legacyWriteMessage(t, OpInsert, "test.foo"), nil)
+	admitted, err := p.admit(m)
+	ensure.DeepEqual(t, err, errOpCodeNotAllowed)
+	ensure.False(t, admitted)
+	ensure.False(t, called)
+	ensure.DeepEqual(t, client.w.Len(), 0)
+	ensure.DeepEqual(t, admitDisconnectReason(err), disconnectProtocolError)
+}
+
+func TestMessageChainError(t *testing.T) {
+	t.Parallel()
+	failed := errors.New("middleware failed")
+	p := &Proxy{ReplicaSet: &ReplicaSet{
+		Middleware: []MessageMiddleware{func(m *Message, next MessageHandler) error {
+			if err := next(m); err != nil {
+				return err
+			}
+			return failed
+		}},
+	}}
+	p.messageChain = p.newMessageChain()
+	m, _ := newTestMessage(p, queryMessage(t, 1, "test.foo", bson.M{}), nil)
+	admitted, err := p.admit(m)
+	ensure.DeepEqual(t, err, failed)
+	ensure.False(t, admitted)
+	ensure.DeepEqual(t, admitDisconnectReason(err), disconnectProxyError)
+}
@@ -0,0 +1,57 @@
+package dvara
+
+import "github.com/facebookgo/stats"
+
+// MultiStats returns a stats.Client forwarding every stat to all the given
+// clients, for example to send metrics to two systems during a migration.
+// Nil clients are skipped. It is safe for concurrent use if the clients are.
+func MultiStats(clients ...stats.Client) stats.Client {
+	var m multiStats
+	for _, c := range clients {
+		if c != nil {
+			m = append(m, c)
+		}
+	}
+	return m
+}
+
+type multiStats []stats.Client
+
+func (m multiStats) BumpAvg(key string, val float64) {
+	for _, c := range m {
+		c.BumpAvg(key, val)
+	}
+}
+
+func (m multiStats) BumpSum(key string, val float64) {
+	for _, c := range m {
+		c.BumpSum(key, val)
+	}
+}
+
+func (m multiStats) BumpHistogram(key string, val float64) {
+	for _, c := range m {
+		c.BumpHistogram(key, val)
+	}
+}
+
+func (m multiStats) BumpTime(key string) interface {
+	End()
+} {
+	enders := make(multiEnder, len(m))
+	for i, c := range m {
+		enders[i] = c.BumpTime(key)
+	}
+	return enders
+}
+
+// multiEnder ends the timers of all the clients together.
+type multiEnder []interface {
+	End()
+}
+
+func (m multiEnder) End() {
+	for _, e := range m {
+		e.End()
+	}
+}
@@ -0,0 +1,38 @@
+package dvara
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestMultiStats(t *testing.T) {
+	t.Parallel()
+	var a, b statsRecorder
+	m := MultiStats(&a, nil, &b)
+	m.BumpAvg("avg", 1)
+	m.BumpSum("sum", 2)
+	m.BumpHistogram("histogram", 3)
+	m.BumpTime("time").End()
+	expected := []string{"avg avg 1", "sum sum 2", "histogram histogram 3", "time time 0", "end time 0"}
+	ensure.DeepEqual(t, a.log(), expected)
+	ensure.DeepEqual(t, b.log(), expected)
+}
+
+func TestMultiStatsConcurrent(t *testing.T) {
+	t.Parallel()
+	var a, b statsRecorder
+	m := MultiStats(&a, &b)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.BumpSum("sum", 1)
+		}()
+	}
+	wg.Wait()
+	ensure.DeepEqual(t, len(a.log()), 10)
+	ensure.DeepEqual(t, len(b.log()), 10)
+}
@@ -0,0 +1,179 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// rewritesNamespace returns true for the opcodes whose messages name a
+// namespace which NamespaceRewrites applies to.
+func rewritesNamespace(op OpCode) bool {
+	switch op {
+	case OpQuery, OpGetMore, OpInsert, OpUpdate, OpDelete, OpMsg:
+		return true
+	}
+	return false
+}
+
+// rewriteNamespace reads the body of a message whose header was read and
+// rewrites the namespace it is for as per NamespaceRewrites, adjusting the
+// message length in the header. The returned conn replays the body.
+func (p *Proxy) rewriteNamespace(h *messageHeader, c net.Conn) (net.Conn, error) {
+	if len(p.ReplicaSet.NamespaceRewrites) == 0 || !rewritesNamespace(h.OpCode) {
+		return c, nil
+	}
+	body := make([]byte, h.MessageLength-headerLen)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, err
+	}
+	if rewritten, ok := p.ReplicaSet.namespaceRewriter().rewrite(h.OpCode, body); ok {
+		stats.BumpSum(p.stats, "namespace.rewritten", 1)
+		body = rewritten
+		h.MessageLength = int32(headerLen + len(body))
+	}
+	return &replayConn{
+		Conn:   c,
+		reader: io.MultiReader(bytes.NewReader(body), c),
+	}, nil
+}
+
+// namespaceRewriter rewrites the namespaces of messages.
+type namespaceRewriter struct {
+	namespaces
+	rewrites map[string]string
+}
+
+func (r *ReplicaSet) namespaceRewriter() namespaceRewriter {
+	return namespaceRewriter{namespaces: r.namespaces(), rewrites: r.NamespaceRewrites}
+}
+
+// rewrite returns the body of the message with its namespace rewritten, and
+// false if it needs no rewriting or is malformed, which is left to the server
+// to report.
+func (n namespaceRewriter) rewrite(op OpCode, body []byte) ([]byte, bool) {
+	if op == OpMsg {
+		return n.rewriteMsg(body)
+	}
+	// int32 flags or ZERO, cstring fullCollectionName, and the rest.
+	if len(body) < 4 {
+		return nil, false
+	}
+	end := bytes.IndexByte(body[4:], x00)
+	if end < 0 {
+		return nil, false
+	}
+	ns := string(body[4 : 4+end])
+	rest := body[4+end+1:]
+	if target, ok := n.rewrites[ns]; ok {
+		return rewrittenBody(body[:4], target, rest), true
+	}
+	if op != OpQuery || !n.isCommandNamespace(body[4:4+end]) {
+		return nil, false
+	}
+
+	// int32 numberToSkip, int32 numberToReturn, document query, and the
+	// optional returnFieldsSelector.
+	if len(rest) < 8 {
+		return nil, false
+	}
+	doc, ok := bsonDocument(rest[8:])
+	if !ok {
+		return nil, false
+	}
+	db := databaseName([]byte(ns))
+	newDoc, target, ok := n.rewriteCommand(doc, db)
+	if !ok {
+		return nil, false
+	}
+	newRest := append(append(append([]byte(nil), rest[:8]...), newDoc...), rest[8+len(doc):]...)
+	return rewrittenBody(body[:4], databaseName([]byte(target))+"."+n.command, newRest), true
+}
+
+// rewrittenBody assembles a body from the leading int32, the namespace and the
+// rest.
+func rewrittenBody(prefix []byte, ns string, rest []byte) []byte {
+	b := append([]byte(nil), prefix...)
+	b = addCString(b, ns)
+	return append(b, rest...)
+}
+
+// rewriteCommand rewrites the collection a command document in the database
+// runs on, the value of its first field as in {count: "foo"}. Commands
+// wrapped in $query, as when sent with a read preference, are rewritten too.
+// It returns the new document and the namespace the command runs on.
+func (n namespaceRewriter) rewriteCommand(doc []byte, db string) ([]byte, string, bool) {
+	var q bson.D
+	if err := bson.Unmarshal(doc, &q); err != nil || len(q) == 0 {
+		return nil, "", false
+	}
+	command := q
+	if q[0].Name == "$query" || q[0].Name == "query" {
+		wrapped, ok := q[0].Value.(bson.D)
+		if !ok || len(wrapped) == 0 {
+			return nil, "", false
+		}
+		command = wrapped
+	}
+	collection, ok := command[0].Value.(string)
+	if !ok {
+		return nil, "", false
+	}
+	target, ok := n.rewrites[db+"."+collection]
+	if !ok {
+		return nil, "", false
+	}
+	command[0].Value = target[strings.IndexByte(target, '.')+1:]
+	newDoc, err := bson.Marshal(q)
+	if err != nil {
+		return nil, "", false
+	}
+	return newDoc, target, true
+}
+
+// rewriteMsg rewrites the command of an OP_MSG body, whose database is its $db
+// field. The checksum, if any, is dropped as it would no longer match.
+func (n namespaceRewriter) rewriteMsg(body []byte) ([]byte, bool) {
+	m, err := parseOpMsg(body)
+	if err != nil {
+		return nil, false
+	}
+	var q bson.D
+	if err := bson.Unmarshal(m.Body, &q); err != nil || len(q) == 0 {
+		return nil, false
+	}
+	collection, ok := q[0].Value.(string)
+	if !ok {
+		return nil, false
+	}
+	for i, e := range q {
+		if e.Name != "$db" {
+			continue
+		}
+		db, _ := e.Value.(string)
+		target, ok := n.rewrites[db+"."+collection]
+		if !ok {
+			return nil, false
+		}
+		dot := strings.IndexByte(target, '.')
+		q[0].Value = target[dot+1:]
+		q[i].Value = target[:dot]
+		doc, err := bson.Marshal(q)
+		if err != nil {
+			return nil, false
+		}
+		end := len(body)
+		if m.Flags&opMsgChecksumPresent != 0 {
+			end -= 4
+		}
+		b := addInt32(nil, int32(m.Flags&^opMsgChecksumPresent))
+		b = append(b, body[4:m.BodyOffset]...)
+		b = append(b, doc...)
+		return append(b, body[m.BodyOffset+len(m.Body):end]...), true
+	}
+	return nil, false
+}
@@ -0,0 +1,92 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func rewriteProxy() *Proxy {
+	return &Proxy{ReplicaSet: &ReplicaSet{NamespaceRewrites: map[string]string{
+		"test.foo": "test.bar",
+		"test.old": "archive.old",
+	}}}
+}
+
+// rewrittenMessage runs the message through rewriteNamespace and returns the
+// header and body read from the returned conn.
+func rewrittenMessage(t *testing.T, p *Proxy, msg []byte) (*messageHeader, []byte) {
+	c := &bufferConn{r: bytes.NewReader(msg)}
+	h, err := readHeader(c)
+	ensure.Nil(t, err)
+	client, err := p.rewriteNamespace(h, c)
+	ensure.Nil(t, err)
+	body, err := ioutil.ReadAll(client)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, int(h.MessageLength), headerLen+len(body))
+	return h, body
+}
+
+func TestRewriteNamespaceQuery(t *testing.T) {
+	t.Parallel()
+	_, body := rewrittenMessage(t, rewriteProxy(), queryMessage(t, 1, "test.foo", bson.M{"a": 1}))
+	ensure.DeepEqual(t, body, queryBody(t, "test.bar", bson.M{"a": 1}))
+}
+
+func TestRewriteNamespaceUnchanged(t *testing.T) {
+	t.Parallel()
+	msg := queryMessage(t, 1, "test.baz", bson.M{"a": 1})
+	_, body := rewrittenMessage(t, rewriteProxy(), msg)
+	ensure.DeepEqual(t, body, msg[headerLen:])
+}
+
+func TestRewriteNamespaceCommand(t *testing.T) {
+	t.Parallel()
+	_, body := rewrittenMessage(t, rewriteProxy(),
+		queryMessage(t, 1, "test.$cmd", bson.D{{Name: "count", Value: "foo"}, {Name: "query", Value: bson.M{}}}))
+	ensure.DeepEqual(t, body,
+		queryBody(t, "test.$cmd", bson.D{{Name: "count", Value: "bar"}, {Name: "query", Value: bson.M{}}}))
+}
+
+func TestRewriteNamespaceCommandOtherDatabase(t *testing.T) {
+	t.Parallel()
+	_, body := rewrittenMessage(t, rewriteProxy(), queryMessage(t, 1, "test.$cmd", bson.D{
+		{Name: "$query", Value: bson.D{{Name: "find", Value: "old"}}},
+		{Name: "$readPreference", Value: bson.M{"mode": "secondary"}},
+	}))
+	ensure.DeepEqual(t, body, queryBody(t, "archive.$cmd", bson.D{
+		{Name: "$query", Value: bson.D{{Name: "find", Value: "old"}}},
+		{Name: "$readPreference", Value: bson.M{"mode": "secondary"}},
+	}))
+}
+
+func TestRewriteNamespaceGetMore(t *testing.T) {
+	t.Parallel()
+	body := getMoreBody("test.foo", 7)
+	h := messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpGetMore}
+	_, rewritten := rewrittenMessage(t, rewriteProxy(), append(h.ToWire(), body...))
+	ensure.DeepEqual(t, rewritten, getMoreBody("test.bar", 7))
+}
+
+func TestRewriteNamespaceMsg(t *testing.T) {
+	t.Parallel()
+	body := msgBody(t, opMsgChecksumPresent,
+		msgSection{Documents: []interface{}{bson.D{{Name: "find", Value: "old"}, {Name: "$db", Value: "test"}}}})
+	h := messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpMsg}
+	_, rewritten := rewrittenMessage(t, rewriteProxy(), append(h.ToWire(), body...))
+	ensure.DeepEqual(t, rewritten, msgBody(t, 0,
+		msgSection{Documents: []interface{}{bson.D{{Name: "find", Value: "old"}, {Name: "$db", Value: "archive"}}}}))
+}
+
+func TestRewriteNamespaceDisabled(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}}
+	c := &bufferConn{}
+	h := &messageHeader{OpCode: OpQuery}
+	client, err := p.rewriteNamespace(h, c)
+	ensure.Nil(t, err)
+	ensure.True(t, client == c)
+}
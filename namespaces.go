@@ -0,0 +1,51 @@
+package dvara
+
+import "bytes"
+
+// The special namespaces used by all mongo versions speaking OP_QUERY.
+const (
+	defaultCommandCollection = "$cmd"
+	defaultAdminDatabase     = "admin"
+)
+
+// namespaces are the special collection and database names the proxy looks
+// for to recognize commands in queries.
+type namespaces struct {
+	command string // the collection commands are sent to as queries
+	admin   string // the database admin commands run in
+}
+
+var defaultNamespaces = namespaces{command: defaultCommandCollection, admin: defaultAdminDatabase}
+
+// namespaces returns the special namespaces to use, CommandCollection and
+// AdminDatabase or their defaults. The ReplicaSet may be nil.
+func (r *ReplicaSet) namespaces() namespaces {
+	n := defaultNamespaces
+	if r == nil {
+		return n
+	}
+	if r.CommandCollection != "" {
+		n.command = r.CommandCollection
+	}
+	if r.AdminDatabase != "" {
+		n.admin = r.AdminDatabase
+	}
+	return n
+}
+
+// isCommandNamespace returns true if the null terminated full collection name
+// is that of commands, like "test.$cmd\x00".
+func (n namespaces) isCommandNamespace(fullCollectionName []byte) bool {
+	name := bytes.TrimSuffix(fullCollectionName, []byte{x00})
+	dot := len(name) - len(n.command) - 1
+	return dot >= 0 && name[dot] == '.' && string(name[dot+1:]) == n.command
+}
+
+// isAdminCommandNamespace returns true if the null terminated full collection
+// name is that of admin commands, like "admin.$cmd\x00".
+func (n namespaces) isAdminCommandNamespace(fullCollectionName []byte) bool {
+	name := bytes.TrimSuffix(fullCollectionName, []byte{x00})
+	dot := len(n.admin)
+	return len(name) > dot && name[dot] == '.' &&
+		string(name[:dot]) == n.admin && string(name[dot+1:]) == n.command
+}
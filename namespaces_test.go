@@ -0,0 +1,61 @@
+package dvara
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReplicaSetNamespaces(t *testing.T) {
+	t.Parallel()
+	var r *ReplicaSet
+	ensure.DeepEqual(t, r.namespaces(), namespaces{command: "$cmd", admin: "admin"})
+	ensure.DeepEqual(t, (&ReplicaSet{}).namespaces(), defaultNamespaces)
+	r = &ReplicaSet{CommandCollection: "$command", AdminDatabase: "root"}
+	ensure.DeepEqual(t, r.namespaces(), namespaces{command: "$command", admin: "root"})
+}
+
+func TestCommandNamespaces(t *testing.T) {
+	t.Parallel()
+	custom := namespaces{command: "$command", admin: "root"}
+	cases := []struct {
+		Namespaces namespaces
+		Name       string
+		Command    bool
+		Admin      bool
+	}{
+		{defaultNamespaces, "test.$cmd\x00", true, false},
+		{defaultNamespaces, "admin.$cmd\x00", true, true},
+		{defaultNamespaces, "admin.$cmd", true, true},
+		{defaultNamespaces, "test.foo\x00", false, false},
+		{defaultNamespaces, "admin.foo\x00", false, false},
+		{defaultNamespaces, "$cmd\x00", false, false},
+		{defaultNamespaces, "test$cmd\x00", false, false},
+		{custom, "test.$command\x00", true, false},
+		{custom, "root.$command\x00", true, true},
+		{custom, "admin.$cmd\x00", false, false},
+		{custom, "root.$cmd\x00", false, false},
+	}
+	for _, c := range cases {
+		ensure.DeepEqual(t, c.Namespaces.isCommandNamespace([]byte(c.Name)), c.Command, c.Name)
+		ensure.DeepEqual(t, c.Namespaces.isAdminCommandNamespace([]byte(c.Name)), c.Admin, c.Name)
+	}
+}
+
+func TestCustomCommandCollection(t *testing.T) {
+	t.Parallel()
+	custom := namespaces{command: "$command", admin: "admin"}
+	count := queryBody(t, "test.$command", bson.M{"count": "foo"})
+	name, ok := custom.queryCommand(count)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, name, "count")
+	ensure.True(t, custom.isReadQuery(count))
+	_, ok = defaultNamespaces.queryCommand(count)
+	ensure.False(t, ok)
+
+	insert := queryBody(t, "test.$command", bson.M{"insert": "foo"})
+	ensure.False(t, custom.isReadQuery(insert))
+	_, ok = custom.queryCommand(queryBody(t, "test.$cmd", bson.M{"count": "foo"}))
+	ensure.False(t, ok)
+}
@@ -0,0 +1,215 @@
+package dvara
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OpMsg is the extensible message format used by newer drivers, which carries
+// a command document and optionally sequences of documents.
+const OpMsg = OpCode(2013)
+
+var errMalformedOpMsg = errors.New("dvara: malformed OP_MSG")
+
+// OP_MSG flags: opMsgChecksumPresent is set when an OP_MSG ends with a
+// checksum, opMsgMoreToCome when the sender expects no response, and
+// opMsgExhaustAllowed when the server may stream several replies to a request.
+const (
+	opMsgChecksumPresent = 1 << 0
+	opMsgMoreToCome      = 1 << 1
+	opMsgExhaustAllowed  = 1 << 16
+)
+
+// OP_MSG section kinds.
+const (
+	opMsgBodySection     = 0
+	opMsgSequenceSection = 1
+)
+
+// opMsg is a parsed OP_MSG body. Documents are left as raw BSON.
+type opMsg struct {
+	Flags uint32
+
+	// Body is the kind 0 section, the command document, found at BodyOffset in
+	// the message body.
+	Body       []byte
+	BodyOffset int
+
+	// Sequences are the kind 1 sections, such as the documents of a bulk
+	// insert, in the order they appear in the message.
+	Sequences []opMsgSequence
+}
+
+// opMsgSequence is a kind 1 section, a sequence of documents which is part of
+// the command under the field named by Identifier.
+type opMsgSequence struct {
+	Identifier string
+	Documents  [][]byte
+}
+
+// parseOpMsg parses the body of an OP_MSG, following the header: uint32
+// flagBits, the sections, and an optional uint32 checksum which is not
+// verified. There must be exactly one kind 0 section, which may come before or
+// after any kind 1 sections.
+func parseOpMsg(body []byte) (*opMsg, error) {
+	if len(body) < 4 {
+		return nil, errMalformedOpMsg
+	}
+	m := &opMsg{Flags: uint32(getInt32(body, 0))}
+	end := len(body)
+	if m.Flags&opMsgChecksumPresent != 0 {
+		end -= 4
+	}
+	pos := 4
+	for pos < end {
+		kind := body[pos]
+		pos++
+		switch kind {
+		case opMsgBodySection:
+			doc, ok := bsonDocument(body[pos:end])
+			if !ok || m.Body != nil {
+				return nil, errMalformedOpMsg
+			}
+			m.Body = doc
+			m.BodyOffset = pos
+			pos += len(doc)
+		case opMsgSequenceSection:
+			// int32 size, including itself, cstring identifier, documents.
+			if end-pos < 4 {
+				return nil, errMalformedOpMsg
+			}
+			size := int(getInt32(body, pos))
+			if size < 5 || size > end-pos {
+				return nil, errMalformedOpMsg
+			}
+			section := body[pos+4 : pos+size]
+			nameEnd := bytes.IndexByte(section, x00)
+			if nameEnd < 0 {
+				return nil, errMalformedOpMsg
+			}
+			seq := opMsgSequence{Identifier: string(section[:nameEnd])}
+			for docs := section[nameEnd+1:]; len(docs) > 0; {
+				doc, ok := bsonDocument(docs)
+				if !ok {
+					return nil, errMalformedOpMsg
+				}
+				seq.Documents = append(seq.Documents, doc)
+				docs = docs[len(doc):]
+			}
+			m.Sequences = append(m.Sequences, seq)
+			pos += size
+		default:
+			return nil, errMalformedOpMsg
+		}
+	}
+	if m.Body == nil {
+		return nil, errMalformedOpMsg
+	}
+	return m, nil
+}
+
+// bsonDocument returns the BSON document at the start of b, as framed by its
+// length prefix.
+func bsonDocument(b []byte) ([]byte, bool) {
+	if len(b) < 5 {
+		return nil, false
+	}
+	size := int(getInt32(b, 0))
+	if size < 5 || size > len(b) || b[size-1] != x00 {
+		return nil, false
+	}
+	return b[:size], true
+}
+
+// msgCommand returns the name of the command an OP_MSG body runs, along with
+// its namespace. The command is the first field of the kind 0 section and the
+// database its $db field. For commands naming a collection, like insert or
+// find, the namespace is the database and collection as in test.foo, and
+// otherwise just the database.
+func msgCommand(body []byte) (name, ns string, ok bool) {
+	m, err := parseOpMsg(body)
+	if err != nil {
+		return "", "", false
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(m.Body, &doc); err != nil || len(doc) == 0 {
+		return "", "", false
+	}
+	for _, e := range doc {
+		if e.Name == "$db" {
+			ns, _ = e.Value.(string)
+		}
+	}
+	if collection, isString := doc[0].Value.(string); isString && collection != "" {
+		ns += "." + collection
+	}
+	return doc[0].Name, ns, true
+}
+
+// messageCommand returns the name of the command an OP_QUERY or OP_MSG body
+// runs.
+func (n namespaces) messageCommand(op OpCode, body []byte) (string, bool) {
+	switch op {
+	case OpQuery:
+		return n.queryCommand(body)
+	case OpMsg:
+		name, _, ok := msgCommand(body)
+		return name, ok
+	}
+	return "", false
+}
+
+// readMsgFlags reads the flagBits of an OP_MSG whose header was read, and
+// tells if the server responds to it. The returned conn replays the flags.
+func readMsgFlags(h *messageHeader, c net.Conn) (net.Conn, bool, error) {
+	if h.MessageLength < headerLen+4 {
+		return c, true, nil
+	}
+	prefix := make([]byte, headerLen+4)
+	h.putWire(prefix)
+	if _, err := io.ReadFull(c, prefix[headerLen:]); err != nil {
+		return nil, false, err
+	}
+	replay := &replayConn{
+		Conn:   c,
+		reader: io.MultiReader(bytes.NewReader(prefix[headerLen:]), c),
+	}
+	return replay, expectsResponse(prefix), nil
+}
+
+// copyMsgReplies relays the replies to an OP_MSG. A reply with the moreToCome
+// flag is followed by another one without the client asking for it, which
+// servers only do for requests with the exhaustAllowed flag, until the last
+// reply without the flag.
+func copyMsgReplies(w io.Writer, r io.Reader) error {
+	for {
+		reply := &msgReplyPrefix{Writer: w}
+		if err := copyMessage(reply, r); err != nil {
+			return err
+		}
+		if OpCode(getInt32(reply.prefix, 12)) != OpMsg || expectsResponse(reply.prefix) {
+			return nil
+		}
+	}
+}
+
+// msgReplyPrefix keeps the header and flagBits of the reply written through
+// it.
+type msgReplyPrefix struct {
+	io.Writer
+	prefix []byte
+}
+
+func (m *msgReplyPrefix) Write(b []byte) (int, error) {
+	if n := headerLen + 4 - len(m.prefix); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		m.prefix = append(m.prefix, b[:n]...)
+	}
+	return m.Writer.Write(b)
+}
@@ -0,0 +1,222 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// msgSection is a section of an OP_MSG built by msgBody. A section with an
+// identifier is a kind 1 document sequence, otherwise it is the kind 0 body.
+type msgSection struct {
+	Identifier string
+	Documents  []interface{}
+}
+
+func msgBody(t testing.TB, flags int32, sections ...msgSection) []byte {
+	b := addInt32(nil, flags)
+	for _, s := range sections {
+		if s.Identifier == "" {
+			b = append(b, opMsgBodySection)
+			var err error
+			b, err = addBSON(b, s.Documents[0])
+			ensure.Nil(t, err)
+			continue
+		}
+		seq := addCString(nil, s.Identifier)
+		for _, d := range s.Documents {
+			var err error
+			seq, err = addBSON(seq, d)
+			ensure.Nil(t, err)
+		}
+		b = append(b, opMsgSequenceSection)
+		b = addInt32(b, int32(4+len(seq)))
+		b = append(b, seq...)
+	}
+	if flags&opMsgChecksumPresent != 0 {
+		b = addInt32(b, 0)
+	}
+	return b
+}
+
+func msgMessage(t testing.TB, requestID int32, sections ...msgSection) []byte {
+	body := msgBody(t, 0, sections...)
+	h := messageHeader{
+		MessageLength: int32(headerLen + len(body)),
+		RequestID:     requestID,
+		OpCode:        OpMsg,
+	}
+	return append(h.ToWire(), body...)
+}
+
+func bulkInsert() []msgSection {
+	return []msgSection{
+		{Documents: []interface{}{bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}}}},
+		{Identifier: "documents", Documents: []interface{}{bson.M{"a": 1}, bson.M{"a": 2}, bson.M{"a": 3}}},
+	}
+}
+
+func TestParseOpMsgBulkInsert(t *testing.T) {
+	t.Parallel()
+	sections := bulkInsert()
+	reversed := []msgSection{sections[1], sections[0]}
+	for _, body := range [][]byte{
+		msgBody(t, 0, sections...),
+		msgBody(t, 0, reversed...),
+		msgBody(t, opMsgChecksumPresent, sections...),
+	} {
+		m, err := parseOpMsg(body)
+		ensure.Nil(t, err)
+		var command bson.D
+		ensure.Nil(t, bson.Unmarshal(m.Body, &command))
+		ensure.DeepEqual(t, command[0].Name, "insert")
+		ensure.DeepEqual(t, len(m.Sequences), 1)
+		ensure.DeepEqual(t, m.Sequences[0].Identifier, "documents")
+		ensure.DeepEqual(t, len(m.Sequences[0].Documents), 3)
+		for i, doc := range m.Sequences[0].Documents {
+			actual := bson.M{}
+			ensure.Nil(t, bson.Unmarshal(doc, &actual))
+			ensure.DeepEqual(t, actual, bson.M{"a": i + 1})
+		}
+
+		name, ns, ok := msgCommand(body)
+		ensure.True(t, ok)
+		ensure.DeepEqual(t, name, "insert")
+		ensure.DeepEqual(t, ns, "test.foo")
+	}
+}
+
+func TestParseOpMsgMalformed(t *testing.T) {
+	t.Parallel()
+	valid := msgBody(t, 0, bulkInsert()...)
+	twoBodies := msgBody(t, 0, bulkInsert()[0], bulkInsert()[0])
+	onlySequence := msgBody(t, 0, bulkInsert()[1])
+	badKind := append([]byte(nil), valid...)
+	badKind[4] = 2
+	badSequenceSize := msgBody(t, 0, bulkInsert()[1], bulkInsert()[0])
+	setInt32(badSequenceSize, 5, int32(len(badSequenceSize)))
+	cases := [][]byte{
+		nil,
+		valid[:3],
+		valid[:len(valid)-1],
+		twoBodies,
+		onlySequence,
+		badKind,
+		badSequenceSize,
+	}
+	for i, body := range cases {
+		if _, err := parseOpMsg(body); err != errMalformedOpMsg {
+			t.Fatalf("case %d: did not get expected error, instead got: %v", i, err)
+		}
+	}
+}
+
+func TestMessageCommand(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		OpCode OpCode
+		Body   []byte
+		Name   string
+		Found  bool
+	}{
+		{OpMsg, msgBody(t, 0, bulkInsert()...), "insert", true},
+		{OpMsg, msgBody(t, 0, msgSection{Documents: []interface{}{bson.D{{Name: "isMaster", Value: 1}, {Name: "$db", Value: "admin"}}}}), "isMaster", true},
+		{OpMsg, []byte{0, 0, 0, 0}, "", false},
+		{OpQuery, queryBody(t, "test.$cmd", bson.M{"count": "foo"}), "count", true},
+		{OpQuery, queryBody(t, "test.foo", bson.M{"a": 1}), "", false},
+		{OpInsert, queryBody(t, "test.$cmd", bson.M{"count": "foo"}), "", false},
+	}
+	for i, c := range cases {
+		name, found := defaultNamespaces.messageCommand(c.OpCode, c.Body)
+		if name != c.Name || found != c.Found {
+			t.Fatalf("case %d: expected %q %v got %q %v", i, c.Name, c.Found, name, found)
+		}
+	}
+	_, ns, _ := msgCommand(cases[1].Body)
+	ensure.DeepEqual(t, ns, "admin")
+}
+
+func TestExpectsResponse(t *testing.T) {
+	t.Parallel()
+	msg := msgMessage(t, 1, msgSection{Documents: []interface{}{bson.M{"ping": 1}}})
+	ensure.True(t, expectsResponse(msg))
+	ensure.True(t, expectsResponse(msg[:headerLen]))
+	setInt32(msg, headerLen, opMsgMoreToCome)
+	ensure.False(t, expectsResponse(msg))
+	ensure.True(t, expectsResponse(queryMessage(t, 1, "test.foo", bson.M{})))
+	insert := messageHeader{MessageLength: headerLen, OpCode: OpInsert}
+	ensure.False(t, expectsResponse(insert.ToWire()))
+}
+
+// msgReply returns an OP_MSG reply with the document as its body, and the
+// flags.
+func msgReply(t testing.TB, flags int32, doc interface{}) []byte {
+	b, err := bson.Marshal(doc)
+	ensure.Nil(t, err)
+	reply := msgDocumentMessage(0, b)
+	setInt32(reply, headerLen, flags)
+	return reply
+}
+
+func TestReadMsgFlags(t *testing.T) {
+	t.Parallel()
+	for _, flags := range []int32{0, opMsgMoreToCome} {
+		body := msgBody(t, flags, msgSection{Documents: []interface{}{bson.M{"ping": 1}}})
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpMsg}
+		replay, hasResponse, err := readMsgFlags(h, &bufferConn{r: bytes.NewReader(body)})
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, hasResponse, flags == 0)
+		replayed, err := ioutil.ReadAll(replay)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, replayed, body)
+	}
+}
+
+func TestCopyMsgReplies(t *testing.T) {
+	t.Parallel()
+	// Replies with moreToCome are streamed until one without it.
+	first := msgReply(t, opMsgMoreToCome, bson.M{"n": 1})
+	last := msgReply(t, 0, bson.M{"n": 2})
+	after := msgReply(t, 0, bson.M{"n": 3})
+	stream := append(append(append([]byte(nil), first...), last...), after...)
+	r := bytes.NewReader(stream)
+	var w bytes.Buffer
+	ensure.Nil(t, copyMsgReplies(&w, r))
+	ensure.DeepEqual(t, w.Bytes(), stream[:len(first)+len(last)])
+	ensure.DeepEqual(t, r.Len(), len(after))
+}
+
+func TestProxyMsg(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MessageTimeout: time.Second},
+		Clock:      clock.NewMock(),
+		stats:      &stats.HookClient{},
+	}
+	reply := msgReply(t, 0, bson.M{"ok": 1})
+	for _, flags := range []int32{0, opMsgMoreToCome} {
+		body := msgBody(t, flags, msgSection{Documents: []interface{}{
+			bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}},
+		}})
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), RequestID: 7, OpCode: OpMsg}
+		client := &bufferConn{r: bytes.NewReader(body)}
+		server := &bufferConn{r: bytes.NewReader(reply)}
+		ensure.Nil(t, p.proxyMessage(h, nil, client, server, &LastError{}))
+		ensure.DeepEqual(t, server.w.Bytes()[headerLen:], body)
+		if flags == 0 {
+			// The reply goes back in response to the client's request.
+			ensure.DeepEqual(t, getInt32(client.w.Bytes(), 8), h.RequestID)
+			ensure.DeepEqual(t, client.w.Bytes()[12:], reply[12:])
+		} else {
+			// No reply is read for a message with moreToCome.
+			ensure.DeepEqual(t, client.w.Len(), 0)
+			ensure.DeepEqual(t, server.r.Len(), len(reply))
+		}
+	}
+}
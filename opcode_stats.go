@@ -0,0 +1,57 @@
+package dvara
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// opCodeStatKeys are the per opcode stats of the request opcodes, such as
+// opcode.query or opcode.get_more.
+var opCodeStatKeys = func() map[OpCode]string {
+	keys := make(map[OpCode]string, len(requestOpCodes))
+	for _, c := range requestOpCodes {
+		keys[c] = "opcode." + strings.ToLower(c.String())
+	}
+	return keys
+}()
+
+// unknownOpCodes remembers the unknown opcodes a proxy has seen, so each is
+// only logged the first time.
+type unknownOpCodes struct {
+	mutex sync.Mutex
+	seen  map[OpCode]bool
+}
+
+// add returns true if the opcode was not seen before.
+func (u *unknownOpCodes) add(c OpCode) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.seen[c] {
+		return false
+	}
+	if u.seen == nil {
+		u.seen = make(map[OpCode]bool)
+	}
+	u.seen[c] = true
+	return true
+}
+
+// countOpCode counts the message by opcode. Opcodes clients are not expected
+// to send, which may come from a newer driver or a misbehaving client, are
+// counted as opcode.unknown and by value, and logged the first time.
+func (p *Proxy) countOpCode(h *messageHeader, remoteIP string) {
+	if key, ok := opCodeStatKeys[h.OpCode]; ok {
+		stats.BumpSum(p.stats, key, 1)
+		return
+	}
+	stats.BumpSum(p.stats, "opcode.unknown", 1)
+	stats.BumpSum(p.stats, fmt.Sprintf("opcode.unknown.%d", int32(h.OpCode)), 1)
+	if p.unknownOpCodes.add(h.OpCode) {
+		corelog.LogInfoMessage("unknown opcode",
+			"opcode", int32(h.OpCode), "client", remoteIP, "proxy", p.String())
+	}
+}
@@ -0,0 +1,26 @@
+package dvara
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestCountOpCode(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := &Proxy{stats: &rec}
+	for _, c := range []OpCode{OpQuery, OpGetMore, OpQuery, OpMsg, OpCode(2099), OpReply, OpCode(2099)} {
+		p.countOpCode(&messageHeader{OpCode: c}, "1.2.3.4")
+	}
+	ensure.DeepEqual(t, rec.summed(), map[string]float64{
+		"opcode.query":        2,
+		"opcode.get_more":     1,
+		"opcode.msg":          1,
+		"opcode.unknown":      3,
+		"opcode.unknown.2099": 2,
+		"opcode.unknown.1":    1,
+	})
+	ensure.False(t, p.unknownOpCodes.add(OpCode(2099)))
+	ensure.True(t, p.unknownOpCodes.add(OpCode(2100)))
+}
@@ -0,0 +1,83 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func newPipeliningProxy(t *testing.T) (*Proxy, net.Conn) {
+	p := startLoopbackProxy(t, func(p *Proxy) {
+		p.ReplicaSet.ReadBufferSize = 16 * 1024
+		p.ProxyAddr = "127.0.0.1:6000"
+	})
+	c, err := net.Dial("tcp", p.Addr().String())
+	ensure.Nil(t, err)
+	return p, c
+}
+
+// pipelinedMessages returns n messages mixing queries, commands and legacy
+// writes, the latter getting no response, along with the request IDs of the
+// messages which do in order.
+func pipelinedMessages(t *testing.T, n int) ([]byte, []int32) {
+	var stream []byte
+	var expected []int32
+	for i := int32(1); i <= int32(n); i++ {
+		switch i % 3 {
+		case 0:
+			msg := legacyWriteMessage(t, OpInsert, "test.foo")
+			setInt32(msg, 4, i)
+			stream = append(stream, msg...)
+			continue
+		case 1:
+			stream = append(stream, queryMessage(t, i, "test.foo", bson.M{"a": "b"})...)
+		case 2:
+			stream = append(stream, queryMessage(t, i, "admin.$cmd", bson.M{"isMaster": 1})...)
+		}
+		expected = append(expected, i)
+	}
+	return stream, expected
+}
+
+// Requests written all at once, before reading any response, are answered in
+// order.
+func TestPipelinedRequests(t *testing.T) {
+	t.Parallel()
+	p, c := newPipeliningProxy(t)
+	defer p.Stop()
+	defer c.Close()
+
+	stream, expected := pipelinedMessages(t, 12)
+	_, err := c.Write(stream)
+	ensure.Nil(t, err)
+	for _, id := range expected {
+		var reply bytes.Buffer
+		ensure.Nil(t, copyMessage(&reply, c))
+		ensure.DeepEqual(t, getInt32(reply.Bytes(), 8), id)
+	}
+}
+
+// A client writing far more than the socket buffers hold before reading is
+// served as long as it reads responses concurrently.
+func TestPipelinedRequestsConcurrentReader(t *testing.T) {
+	t.Parallel()
+	p, c := newPipeliningProxy(t)
+	defer p.Stop()
+	defer c.Close()
+
+	stream, expected := pipelinedMessages(t, 3000)
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write(stream)
+		written <- err
+	}()
+	for _, id := range expected {
+		var reply bytes.Buffer
+		ensure.Nil(t, copyMessage(&reply, c))
+		ensure.DeepEqual(t, getInt32(reply.Bytes(), 8), id)
+	}
+	ensure.Nil(t, <-written)
+}
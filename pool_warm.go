@@ -0,0 +1,72 @@
+package dvara
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+type warmResult struct {
+	conn io.Closer
+	err  error
+}
+
+// warmServerPool establishes the MinIdleConnections of the server pool, for
+// up to the WarmPoolTimeout, so the first clients don't wait on connecting and
+// authenticating. The connections are all acquired at once so each is a new
+// one, and released to the pool together. Those which could not be established
+// in time are left for the pool to make as clients need them.
+func (p *Proxy) warmServerPool() {
+	timeout := p.ReplicaSet.WarmPoolTimeout
+	want := int(p.ReplicaSet.backendLimits(p.MongoAddr).MinIdleConnections)
+	if timeout <= 0 || want == 0 {
+		return
+	}
+	t := stats.BumpTime(p.stats, "server.pool.warm.time")
+	defer t.End()
+
+	pool := p.serverPool
+	results := make(chan warmResult, want)
+	for i := 0; i < want; i++ {
+		go func() {
+			c, err := pool.Acquire()
+			results <- warmResult{conn: c, err: err}
+		}()
+	}
+
+	var acquired []io.Closer
+	var failed int
+	deadline := p.Clock.After(timeout)
+	for pending := want; pending > 0; pending-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				failed++
+				stats.BumpSum(p.stats, "server.pool.warm.failed", 1)
+				continue
+			}
+			acquired = append(acquired, r.conn)
+			stats.BumpSum(p.stats, "server.pool.warm.established", 1)
+		case <-deadline:
+			stats.BumpSum(p.stats, "server.pool.warm.timeout", 1)
+			go releaseLate(pool, results, pending)
+			pending = 0
+		}
+	}
+	for _, c := range acquired {
+		pool.Release(c)
+	}
+	corelog.LogInfoMessage(fmt.Sprintf("warmed %d of %d server connections for %s, %d failed", len(acquired), want, p, failed))
+}
+
+// releaseLate releases the connections established after warming the pool
+// timed out.
+func releaseLate(pool ConnPool, results <-chan warmResult, pending int) {
+	for ; pending > 0; pending-- {
+		if r := <-results; r.err == nil {
+			pool.Release(r.conn)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package dvara
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+)
+
+func newWarmProxy(newConn func() (io.Closer, error)) (*Proxy, *Pool, *statsRecorder) {
+	rec := &statsRecorder{}
+	pool := &Pool{New: newConn, Max: 3, IdleTimeout: time.Hour, ClosePoolSize: 1}
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MinIdleConnections: 2, WarmPoolTimeout: time.Minute},
+		Clock:      clock.NewMock(),
+		serverPool: pool,
+		stats:      rec,
+	}
+	return p, pool, rec
+}
+
+func TestWarmServerPool(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p, pool, rec := newWarmProxy(cm.New)
+	p.warmServerPool()
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{Total: 2, Idle: 2})
+	ensure.DeepEqual(t, rec.summed(), map[string]float64{"server.pool.warm.established": 2})
+	ensure.Nil(t, pool.Close())
+}
+
+func TestWarmServerPoolFailed(t *testing.T) {
+	t.Parallel()
+	p, pool, rec := newWarmProxy(func() (io.Closer, error) {
+		return nil, errors.New("connection refused")
+	})
+	p.warmServerPool()
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{})
+	ensure.DeepEqual(t, rec.summed(), map[string]float64{"server.pool.warm.failed": 2})
+	ensure.Nil(t, pool.Close())
+}
+
+func TestWarmServerPoolTimeout(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	unblock := make(chan struct{})
+	p, pool, rec := newWarmProxy(func() (io.Closer, error) {
+		<-unblock
+		return cm.New()
+	})
+	done := make(chan struct{})
+	go func() {
+		p.warmServerPool()
+		close(done)
+	}()
+	for warming := true; warming; {
+		select {
+		case <-done:
+			warming = false
+		default:
+			p.Clock.(*clock.Mock).Add(time.Minute)
+			time.Sleep(time.Millisecond)
+		}
+	}
+	ensure.DeepEqual(t, rec.summed(), map[string]float64{"server.pool.warm.timeout": 1})
+
+	// the connections established late still go to the pool
+	close(unblock)
+	for pool.Snapshot().Idle != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	ensure.Nil(t, pool.Close())
+}
+
+func TestWarmServerPoolDisabled(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p, pool, rec := newWarmProxy(cm.New)
+	p.ReplicaSet.WarmPoolTimeout = 0
+	p.warmServerPool()
+	ensure.DeepEqual(t, pool.Snapshot(), PoolStats{})
+	ensure.DeepEqual(t, len(rec.summed()), 0)
+	ensure.Nil(t, pool.Close())
+}
@@ -4,14 +4,22 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"gopkg.in/mgo.v2/bson"
 )
 
 var (
-	errWrite = errors.New("incorrect number of bytes written")
+	errWrite                 = errors.New("incorrect number of bytes written")
+	errInvalidMessageLength  = errors.New("dvara: invalid message length")
+	errInvalidDocumentLength = errors.New("dvara: invalid document length")
+	errShortHeader           = errors.New("dvara: short message header")
 )
 
+// maxMessageLength is the largest message mongo accepts, its
+// maxMessageSizeBytes.
+const maxMessageLength = 48000000
+
 // Look at http://docs.mongodb.org/meta-driver/latest/legacy/mongodb-wire-protocol/ for the protocol.
 
 // OpCode allow identifying the type of operation:
@@ -42,6 +50,10 @@ func (c OpCode) String() string {
 		return "DELETE"
 	case OpKillCursors:
 		return "KILL_CURSORS"
+	case OpCompressed:
+		return "COMPRESSED"
+	case OpMsg:
+		return "MSG"
 	}
 }
 
@@ -52,8 +64,19 @@ func (c OpCode) IsMutation() bool {
 }
 
 // HasResponse tells us if the operation will have a response from the server.
+// An OP_MSG has one unless its moreToCome flag is set, see expectsResponse.
 func (c OpCode) HasResponse() bool {
-	return c == OpQuery || c == OpGetMore
+	return c == OpQuery || c == OpGetMore || c == OpMsg
+}
+
+// expectsResponse tells if the server responds to the message starting with
+// b, which holds at least its header and, for an OP_MSG, its flagBits.
+func expectsResponse(b []byte) bool {
+	c := OpCode(getInt32(b, 12))
+	if c == OpMsg && len(b) >= headerLen+4 {
+		return uint32(getInt32(b, headerLen))&opMsgMoreToCome == 0
+	}
+	return c.HasResponse()
 }
 
 // The full set of known request op codes:
@@ -84,13 +107,17 @@ type messageHeader struct {
 
 // ToWire converts the messageHeader to the wire protocol
 func (m messageHeader) ToWire() []byte {
-	var d [headerLen]byte
-	b := d[:]
+	b := make([]byte, headerLen)
+	m.putWire(b)
+	return b
+}
+
+// putWire writes the messageHeader in the wire protocol to b.
+func (m messageHeader) putWire(b []byte) {
 	setInt32(b, 0, m.MessageLength)
 	setInt32(b, 4, m.RequestID)
 	setInt32(b, 8, m.ResponseTo)
 	setInt32(b, 12, int32(m.OpCode))
-	return b
 }
 
 // FromWire reads the wirebytes into this object
@@ -102,7 +129,10 @@ func (m *messageHeader) FromWire(b []byte) {
 }
 
 func (m *messageHeader) WriteTo(w io.Writer) error {
-	b := m.ToWire()
+	d := headerBuffers.Get().(*[headerLen]byte)
+	defer headerBuffers.Put(d)
+	b := d[:]
+	m.putWire(b)
 	n, err := w.Write(b)
 	if err != nil {
 		return err
@@ -125,28 +155,92 @@ func (m *messageHeader) String() string {
 	)
 }
 
+// readHeader reads a message header, rejecting message lengths that can't be
+// framed. If the reader fails or stalls part way through the header the error
+// is errShortHeader, as the stream can no longer be framed either.
 func readHeader(r io.Reader) (*messageHeader, error) {
-	var d [headerLen]byte
+	d := headerBuffers.Get().(*[headerLen]byte)
+	defer headerBuffers.Put(d)
 	b := d[:]
-	if _, err := io.ReadFull(r, b); err != nil {
+	if n, err := io.ReadFull(r, b); err != nil {
+		if n > 0 {
+			return nil, errShortHeader
+		}
 		return nil, err
 	}
 	h := messageHeader{}
 	h.FromWire(b)
+	if h.MessageLength < headerLen || h.MessageLength > maxMessageLength {
+		return nil, errInvalidMessageLength
+	}
 	return &h, nil
 }
 
-// copyMessage copies reads & writes an entire message.
+// headerBuffers holds the buffers headers are read and written through, as
+// they escape to the heap when passed to a reader or writer.
+var headerBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([headerLen]byte)
+	},
+}
+
+// CopyBufferSize is the size of the buffers messages are copied through
+// between clients and servers. Larger messages are copied in several passes. It
+// should be changed before any proxy is started.
+var CopyBufferSize = 32 * 1024
+
+// copyBuffers holds the buffers used by copyMessage, so that copying a message
+// doesn't allocate.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		size := CopyBufferSize
+		if size < headerLen {
+			size = headerLen
+		}
+		b := make([]byte, size)
+		return &b
+	},
+}
+
+// copyMessage copies reads & writes an entire message. The message is streamed
+// through a pooled buffer, the header going out along with the start of the
+// body.
 func copyMessage(w io.Writer, r io.Reader) error {
-	h, err := readHeader(r)
-	if err != nil {
+	bp := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(bp)
+	buf := *bp
+
+	if _, err := io.ReadFull(r, buf[:headerLen]); err != nil {
 		return err
 	}
-	if err := h.WriteTo(w); err != nil {
-		return err
+	length := getInt32(buf, 0)
+	if length < headerLen || length > maxMessageLength {
+		return errInvalidMessageLength
+	}
+
+	filled, remaining := headerLen, int(length-headerLen)
+	for {
+		n := len(buf) - filled
+		if n > remaining {
+			n = remaining
+		}
+		if _, err := io.ReadFull(r, buf[filled:filled+n]); err != nil {
+			return err
+		}
+		remaining -= n
+		filled += n
+		written, err := w.Write(buf[:filled])
+		if err != nil {
+			return err
+		}
+		if written != filled {
+			return errWrite
+		}
+		if remaining == 0 {
+			return nil
+		}
+		filled = 0
 	}
-	_, err = io.CopyN(w, r, int64(h.MessageLength-headerLen))
-	return err
 }
 
 // readDocument read an entire BSON document. This document can be used with
@@ -157,6 +251,9 @@ func readDocument(r io.Reader) ([]byte, error) {
 		return nil, err
 	}
 	size := getInt32(sizeRaw[:], 0)
+	if size < 5 || size > maxMessageLength {
+		return nil, errInvalidDocumentLength
+	}
 	doc := make([]byte, size)
 	setInt32(doc, 0, size)
 	if _, err := io.ReadFull(r, doc[4:]); err != nil {
@@ -214,6 +311,11 @@ func addInt32(b []byte, i int32) []byte {
 	return append(b, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
 }
 
+func addInt64(b []byte, i int64) []byte {
+	return append(b, byte(i), byte(i>>8), byte(i>>16), byte(i>>24),
+		byte(i>>32), byte(i>>40), byte(i>>48), byte(i>>56))
+}
+
 func addCString(b []byte, s string) []byte {
 	b = append(b, []byte(s)...)
 	b = append(b, 0)
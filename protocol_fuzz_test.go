@@ -0,0 +1,126 @@
+//go:build go1.18
+// +build go1.18
+
+package dvara
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func FuzzReadHeader(f *testing.F) {
+	f.Add(messageHeader{MessageLength: headerLen, OpCode: OpQuery}.ToWire())
+	f.Add(messageHeader{MessageLength: -1, OpCode: OpQuery}.ToWire())
+	f.Add(messageHeader{MessageLength: maxMessageLength, OpCode: OpInsert}.ToWire())
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, err := readHeader(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		if h.MessageLength < headerLen || h.MessageLength > maxMessageLength {
+			t.Fatalf("accepted invalid message length %d", h.MessageLength)
+		}
+		if !bytes.Equal(h.ToWire(), b[:headerLen]) {
+			t.Fatalf("header %s does not round trip", h)
+		}
+	})
+}
+
+func FuzzQueryCommand(f *testing.F) {
+	f.Add(queryBody(f, "admin.$cmd", bson.M{"isMaster": 1}))
+	f.Add(queryBody(f, "test.$cmd", bson.D{{Name: "find", Value: "foo"}, {Name: "filter", Value: bson.M{}}}))
+	f.Add(queryBody(f, "test.foo", bson.M{"a": 1}))
+	f.Add([]byte("\x00\x00\x00\x00a.$cmd\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05\x00\x00\x00\x00"))
+	f.Add(queryBody(f, "test.foo", bson.D{{Name: "$query", Value: bson.M{}}, {Name: "$maxTimeMS", Value: 100}}))
+	p := &Proxy{ReplicaSet: &ReplicaSet{MaxTimeMSGrace: time.Second}, isMasterCache: newIsMasterCache(time.Second)}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		collection, pos, ok := queryCollection(b)
+		if ok && (pos > len(b) || b[pos-1] != x00 || !strings.HasSuffix(string(b[4:pos-1]), "."+collection)) {
+			t.Fatalf("collection %q at %d is not framed in the body", collection, pos)
+		}
+		name, ok := defaultNamespaces.queryCommand(b)
+		if ok {
+			if collection != "$cmd" {
+				t.Fatalf("command %q found on collection %q", name, collection)
+			}
+			if strings.IndexByte(name, x00) >= 0 || !bytes.Contains(b[pos:], []byte(name+"\x00")) {
+				t.Fatalf("command %q is not framed in the body", name)
+			}
+		}
+		defaultNamespaces.isReadQuery(b)
+		p.messageTimeout(b)
+		if command, ok := p.cacheableIsMaster(b); ok && command != name {
+			t.Fatalf("cacheable %q is not the command %q", command, name)
+		}
+	})
+}
+
+// nextMessage is sent after the fuzzed one, it must never be read while
+// proxying the first.
+var nextMessage = messageHeader{MessageLength: headerLen, RequestID: 99, OpCode: OpQuery}.ToWire()
+
+func FuzzProxyQuery(f *testing.F) {
+	f.Add(queryBody(f, "admin.$cmd", bson.M{"isMaster": 1}))
+	f.Add(queryBody(f, "admin.$cmd", bson.M{"getLastError": 1}))
+	f.Add(queryBody(f, "admin.$cmd", bson.M{"replSetGetStatus": 1}))
+	f.Add(queryBody(f, "test.$cmd", bson.D{{Name: "insert", Value: "foo"}, {Name: "writeConcern", Value: bson.M{"w": 0}}}))
+	f.Add(queryBody(f, "test.foo", bson.M{"a": 1}))
+	f.Add([]byte("\x00\x00\x00\x00a.$cmd\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\x7f"))
+	mapper := fakeProxyMapper{m: map[string]string{"a": "1"}}
+	q := &ProxyQuery{
+		GetLastErrorRewriter:             &GetLastErrorRewriter{},
+		IsMasterResponseRewriter:         &IsMasterResponseRewriter{ProxyMapper: mapper, ReplyRW: &ReplyRW{}},
+		ReplSetGetStatusResponseRewriter: &ReplSetGetStatusResponseRewriter{ProxyMapper: mapper, ReplyRW: &ReplyRW{}},
+	}
+	r := &ReplicaSet{MinWriteConcern: 1, Compressors: []string{"zlib"}, InjectTraceComment: true}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		if len(body) > maxMessageLength-headerLen {
+			return
+		}
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+		client := &bufferConn{r: bytes.NewReader(append(append([]byte(nil), body...), nextMessage...))}
+		server := &bufferConn{r: bytes.NewReader(replyMessage(0, 0))}
+		var lastError LastError
+		err := q.Proxy(h, client, server, &lastError, r)
+
+		// Whatever happened, the next message was left alone.
+		if client.r.Len() < len(nextMessage) {
+			t.Fatalf("read %d bytes of the next message", len(nextMessage)-client.r.Len())
+		}
+		// And if it was proxied, the server got exactly the message its header
+		// claims.
+		if err == nil {
+			sent := server.w.Bytes()
+			if len(sent) < headerLen || int(getInt32(sent, 0)) != len(sent) {
+				t.Fatalf("sent a misframed message of %d bytes", len(sent))
+			}
+		}
+	})
+}
+
+func FuzzParseOpMsg(f *testing.F) {
+	f.Add(msgBody(f, 0, bulkInsert()...))
+	f.Add(msgBody(f, opMsgChecksumPresent, bulkInsert()...))
+	f.Add(msgBody(f, 0, msgSection{Documents: []interface{}{bson.M{"isMaster": 1}}}))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := parseOpMsg(b)
+		if err != nil {
+			return
+		}
+		if !bytes.Contains(b, m.Body) {
+			t.Fatal("body is not framed in the message")
+		}
+		for _, seq := range m.Sequences {
+			for _, doc := range seq.Documents {
+				if !bytes.Contains(b, doc) {
+					t.Fatalf("document in %q is not framed in the message", seq.Identifier)
+				}
+			}
+		}
+		msgCommand(b)
+	})
+}
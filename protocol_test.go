@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -35,6 +36,8 @@ func TestOpStrings(t *testing.T) {
 		{OpGetMore, "GET_MORE"},
 		{OpDelete, "DELETE"},
 		{OpKillCursors, "KILL_CURSORS"},
+		{OpCompressed, "COMPRESSED"},
+		{OpMsg, "MSG"},
 	}
 	for _, c := range cases {
 		if c.OpCode.String() != c.String {
@@ -43,6 +46,52 @@ func TestOpStrings(t *testing.T) {
 	}
 }
 
+func TestOpIsMutation(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		OpCode   OpCode
+		Mutation bool
+	}{
+		{OpReply, false},
+		{OpMessage, false},
+		{OpUpdate, true},
+		{OpInsert, true},
+		{Reserved, false},
+		{OpQuery, false},
+		{OpGetMore, false},
+		{OpDelete, true},
+		{OpKillCursors, false},
+		{OpCompressed, false},
+		{OpMsg, false},
+	}
+	for _, c := range cases {
+		if c.OpCode.IsMutation() != c.Mutation {
+			t.Fatalf("for code %s expected mutation %v", c.OpCode, c.Mutation)
+		}
+	}
+}
+
+func TestOpHasResponse(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		OpCode      OpCode
+		HasResponse bool
+	}{
+		{OpUpdate, false},
+		{OpInsert, false},
+		{OpQuery, true},
+		{OpGetMore, true},
+		{OpDelete, false},
+		{OpKillCursors, false},
+		{OpMsg, true},
+	}
+	for _, c := range cases {
+		if c.OpCode.HasResponse() != c.HasResponse {
+			t.Fatalf("for code %s expected has response %v", c.OpCode, c.HasResponse)
+		}
+	}
+}
+
 func TestMsgHeaderString(t *testing.T) {
 	t.Parallel()
 	m := &messageHeader{
@@ -58,7 +107,7 @@ func TestMsgHeaderString(t *testing.T) {
 
 func TestCopyEmptyMessage(t *testing.T) {
 	t.Parallel()
-	msg := messageHeader{}
+	msg := messageHeader{MessageLength: headerLen}
 	msgBytes := msg.ToWire()
 	r := bytes.NewReader(msgBytes)
 	var w bytes.Buffer
@@ -86,7 +135,7 @@ func TestCopyMessageFromReadError(t *testing.T) {
 
 func TestCopyMessageFromWriteError(t *testing.T) {
 	t.Parallel()
-	msg := messageHeader{}
+	msg := messageHeader{MessageLength: headerLen}
 	r := bytes.NewReader(msg.ToWire())
 	expectedErr := errors.New("foo")
 	w := testWriter{
@@ -101,7 +150,7 @@ func TestCopyMessageFromWriteError(t *testing.T) {
 
 func TestCopyMessageFromWriteLengthError(t *testing.T) {
 	t.Parallel()
-	msg := messageHeader{}
+	msg := messageHeader{MessageLength: headerLen}
 	r := bytes.NewReader(msg.ToWire())
 	w := testWriter{
 		write: func(b []byte) (int, error) {
@@ -113,6 +162,99 @@ func TestCopyMessageFromWriteLengthError(t *testing.T) {
 	}
 }
 
+func TestCopyMessageLargerThanBuffer(t *testing.T) {
+	t.Parallel()
+	body := make([]byte, CopyBufferSize*3+CopyBufferSize/2)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	h := messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpReply}
+	msg := append(h.ToWire(), body...)
+	var w bytes.Buffer
+	writes := 0
+	tw := testWriter{
+		write: func(b []byte) (int, error) {
+			if len(b) > CopyBufferSize {
+				t.Fatalf("write of %d bytes is larger than the buffer", len(b))
+			}
+			writes++
+			return w.Write(b)
+		},
+	}
+	if err := copyMessage(tw, bytes.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, w.Bytes()) {
+		t.Fatal("did not get the expected bytes")
+	}
+	if writes != 4 {
+		t.Fatalf("expected 4 writes, got %d", writes)
+	}
+}
+
+func TestCopyMessageInvalidLength(t *testing.T) {
+	t.Parallel()
+	msg := messageHeader{MessageLength: headerLen - 1, OpCode: OpReply}
+	var w bytes.Buffer
+	if err := copyMessage(&w, bytes.NewReader(msg.ToWire())); err != errInvalidMessageLength {
+		t.Fatalf("did not get expected error, instead got: %v", err)
+	}
+	if w.Len() != 0 {
+		t.Fatal("expected nothing to be written")
+	}
+}
+
+func benchmarkCopyMessageSize(b *testing.B, size int) {
+	h := messageHeader{MessageLength: int32(headerLen + size), OpCode: OpReply}
+	msg := append(h.ToWire(), make([]byte, size)...)
+	r := bytes.NewReader(msg)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(msg)
+		if err := copyMessage(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyMessageSmall(b *testing.B) {
+	benchmarkCopyMessageSize(b, 1024)
+}
+
+func BenchmarkCopyMessageLarge(b *testing.B) {
+	benchmarkCopyMessageSize(b, 4*CopyBufferSize)
+}
+
+func TestReadHeaderInvalidLength(t *testing.T) {
+	t.Parallel()
+	cases := []int32{-1, 0, headerLen - 1, maxMessageLength + 1, -2147483648}
+	for _, length := range cases {
+		msg := messageHeader{MessageLength: length, OpCode: OpQuery}
+		h, err := readHeader(bytes.NewReader(msg.ToWire()))
+		if err != errInvalidMessageLength {
+			t.Fatalf("for length %d did not get expected error, instead got: %v %v", length, err, h)
+		}
+	}
+}
+
+func TestReadHeaderShort(t *testing.T) {
+	t.Parallel()
+	msg := messageHeader{MessageLength: 100, OpCode: OpQuery}
+	r := io.MultiReader(bytes.NewReader(msg.ToWire()[:10]), testReader{
+		read: func(b []byte) (int, error) {
+			return 0, errors.New("i/o timeout")
+		},
+	})
+	if _, err := readHeader(r); err != errShortHeader {
+		t.Fatalf("did not get expected error, instead got: %v", err)
+	}
+	if _, err := readHeader(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatalf("did not get expected error, instead got: %v", err)
+	}
+}
+
 func TestReadDocumentEmpty(t *testing.T) {
 	t.Parallel()
 	doc, err := readDocument(bytes.NewReader([]byte{}))
@@ -146,6 +288,16 @@ func TestReadDocumentPartial(t *testing.T) {
 	}
 }
 
+func TestReadDocumentInvalidLength(t *testing.T) {
+	t.Parallel()
+	for _, size := range []int32{-1, 0, 4, maxMessageLength + 1} {
+		doc, err := readDocument(bytes.NewReader(addInt32(nil, size)))
+		if err != errInvalidDocumentLength {
+			t.Fatalf("did not find expected error for size %d, instead got %s %v", size, err, doc)
+		}
+	}
+}
+
 func TestReadCString(t *testing.T) {
 	t.Parallel()
 	cases := []struct {
@@ -1,26 +1,45 @@
 package dvara
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/facebookgo/clock"
 	"github.com/facebookgo/stats"
 	corelog "github.com/intercom/gocore/log"
 )
 
-const headerLen = 16
+const (
+	headerLen = 16
+
+	// defaultServerConnectJitter is used when ReplicaSet.ServerConnectJitter is
+	// not set.
+	defaultServerConnectJitter = 0.5
+
+	// serverConnectTimeout bounds each attempt at connecting to a server.
+	serverConnectTimeout = time.Second
+
+	// slowAuthThreshold is the time above which authenticating a server
+	// connection is logged.
+	slowAuthThreshold = 500 * time.Millisecond
+)
 
 var (
-	errZeroMaxConnections          = errors.New("dvara: MaxConnections cannot be 0")
-	errZeroMaxPerClientConnections = errors.New("dvara: MaxPerClientConnections cannot be 0")
-	errNormalClose                 = errors.New("dvara: normal close")
-	errClientReadTimeout           = errors.New("dvara: client read timeout")
+	errNilClientListener = errors.New("dvara: ClientListener cannot be nil")
+	errNormalClose       = errors.New("dvara: normal close")
+	errClientReadTimeout = errors.New("dvara: client read timeout")
+
+	errClientHandshakeTimeout = errors.New("dvara: client handshake timeout")
 
 	timeInPast = time.Now()
 )
@@ -31,14 +50,67 @@ type Proxy struct {
 	ClientListener net.Listener // Listener for incoming client connections
 	Username       string       // Mongo user, if mongo uses auth
 	Password       string       // Mongo password, if mongo uses auth
+	AuthSource     string       // Database the Mongo user is defined in, "admin" if empty
 	ProxyAddr      string       // Address for incoming client connections
 	MongoAddr      string       // Address for destination Mongo server
 
+	// ExtraListeners are additional listeners for clients, each with its own
+	// policy. They share the server connection pool and are closed on Stop.
+	ExtraListeners []PolicyListener
+
+	// ServerDialer if set is used to open connections to mongo servers, for
+	// example to go through a SOCKS proxy or a service mesh sidecar. It defaults
+	// to a net.Dialer. The context carries the connect timeout. Retries and
+	// authentication apply to the connections it returns as usual.
+	ServerDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Events if set receives an Event as clients connect and disconnect and as
+	// their messages are proxied, for integrating with external systems. It
+	// should be buffered, events are dropped when it is full. It must not be
+	// closed before the proxy is stopped.
+	Events chan<- Event
+
+	// Clock allows for testing timing related functionality. Do not specify this
+	// in production code.
+	Clock clock.Clock
+
 	wg                      sync.WaitGroup
 	closed                  chan struct{}
-	serverPool              Pool
+	stopMutex               sync.Mutex
+	credentialsMutex        sync.RWMutex
+	serverPool              ConnPool
 	stats                   stats.Client
 	maxPerClientConnections *maxPerClientConnections
+	liveTimeouts            atomic.Value // proxyTimeouts
+	backendPoolsMutex       sync.Mutex
+	backendPools            map[string]ConnPool
+	shadowSlots             chan struct{}
+	shadowWG                sync.WaitGroup
+	acquiring               int64 // atomic, number of server connections being acquired
+	poolGeneration          int64 // atomic, see FlushServerPool
+	lastRequestID           int32 // atomic, the last request ID sent to a server
+	byteRateLimiter         *byteRateLimiter
+	clients                 clientRegistry
+	isMasterCache           *isMasterCache
+	listeners               []*clientListener
+	transactions            transactionAffinity
+	cursorOwners            cursorOwners
+	allowedOpCodes          map[OpCode]bool
+	messageChain            MessageHandler
+	requestLog              *requestLogger
+	serverConnErrors        serverConnErrors
+	drainingMutex           sync.RWMutex
+	draining                map[string]bool
+	databasePools           map[string]ConnPool
+	peaks                   connPeaks
+	unknownOpCodes          unknownOpCodes
+	authFailures            uint32 // atomic, server connections failing to authenticate in a row
+	retryableErrors         uint32 // atomic, replies with retryable errors in a row
+	quiesced                bool   // guarded by stopMutex
+	stopped                 bool   // guarded by stopMutex, once Stop is done
+
+	// random allows for testing the retry backoff jitter.
+	random func() float64
 }
 
 // String representation for debugging.
@@ -46,65 +118,260 @@ func (p *Proxy) String() string {
 	return fmt.Sprintf("proxy %s => mongo %s", p.ProxyAddr, p.MongoAddr)
 }
 
-// Start the proxy.
+// Addr returns the address the proxy listens on for clients. Unlike ProxyAddr
+// it is the actual address, with the port assigned by the OS if the listener
+// was bound to port 0.
+func (p *Proxy) Addr() net.Addr {
+	return p.ClientListener.Addr()
+}
+
+// Listen creates the ClientListener on the ProxyAddr, with the ReusePort,
+// ReuseAddr and ListenBacklog settings of the ReplicaSet. It is an alternative
+// to handing the proxy a listener, and must be called before Start.
+func (p *Proxy) Listen() error {
+	l, err := p.ReplicaSet.listen(p.ProxyAddr)
+	if err != nil {
+		return err
+	}
+	p.ClientListener = l
+	return nil
+}
+
+// Start the proxy. If the ReplicaSet settings are invalid the error is
+// ConfigErrors listing all of them.
 func (p *Proxy) Start() error {
-	if p.ReplicaSet.MaxConnections == 0 {
-		return errZeroMaxConnections
+	if err := p.ReplicaSet.validate().err(); err != nil {
+		return err
+	}
+	if p.ClientListener == nil {
+		return errNilClientListener
 	}
-	if p.ReplicaSet.MaxPerClientConnections == 0 {
-		return errZeroMaxPerClientConnections
+	for _, l := range p.ExtraListeners {
+		if l.Listener == nil {
+			return errNilClientListener
+		}
 	}
 
+	if p.Clock == nil {
+		p.Clock = clock.New()
+	}
+	p.stopMutex.Lock()
 	p.closed = make(chan struct{})
+	p.stopped = false
+	p.stopMutex.Unlock()
+	p.peaks.since.Store(p.Clock.Now())
+	p.liveTimeouts.Store(newProxyTimeouts(p.ReplicaSet))
 	p.maxPerClientConnections = newMaxPerClientConnections(p.ReplicaSet.MaxPerClientConnections)
-	p.serverPool = Pool{
-		New:               p.newServerConn,
-		CloseErrorHandler: p.serverCloseErrorHandler,
-		Max:               p.ReplicaSet.MaxConnections,
-		MinIdle:           p.ReplicaSet.MinIdleConnections,
-		IdleTimeout:       p.ReplicaSet.ServerIdleTimeout,
-		ClosePoolSize:     p.ReplicaSet.ServerClosePoolSize,
+	p.maxPerClientConnections.overrides = p.ReplicaSet.clientConnectionLimits()
+	p.startListeners()
+	p.allowedOpCodes = newAllowedOpCodes(p.ReplicaSet.AllowedOpCodes)
+	p.messageChain = p.newMessageChain()
+	p.requestLog = newRequestLogger(p.ReplicaSet)
+	p.serverPool = p.newPool(p.MongoAddr, p.newServerConn)
+	p.startDatabasePools()
+	if p.ReplicaSet.ShadowMongoAddr != "" {
+		p.shadowSlots = make(chan struct{}, p.ReplicaSet.MaxConnections)
+	}
+	if p.ReplicaSet.CacheIsMaster > 0 {
+		p.isMasterCache = newIsMasterCache(p.ReplicaSet.CacheIsMaster)
+	}
+	if rates := p.ReplicaSet.clientByteRates(); p.ReplicaSet.MaxBytesPerSecondPerClient > 0 || len(rates) > 0 {
+		p.byteRateLimiter = newByteRateLimiter(p.ReplicaSet.MaxBytesPerSecondPerClient)
+		p.byteRateLimiter.rates = rates
 	}
 
 	// plug stats if we can
 	if p.ReplicaSet.Stats != nil {
-		p.serverPool.Stats = stats.PrefixClient(
-			[]string{"mongoproxy.server.pool."},
-			p.ReplicaSet.Stats,
-		)
 		p.stats = stats.PrefixClient(
 			[]string{"mongoproxy."},
 			p.ReplicaSet.Stats,
 		)
 	}
 
-	go p.clientAcceptLoop()
+	if p.ReplicaSet.ValidateOnStart {
+		c, err := p.serverPool.Acquire()
+		if err != nil {
+			p.serverPool.Close()
+			return err
+		}
+		p.serverPool.Release(c)
+	}
+	p.warmServerPool()
+	p.wg.Add(1)
+	go p.reclaimTransactions()
+
+	for _, l := range p.listeners {
+		for i := 0; i < p.ReplicaSet.acceptGoroutines(); i++ {
+			go p.clientAcceptLoop(l)
+		}
+	}
+
+	return nil
+}
 
+// Reconfigure applies new limits to a running proxy without dropping any
+// connections. The settings that can be changed live are MaxConnections,
+// MaxPerClientConnections, ClientIdleTimeout, GetLastErrorTimeout and
+// MessageTimeout. Timeouts apply from the next message on. Lowering the
+// connection limits does not close connections in use, they are closed as
+// they are released. Other settings, such as ServerIdleTimeout,
+// MinIdleConnections or the listening ports, require a restart. Invalid
+// settings are returned as ConfigErrors and none are applied.
+func (p *Proxy) Reconfigure(r *ReplicaSet) error {
+	if err := r.validateLive().err(); err != nil {
+		return err
+	}
+	p.eachPool(func(addr string, pool ConnPool) {
+		if p.isDatabasePool(pool) {
+			return
+		}
+		if l, ok := p.ReplicaSet.BackendLimits[addr]; !ok || l.MaxConnections == 0 {
+			pool.SetMax(r.MaxConnections)
+		}
+	})
+	p.maxPerClientConnections.setMax(r.MaxPerClientConnections)
+	p.liveTimeouts.Store(newProxyTimeouts(r))
+	stats.BumpSum(p.stats, "reconfigured", 1)
 	return nil
 }
 
-// Stop the proxy.
+// proxyTimeouts are the timeouts which can be changed by Reconfigure.
+type proxyTimeouts struct {
+	ClientIdle   time.Duration
+	GetLastError time.Duration
+	Message      time.Duration
+}
+
+func newProxyTimeouts(r *ReplicaSet) proxyTimeouts {
+	return proxyTimeouts{
+		ClientIdle:   r.ClientIdleTimeout,
+		GetLastError: r.GetLastErrorTimeout,
+		Message:      r.MessageTimeout,
+	}
+}
+
+// timeouts returns the current timeouts.
+func (p *Proxy) timeouts() proxyTimeouts {
+	if t, ok := p.liveTimeouts.Load().(proxyTimeouts); ok {
+		return t
+	}
+	return newProxyTimeouts(p.ReplicaSet)
+}
+
+// messageTimeout returns the timeout for proxying a message. Commands listed in
+// CommandTimeouts get their own timeout, and so do plain queries if "find" is
+// listed, as they are the legacy form of the find command. Anything else uses
+// the MessageTimeout. Either is capped by the maxTimeMS of the message, see
+// MaxTimeMSGrace.
+func (p *Proxy) messageTimeout(query []byte) time.Duration {
+	return p.capToMaxTime(p.commandTimeout(query), query)
+}
+
+// commandTimeout returns the CommandTimeouts or MessageTimeout for a message.
+func (p *Proxy) commandTimeout(query []byte) time.Duration {
+	if len(p.ReplicaSet.CommandTimeouts) == 0 || query == nil {
+		return p.timeouts().Message
+	}
+	name, ok := p.ReplicaSet.namespaces().operationName(query)
+	if timeout, found := p.ReplicaSet.CommandTimeouts[name]; ok && found {
+		return timeout
+	}
+	return p.timeouts().Message
+}
+
+// Stop the proxy. Stopping a proxy which was not started, or which is already
+// stopped, does nothing.
 func (p *Proxy) Stop() error {
 	return p.stop(false)
 }
 
 func (p *Proxy) stop(hard bool) error {
-	if err := p.ClientListener.Close(); err != nil {
-		return err
+	p.stopMutex.Lock()
+	if p.closed == nil || isClosed(p.closed) {
+		p.stopMutex.Unlock()
+		return nil
 	}
 	close(p.closed)
+	p.stopMutex.Unlock()
+
+	for _, l := range p.listeners {
+		if err := l.Close(); err != nil && !isClosedConnError(err) {
+			return err
+		}
+	}
 	if !hard {
 		p.wg.Wait()
 	}
-	p.serverPool.Close()
+	p.shadowWG.Wait()
+	// Transactions left open by their clients don't hold up closing the pools.
+	for _, c := range p.transactions.releaseAll() {
+		p.returnServerConn(c)
+	}
+	p.eachPool(func(addr string, pool ConnPool) {
+		pool.Close()
+	})
+	p.stopMutex.Lock()
+	p.stopped = true
+	p.stopMutex.Unlock()
 	return nil
 }
 
+// UpdateCredentials swaps the credentials used to authenticate future server
+// connections. Connections already in the pool keep working until they are
+// retired, unless recycleIdle is set in which case idle ones are closed right
+// away so they get re-established with the new credentials.
+func (p *Proxy) UpdateCredentials(username, password string, recycleIdle bool) {
+	p.credentialsMutex.Lock()
+	p.Username = username
+	p.Password = password
+	p.credentialsMutex.Unlock()
+	p.authSucceeded()
+
+	stats.BumpSum(p.stats, "credentials.reload", 1)
+	corelog.LogInfoMessage(fmt.Sprintf("reloaded credentials for %s", p))
+	if recycleIdle {
+		p.eachPool(func(addr string, pool ConnPool) {
+			pool.CloseIdle()
+		})
+	}
+}
+
+func (p *Proxy) credentials() (string, string) {
+	p.credentialsMutex.RLock()
+	defer p.credentialsMutex.RUnlock()
+	return p.Username, p.Password
+}
+
+// clock returns the Clock, or the real one if the proxy was not started yet
+// and has none, for the exported methods which may be called before Start.
+func (p *Proxy) clock() clock.Clock {
+	if p.Clock == nil {
+		return clock.New()
+	}
+	return p.Clock
+}
+
+// AuthConn authenticates the server connection with the proxy credentials.
+// The time it takes is recorded as server.auth.time, and logged if slow.
 func (p *Proxy) AuthConn(conn net.Conn) error {
 	socket := &mongoSocket{
 		conn: conn,
 	}
-	err := socket.Login(Credential{Username: p.Username, Password: p.Password, Source: "admin"})
+	username, password := p.credentials()
+	source := p.AuthSource
+	if source == "" {
+		source = defaultAuthSource
+	}
+	klock := p.clock()
+	start := klock.Now()
+	authTime := stats.BumpTime(p.stats, "server.auth.time")
+	err := socket.Login(Credential{Username: username, Password: password, Source: source})
+	authTime.End()
+	if elapsed := klock.Now().Sub(start); elapsed > slowAuthThreshold {
+		stats.BumpSum(p.stats, "server.auth.slow", 1)
+		corelog.LogInfoMessage("slow server authentication",
+			"backend", backendAddr(conn), "duration", elapsed.String(), "failed", err != nil)
+	}
 	if err != nil {
 		return err
 	}
@@ -113,57 +380,379 @@ func (p *Proxy) AuthConn(conn net.Conn) error {
 
 // Open up a new connection to the server. Retry 7 times, doubling the sleep
 // each time. This means we'll a total of 12.75 seconds with the last wait
-// being 6.4 seconds.
+// being 6.4 seconds. Each sleep is randomized by ServerConnectJitter so that
+// proxies don't all retry in lockstep against a recovering server.
 func (p *Proxy) newServerConn() (io.Closer, error) {
+	random := p.random
+	if random == nil {
+		random = rand.Float64
+	}
+	jitterFactor := p.ReplicaSet.ServerConnectJitter
+	if jitterFactor == 0 {
+		jitterFactor = defaultServerConnectJitter
+	}
+
+	var lastErr error
 	retrySleep := 50 * time.Millisecond
 	for retryCount := 7; retryCount > 0; retryCount-- {
-		c, err := net.DialTimeout("tcp", p.MongoAddr, time.Second)
+		c, err := p.dial(p.MongoAddr)
 		if err == nil {
-			if len(p.Username) == 0 {
-				return c, nil
+			sc := &serverConn{
+				Conn:       p.bufferConn(c),
+				backend:    p.MongoAddr,
+				lifetime:   stats.BumpTime(p.stats, "server.connection.lifetime"),
+				expires:    p.serverConnExpiry(),
+				generation: atomic.LoadInt64(&p.poolGeneration),
+			}
+			if username, _ := p.credentials(); len(username) == 0 {
+				p.serverConnOpened(sc)
+				return sc, nil
 			}
 			err = p.AuthConn(c)
 			if err == nil {
-				return c, nil
+				p.authSucceeded()
+				p.serverConnOpened(sc)
+				return sc, nil
 			}
+			c.Close()
+			p.authFailed()
 		}
 		corelog.LogError("error", err)
+		p.recordServerConnError(p.MongoAddr, err)
+		lastErr = err
 
-		time.Sleep(retrySleep)
+		p.Clock.Sleep(jitter(retrySleep, jitterFactor, random()))
 		retrySleep = retrySleep * 2
 	}
-	return nil, fmt.Errorf("could not connect to %s", p.MongoAddr)
+	return nil, fmt.Errorf("could not connect to %s: %s", p.MongoAddr, lastErr)
+}
+
+// dial opens a connection to a mongo server with the ServerDialer.
+func (p *Proxy) dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverConnectTimeout)
+	defer cancel()
+	if p.ServerDialer != nil {
+		c, err := p.ServerDialer(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		p.setNoDelay(c)
+		return c, nil
+	}
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p.setNoDelay(c)
+	return c, nil
+}
+
+// dialServerConn opens a single connection to the given mongo server,
+// authenticating it if needed. The connection is returned to the given pool,
+// or to the server pool if nil.
+func (p *Proxy) dialServerConn(addr string, pool ConnPool) (io.Closer, error) {
+	c, err := p.dial(addr)
+	if err != nil {
+		p.recordServerConnError(addr, err)
+		return nil, err
+	}
+	if username, _ := p.credentials(); len(username) != 0 {
+		if err := p.AuthConn(c); err != nil {
+			c.Close()
+			p.authFailed()
+			p.recordServerConnError(addr, err)
+			return nil, err
+		}
+		p.authSucceeded()
+	}
+	sc := &serverConn{
+		Conn:       p.bufferConn(c),
+		backend:    addr,
+		pool:       pool,
+		lifetime:   stats.BumpTime(p.stats, "server.connection.lifetime"),
+		expires:    p.serverConnExpiry(),
+		generation: atomic.LoadInt64(&p.poolGeneration),
+	}
+	p.serverConnOpened(sc)
+	return sc, nil
+}
+
+// setNoDelay applies the TCPNoDelay setting to connections which are TCP ones,
+// custom dialers may return others.
+func (p *Proxy) setNoDelay(c net.Conn) {
+	if conn, ok := c.(*net.TCPConn); ok {
+		conn.SetNoDelay(p.ReplicaSet.tcpNoDelay())
+	}
+}
+
+// jitter spreads d by up to +/- factor of its value, using r in [0, 1) as the
+// source of randomness. A factor <= 0 disables jitter.
+func jitter(d time.Duration, factor float64, r float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+	if factor > 1 {
+		factor = 1
+	}
+	return d + time.Duration(float64(d)*factor*(2*r-1))
 }
 
-// getServerConn gets a server connection from the pool.
-func (p *Proxy) getServerConn() (net.Conn, error) {
-	c, err := p.serverPool.Acquire()
+// serverConn is a connection to a mongo server, which remembers the backend
+// address it was established to and the pool it belongs to.
+type serverConn struct {
+	net.Conn
+	backend  string
+	pool     ConnPool
+	lifetime interface {
+		End()
+	}
+
+	// stale is set once the server was found to no longer be primary, so the
+	// connection is discarded instead of going back to the pool.
+	stale bool
+
+	// written counts the bytes written to the server, and reset is set once it
+	// reset the connection, see proxyRetryingReset.
+	written int64
+	reset   bool
+
+	// sent and received follow the messages on the connection, so it can be
+	// brought back in step after a timeout, see resetTimedOut.
+	sent     messageFraming
+	received messageFraming
+
+	// peak counts the open server connections, see serverConnOpened.
+	peak *highWaterMark
+
+	// expires is when the connection is recycled for its age, see
+	// MaxServerConnectionAge.
+	expires time.Time
+
+	// generation is the number of times the pools were flushed when the
+	// connection was opened, see FlushServerPool.
+	generation int64
+}
+
+func (s *serverConn) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+	s.received.observe(b[:n])
+	if err != nil && isConnReset(err) {
+		s.reset = true
+	}
+	return n, err
+}
+
+func (s *serverConn) Write(b []byte) (int, error) {
+	n, err := s.Conn.Write(b)
+	s.written += int64(n)
+	s.sent.observe(b[:n])
+	if err != nil && isConnReset(err) {
+		s.reset = true
+	}
+	return n, err
+}
+
+// Close closes the connection and records how long it was alive.
+func (s *serverConn) Close() error {
+	if s.lifetime != nil {
+		s.lifetime.End()
+	}
+	if s.peak != nil {
+		s.peak.dec()
+	}
+	return s.Conn.Close()
+}
+
+// countingConn counts the bytes read from and written to the connection.
+type countingConn struct {
+	net.Conn
+	in  int64 // atomic
+	out int64 // atomic
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.in, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.out, int64(n))
+	return n, err
+}
+
+// counts returns the number of bytes read and written so far.
+func (c *countingConn) counts() (int64, int64) {
+	return atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out)
+}
+
+// bufferedConn buffers reads from the underlying connection, so that reading a
+// header and then the body of a message doesn't each take a syscall. Deadlines
+// still apply since the buffer is filled by reading from the connection. Client
+// connections use a pooledBufferConn instead.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// bufferConn wraps the connection in a bufferedConn if ReadBufferSize is set.
+func (p *Proxy) bufferConn(c net.Conn) net.Conn {
+	if p.ReplicaSet.ReadBufferSize <= 0 {
+		return c
+	}
+	return &bufferedConn{Conn: c, reader: bufio.NewReaderSize(c, p.ReplicaSet.ReadBufferSize)}
+}
+
+// unreadBytes returns the number of bytes read from a server connection but not
+// consumed yet.
+func unreadBytes(c net.Conn) int {
+	if sc, ok := c.(*serverConn); ok {
+		c = sc.Conn
+	}
+	if bc, ok := c.(*bufferedConn); ok {
+		return bc.reader.Buffered()
+	}
+	return 0
+}
+
+// backendAddr returns the address of the mongo server the connection talks
+// to.
+func backendAddr(c net.Conn) string {
+	if sc, ok := c.(*serverConn); ok {
+		return sc.backend
+	}
+	if addr := c.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return "unknown"
+}
+
+// poolFor returns the pool the server connection belongs to.
+func (p *Proxy) poolFor(c net.Conn) ConnPool {
+	if sc, ok := c.(*serverConn); ok && sc.pool != nil {
+		return sc.pool
+	}
+	return p.serverPool
+}
+
+// getServerConn gets a connection to the given backend from its pool.
+func (p *Proxy) getServerConn(addr string) (net.Conn, error) {
+	if p.isDraining(addr) {
+		return nil, errBackendDraining
+	}
+	return p.acquire(p.backendPool(addr))
+}
+
+// acquire gets a connection from the pool, counting it as being acquired
+// meanwhile.
+func (p *Proxy) acquire(pool ConnPool) (net.Conn, error) {
+	atomic.AddInt64(&p.acquiring, 1)
+	c, err := pool.Acquire()
+	atomic.AddInt64(&p.acquiring, -1)
 	if err != nil {
 		return nil, err
 	}
 	return c.(net.Conn), nil
 }
 
+// idleAcquirer is a ConnPool which can hand out an idle connection without
+// waiting for one or opening one, like Pool.
+type idleAcquirer interface {
+	TryAcquire() (io.Closer, bool)
+}
+
+// tryAcquire gets an idle connection to the backend from the pool, without
+// waiting for one or opening one, counting it as being acquired meanwhile. It
+// returns nil if there is none, the backend is being drained or the pool can't
+// tell.
+func (p *Proxy) tryAcquire(pool ConnPool, backend string) net.Conn {
+	idle, ok := pool.(idleAcquirer)
+	if !ok || p.isDraining(backend) {
+		return nil
+	}
+	atomic.AddInt64(&p.acquiring, 1)
+	c, ok := idle.TryAcquire()
+	atomic.AddInt64(&p.acquiring, -1)
+	if !ok {
+		return nil
+	}
+	return c.(net.Conn)
+}
+
+// ServerPoolStats returns the current state of the server connection pool.
+func (p *Proxy) ServerPoolStats() PoolStats {
+	return p.serverPool.Snapshot()
+}
+
 func (p *Proxy) serverCloseErrorHandler(err error) {
 	corelog.LogError("error", err)
 }
 
 // proxyMessage proxies a message, possibly it's response, and possibly a
-// follow up call.
+// follow up call. The query is the body of the message if it was read ahead,
+// see readQueryBody.
 func (p *Proxy) proxyMessage(
 	h *messageHeader,
+	query []byte,
 	client net.Conn,
 	server net.Conn,
 	lastError *LastError,
-) error {
-	deadline := time.Now().Add(p.ReplicaSet.MessageTimeout)
+) (err error) {
+	deadline := p.Clock.Now().Add(p.messageTimeout(query))
 	server.SetDeadline(deadline)
 	client.SetDeadline(deadline)
 
+	// The flagBits of an OP_MSG tell if the server responds to it.
+	hasResponse := h.OpCode.HasResponse()
+	if h.OpCode == OpMsg {
+		if client, hasResponse, err = readMsgFlags(h, client); err != nil {
+			return err
+		}
+	}
+
+	// Replies are checked for errors showing the server stepped down or is in
+	// trouble, and kept if they can be cached. If the message deadline passes
+	// while waiting for the server, the client is sent an error in place of the
+	// response.
+	var inspector *replyInspector
+	var timer *responseTimer
+	if hasResponse {
+		inspector = &replyInspector{Conn: client}
+		client = inspector
+		defer func() {
+			if err != nil {
+				if isTimeout(err) && timer.readingResponse() {
+					p.replyTimedOut(h, inspector)
+				}
+				return
+			}
+			doc := inspector.errorDocument(p.ReplicaSet.namespaces())
+			if isTimeLimitReply(doc) {
+				stats.BumpSum(p.stats, "message.server.timeout", 1)
+			}
+			if retired := p.checkReplyError(server, doc); !retired && query != nil {
+				p.cacheIsMaster(query, doc)
+			}
+		}()
+	}
+
+	var upstream io.ReadWriter = server
+	if hasResponse {
+		timer = &responseTimer{ReadWriter: server, stats: p.stats}
+		upstream = timer
+	}
+	upstream = p.upstreamConn(h, upstream)
+
 	// OpQuery may need to be transformed and need special handling in order to
 	// make the proxy transparent.
 	if h.OpCode == OpQuery {
-		return p.ReplicaSet.ProxyQuery.Proxy(h, client, server, lastError)
+		return p.ReplicaSet.ProxyQuery.Proxy(h, client, upstream, lastError, p.ReplicaSet)
 	}
 
 	// Anything besides a getlasterror call (which requires an OpQuery) resets
@@ -174,19 +763,26 @@ func (p *Proxy) proxyMessage(
 	}
 
 	// For other Ops we proxy the header & raw body over.
-	if err := h.WriteTo(server); err != nil {
+	if err := h.WriteTo(upstream); err != nil {
 		corelog.LogError("error", err)
 		return err
 	}
 
-	if _, err := io.CopyN(server, client, int64(h.MessageLength-headerLen)); err != nil {
+	if _, err := io.CopyN(upstream, client, int64(h.MessageLength-headerLen)); err != nil {
 		corelog.LogError("error", err)
 		return err
 	}
 
 	// For Ops with responses we proxy the raw response message over.
-	if h.OpCode.HasResponse() {
-		if err := copyMessage(client, server); err != nil {
+	switch {
+	case !hasResponse:
+	case h.OpCode == OpMsg:
+		if err := copyMsgReplies(client, upstream); err != nil {
+			corelog.LogError("error", err)
+			return err
+		}
+	default:
+		if err := copyMessage(client, upstream); err != nil {
 			corelog.LogError("error", err)
 			return err
 		}
@@ -195,90 +791,294 @@ func (p *Proxy) proxyMessage(
 	return nil
 }
 
+// responseTimer records how long the server takes to respond to a message as
+// server.response.time, from the first byte written to it to the first byte of
+// its response. Unlike message.proxy.time it leaves out the time spent reading
+// from and writing to the client.
+type responseTimer struct {
+	io.ReadWriter
+	stats stats.Client
+	timer interface {
+		End()
+	}
+	done    bool
+	reading bool
+}
+
+func (r *responseTimer) Write(b []byte) (int, error) {
+	r.reading = false
+	if r.timer == nil {
+		r.timer = stats.BumpTime(r.stats, "server.response.time")
+	}
+	return r.ReadWriter.Write(b)
+}
+
+func (r *responseTimer) Read(b []byte) (int, error) {
+	r.reading = true
+	n, err := r.ReadWriter.Read(b)
+	if n > 0 && r.timer != nil && !r.done {
+		r.done = true
+		r.timer.End()
+	}
+	return n, err
+}
+
+// readingResponse returns true if the message was sent and the server's
+// response is being read.
+func (r *responseTimer) readingResponse() bool {
+	return r.reading
+}
+
 // clientAcceptLoop accepts new clients and creates a clientServeLoop for each
-// new client that connects to the proxy.
-func (p *Proxy) clientAcceptLoop() {
+// new client that connects to the proxy. There are AcceptGoroutines of them
+// per listener, each holding at most one count in wg while it waits on Accept.
+func (p *Proxy) clientAcceptLoop(l *clientListener) {
 	for {
 		p.wg.Add(1)
-		c, err := p.ClientListener.Accept()
+		c, err := l.Accept()
 		if err != nil {
 			p.wg.Done()
-			if strings.Contains(err.Error(), "use of closed network connection") {
+			if isClosedConnError(err) {
 				break
 			}
 			corelog.LogError("error", err)
 			continue
 		}
-		go p.clientServeLoop(c)
+		if !p.applyBackpressure(c) {
+			continue
+		}
+		go p.clientServeLoop(c, l)
 	}
 }
 
 // clientServeLoop loops on a single client connected to the proxy and
-// dispatches its requests.
-func (p *Proxy) clientServeLoop(c net.Conn) {
+// dispatches its requests. They are proxied one at a time, in order, see the
+// package documentation about pipelining.
+func (p *Proxy) clientServeLoop(c net.Conn, l *clientListener) {
 	remoteIP := c.RemoteAddr().(*net.TCPAddr).IP.String()
 
 	// enforce per-client max connection limit
-	if p.maxPerClientConnections.inc(remoteIP) {
-		c.Close()
+	if l.maxPerClientConnections.inc(remoteIP) {
+		defer p.wg.Done()
 		stats.BumpSum(p.stats, "client.rejected.max.connections", 1)
 		corelog.LogErrorMessage(fmt.Sprintf("rejecting client connection due to max connections limit: %s", remoteIP))
+		p.rejectClient(c, ErrorCodeMaxPerClientConnections,
+			fmt.Sprintf("dvara: too many connections from %s", remoteIP))
 		return
 	}
 
-	// turn on TCP keep-alive and set it to the recommended period of 2 minutes
-	// http://docs.mongodb.org/manual/faq/diagnostics/#faq-keepalive
+	// turn on TCP keep-alive, by default with the recommended period of 2
+	// minutes http://docs.mongodb.org/manual/faq/diagnostics/#faq-keepalive
 	if conn, ok := c.(*net.TCPConn); ok {
-		conn.SetKeepAlivePeriod(2 * time.Minute)
-		conn.SetKeepAlive(true)
+		if period := p.ReplicaSet.clientKeepAlive(); period > 0 {
+			conn.SetKeepAlivePeriod(period)
+			conn.SetKeepAlive(true)
+		} else {
+			conn.SetKeepAlive(false)
+		}
 	}
+	p.setNoDelay(c)
 
-	c = teeIf(fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
+	c = p.teeIf(fmt.Sprintf("client %s <=> %s", c.RemoteAddr(), p), c)
+	counter := &countingConn{Conn: c}
+	throttled, unthrottle := p.throttleIf(counter, remoteIP)
+	defer unthrottle()
+	c = p.captureIf(newCompressedConn(p.bufferClientConn(throttled)))
 	stats.BumpSum(p.stats, "client.connected", 1)
+	lifetime := stats.BumpTime(p.stats, "client.connection.lifetime")
+	connected := p.Clock.Now()
+	if p.ReplicaSet.OnClientConnect != nil {
+		p.ReplicaSet.OnClientConnect(remoteIP)
+	}
+	p.emit(ClientConnected{Time: connected, Proxy: p.ProxyAddr, RemoteIP: remoteIP})
+	tracked := p.trackClient(c, remoteIP, counter, connected)
+	uncount := p.countClient()
+	defer uncount()
+	reason := disconnectNormal
+	var reasonErr error
 	defer func() {
+		p.clients.remove(tracked)
+		if tracked.closedByAdmin() {
+			reason = disconnectAdmin
+		}
+		p.clientDisconnected(remoteIP, reason, reasonErr)
+		lifetime.End()
+		now := p.Clock.Now()
+		disconnected := ClientDisconnected{
+			Time:     now,
+			Proxy:    p.ProxyAddr,
+			RemoteIP: remoteIP,
+			Reason:   reason,
+			Duration: now.Sub(connected),
+		}
+		if reason != disconnectNormal {
+			disconnected.Err = reasonErr
+		}
+		p.emit(disconnected)
+		if p.ReplicaSet.OnClientDisconnect != nil {
+			in, out := counter.counts()
+			p.ReplicaSet.OnClientDisconnect(remoteIP, p.Clock.Now().Sub(connected), in, out)
+		}
 		p.wg.Done()
 		if err := c.Close(); err != nil {
 			corelog.LogError("error", err)
 		}
-		p.maxPerClientConnections.dec(remoteIP)
+		l.maxPerClientConnections.dec(remoteIP)
+	}()
+
+	// Connections pinned by open cursors are still good, so they go back to the
+	// pool when the client goes away.
+	cursors := newCursorAffinity(&p.cursorOwners)
+	defer func() {
+		cursors.releaseAll()
+		for _, serverConn := range cursors.conns() {
+			p.returnServerConn(serverConn)
+		}
 	}()
 
 	var lastError LastError
+	var shadowMsg, query []byte
+	clientReadHeader := p.handshakeClientReadHeader
 	for {
-		h, err := p.idleClientReadHeader(c)
+		tracked.setState(ClientStateIdle, "")
+		h, err := clientReadHeader(c)
 		if err != nil {
-			if err != errNormalClose {
-				corelog.LogError("error", err)
-			}
+			reason, reasonErr = p.readDisconnectReason(err), err
 			return
 		}
+		clientReadHeader = p.idleClientReadHeader
+		p.countOpCode(h, remoteIP)
 
 		mpt := stats.BumpTime(p.stats, "message.proxy.time")
-		serverConn, err := p.getServerConn()
+		client, err := p.rewriteNamespace(h, c)
+		var cursorIDs []int64
+		if err == nil {
+			client, cursorIDs, err = readCursorIDs(h, client, p.ReplicaSet.namespaces())
+		}
+		if err == nil {
+			client, query, err = p.readQueryBody(h, client, l.inspectsQueries())
+		}
+		var session msgSession
+		if err == nil {
+			client, session, err = readMsgSession(h, client)
+		}
 		if err != nil {
-			if err != errNormalClose {
-				corelog.LogError("error", err)
+			reason, reasonErr = p.readDisconnectReason(err), err
+			return
+		}
+		if admitted, err := p.admit(&Message{
+			OpCode:    h.OpCode,
+			RequestID: h.RequestID,
+			Query:     query,
+			RemoteIP:  remoteIP,
+			h:         h,
+			client:    client,
+			listener:  l,
+			cursorIDs: cursorIDs,
+			cursors:   cursors,
+		}); !admitted {
+			if err != nil {
+				reason, reasonErr = admitDisconnectReason(err), err
+				return
+			}
+			mpt.End()
+			continue
+		}
+		if cached, err := p.replyFromIsMasterCache(h, query, client); cached {
+			if err != nil {
+				reason, reasonErr = disconnectProxyError, err
+				return
+			}
+			mpt.End()
+			continue
+		}
+		shadowMsg = p.shadowQuery(h, query)
+
+		serverConn, pinned, err := p.routeMessage(query, cursorIDs, session, cursors, tracked)
+		if err != nil {
+			if err == errNormalClose {
+				reason = disconnectStopped
+			} else {
+				reason, reasonErr = disconnectServerPool, err
+				rejectMessage(h, client, ErrorCodeHostUnreachable, err.Error())
 			}
 			return
 		}
 
+		tracked.setState(ClientStateProxying, backendAddr(serverConn))
 		scht := stats.BumpTime(p.stats, "server.conn.held.time")
+		// Only the first message of an exchange may move to another connection,
+		// a getLastError must follow its write.
+		first := true
 		for {
-			err := p.proxyMessage(h, c, serverConn, &lastError)
+			start := p.Clock.Now()
+			var err error
+			if p.hedgeable(h, query, pinned) {
+				serverConn, err = p.proxyHedged(h, query, client, serverConn, &lastError, cursors)
+			} else if first && !pinned {
+				serverConn, err = p.proxyRetryingReset(h, query, client, serverConn, &lastError, cursorIDs, cursors)
+			} else {
+				err = p.proxyCursorMessage(h, query, client, serverConn, &lastError, cursorIDs, cursors)
+			}
+			first = false
+			if shadowMsg != nil {
+				if err == nil {
+					p.shadowMessage(shadowMsg, p.Clock.Now().Sub(start))
+				} else {
+					stats.BumpSum(p.stats, "shadow.primary.error", 1)
+				}
+				shadowMsg = nil
+			}
+			if err != nil && serverConn == nil {
+				// The connection to retry on could not be acquired.
+				reason, reasonErr = disconnectServerPool, err
+				return
+			}
 			if err != nil {
-				p.serverPool.Discard(serverConn)
-				corelog.LogErrorMessage(fmt.Sprintf("Proxy message failed %s ", err))
+				cursors.drop(serverConn)
+				p.transactions.drop(serverConn)
+				if isTimeout(err) && p.resetTimedOut(serverConn) {
+					p.returnServerConn(serverConn)
+				} else {
+					p.poolFor(serverConn).Discard(serverConn)
+				}
+				backend := backendAddr(serverConn)
+				corelog.LogErrorMessage(fmt.Sprintf("Proxy message failed for backend %s: %s", backend, err))
 				stats.BumpSum(p.stats, "message.proxy.error", 1)
-				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				stats.BumpSum(p.stats, fmt.Sprintf("backend.%s.message.proxy.error", backend), 1)
+				if isTimeout(err) {
 					stats.BumpSum(p.stats, "message.proxy.timeout", 1)
 				}
+				p.emit(MessageFailed{
+					Time:     p.Clock.Now(),
+					Proxy:    p.ProxyAddr,
+					RemoteIP: remoteIP,
+					Backend:  backend,
+					OpCode:   h.OpCode,
+					Err:      err,
+				})
+				reason, reasonErr = disconnectProxyError, err
 				return
 			}
 
 			// One message was proxied, stop it's timer.
 			mpt.End()
+			if p.Events != nil || p.requestLog != nil {
+				now := p.Clock.Now()
+				p.emit(MessageProxied{
+					Time:     now,
+					Proxy:    p.ProxyAddr,
+					RemoteIP: remoteIP,
+					Backend:  backendAddr(serverConn),
+					OpCode:   h.OpCode,
+					Duration: now.Sub(start),
+				})
+				if p.requestLog != nil {
+					p.logRequest(h, query, remoteIP, backendAddr(serverConn), now.Sub(start))
+				}
+			}
 
-			if !h.OpCode.IsMutation() {
+			if !h.OpCode.IsMutation() || p.ReplicaSet.DisableGetLastError {
 				break
 			}
 
@@ -287,59 +1087,322 @@ func (p *Proxy) clientServeLoop(c net.Conn) {
 			// call which expects this behavior.
 
 			stats.BumpSum(p.stats, "message.with.mutation", 1)
+			var next msgSession
 			h, err = p.gleClientReadHeader(c)
+			if err == nil {
+				client, err = p.rewriteNamespace(h, c)
+			}
+			if err == nil {
+				client, cursorIDs, err = readCursorIDs(h, client, p.ReplicaSet.namespaces())
+			}
+			// The query is always read, to tell a getLastError from other
+			// operations.
+			if err == nil {
+				client, query, err = p.readQueryBody(h, client, true)
+			}
+			if err == nil {
+				client, next, err = readMsgSession(h, client)
+			}
 			if err != nil {
 				// Client did not make _any_ query within the GetLastErrorTimeout.
 				// Return the server to the pool and wait go back to outer loop.
 				if err == errClientReadTimeout {
+					stats.BumpSum(p.stats, "message.mutation.followup.timeout", 1)
 					break
 				}
-				// Prevent noise of normal client disconnects, but log if anything else.
-				if err != errNormalClose {
-					corelog.LogError("error", err)
+				if err == errNormalClose {
+					stats.BumpSum(p.stats, "message.mutation.followup.closed", 1)
+				} else {
+					stats.BumpSum(p.stats, "message.mutation.followup.error", 1)
 				}
+				reason, reasonErr = p.readDisconnectReason(err), err
 				// We need to return our server to the pool (it's still good as far
 				// as we know).
-				p.serverPool.Release(serverConn)
+				p.doneWithServerConn(session, serverConn, cursors)
 				return
 			}
 
 			// Successfully read message when waiting for the getLastError call.
+			stats.BumpSum(p.stats, "message.mutation.followup", 1)
+			p.countFollowup(query)
+			p.countOpCode(h, remoteIP)
+			if admitted, err := p.admit(&Message{
+				OpCode:    h.OpCode,
+				RequestID: h.RequestID,
+				Query:     query,
+				RemoteIP:  remoteIP,
+				h:         h,
+				client:    client,
+				listener:  l,
+				cursorIDs: cursorIDs,
+				cursors:   cursors,
+			}); !admitted {
+				if err != nil {
+					// Nothing was sent to the server, the connection is still good.
+					p.doneWithServerConn(session, serverConn, cursors)
+					reason, reasonErr = admitDisconnectReason(err), err
+					return
+				}
+				break
+			}
+
+			// A follow up with routing of its own, a cursor held by another
+			// connection or a transaction, is routed like any other message.
+			// Others stay on the connection of the mutation.
+			owner, owned := cursors.owner(cursorIDs)
+			if (owned && owner != serverConn) || session.inTransaction() || next.inTransaction() {
+				stats.BumpSum(p.stats, "message.mutation.followup.routed", 1)
+				p.doneWithServerConn(session, serverConn, cursors)
+				serverConn, pinned, err = p.routeMessage(query, cursorIDs, next, cursors, tracked)
+				if err != nil {
+					if err == errNormalClose {
+						reason = disconnectStopped
+					} else {
+						reason, reasonErr = disconnectServerPool, err
+						rejectMessage(h, client, ErrorCodeHostUnreachable, err.Error())
+					}
+					return
+				}
+				tracked.setState(ClientStateProxying, backendAddr(serverConn))
+			} else {
+				pinned = true
+			}
+			session = next
+			shadowMsg = p.shadowQuery(h, query)
 			mpt = stats.BumpTime(p.stats, "message.proxy.time")
 		}
-		p.serverPool.Release(serverConn)
+		p.doneWithServerConn(session, serverConn, cursors)
 		scht.End()
 		stats.BumpSum(p.stats, "message.proxy.success", 1)
+
+		// Recycle long lived connections between messages so clients reconnect
+		// and get balanced across proxies.
+		if p.clientExpired(connected) {
+			stats.BumpSum(p.stats, "client.lifetime.recycled", 1)
+			reason = disconnectRecycled
+			return
+		}
 	}
 }
 
+// clientExpired returns true if a client connected at the given time has
+// exceeded the ClientMaxLifetime.
+func (p *Proxy) clientExpired(connected time.Time) bool {
+	max := p.ReplicaSet.ClientMaxLifetime
+	return max > 0 && p.Clock.Now().Sub(connected) >= max
+}
+
+// proxyCursorMessage proxies a message and keeps track of the cursors it
+// opens or closes on the server connection.
+func (p *Proxy) proxyCursorMessage(
+	h *messageHeader,
+	query []byte,
+	client net.Conn,
+	server net.Conn,
+	lastError *LastError,
+	cursorIDs []int64,
+	cursors *cursorAffinity,
+) error {
+	reply := &replyWatcher{Conn: server}
+	capped := p.capResponseIf(h, server, cursorIDs, cursors)
+	if capped != nil {
+		reply.Conn = capped
+	}
+	request := &requestWatcher{Conn: client}
+	if h.OpCode == OpQuery || h.OpCode == OpMsg {
+		reply.command = newCommandCursorScanner()
+	}
+	if err := p.proxyMessage(h, query, request, reply, lastError); err != nil {
+		if err == errResponseCapped {
+			return p.capResponse(h, client, capped, cursors)
+		}
+		return err
+	}
+
+	switch h.OpCode {
+	case OpKillCursors:
+		for _, id := range cursorIDs {
+			cursors.unpin(id)
+		}
+	case OpMsg:
+		p.trackCommandCursors(reply, cursorIDs, cursors)
+	case OpQuery:
+		if len(cursorIDs) > 0 {
+			p.trackCommandCursors(reply, cursorIDs, cursors)
+			break
+		}
+		if id, ok := reply.cursorID(); ok && id != 0 {
+			cursors.pin(id, server)
+			stats.BumpSum(p.stats, "cursor.pinned", 1)
+			if capped != nil {
+				cursors.addReturned(id, capped.length())
+			}
+		}
+		if request.request.command(p.ReplicaSet.namespaces()) {
+			p.trackCommandCursors(reply, nil, cursors)
+		}
+	case OpGetMore:
+		if capped != nil {
+			for _, id := range cursorIDs {
+				cursors.addReturned(id, capped.length())
+			}
+		}
+		// The pin is released once the cursor is exhausted, or if the server no
+		// longer knows about it.
+		if id, ok := reply.cursorID(); ok && (id == 0 || reply.cursorNotFound()) {
+			for _, id := range cursorIDs {
+				cursors.unpin(id)
+			}
+			stats.BumpSum(p.stats, "cursor.exhausted", 1)
+		}
+	}
+	return nil
+}
+
+// trackCommandCursors records the cursor opened by a command, found in the
+// cursor.id of its reply. The cursors a getMore or killCursors command referred
+// to are gone, unless a getMore returned more to come.
+func (p *Proxy) trackCommandCursors(reply *replyWatcher, cursorIDs []int64, cursors *cursorAffinity) {
+	id, ok := reply.commandCursorID()
+	if len(cursorIDs) > 0 {
+		if !ok || id == 0 {
+			for _, id := range cursorIDs {
+				cursors.unpin(id)
+			}
+		}
+		return
+	}
+	if ok && id != 0 {
+		cursors.claim(id)
+		stats.BumpSum(p.stats, "cursor.command.claimed", 1)
+	}
+}
+
+// rejectForeignCursors rejects a getMore or killCursors for a cursor opened by
+// another client. The client is told the cursor was not found, as if it did
+// not exist, so cursor IDs cannot be probed.
+func (p *Proxy) rejectForeignCursors(h *messageHeader, client io.ReadWriter, remoteIP string) error {
+	stats.BumpSum(p.stats, "cursor.cross.client.rejected", 1)
+	corelog.LogInfoMessage("rejected access to the cursor of another client",
+		"client", remoteIP, "proxy", p.String())
+	return rejectMessage(h, client, ErrorCodeCursorNotFound, "dvara: cursor not found")
+}
+
+// releaseServerConn returns the server connection to the pool unless it is
+// holding cursors for the client.
+func (p *Proxy) releaseServerConn(serverConn net.Conn, cursors *cursorAffinity) {
+	if cursors.pinned(serverConn) {
+		return
+	}
+	p.returnServerConn(serverConn)
+}
+
+// routeMessage returns the server connection a message goes to, and whether
+// the message is tied to it. Cursor operations must go to the server connection
+// holding the cursor, and the statements of a transaction to the one it runs
+// on. Other messages get a connection from the pool.
+func (p *Proxy) routeMessage(
+	query []byte,
+	cursorIDs []int64,
+	session msgSession,
+	cursors *cursorAffinity,
+	tracked *trackedClient,
+) (net.Conn, bool, error) {
+	if serverConn, ok := cursors.owner(cursorIDs); ok {
+		return serverConn, true, nil
+	}
+	if serverConn, ok := p.transactions.take(session); ok {
+		return serverConn, true, nil
+	}
+	tracked.setState(ClientStateAcquiring, "")
+	serverConn, err := p.acquireServerConn(query)
+	return serverConn, false, err
+}
+
+// doneWithServerConn gives the server connection a message of the session ran
+// on back to its transaction, or releases it.
+func (p *Proxy) doneWithServerConn(session msgSession, serverConn net.Conn, cursors *cursorAffinity) {
+	if !p.keepTransactionConn(session, serverConn) {
+		p.releaseServerConn(serverConn, cursors)
+	}
+}
+
+// returnServerConn returns the server connection to the pool. A connection with
+// buffered bytes left over is out of sync with the protocol and is discarded
+// instead, as the next client would read a stale response.
+func (p *Proxy) returnServerConn(serverConn net.Conn) {
+	if isStale(serverConn) || p.drained(serverConn) || p.flushed(serverConn) {
+		p.poolFor(serverConn).Discard(serverConn)
+		return
+	}
+	if unreadBytes(serverConn) > 0 {
+		stats.BumpSum(p.stats, "server.conn.unread.discard", 1)
+		p.poolFor(serverConn).Discard(serverConn)
+		return
+	}
+	p.poolFor(serverConn).Release(serverConn)
+}
+
 // We wait for upto ClientIdleTimeout in MessageTimeout increments and keep
 // checking if we're waiting to be closed. This ensures that at worse we
 // wait for MessageTimeout when closing even when we're idling.
 func (p *Proxy) idleClientReadHeader(c net.Conn) (*messageHeader, error) {
-	h, err := p.clientReadHeader(c, p.ReplicaSet.ClientIdleTimeout)
+	h, err := p.clientReadHeader(c, p.timeouts().ClientIdle, p.closed)
 	if err == errClientReadTimeout {
 		stats.BumpSum(p.stats, "client.idle.timeout", 1)
 	}
 	return h, err
 }
 
+// handshakeClientReadHeader reads the first message from a newly accepted
+// client, which must arrive within ClientHandshakeTimeout if set. This keeps
+// clients which connect but send nothing, or send slowly, from holding on to a
+// connection slot for the whole ClientIdleTimeout.
+func (p *Proxy) handshakeClientReadHeader(c net.Conn) (*messageHeader, error) {
+	if p.ReplicaSet.ClientHandshakeTimeout == 0 {
+		return p.idleClientReadHeader(c)
+	}
+	h, err := p.clientReadHeader(c, p.ReplicaSet.ClientHandshakeTimeout, p.closed)
+	if err == errClientReadTimeout {
+		stats.BumpSum(p.stats, "client.handshake.timeout", 1)
+		return nil, errClientHandshakeTimeout
+	}
+	return h, err
+}
+
+// gleClientReadHeader reads the message following a legacy write, which may be
+// the getLastError acknowledging it. Stopping the proxy does not interrupt the
+// wait, so writes made just before get acknowledged, but the wait is still
+// bounded by GetLastErrorTimeout.
 func (p *Proxy) gleClientReadHeader(c net.Conn) (*messageHeader, error) {
-	h, err := p.clientReadHeader(c, p.ReplicaSet.GetLastErrorTimeout)
+	h, err := p.clientReadHeader(c, p.timeouts().GetLastError, nil)
 	if err == errClientReadTimeout {
 		stats.BumpSum(p.stats, "client.gle.timeout", 1)
 	}
 	return h, err
 }
 
-func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHeader, error) {
+// countFollowup counts whether the message following a legacy write is the
+// getLastError it was held for, or an unrelated operation which is proxied on
+// the same server connection all the same.
+func (p *Proxy) countFollowup(query []byte) {
+	if name, ok := p.ReplicaSet.namespaces().queryCommand(query); ok && strings.EqualFold(name, "getLastError") {
+		stats.BumpSum(p.stats, "message.mutation.followup.gle", 1)
+		return
+	}
+	stats.BumpSum(p.stats, "message.mutation.followup.unrelated", 1)
+}
+
+// clientReadHeader reads the header of the next message from the client,
+// waiting for up to the timeout unless stop is closed first.
+func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration, stop <-chan struct{}) (*messageHeader, error) {
 	type headerError struct {
 		header *messageHeader
 		error  error
 	}
 	resChan := make(chan headerError)
 
-	c.SetReadDeadline(time.Now().Add(timeout))
+	c.SetReadDeadline(p.Clock.Now().Add(timeout))
 	go func() {
 		h, err := readHeader(c)
 		resChan <- headerError{header: h, error: err}
@@ -351,7 +1414,7 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 	select {
 	case response = <-resChan:
 		// all good
-	case <-p.closed:
+	case <-stop:
 		closed = true
 		c.SetReadDeadline(timeInPast)
 		response = <-resChan
@@ -375,23 +1438,58 @@ func (p *Proxy) clientReadHeader(c net.Conn, timeout time.Duration) (*messageHea
 		return nil, errClientReadTimeout
 	}
 
+	// The client is not speaking the protocol, we can't find the next message.
+	// A header cut short by the proxy stopping is not the client's fault.
+	if response.error == errInvalidMessageLength || response.error == errShortHeader {
+		if closed {
+			return nil, errNormalClose
+		}
+		stats.BumpSum(p.stats, "client.protocol.error", 1)
+		return nil, response.error
+	}
+
 	// Some other unknown error.
 	stats.BumpSum(p.stats, "client.error.disconnect", 1)
 	corelog.LogError("error", response.error)
 	return nil, response.error
 }
 
+// isClosed returns true if the channel was closed.
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// isClosedConnError returns true if the error is the result of using a
+// connection or listener which was closed.
+func isClosedConnError(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
 var teeIfEnable = os.Getenv("MONGOPROXY_TEE") == "1"
 
+// teeOutput writes the traffic of teed connections to stdout in the
+// background, so a slow terminal doesn't hold up the clients.
+var (
+	teeOnce   sync.Once
+	teeOutput *asyncWriter
+)
+
 type teeConn struct {
 	context string
 	net.Conn
+	proxy  *Proxy
+	buffer *asyncBuffer
 }
 
 func (t teeConn) Read(b []byte) (int, error) {
 	n, err := t.Conn.Read(b)
 	if n > 0 {
-		fmt.Fprintf(os.Stdout, "READ %s: %s %v\n", t.context, b[0:n], b[0:n])
+		t.tee("READ", b[0:n])
 	}
 	return n, err
 }
@@ -399,54 +1497,136 @@ func (t teeConn) Read(b []byte) (int, error) {
 func (t teeConn) Write(b []byte) (int, error) {
 	n, err := t.Conn.Write(b)
 	if n > 0 {
-		fmt.Fprintf(os.Stdout, "WRIT %s: %s %v\n", t.context, b[0:n], b[0:n])
+		t.tee("WRIT", b[0:n])
 	}
 	return n, err
 }
 
-func teeIf(context string, c net.Conn) net.Conn {
+// tee queues the bytes to be printed, or drops them if the connection has
+// CaptureBufferBytes waiting already.
+func (t teeConn) tee(direction string, b []byte) {
+	line := fmt.Sprintf("%s %s: %s %v\n", direction, t.context, b, b)
+	if !t.buffer.write([]byte(line)) {
+		stats.BumpSum(t.proxy.stats, "tee.dropped", 1)
+	}
+}
+
+func (p *Proxy) teeIf(context string, c net.Conn) net.Conn {
 	if teeIfEnable {
+		teeOnce.Do(func() {
+			teeOutput = newAsyncWriter(os.Stdout)
+		})
 		return teeConn{
 			context: context,
 			Conn:    c,
+			proxy:   p,
+			buffer:  teeOutput.buffer(p.ReplicaSet.CaptureBufferBytes, nil),
 		}
 	}
 	return c
 }
 
+// maxPerClientConnectionsStripes is the number of independently locked stripes
+// the per client counts are spread over, to reduce contention when many
+// clients connect and disconnect concurrently.
+const maxPerClientConnectionsStripes = 32
+
+// maxPerClientConnections counts the connections from each client IP. The
+// counts are sharded by a hash of the IP, so clients only contend with others
+// in the same stripe.
 type maxPerClientConnections struct {
-	max    uint
-	counts map[string]uint
+	max       uint64          // accessed atomically
+	overrides map[string]uint // limits of specific client IPs, see ClientLimits
+	stripes   []clientCountStripe
+}
+
+type clientCountStripe struct {
 	mutex  sync.Mutex
+	counts map[string]uint
 }
 
 func newMaxPerClientConnections(max uint) *maxPerClientConnections {
-	return &maxPerClientConnections{
-		max:    max,
-		counts: make(map[string]uint),
+	return newStripedMaxPerClientConnections(max, maxPerClientConnectionsStripes)
+}
+
+func newStripedMaxPerClientConnections(max uint, stripes int) *maxPerClientConnections {
+	m := &maxPerClientConnections{
+		max:     uint64(max),
+		stripes: make([]clientCountStripe, stripes),
+	}
+	for i := range m.stripes {
+		m.stripes[i].counts = make(map[string]uint)
+	}
+	return m
+}
+
+// stripe returns the stripe holding the count for the IP, using an FNV-1a hash.
+func (m *maxPerClientConnections) stripe(remoteIP string) *clientCountStripe {
+	h := uint32(2166136261)
+	for i := 0; i < len(remoteIP); i++ {
+		h ^= uint32(remoteIP[i])
+		h *= 16777619
 	}
+	return &m.stripes[h%uint32(len(m.stripes))]
 }
 
+// limit returns the current limit.
+func (m *maxPerClientConnections) limit() uint {
+	return uint(atomic.LoadUint64(&m.max))
+}
+
+// limitFor returns the current limit for the client IP.
+func (m *maxPerClientConnections) limitFor(remoteIP string) uint {
+	if max, ok := m.overrides[remoteIP]; ok {
+		return max
+	}
+	return m.limit()
+}
+
+// setMax changes the limit. Clients already over a lowered limit are not
+// disconnected, but can't make new connections until they are under it.
+func (m *maxPerClientConnections) setMax(max uint) {
+	atomic.StoreUint64(&m.max, uint64(max))
+}
+
+// inc counts a new connection from the client IP, returning true if it is over
+// its limit, in which case it is not counted.
 func (m *maxPerClientConnections) inc(remoteIP string) bool {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	current := m.counts[remoteIP]
-	if current >= m.max {
+	s := m.stripe(remoteIP)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current := s.counts[remoteIP]
+	if current >= m.limitFor(remoteIP) {
 		return true
 	}
-	m.counts[remoteIP] = current + 1
+	s.counts[remoteIP] = current + 1
 	return false
 }
 
+// snapshot returns a copy of the current count for each client IP.
+func (m *maxPerClientConnections) snapshot() map[string]uint {
+	counts := make(map[string]uint)
+	for i := range m.stripes {
+		s := &m.stripes[i]
+		s.mutex.Lock()
+		for remoteIP, count := range s.counts {
+			counts[remoteIP] = count
+		}
+		s.mutex.Unlock()
+	}
+	return counts
+}
+
 func (m *maxPerClientConnections) dec(remoteIP string) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	current := m.counts[remoteIP]
+	s := m.stripe(remoteIP)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current := s.counts[remoteIP]
 
 	// delete rather than having entries with 0 connections
 	if current == 1 {
-		delete(m.counts, remoteIP)
+		delete(s.counts, remoteIP)
 	} else {
-		m.counts[remoteIP] = current - 1
+		s.counts[remoteIP] = current - 1
 	}
 }
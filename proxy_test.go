@@ -274,7 +274,7 @@ func TestZeroMaxConnections(t *testing.T) {
 	withHarness(t, func(harness *ReplicaSetHarness) {
 		p := &Proxy{ReplicaSet: &ReplicaSet{}}
 		err := p.Start()
-		if err != errZeroMaxConnections {
+		if _, ok := err.(ConfigErrors); !ok {
 			t.Fatal("did not get expected error")
 		}
 	})
@@ -0,0 +1,1096 @@
+package dvara
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// sleepRecorder is a clock that records sleeps instead of sleeping.
+type sleepRecorder struct {
+	clock.Clock
+	sleeps []time.Duration
+}
+
+func (s *sleepRecorder) Sleep(d time.Duration) {
+	s.sleeps = append(s.sleeps, d)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// clockConn is a net.Conn whose read deadline is driven by a mock clock. Only
+// the methods the proxy uses for reading are implemented.
+type clockConn struct {
+	net.Conn
+	clock    *clock.Mock
+	mutex    sync.Mutex
+	deadline time.Time
+	data     chan []byte
+}
+
+func newClockConn(klock *clock.Mock) *clockConn {
+	return &clockConn{clock: klock, data: make(chan []byte, 1)}
+}
+
+func (c *clockConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *clockConn) Deadline() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.deadline
+}
+
+func (c *clockConn) Read(b []byte) (int, error) {
+	deadline := c.Deadline()
+	now := c.clock.Now()
+	if !deadline.IsZero() && !now.Before(deadline) {
+		return 0, timeoutError{}
+	}
+	select {
+	case d := <-c.data:
+		return copy(b, d), nil
+	case <-c.clock.After(deadline.Sub(now)):
+		return 0, timeoutError{}
+	}
+}
+
+// waitForDeadline waits until a read deadline has been set on the conn.
+func waitForDeadline(c *clockConn) {
+	for c.Deadline().IsZero() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newClockProxy(klock clock.Clock, hc stats.Client) *Proxy {
+	return &Proxy{
+		ReplicaSet: &ReplicaSet{
+			ClientIdleTimeout:   time.Hour,
+			GetLastErrorTimeout: time.Minute,
+		},
+		Clock:  klock,
+		closed: make(chan struct{}),
+		stats:  hc,
+	}
+}
+
+// closedAddr returns an address nothing is listening on.
+func closedAddr(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	addr := l.Addr().String()
+	ensure.Nil(t, l.Close())
+	return addr
+}
+
+func TestJitter(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Factor   float64
+		Random   float64
+		Expected time.Duration
+	}{
+		{0, 0, time.Second},
+		{-1, 0.9, time.Second},
+		{0.5, 0, 500 * time.Millisecond},
+		{0.5, 0.5, time.Second},
+		{0.5, 0.75, 1250 * time.Millisecond},
+		{2, 0, 0},
+	}
+	for _, c := range cases {
+		actual := jitter(time.Second, c.Factor, c.Random)
+		if actual != c.Expected {
+			t.Fatalf("for factor %v and random %v expected %s but got %s", c.Factor, c.Random, c.Expected, actual)
+		}
+	}
+}
+
+func TestNewServerConnBackoffJitter(t *testing.T) {
+	t.Parallel()
+	klock := &sleepRecorder{Clock: clock.NewMock()}
+	randoms := []float64{0, 0.99, 0.5, 0.25, 0.75, 0.1, 0.9}
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{},
+		MongoAddr:  closedAddr(t),
+		Clock:      klock,
+		random: func() float64 {
+			r := randoms[0]
+			randoms = randoms[1:]
+			return r
+		},
+	}
+	_, err := p.newServerConn()
+	ensure.NotNil(t, err)
+	sleeps := klock.sleeps
+	ensure.DeepEqual(t, len(sleeps), 7)
+
+	base := 50 * time.Millisecond
+	for i, s := range sleeps {
+		if s < base/2 || s > base+base/2 {
+			t.Fatalf("sleep %d of %s not within jittered range of %s", i, s, base)
+		}
+		base *= 2
+	}
+	ensure.DeepEqual(t, sleeps[0], 25*time.Millisecond)
+	ensure.DeepEqual(t, sleeps[2], 200*time.Millisecond)
+}
+
+func TestIdleClientReadHeaderTimeout(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	timedOut := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "client.idle.timeout" {
+				close(timedOut)
+			}
+		},
+	}
+	p := newClockProxy(klock, hc)
+	c := newClockConn(klock)
+
+	errs := make(chan error)
+	go func() {
+		_, err := p.idleClientReadHeader(c)
+		errs <- err
+	}()
+	waitForDeadline(c)
+	ensure.DeepEqual(t, c.Deadline(), klock.Now().Add(p.ReplicaSet.ClientIdleTimeout))
+
+	// just short of the timeout nothing happens
+	klock.Add(p.ReplicaSet.ClientIdleTimeout - time.Second)
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected early return: %v", err)
+	default:
+	}
+
+	klock.Add(time.Second)
+	ensure.DeepEqual(t, <-errs, errClientReadTimeout)
+	<-timedOut
+}
+
+func TestGLEClientReadHeaderTimeout(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	timedOut := make(chan struct{})
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if key == "client.gle.timeout" {
+				close(timedOut)
+			}
+		},
+	}
+	p := newClockProxy(klock, hc)
+	c := newClockConn(klock)
+
+	errs := make(chan error)
+	go func() {
+		_, err := p.gleClientReadHeader(c)
+		errs <- err
+	}()
+	waitForDeadline(c)
+	ensure.DeepEqual(t, c.Deadline(), klock.Now().Add(p.ReplicaSet.GetLastErrorTimeout))
+	klock.Add(p.ReplicaSet.GetLastErrorTimeout)
+	ensure.DeepEqual(t, <-errs, errClientReadTimeout)
+	<-timedOut
+}
+
+func TestClientReadHeaderBeforeTimeout(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	p := newClockProxy(klock, nil)
+	c := newClockConn(klock)
+	expected := messageHeader{MessageLength: 42, RequestID: 1, OpCode: OpQuery}
+	c.data <- expected.ToWire()
+	h, err := p.idleClientReadHeader(c)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, *h, expected)
+}
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (a addrConn) RemoteAddr() net.Addr { return a.addr }
+
+func TestBackendAddr(t *testing.T) {
+	t.Parallel()
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 27017}
+	ensure.DeepEqual(t, backendAddr(&serverConn{backend: "mongo-a:27017"}), "mongo-a:27017")
+	ensure.DeepEqual(t, backendAddr(addrConn{addr: tcpAddr}), "10.0.0.1:27017")
+	ensure.DeepEqual(t, backendAddr(addrConn{}), "unknown")
+}
+
+func TestMaxPerClientConnectionsSetMax(t *testing.T) {
+	t.Parallel()
+	m := newMaxPerClientConnections(2)
+	ensure.False(t, m.inc("a"))
+	ensure.False(t, m.inc("a"))
+	ensure.True(t, m.inc("a"))
+	m.setMax(3)
+	ensure.False(t, m.inc("a"))
+	m.setMax(1)
+	m.dec("a")
+	ensure.True(t, m.inc("a"))
+}
+
+func TestReconfigure(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			MessageTimeout:          time.Second,
+		},
+		ClientListener: l,
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	r := &ReplicaSet{
+		MaxConnections:          5,
+		MaxPerClientConnections: 2,
+		ClientIdleTimeout:       time.Hour,
+		GetLastErrorTimeout:     time.Minute,
+		MessageTimeout:          time.Second * 2,
+	}
+	ensure.Nil(t, p.Reconfigure(r))
+	ensure.DeepEqual(t, p.timeouts(), proxyTimeouts{
+		ClientIdle:   time.Hour,
+		GetLastError: time.Minute,
+		Message:      time.Second * 2,
+	})
+	ensure.DeepEqual(t, p.maxPerClientConnections.limit(), uint(2))
+	ensure.DeepEqual(t, p.Reconfigure(&ReplicaSet{MaxConnections: 1}), ConfigErrors{
+		{Field: "MaxPerClientConnections", Value: uint(0), Reason: "must be at least 1"},
+	})
+}
+
+type endCounter struct {
+	ended int
+}
+
+func (e *endCounter) End() { e.ended++ }
+
+func TestServerConnCloseRecordsLifetime(t *testing.T) {
+	t.Parallel()
+	server, client := net.Pipe()
+	defer client.Close()
+	lifetime := &endCounter{}
+	sc := &serverConn{Conn: server, lifetime: lifetime}
+	ensure.Nil(t, sc.Close())
+	ensure.DeepEqual(t, lifetime.ended, 1)
+}
+
+func TestValidateOnStartFailure(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer l.Close()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			ValidateOnStart:         true,
+		},
+		ClientListener: l,
+		MongoAddr:      closedAddr(t),
+		Clock:          &sleepRecorder{Clock: clock.NewMock()},
+	}
+	ensure.Err(t, p.Start(), regexp.MustCompile("could not connect to"))
+}
+
+func TestValidateOnStartKeepsConnection(t *testing.T) {
+	t.Parallel()
+	mongo, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer mongo.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			ValidateOnStart:         true,
+		},
+		ClientListener: l,
+		MongoAddr:      mongo.Addr().String(),
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+	ensure.DeepEqual(t, p.ServerPoolStats(), PoolStats{Total: 1, Idle: 1})
+}
+
+func TestClientReadHeaderProtocolError(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	hc := &statsRecorder{}
+	p := newClockProxy(klock, hc)
+	c := newClockConn(klock)
+	c.data <- messageHeader{MessageLength: 3, OpCode: OpQuery}.ToWire()
+	_, err := p.idleClientReadHeader(c)
+	ensure.DeepEqual(t, err, errInvalidMessageLength)
+	ensure.DeepEqual(t, hc.sum("client.protocol.error"), float64(1))
+}
+
+func TestReturnServerConnDiscardsUnread(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Pending   []byte
+		Discarded bool
+	}{
+		{nil, false},
+		{[]byte{1}, true},
+	}
+	for _, c := range cases {
+		hc := &statsRecorder{}
+		p := &Proxy{ReplicaSet: &ReplicaSet{ReadBufferSize: 64}, stats: hc}
+		data := append(replyMessage(0, 0), c.Pending...)
+		server := &serverConn{Conn: p.bufferConn(&bufferConn{r: bytes.NewReader(data)})}
+		p.serverPool = &Pool{
+			New:           func() (io.Closer, error) { return server, nil },
+			Max:           1,
+			IdleTimeout:   time.Hour,
+			ClosePoolSize: 1,
+		}
+		conn, err := p.getServerConn(p.MongoAddr)
+		ensure.Nil(t, err)
+		ensure.Nil(t, copyMessage(ioutil.Discard, conn))
+		p.returnServerConn(conn)
+		ensure.DeepEqual(t, hc.sum("server.conn.unread.discard") > 0, c.Discarded)
+		ensure.DeepEqual(t, p.ServerPoolStats().Idle, map[bool]uint{false: 1, true: 0}[c.Discarded])
+		p.serverPool.Close()
+	}
+}
+
+func benchmarkCopyMessage(b *testing.B, wrap func(net.Conn) net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(b, err)
+	defer l.Close()
+	body := make([]byte, 1024)
+	h := messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpReply}
+	msg := append(h.ToWire(), body...)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(b, err)
+	defer c.Close()
+	r := wrap(c)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := copyMessage(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyMessageUnbuffered(b *testing.B) {
+	benchmarkCopyMessage(b, func(c net.Conn) net.Conn { return c })
+}
+
+func BenchmarkCopyMessageBuffered(b *testing.B) {
+	p := &Proxy{ReplicaSet: &ReplicaSet{ReadBufferSize: 16 * 1024}}
+	benchmarkCopyMessage(b, p.bufferConn)
+}
+
+func TestClientConnectDisconnectCallbacks(t *testing.T) {
+	t.Parallel()
+	type disconnect struct {
+		RemoteIP string
+		BytesIn  int64
+		BytesOut int64
+	}
+	connects := make(chan string, 1)
+	disconnects := make(chan disconnect, 1)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			ClientIdleTimeout:       time.Hour,
+			MessageTimeout:          time.Second,
+			OnClientConnect: func(remoteIP string) {
+				connects <- remoteIP
+			},
+			OnClientDisconnect: func(remoteIP string, dur time.Duration, bytesIn, bytesOut int64) {
+				disconnects <- disconnect{remoteIP, bytesIn, bytesOut}
+			},
+		},
+		ClientListener: l,
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer c.Close()
+	ensure.DeepEqual(t, <-connects, "127.0.0.1")
+	_, err = c.Write(messageHeader{MessageLength: 3, OpCode: OpQuery}.ToWire())
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, <-disconnects, disconnect{"127.0.0.1", headerLen, 0})
+}
+
+func TestClientExpired(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	connected := klock.Now()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}, Clock: klock}
+	klock.Add(time.Hour)
+	ensure.False(t, p.clientExpired(connected))
+
+	p.ReplicaSet.ClientMaxLifetime = 2 * time.Hour
+	ensure.False(t, p.clientExpired(connected))
+	klock.Add(time.Hour)
+	ensure.True(t, p.clientExpired(connected))
+}
+
+func TestMaxPerClientConnectionsStripes(t *testing.T) {
+	t.Parallel()
+	m := newMaxPerClientConnections(1)
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "192.168.1.1"}
+	for _, ip := range ips {
+		ensure.False(t, m.inc(ip))
+		ensure.True(t, m.inc(ip))
+	}
+	for _, ip := range ips {
+		m.dec(ip)
+		_, ok := m.stripe(ip).counts[ip]
+		ensure.False(t, ok)
+		ensure.False(t, m.inc(ip))
+	}
+}
+
+func TestMaxPerClientConnectionsSnapshot(t *testing.T) {
+	t.Parallel()
+	m := newMaxPerClientConnections(3)
+	m.inc("10.0.0.1")
+	m.inc("10.0.0.1")
+	m.inc("10.0.0.2")
+	counts := m.snapshot()
+	ensure.DeepEqual(t, counts, map[string]uint{"10.0.0.1": 2, "10.0.0.2": 1})
+	m.dec("10.0.0.2")
+	ensure.DeepEqual(t, m.snapshot(), map[string]uint{"10.0.0.1": 2})
+	ensure.DeepEqual(t, counts["10.0.0.2"], uint(1))
+}
+
+func benchmarkMaxPerClientConnections(b *testing.B, stripes int) {
+	m := newStripedMaxPerClientConnections(uint(b.N)+1, stripes)
+	ips := make([]string, 256)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.%d.%d", i/16, i%16)
+	}
+	var next uint32
+	b.RunParallel(func(pb *testing.PB) {
+		ip := ips[atomic.AddUint32(&next, 1)%uint32(len(ips))]
+		for pb.Next() {
+			m.inc(ip)
+			m.dec(ip)
+		}
+	})
+}
+
+func BenchmarkMaxPerClientConnectionsSingleLock(b *testing.B) {
+	benchmarkMaxPerClientConnections(b, 1)
+}
+
+func BenchmarkMaxPerClientConnectionsStriped(b *testing.B) {
+	benchmarkMaxPerClientConnections(b, maxPerClientConnectionsStripes)
+}
+
+func TestMessageTimeout(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		MessageTimeout: time.Minute,
+		CommandTimeouts: map[string]time.Duration{
+			"find":      time.Second,
+			"aggregate": time.Hour,
+		},
+	}
+	p := &Proxy{ReplicaSet: r}
+	cases := []struct {
+		Query    []byte
+		Expected time.Duration
+	}{
+		{nil, time.Minute},
+		{queryBody(t, "test.$cmd", bson.M{"aggregate": "foo"}), time.Hour},
+		{queryBody(t, "test.$cmd", bson.M{"find": "foo"}), time.Second},
+		{queryBody(t, "test.$cmd", bson.M{"count": "foo"}), time.Minute},
+		{queryBody(t, "test.foo", bson.M{"a": 1}), time.Second},
+		{queryBody(t, "test.system.indexes", bson.M{}), time.Minute},
+	}
+	for i, c := range cases {
+		if actual := p.messageTimeout(c.Query); actual != c.Expected {
+			t.Fatalf("case %d: expected %s got %s", i, c.Expected, actual)
+		}
+	}
+
+	p = &Proxy{ReplicaSet: &ReplicaSet{MessageTimeout: time.Minute}}
+	ensure.DeepEqual(t, p.messageTimeout(queryBody(t, "test.foo", bson.M{})), time.Minute)
+}
+
+func TestMutationFollowupStats(t *testing.T) {
+	t.Parallel()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer backend.Close()
+	go func() {
+		c, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for copyMessage(ioutil.Discard, c) == nil {
+		}
+	}()
+
+	followups := make(chan string, 3)
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			if strings.HasPrefix(key, "mongoproxy.message.mutation.followup") {
+				followups <- key
+			}
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			Stats:                   hc,
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			ClientIdleTimeout:       time.Hour,
+			GetLastErrorTimeout:     50 * time.Millisecond,
+			MessageTimeout:          time.Second,
+		},
+		ClientListener: l,
+		MongoAddr:      backend.Addr().String(),
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	insert := queryMessage(t, 1, "test.foo", bson.M{})
+	setInt32(insert, 12, int32(OpInsert))
+	c, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	_, err = c.Write(append(append([]byte(nil), insert...), insert...))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, <-followups, "mongoproxy.message.mutation.followup")
+	ensure.DeepEqual(t, <-followups, "mongoproxy.message.mutation.followup.unrelated")
+	ensure.DeepEqual(t, <-followups, "mongoproxy.message.mutation.followup.timeout")
+
+	_, err = c.Write(insert)
+	ensure.Nil(t, err)
+	ensure.Nil(t, c.Close())
+	ensure.DeepEqual(t, <-followups, "mongoproxy.message.mutation.followup.closed")
+}
+
+func TestCountFollowup(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := &Proxy{ReplicaSet: &ReplicaSet{}, stats: &rec}
+	p.countFollowup(queryBody(t, "test.$cmd", bson.D{{Name: "getLastError", Value: 1}}))
+	p.countFollowup(queryBody(t, "admin.$cmd", bson.D{{Name: "getlasterror", Value: 1}, {Name: "w", Value: 2}}))
+	p.countFollowup(queryBody(t, "test.$cmd", bson.D{{Name: "count", Value: "foo"}}))
+	p.countFollowup(queryBody(t, "test.foo", bson.M{"getLastError": 1}))
+	p.countFollowup(nil)
+	ensure.DeepEqual(t, rec.summed(), map[string]float64{
+		"message.mutation.followup.gle":       2,
+		"message.mutation.followup.unrelated": 3,
+	})
+}
+
+// readQuery reads a query sent to a fake server.
+func readQuery(t testing.TB, c net.Conn) (*messageHeader, []byte) {
+	h, err := readHeader(c)
+	ensure.Nil(t, err)
+	body := make([]byte, h.MessageLength-headerLen)
+	_, err = io.ReadFull(c, body)
+	ensure.Nil(t, err)
+	return h, body
+}
+
+// replyDoc replies with a single document from a fake server.
+func replyDoc(t testing.TB, c net.Conn, h *messageHeader, doc bson.M) {
+	data, err := bson.Marshal(doc)
+	ensure.Nil(t, err)
+	r := messageHeader{
+		MessageLength: int32(headerLen + len(emptyPrefix) + len(data)),
+		ResponseTo:    h.RequestID,
+		OpCode:        OpReply,
+	}
+	msg := append(r.ToWire(), make([]byte, len(emptyPrefix))...)
+	setInt32(msg, headerLen+16, 1)
+	_, err = c.Write(append(msg, data...))
+	ensure.Nil(t, err)
+}
+
+func TestAuthConnSource(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		AuthSource string
+		Expected   string
+	}{
+		{"", "admin.$cmd"},
+		{"app", "app.$cmd"},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		// The proxy is not started, so it has no Clock.
+		p := &Proxy{Username: "u", Password: "p", AuthSource: c.AuthSource}
+		done := make(chan error)
+		go func() {
+			done <- p.AuthConn(client)
+		}()
+
+		h, _ := readQuery(t, server)
+		replyDoc(t, server, h, bson.M{"nonce": "abc", "ok": 1})
+		h, body := readQuery(t, server)
+		replyDoc(t, server, h, bson.M{"ok": 1})
+		ensure.Nil(t, <-done)
+		server.Close()
+
+		// The authenticate command is sent to the source database.
+		_, end, ok := queryCollection(body)
+		ensure.True(t, ok)
+		ensure.DeepEqual(t, string(body[4:end-1]), c.Expected)
+	}
+}
+
+func TestAuthConnTime(t *testing.T) {
+	t.Parallel()
+	hc := &statsRecorder{}
+	klock := clock.NewMock()
+	p := &Proxy{Username: "u", Password: "p", Clock: klock, stats: hc}
+	for _, elapsed := range []time.Duration{time.Millisecond, time.Second} {
+		client, server := net.Pipe()
+		done := make(chan error)
+		go func() {
+			done <- p.AuthConn(client)
+		}()
+		h, _ := readQuery(t, server)
+		replyDoc(t, server, h, bson.M{"nonce": "abc", "ok": 1})
+		h, _ = readQuery(t, server)
+		klock.Add(elapsed)
+		replyDoc(t, server, h, bson.M{"ok": 1})
+		ensure.Nil(t, <-done)
+		server.Close()
+	}
+	ensure.DeepEqual(t, hc.log(), []string{
+		"time server.auth.time 0",
+		"end server.auth.time 0",
+		"time server.auth.time 0",
+		"end server.auth.time 0",
+		"sum server.auth.slow 1",
+	})
+}
+
+func TestProxyAddr(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+		},
+		ClientListener: l,
+		ProxyAddr:      "127.0.0.1:0",
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+	ensure.DeepEqual(t, p.Addr(), l.Addr())
+	ensure.True(t, p.Addr().(*net.TCPAddr).Port != 0)
+}
+
+func TestStartNilClientListener(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerClosePoolSize:     1,
+		},
+	}
+	ensure.DeepEqual(t, p.Start(), errNilClientListener)
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}}
+	ensure.Nil(t, p.Stop())
+}
+
+func TestDoubleStop(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+		},
+		ClientListener: l,
+	}
+	ensure.Nil(t, p.Start())
+	ensure.Nil(t, p.Stop())
+	ensure.Nil(t, p.Stop())
+}
+
+func TestStopAcknowledgesPendingWrite(t *testing.T) {
+	t.Parallel()
+	waiting := make(chan struct{}, 1)
+	p := startLoopbackProxy(t, func(p *Proxy) {
+		p.ReplicaSet.Stats = &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "mongoproxy.message.with.mutation" {
+					waiting <- struct{}{}
+				}
+			},
+		}
+	})
+
+	c, err := net.Dial("tcp", p.Addr().String())
+	ensure.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write(legacyWriteMessage(t, OpInsert, "test.foo"))
+	ensure.Nil(t, err)
+	<-waiting
+
+	// The proxy is stopping while the client is about to ask for getLastError.
+	stopped := make(chan error)
+	go func() { stopped <- p.Stop() }()
+	for !isClosed(p.closed) {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = c.Write(queryMessage(t, 2, "test.$cmd", bson.M{"getLastError": 1}))
+	ensure.Nil(t, err)
+	var reply bytes.Buffer
+	ensure.Nil(t, copyMessage(&reply, c))
+	ensure.DeepEqual(t, getInt32(reply.Bytes(), 8), int32(2))
+	ensure.Nil(t, <-stopped)
+}
+
+func TestStopClosedListener(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 1,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+		},
+		ClientListener: l,
+	}
+	ensure.Nil(t, p.Start())
+	ensure.Nil(t, l.Close())
+	ensure.Nil(t, p.Stop())
+}
+
+func TestServerDialer(t *testing.T) {
+	t.Parallel()
+	var dialed []string
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{},
+		MongoAddr:  "mongo:27017",
+		Clock:      clock.New(),
+		ServerDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, hasDeadline := ctx.Deadline()
+			ensure.True(t, hasDeadline)
+			dialed = append(dialed, network+" "+addr)
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		},
+	}
+	c, err := p.newServerConn()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, backendAddr(c.(net.Conn)), "mongo:27017")
+	ensure.Nil(t, c.Close())
+
+	c, err = p.dialServerConn("other:27017", nil)
+	ensure.Nil(t, err)
+	ensure.Nil(t, c.Close())
+	ensure.DeepEqual(t, dialed, []string{"tcp mongo:27017", "tcp other:27017"})
+}
+
+func TestServerDialerError(t *testing.T) {
+	t.Parallel()
+	dials := 0
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{},
+		MongoAddr:  "mongo:27017",
+		Clock:      &sleepRecorder{Clock: clock.NewMock()},
+		ServerDialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			return nil, errors.New("mesh unavailable")
+		},
+	}
+	_, err := p.newServerConn()
+	ensure.Err(t, err, regexp.MustCompile("could not connect to mongo:27017: mesh unavailable"))
+	ensure.DeepEqual(t, dials, 7)
+	errs := p.ServerConnErrors()
+	ensure.DeepEqual(t, len(errs), 7)
+	ensure.DeepEqual(t, errs[6].Backend, "mongo:27017")
+	ensure.DeepEqual(t, errs[6].Error, "mesh unavailable")
+}
+
+// legacyWriteMessage returns an OP_INSERT, OP_UPDATE or OP_DELETE message as
+// old drivers send them, to be followed by a getLastError.
+func legacyWriteMessage(t testing.TB, op OpCode, ns string) []byte {
+	doc, err := addBSON(nil, bson.M{"a": 1})
+	ensure.Nil(t, err)
+	b := addInt32(nil, 0)
+	b = addCString(b, ns)
+	switch op {
+	case OpInsert:
+		b = append(b, doc...)
+	case OpUpdate:
+		b = addInt32(b, 0)
+		b = append(b, doc...)
+		b = append(b, doc...)
+	case OpDelete:
+		b = addInt32(b, 0)
+		b = append(b, doc...)
+	}
+	h := messageHeader{MessageLength: int32(headerLen + len(b)), OpCode: op}
+	return append(h.ToWire(), b...)
+}
+
+func TestLegacyWriteFollowupAffinity(t *testing.T) {
+	t.Parallel()
+	type received struct {
+		conn   int
+		opCode OpCode
+	}
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer backend.Close()
+	messages := make(chan received, 10)
+	go func() {
+		for i := 0; ; i++ {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int, c net.Conn) {
+				defer c.Close()
+				for {
+					var b bytes.Buffer
+					if copyMessage(&b, c) != nil {
+						return
+					}
+					var h messageHeader
+					h.FromWire(b.Bytes())
+					messages <- received{conn: i, opCode: h.OpCode}
+					if h.OpCode.HasResponse() {
+						c.Write(replyMessage(0, 0))
+					}
+				}
+			}(i, c)
+		}
+	}()
+
+	hc := &statsRecorder{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			Stats:                   hc,
+			MaxConnections:          3,
+			MaxPerClientConnections: 3,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     3,
+			ClientIdleTimeout:       time.Hour,
+			GetLastErrorTimeout:     time.Minute,
+			MessageTimeout:          time.Second,
+			ProxyQuery: &ProxyQuery{
+				GetLastErrorRewriter: &GetLastErrorRewriter{},
+			},
+		},
+		ClientListener: l,
+		MongoAddr:      backend.Addr().String(),
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	gle := queryMessage(t, 2, "test.$cmd", bson.M{"getLastError": 1})
+	for i, op := range []OpCode{OpInsert, OpUpdate, OpDelete} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		ensure.Nil(t, err)
+		_, err = c.Write(legacyWriteMessage(t, op, "test.foo"))
+		ensure.Nil(t, err)
+		write := <-messages
+		ensure.DeepEqual(t, write.opCode, op)
+
+		_, err = c.Write(gle)
+		ensure.Nil(t, err)
+		ensure.Nil(t, copyMessage(ioutil.Discard, c))
+		followup := <-messages
+		ensure.DeepEqual(t, followup, received{conn: write.conn, opCode: OpQuery})
+		ensure.DeepEqual(t, hc.sum("mongoproxy.message.with.mutation"), float64(i+1))
+		ensure.Nil(t, c.Close())
+	}
+}
+
+func TestDisableGetLastError(t *testing.T) {
+	t.Parallel()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer backend.Close()
+	writes := make(chan OpCode, 10)
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					var b bytes.Buffer
+					if copyMessage(&b, c) != nil {
+						return
+					}
+					var h messageHeader
+					h.FromWire(b.Bytes())
+					if h.OpCode.HasResponse() {
+						c.Write(replyMessage(0, 0))
+					} else {
+						writes <- h.OpCode
+					}
+				}
+			}(c)
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MaxConnections:          1,
+			MaxPerClientConnections: 2,
+			ServerIdleTimeout:       time.Hour,
+			ServerClosePoolSize:     1,
+			ClientIdleTimeout:       time.Hour,
+			GetLastErrorTimeout:     time.Hour,
+			MessageTimeout:          time.Second,
+			DisableGetLastError:     true,
+			ProxyQuery:              &ProxyQuery{},
+		},
+		ClientListener: l,
+		MongoAddr:      backend.Addr().String(),
+	}
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	// The writer doesn't follow up, yet the only server connection is free for
+	// the reader right away rather than after the GetLastErrorTimeout.
+	writer, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer writer.Close()
+	_, err = writer.Write(legacyWriteMessage(t, OpInsert, "test.foo"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, <-writes, OpInsert)
+
+	reader, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer reader.Close()
+	reader.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = reader.Write(queryMessage(t, 1, "test.foo", bson.M{}))
+	ensure.Nil(t, err)
+	ensure.Nil(t, copyMessage(ioutil.Discard, reader))
+}
+
+func TestServerResponseTime(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		OpCode OpCode
+		Timed  bool
+	}{
+		{OpGetMore, true},
+		{OpInsert, false},
+	}
+	for _, c := range cases {
+		timers := make(map[string]*endCounter)
+		hc := &stats.HookClient{
+			BumpTimeHook: func(key string) interface {
+				End()
+			} {
+				timers[key] = &endCounter{}
+				return timers[key]
+			},
+		}
+		p := &Proxy{
+			ReplicaSet: &ReplicaSet{MessageTimeout: time.Second},
+			Clock:      clock.NewMock(),
+			stats:      hc,
+		}
+		body := getMoreBody("test.foo", 5)
+		h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: c.OpCode}
+		client := &bufferConn{r: bytes.NewReader(body)}
+		server := &bufferConn{r: bytes.NewReader(replyMessage(0, 0))}
+		var lastError LastError
+		ensure.Nil(t, p.proxyMessage(h, nil, client, server, &lastError))
+		if c.Timed {
+			ensure.DeepEqual(t, timers["server.response.time"], &endCounter{ended: 1})
+		} else {
+			ensure.True(t, timers["server.response.time"] == nil)
+		}
+	}
+}
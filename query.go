@@ -0,0 +1,129 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+)
+
+// readCommands are the commands which are known to be read only. Anything else
+// sent to a $cmd namespace may have side effects.
+var readCommands = []string{"find", "count", "distinct"}
+
+// readQueryBody reads the body of an OP_QUERY when shadowing, secondary
+// routing, command timeouts or maxTimeMS caps, hedged reads, the isMaster
+// cache, database pools, the Middleware, the cursor limit, the LocalCommands,
+// per command request log sampling or the caller, with inspect, need to look at
+// it. The returned conn replays the body, so the message can still be proxied
+// as is. Other messages are left untouched.
+func (p *Proxy) readQueryBody(h *messageHeader, c net.Conn, inspect bool) (net.Conn, []byte, error) {
+	if h.OpCode != OpQuery || !(inspect || p.inspectsQueries()) {
+		return c, nil, nil
+	}
+	body := make([]byte, h.MessageLength-headerLen)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, nil, err
+	}
+	replay := &replayConn{
+		Conn:   c,
+		reader: io.MultiReader(bytes.NewReader(body), c),
+	}
+	return replay, body, nil
+}
+
+func (p *Proxy) inspectsQueries() bool {
+	return p.shadowSlots != nil ||
+		p.ReplicaSet.SecondaryMongoAddr != "" ||
+		len(p.ReplicaSet.CommandTimeouts) > 0 ||
+		p.ReplicaSet.HedgeReads > 0 ||
+		p.isMasterCache != nil ||
+		len(p.databasePools) > 0 ||
+		p.inspectsOpCodes() ||
+		len(p.ReplicaSet.Middleware) > 0 ||
+		p.ReplicaSet.MaxCursorsPerClient > 0 ||
+		len(p.ReplicaSet.LocalCommands) > 0 ||
+		p.ReplicaSet.MaxTimeMSGrace > 0 ||
+		len(p.ReplicaSet.RequestLogCommandSampling) > 0
+}
+
+// queryCollection returns the collection an OP_QUERY body is for, along with
+// the position right after the full collection name.
+func queryCollection(body []byte) (string, int, bool) {
+	// int32 flags, cstring fullCollectionName, int32 numberToSkip,
+	// int32 numberToReturn, document query
+	if len(body) < 4 {
+		return "", 0, false
+	}
+	end := bytes.IndexByte(body[4:], x00)
+	if end < 0 {
+		return "", 0, false
+	}
+	ns := string(body[4 : 4+end])
+	dot := strings.IndexByte(ns, '.')
+	if dot < 0 {
+		return "", 0, false
+	}
+	return ns[dot+1:], 4 + end + 1, true
+}
+
+// isReadQuery returns true if the OP_QUERY body is a plain query or one of
+// the readCommands.
+func (n namespaces) isReadQuery(body []byte) bool {
+	collection, _, ok := queryCollection(body)
+	if !ok {
+		return false
+	}
+	if collection != n.command {
+		return isReadOnlyCollection(collection)
+	}
+	name, ok := n.queryCommand(body)
+	return ok && isReadCommand(name)
+}
+
+// operationName returns the name of the command an OP_QUERY body runs, or
+// "find" for a plain query against a collection.
+func (n namespaces) operationName(body []byte) (string, bool) {
+	if name, ok := n.queryCommand(body); ok {
+		return name, true
+	}
+	collection, _, isQuery := queryCollection(body)
+	return "find", isQuery && isReadOnlyCollection(collection)
+}
+
+// queryCommand returns the name of the command an OP_QUERY body runs, if it is
+// against a $cmd collection.
+func (n namespaces) queryCommand(body []byte) (string, bool) {
+	collection, pos, ok := queryCollection(body)
+	if !ok || collection != n.command {
+		return "", false
+	}
+	// The command is the name of the first element of the query document, after
+	// numberToSkip and numberToReturn: int32 document length, byte element type,
+	// cstring element name.
+	pos += 8 + 5
+	if len(body) < pos {
+		return "", false
+	}
+	nameEnd := bytes.IndexByte(body[pos:], x00)
+	if nameEnd < 0 {
+		return "", false
+	}
+	return string(body[pos : pos+nameEnd]), true
+}
+
+// isReadOnlyCollection returns true if plain queries against the collection
+// only read data. Special collections like $cmd and the system ones are
+// excluded.
+func isReadOnlyCollection(collection string) bool {
+	return !strings.Contains(collection, "$") && !strings.HasPrefix(collection, "system.")
+}
+
+func isReadCommand(name string) bool {
+	for _, c := range readCommands {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
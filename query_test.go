@@ -0,0 +1,86 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReadQueryBody(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{SecondaryMongoAddr: "secondary:27017"}}
+	body := queryBody(t, "test.foo", bson.M{"a": 1})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+
+	replay, read, err := p.readQueryBody(h, &bufferConn{r: bytes.NewReader(body)}, false)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, read, body)
+	replayed, err := ioutil.ReadAll(replay)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, replayed, body)
+}
+
+func TestReadQueryBodyIgnored(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Proxy  *Proxy
+		OpCode OpCode
+	}{
+		{&Proxy{ReplicaSet: &ReplicaSet{}}, OpQuery},
+		{&Proxy{ReplicaSet: &ReplicaSet{SecondaryMongoAddr: "secondary:27017"}}, OpInsert},
+		{&Proxy{ReplicaSet: &ReplicaSet{}, shadowSlots: make(chan struct{})}, OpGetMore},
+	}
+	for _, c := range cases {
+		h := &messageHeader{MessageLength: headerLen + 4, OpCode: c.OpCode}
+		conn := &bufferConn{r: bytes.NewReader([]byte{1, 2, 3, 4})}
+		replay, body, err := c.Proxy.readQueryBody(h, conn, false)
+		ensure.Nil(t, err)
+		ensure.True(t, body == nil)
+		ensure.True(t, replay == conn)
+	}
+}
+
+func TestIsReadQuery(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Body     []byte
+		Expected bool
+	}{
+		{queryBody(t, "test.foo", bson.M{"a": 1}), true},
+		{queryBody(t, "test.$cmd", bson.M{"count": "foo"}), true},
+		{queryBody(t, "test.$cmd", bson.M{"find": "foo"}), true},
+		{queryBody(t, "test.$cmd", bson.M{"insert": "foo"}), false},
+		{queryBody(t, "test.$cmd", bson.M{"findAndModify": "foo"}), false},
+		{queryBody(t, "admin.$cmd.sys.inprog", bson.M{}), false},
+		{queryBody(t, "test.system.indexes", bson.M{}), false},
+		{queryBody(t, "test", bson.M{}), false},
+		{[]byte{0, 0, 0, 0, 't'}, false},
+		{queryBody(t, "test.$cmd", bson.M{"count": "foo"})[:20], false},
+	}
+	for i, c := range cases {
+		if actual := defaultNamespaces.isReadQuery(c.Body); actual != c.Expected {
+			t.Fatalf("case %d: expected %v got %v", i, c.Expected, actual)
+		}
+	}
+}
+
+func TestQueryCommand(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Body []byte
+		Name string
+		OK   bool
+	}{
+		{queryBody(t, "test.$cmd", bson.M{"aggregate": "foo"}), "aggregate", true},
+		{queryBody(t, "test.foo", bson.M{"aggregate": "foo"}), "", false},
+		{queryBody(t, "test.$cmd", bson.M{"count": "foo"})[:20], "", false},
+	}
+	for _, c := range cases {
+		name, ok := defaultNamespaces.queryCommand(c.Body)
+		ensure.DeepEqual(t, name, c.Name)
+		ensure.DeepEqual(t, ok, c.OK)
+	}
+}
@@ -0,0 +1,58 @@
+package dvara
+
+import (
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// Quiesce stops accepting new clients, for example to move clients over to
+// another proxy during a deploy as they reconnect. Unlike Stop it closes only
+// the listeners: connected clients are served as usual for as long as they
+// stay connected, with no deadline. ActiveConnections tells when they are all
+// gone. Quiescing a proxy which is not running does nothing.
+func (p *Proxy) Quiesce() error {
+	p.stopMutex.Lock()
+	defer p.stopMutex.Unlock()
+	if p.closed == nil || isClosed(p.closed) || p.quiesced {
+		return nil
+	}
+	p.quiesced = true
+	for _, l := range p.listeners {
+		if err := l.Close(); err != nil && !isClosedConnError(err) {
+			return err
+		}
+	}
+	stats.BumpSum(p.stats, "quiesced", 1)
+	corelog.LogInfoMessage("proxy quiesced", "proxy", p.String())
+	return nil
+}
+
+// ActiveConnections returns how many clients are connected to the proxy.
+func (p *Proxy) ActiveConnections() int {
+	return p.clients.len()
+}
+
+// Quiesce stops all the proxies from accepting new clients, see
+// Proxy.Quiesce.
+func (manager *StateManager) Quiesce() error {
+	manager.RLock()
+	defer manager.RUnlock()
+	for _, proxy := range manager.proxies {
+		if err := proxy.Quiesce(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ActiveConnections returns how many clients are connected to all the
+// proxies.
+func (manager *StateManager) ActiveConnections() int {
+	manager.RLock()
+	defer manager.RUnlock()
+	active := 0
+	for _, proxy := range manager.proxies {
+		active += proxy.ActiveConnections()
+	}
+	return active
+}
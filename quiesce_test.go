@@ -0,0 +1,53 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestQuiesce(t *testing.T) {
+	t.Parallel()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	p := newLoopbackProxy(t)
+	p.ReplicaSet.MaxConnections = 2
+	p.ReplicaSet.MaxPerClientConnections = 10
+	p.ReplicaSet.ServerIdleTimeout = time.Hour
+	p.ReplicaSet.ServerClosePoolSize = 1
+	p.ReplicaSet.ClientIdleTimeout = time.Minute
+	p.ReplicaSet.GetLastErrorTimeout = time.Minute
+	p.ClientListener = l
+	ensure.Nil(t, p.Quiesce())
+	ensure.Nil(t, p.Start())
+	defer p.Stop()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	ensure.Nil(t, err)
+	defer c.Close()
+	roundTrip := func(id int32) {
+		_, err := c.Write(queryMessage(t, id, "test.foo", bson.M{"a": "b"}))
+		ensure.Nil(t, err)
+		var reply bytes.Buffer
+		ensure.Nil(t, copyMessage(&reply, c))
+		ensure.DeepEqual(t, getInt32(reply.Bytes(), 8), id)
+	}
+	roundTrip(1)
+	ensure.DeepEqual(t, p.ActiveConnections(), 1)
+
+	ensure.Nil(t, p.Quiesce())
+	ensure.Nil(t, p.Quiesce())
+	_, err = net.Dial("tcp", l.Addr().String())
+	ensure.NotNil(t, err)
+	roundTrip(2)
+	ensure.DeepEqual(t, p.ActiveConnections(), 1)
+
+	c.Close()
+	for p.ActiveConnections() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,91 @@
+package dvara
+
+import (
+	"net"
+	"sync"
+)
+
+// readBufferPools hold the read buffers of client connections, by size.
+var readBufferPools = struct {
+	sync.Mutex
+	pools map[int]*sync.Pool
+}{pools: make(map[int]*sync.Pool)}
+
+// readBufferPool returns the pool of read buffers of the given size.
+func readBufferPool(size int) *sync.Pool {
+	readBufferPools.Lock()
+	defer readBufferPools.Unlock()
+	pool, ok := readBufferPools.pools[size]
+	if !ok {
+		pool = &sync.Pool{New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}}
+		readBufferPools.pools[size] = pool
+	}
+	return pool
+}
+
+// pooledBufferConn buffers reads from a client connection like a bufferedConn,
+// but only holds a buffer while there are buffered bytes. The buffer goes back
+// to a pool once drained, and the header of the next message is read without
+// one, so idle clients hold no buffer. Under a flood of mostly idle
+// connections the buffers in use scale with the active clients rather than
+// all of them, at the cost of the header of a message taking its own syscall.
+type pooledBufferConn struct {
+	net.Conn
+	pool *sync.Pool
+	size int
+	buf  *[]byte
+	r, w int
+}
+
+func (b *pooledBufferConn) Read(p []byte) (int, error) {
+	if b.r == b.w {
+		// Nothing buffered: wait for the next header, and read anything as
+		// large as the buffer, directly.
+		if (b.buf == nil && len(p) <= headerLen) || len(p) >= b.size {
+			return b.Conn.Read(p)
+		}
+		if b.buf == nil {
+			b.buf = b.pool.Get().(*[]byte)
+		}
+		n, err := b.Conn.Read(*b.buf)
+		b.r, b.w = 0, n
+		if n == 0 {
+			b.release()
+			return 0, err
+		}
+		m := b.take(p)
+		return m, err
+	}
+	return b.take(p), nil
+}
+
+// take copies buffered bytes to p, releasing the buffer once drained.
+func (b *pooledBufferConn) take(p []byte) int {
+	n := copy(p, (*b.buf)[b.r:b.w])
+	b.r += n
+	if b.r == b.w {
+		b.release()
+	}
+	return n
+}
+
+func (b *pooledBufferConn) release() {
+	if b.buf != nil {
+		b.pool.Put(b.buf)
+		b.buf = nil
+	}
+	b.r, b.w = 0, 0
+}
+
+// bufferClientConn wraps the client connection in a pooledBufferConn if
+// ReadBufferSize is set.
+func (p *Proxy) bufferClientConn(c net.Conn) net.Conn {
+	size := p.ReplicaSet.ReadBufferSize
+	if size <= 0 {
+		return c
+	}
+	return &pooledBufferConn{Conn: c, pool: readBufferPool(size), size: size}
+}
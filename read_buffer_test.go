@@ -0,0 +1,41 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestPooledBufferConn(t *testing.T) {
+	t.Parallel()
+	first := queryMessage(t, 1, "test.foo", bson.M{"a": 1})
+	second := queryMessage(t, 2, "test.bar", bson.M{"b": 2})
+	stream := append(append([]byte(nil), first...), second...)
+	raw := &bufferConn{r: bytes.NewReader(stream)}
+	p := &Proxy{ReplicaSet: &ReplicaSet{ReadBufferSize: 64}}
+	c := p.bufferClientConn(raw).(*pooledBufferConn)
+
+	// The header of the first message is read without a buffer, its body
+	// through one which is kept as it holds part of the next message.
+	h, err := readHeader(c)
+	ensure.Nil(t, err)
+	ensure.True(t, c.buf == nil)
+	body := make([]byte, h.MessageLength-headerLen)
+	_, err = c.Read(body[:4])
+	ensure.Nil(t, err)
+	ensure.NotNil(t, c.buf)
+	rest, err := ioutil.ReadAll(iotest.OneByteReader(io.LimitReader(c, int64(len(body)-4))))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, append(body[:4], rest...), first[headerLen:])
+
+	var next bytes.Buffer
+	ensure.Nil(t, copyMessage(&next, c))
+	ensure.DeepEqual(t, next.Bytes(), second)
+	// Drained, the buffer went back to the pool.
+	ensure.True(t, c.buf == nil)
+}
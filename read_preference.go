@@ -0,0 +1,110 @@
+package dvara
+
+import (
+	"net"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// secondaryReadModes are the read preference modes which are routed to the
+// secondary.
+var secondaryReadModes = []string{"secondary", "secondaryPreferred"}
+
+// secondaryReadPreference returns the read preference mode of an OP_QUERY body
+// if the query may be served by the secondary, or "" if it must go to the
+// primary. The read preference is found in the $readPreference of the query
+// wrapper, as sent by drivers to mongos. Commands are only eligible if they
+// are known to be read only. OP_MSG bodies are not looked at, see
+// SecondaryMongoAddr.
+func (n namespaces) secondaryReadPreference(body []byte) string {
+	collection, pos, ok := queryCollection(body)
+	if !ok {
+		return ""
+	}
+	// skip numberToSkip and numberToReturn
+	pos += 8
+	if len(body) < pos+4 {
+		return ""
+	}
+	size := int(getInt32(body, pos))
+	if size < 5 || len(body) < pos+size {
+		return ""
+	}
+	var q bson.D
+	if err := bson.Unmarshal(body[pos:pos+size], &q); err != nil || len(q) == 0 {
+		return ""
+	}
+
+	var mode string
+	command := q[0].Name
+	for _, e := range q {
+		switch e.Name {
+		case "$readPreference":
+			mode = readPreferenceMode(e.Value)
+		case "$query":
+			command = ""
+			if inner, ok := e.Value.(bson.D); ok && len(inner) > 0 {
+				command = inner[0].Name
+			}
+		}
+	}
+	if !isSecondaryReadMode(mode) {
+		return ""
+	}
+	if collection == n.command {
+		if !isReadCommand(command) {
+			return ""
+		}
+	} else if !isReadOnlyCollection(collection) {
+		return ""
+	}
+	return mode
+}
+
+func readPreferenceMode(v interface{}) string {
+	if d, ok := v.(bson.D); ok {
+		for _, e := range d {
+			if e.Name == "mode" {
+				mode, _ := e.Value.(string)
+				return mode
+			}
+		}
+	}
+	return ""
+}
+
+func isSecondaryReadMode(mode string) bool {
+	for _, m := range secondaryReadModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// acquireServerConn gets a server connection for a message. Queries which
+// allow it are sent to the secondary, if one is configured. Since connections
+// to other backends are not retried, secondaryPreferred queries fall back to
+// the primary if no secondary connection can be established.
+func (p *Proxy) acquireServerConn(body []byte) (net.Conn, error) {
+	if p.ReplicaSet.SecondaryMongoAddr == "" || body == nil {
+		return p.getPrimaryConn(body)
+	}
+	mode := p.ReplicaSet.namespaces().secondaryReadPreference(body)
+	if mode == "" {
+		return p.getPrimaryConn(body)
+	}
+	c, err := p.getServerConn(p.ReplicaSet.SecondaryMongoAddr)
+	if err == nil {
+		stats.BumpSum(p.stats, "secondary.read", 1)
+		return c, nil
+	}
+	if mode == "secondary" {
+		return nil, err
+	}
+	corelog.LogError("error", err)
+	stats.BumpSum(p.stats, "secondary.fallback", 1)
+	return p.getPrimaryConn(body)
+}
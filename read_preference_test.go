@@ -0,0 +1,104 @@
+package dvara
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSecondaryReadPreference(t *testing.T) {
+	t.Parallel()
+	secondary := bson.D{{Name: "mode", Value: "secondary"}}
+	preferred := bson.D{{Name: "mode", Value: "secondaryPreferred"}}
+	primary := bson.D{{Name: "mode", Value: "primaryPreferred"}}
+	wrap := func(q interface{}, readPreference bson.D) bson.D {
+		return bson.D{
+			{Name: "$query", Value: q},
+			{Name: "$readPreference", Value: readPreference},
+		}
+	}
+	cases := []struct {
+		Body     []byte
+		Expected string
+	}{
+		{queryBody(t, "test.foo", wrap(bson.M{"a": 1}, secondary)), "secondary"},
+		{queryBody(t, "test.foo", wrap(bson.M{"a": 1}, preferred)), "secondaryPreferred"},
+		{queryBody(t, "test.foo", wrap(bson.M{"a": 1}, primary)), ""},
+		{queryBody(t, "test.foo", bson.M{"a": 1}), ""},
+		{queryBody(t, "test.$cmd", wrap(bson.M{"count": "foo"}, secondary)), "secondary"},
+		{queryBody(t, "test.$cmd", wrap(bson.M{"insert": "foo"}, secondary)), ""},
+		{queryBody(t, "test.$cmd", wrap(bson.M{}, secondary)), ""},
+		{queryBody(t, "test.system.users", wrap(bson.M{}, secondary)), ""},
+		{queryBody(t, "test.foo", wrap(bson.M{"a": 1}, secondary))[:30], ""},
+		{[]byte{0, 0, 0, 0}, ""},
+	}
+	for i, c := range cases {
+		if actual := defaultNamespaces.secondaryReadPreference(c.Body); actual != c.Expected {
+			t.Fatalf("case %d: expected %q got %q", i, c.Expected, actual)
+		}
+	}
+}
+
+func TestAcquireServerConnRoutesSecondaryReads(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		ReadPreference string
+		SecondaryDown  bool
+		Backend        string
+		Error          bool
+	}{
+		{"secondary", false, "secondary", false},
+		{"secondaryPreferred", false, "secondary", false},
+		{"primary", false, "primary", false},
+		{"secondaryPreferred", true, "primary", false},
+		{"secondary", true, "", true},
+	}
+	for _, c := range cases {
+		p := &Proxy{ReplicaSet: &ReplicaSet{SecondaryMongoAddr: "secondary"}}
+		newConn := func(backend string, pool ConnPool, down bool) func() (io.Closer, error) {
+			return func() (io.Closer, error) {
+				if down {
+					return nil, errors.New("secondary down")
+				}
+				server, client := net.Pipe()
+				client.Close()
+				return &serverConn{Conn: server, backend: backend, pool: pool}, nil
+			}
+		}
+		p.serverPool = &Pool{
+			New:           newConn("primary", nil, false),
+			Max:           1,
+			IdleTimeout:   time.Hour,
+			ClosePoolSize: 1,
+		}
+		secondaryPool := &Pool{
+			Max:           1,
+			IdleTimeout:   time.Hour,
+			ClosePoolSize: 1,
+		}
+		secondaryPool.New = newConn("secondary", secondaryPool, c.SecondaryDown)
+		p.backendPools = map[string]ConnPool{"secondary": secondaryPool}
+
+		body := queryBody(t, "test.foo", bson.D{
+			{Name: "$query", Value: bson.M{}},
+			{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: c.ReadPreference}}},
+		})
+		conn, err := p.acquireServerConn(body)
+		if c.Error {
+			ensure.NotNil(t, err)
+		} else {
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, backendAddr(conn), c.Backend)
+			p.returnServerConn(conn)
+		}
+		ensure.DeepEqual(t, p.ServerPoolStats().InUse, uint(0))
+		ensure.DeepEqual(t, secondaryPool.InUse(), uint(0))
+		p.serverPool.Close()
+		secondaryPool.Close()
+	}
+}
@@ -2,9 +2,11 @@
 package dvara
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -29,7 +31,8 @@ type ReplicaSet struct {
 	ReplicaSetStateCreator *ReplicaSetStateCreator `inject:""`
 	ProxyQuery             *ProxyQuery             `inject:""`
 
-	// Stats if provided will be used to record interesting stats.
+	// Stats if provided will be used to record interesting stats. MultiStats
+	// sends them to several clients.
 	Stats stats.Client `inject:""`
 
 	// Comma separated list of mongo addresses. This is the list of "seed"
@@ -47,6 +50,34 @@ type ReplicaSet struct {
 	// "0.0.0.0" means public service, "127.0.0.1" means localhost only.
 	ListenAddr string
 
+	// ReusePort if true listens with SO_REUSEPORT, so several dvara processes
+	// can listen on the same ports and share the clients connecting to them.
+	// It is only supported on Linux.
+	ReusePort bool
+
+	// ReuseAddr controls SO_REUSEADDR on the listeners, which lets a restarted
+	// dvara listen again while connections from before the restart linger in
+	// TIME_WAIT. It defaults to true when nil, as for all Go listeners. Turning
+	// it off is only supported on Linux.
+	ReuseAddr *bool
+
+	// ListenBacklog if set is the length of the queue of client connections
+	// waiting to be accepted. It defaults to the system maximum,
+	// net.core.somaxconn on Linux, which the kernel also caps it at, so the
+	// sysctl has to be raised to have a longer queue absorb connection storms
+	// rather than drop SYNs. It is only supported on Linux.
+	ListenBacklog int
+
+	// ClientKeepAlive is the TCP keep-alive period of client connections,
+	// defaulting to 2 minutes as recommended for mongo when zero. A negative
+	// value disables keep-alives.
+	ClientKeepAlive time.Duration
+
+	// AcceptGoroutines is the number of goroutines accepting clients on each
+	// listener, 1 if zero. More than one keeps up better with bursts of
+	// clients connecting.
+	AcceptGoroutines uint
+
 	// Maximum number of connections that will be established to each mongo node.
 	MaxConnections uint
 
@@ -54,6 +85,49 @@ type ReplicaSet struct {
 	// around.
 	MinIdleConnections uint
 
+	// BackendLimits overrides MaxConnections and MinIdleConnections for the
+	// pools of connections to specific backends, keyed by address.
+	BackendLimits map[string]BackendLimits
+
+	// DatabaseConnections gives the listed databases their own pools of
+	// connections to the proxied server, with the given maximum number of
+	// connections, so a burst of messages for one database can't take the
+	// connections others need. Other databases share the server pool. The
+	// database is that of the namespace of queries and commands. Legacy writes
+	// use the server pool, and cursor messages the connection their cursor is
+	// on.
+	DatabaseConnections map[string]uint
+
+	// NamespaceRewrites maps namespaces, as in "db.collection", to those the
+	// messages naming them are sent for instead, for example while a
+	// collection is being renamed. Queries, legacy writes and getMores are
+	// rewritten, and so are commands on the collection. Responses are not: a
+	// command like find reports the cursor as being on the new namespace,
+	// which is where the client's getMores then go, and so do listings like
+	// listCollections.
+	NamespaceRewrites map[string]string
+
+	// InjectTraceComment if true adds a generated trace ID to the comment of
+	// queries and find commands, which the proxy logs along with the
+	// namespace. The comment shows in the server's profiler and logs, so a slow
+	// operation found there can be matched to the proxy log line. An existing
+	// comment string gets the trace ID appended. Other commands, including
+	// writes, are not traced.
+	InjectTraceComment bool
+
+	// MaxServerConnectionAge if set is how long server connections are used for
+	// before being closed and replaced, for example to pick up DNS or load
+	// balancer changes. Each connection's age is randomized by up to 20% so the
+	// pool is recycled gradually rather than all at once. Connections in use are
+	// recycled once released, idle ones are checked periodically.
+	MaxServerConnectionAge time.Duration
+
+	// ServerConnProbeInterval if set is how often the server connections idle
+	// for that long are probed with an isMaster in the background. Those whose
+	// server went away without it being noticed, such as after a reboot, are
+	// closed as server.conn.dead.reaped rather than handed to a client.
+	ServerConnProbeInterval time.Duration
+
 	// ServerIdleTimeout is the duration after which a server connection will be
 	// considered idle.
 	ServerIdleTimeout time.Duration
@@ -62,34 +136,321 @@ type ReplicaSet struct {
 	// server connections.
 	ServerClosePoolSize uint
 
+	// ServerConnErrorHistory is how many of the most recent server connection
+	// errors each proxy keeps for Proxy.ServerConnErrors, 50 if zero.
+	ServerConnErrorHistory uint
+
 	// ClientIdleTimeout is how long until we'll consider a client connection
 	// idle and disconnect and release it's resources.
 	ClientIdleTimeout time.Duration
 
+	// ClientHandshakeTimeout if set is how long a newly accepted client
+	// connection has to send its first message. It is usually much shorter than
+	// the ClientIdleTimeout that applies between later messages, so clients
+	// connecting without sending anything can't exhaust the connection limits.
+	ClientHandshakeTimeout time.Duration
+
+	// ClientMaxLifetime if set is how long a client connection may be used before
+	// it is closed, after the message in flight is proxied. Clients then
+	// reconnect, which rebalances them across proxy instances.
+	ClientMaxLifetime time.Duration
+
 	// MaxPerClientConnections is how many client connections are allowed from a
 	// single client.
 	MaxPerClientConnections uint
 
+	// BackpressureWaiting if set is the number of clients waiting to acquire a
+	// server connection at which the pool is considered saturated. While it is,
+	// new clients are not served, which sheds load at the edge rather than
+	// having more clients compete for the pool.
+	BackpressureWaiting uint
+
+	// BackpressureReject if true makes a saturated proxy accept new clients and
+	// reply to their first request with an error. Otherwise it stops accepting
+	// clients until the pool is no longer saturated.
+	BackpressureReject bool
+
+	// MaxQueueAge if set is how long a client may wait to acquire a server
+	// connection before its driver is assumed to have given up. When a
+	// connection becomes available it goes to the longest waiting client which
+	// has waited less, those that waited longer get an error instead, counted
+	// as server.pool.stale.waiter.dropped. This avoids wasting connections on
+	// abandoned requests while recovering from saturation.
+	MaxQueueAge time.Duration
+
+	// MaxBytesPerSecondPerClient if set limits the rate at which the connections
+	// from a single client may send and receive bytes. Clients going over it are
+	// slowed down rather than disconnected.
+	MaxBytesPerSecondPerClient uint
+
+	// ClientLimits overrides MaxPerClientConnections and
+	// MaxBytesPerSecondPerClient for specific client IPs. The limits apply to
+	// all the connections from an IP, whichever user they authenticate as:
+	// keying them by identity is not supported, as the proxy doesn't
+	// authenticate clients itself. Listeners with their own
+	// MaxPerClientConnections ignore the connection limits.
+	ClientLimits map[string]ClientLimits
+
 	// GetLastErrorTimeout is how long we'll hold on to an acquired server
 	// connection expecting a possibly getLastError call.
 	GetLastErrorTimeout time.Duration
 
+	// TransactionTimeout is how long a multi-statement transaction may go
+	// without a statement before the server connection pinned to it is
+	// returned to the pool, as its client most likely went away without ending
+	// it. Defaults to a minute, after which mongo aborts it too.
+	TransactionTimeout time.Duration
+
+	// DisableGetLastError if true releases the server connection right after a
+	// legacy write instead of holding on to it for a getLastError call. A
+	// getLastError then runs on whichever connection the client gets and
+	// reports nothing about the write, so this must only be enabled when
+	// clients use acknowledged writes, such as write commands or OP_MSG with a
+	// write concern, rather than legacy writes followed by getLastError.
+	DisableGetLastError bool
+
+	// ServerConnectJitter is the fraction by which each server connect retry
+	// sleep is randomized, e.g. 0.5 means +/- 50%. Defaults to 0.5 when zero, a
+	// negative value disables jitter.
+	ServerConnectJitter float64
+
 	// MessageTimeout is used to determine the timeout for a single message to be
 	// proxied.
 	MessageTimeout time.Duration
 
+	// CommandTimeouts overrides the MessageTimeout for the given commands, keyed
+	// by command name. This allows long running analytics or admin commands
+	// while keeping an aggressive timeout for interactive reads.
+	CommandTimeouts map[string]time.Duration
+
+	// MaxTimeMSGrace if set caps the timeout of queries and commands carrying a
+	// maxTimeMS at that time limit plus this grace. Drivers derive how long they
+	// wait from it, so this keeps the proxy from holding a server connection for
+	// a response the client stopped waiting for. The grace leaves the server
+	// time to report the limit being exceeded itself.
+	MaxTimeMSGrace time.Duration
+
+	// TimeoutResetGrace if set keeps server connections whose message timed
+	// out, such as when the client was slow, rather than discarding them. For up
+	// to this long the rest of the response is read and dropped, and if the
+	// connection is back in step it is returned to the pool, saving a dial and
+	// authentication. Connections a request was only partially written to, or
+	// which had an exhaust request, are always discarded.
+	TimeoutResetGrace time.Duration
+
+	// RequestLogSampling if set logs one in every that many proxied requests,
+	// with the client, backend, command and duration. It is meant for seeing
+	// what clients do without the cost of logging every request.
+	RequestLogSampling uint
+
+	// RequestLogCommandSampling overrides the RequestLogSampling for the given
+	// commands, keyed by command name, "find" for plain queries or an opcode
+	// such as GET_MORE. Zero never logs the command, so noisy commands can be
+	// left out while rare ones are logged every time.
+	RequestLogCommandSampling map[string]uint
+
+	// SlowRequestThreshold if set logs every request taking at least this long
+	// to be proxied, regardless of sampling. Failed requests are always logged.
+	SlowRequestThreshold time.Duration
+
+	// MinWriteConcern if set raises the numeric "w" of write commands below it,
+	// so that for example unacknowledged writes (w:0) surface their errors.
+	MinWriteConcern int
+
+	// WriteConcernCaps lowers the "w" of write commands against the given
+	// "db.collection" namespaces to at most the given value. This allows
+	// relaxing an over-strict w:majority for noncritical collections.
+	WriteConcernCaps map[string]int
+
+	// Compressors are the compressors offered to clients which ask for
+	// compression in their isMaster, see SupportedCompressors. The client's
+	// order of preference wins. Clients get uncompressed responses if none of
+	// the compressors they ask for are enabled.
+	Compressors []string
+
+	// CommandCollection is the collection commands are sent to as queries, in
+	// any database, and AdminDatabase the database admin commands such as
+	// replSetGetStatus run in. They are used to recognize commands, getLastError
+	// and isMaster in particular, and default to "$cmd" and "admin" as for all
+	// mongo versions. They only need to be set for servers with other
+	// conventions.
+	CommandCollection string
+	AdminDatabase     string
+
+	// AllowedOpCodes if set are the only opcodes clients may send, named as by
+	// OpCode.String, for example QUERY and GET_MORE. It is meant for migrations,
+	// to make sure all clients moved to the expected protocol. Disallowed
+	// messages which expect a response get an error and otherwise the client is
+	// disconnected. The isMaster handshake is allowed regardless.
+	AllowedOpCodes []string
+
+	// LocalCommands if set are commands the proxy answers itself with an ok of 1
+	// rather than sending them to the server, saving a round trip and a pool
+	// checkout. Only ping and endSessions are supported. The tradeoff is that a
+	// driver pinging to check connectivity is told all is well even when the
+	// server is unreachable, it only finds out on its next real operation.
+	LocalCommands []string
+
+	// ReadBufferSize if set is the size of the buffer used for reading from
+	// client and server connections. Buffering reduces the number of syscalls
+	// needed to read each message. Idle clients give their buffer back to a
+	// pool, so it only takes memory for the clients with messages in flight.
+	ReadBufferSize int
+
+	// SecondaryMongoAddr if set is the address of a secondary which serves the
+	// queries sent with a secondary or secondaryPreferred read preference. This
+	// allows offloading reads from the node being proxied. Mutations and other
+	// reads are unaffected. Only the $readPreference of the OP_QUERY wrapper is
+	// honored: commands sent as OP_MSG always go to the primary, as the cursors
+	// they open aren't tracked and their getMore would not follow them to the
+	// secondary.
+	SecondaryMongoAddr string
+
+	// HedgeReads if set is how long to wait for the response to a read query
+	// before sending it again over a second server connection, the client
+	// getting whichever response comes first. This trades some extra load for
+	// lower tail latency. Only plain queries and read commands are hedged, and
+	// only if an idle server connection is available and its backend isn't
+	// being drained. Both sends are proxied like any other query.
+	HedgeReads time.Duration
+
+	// MaxResponseBytes if set limits the bytes returned to a client for a single
+	// query, across its first batch and the getMores on its cursor. A reply
+	// which would go over it is discarded, the cursor killed and the client
+	// gets an error instead.
+	MaxResponseBytes uint
+
+	// MaxCursorsPerClient if set limits the cursors a client connection may
+	// have open at once, to protect mongo from clients leaking cursors. Once it
+	// is reached, queries which could open another cursor get an error until the
+	// client exhausts or kills one of its cursors.
+	MaxCursorsPerClient uint
+
+	// CacheIsMaster if set is how long the responses to isMaster and hello are
+	// cached for and used to answer clients without a server connection. The
+	// cache is dropped when the replica set topology changes.
+	CacheIsMaster time.Duration
+
+	// ShadowMongoAddr if set is the address of a mongo server which gets a copy
+	// of the read only queries sent by clients. Its responses are discarded,
+	// clients always get the response of the real server. This allows trying
+	// out a new cluster with production traffic.
+	ShadowMongoAddr string
+
+	// ValidateOnStart if true makes starting a proxy establish and authenticate
+	// one server connection, failing the start if that isn't possible. The
+	// connection is then kept in the pool.
+	ValidateOnStart bool
+
+	// WarmPoolTimeout if set makes starting a proxy establish the
+	// MinIdleConnections of the server pool before accepting clients, waiting
+	// for up to this long. The proxy starts regardless, the connections which
+	// failed or were not established in time are counted and left to be made
+	// as clients need them.
+	WarmPoolTimeout time.Duration
+
+	// TCPNoDelay controls TCP_NODELAY on the client and server connections,
+	// disabling Nagle's algorithm to cut the latency of small messages. It
+	// defaults to true when nil, like the drivers do.
+	TCPNoDelay *bool
+
+	// ServerDialer if set is used by the proxies to open connections to mongo
+	// servers, see Proxy.ServerDialer.
+	ServerDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// NewPool if set creates the pool of connections to each backend in place of
+	// the built-in Pool, for example to reuse connections in a different order or
+	// to share a pool between proxies. The limits are those configured for the
+	// backend, and dial establishes a new connection to it.
+	NewPool func(addr string, limits BackendLimits, dial func() (io.Closer, error)) ConnPool
+
+	// Middleware is run, in order, on each client message before it is proxied,
+	// after the built-in checks such as AllowedOpCodes and the listener
+	// policies. It allows rejecting or observing messages without changing the
+	// proxy, see MessageMiddleware. The Query of OP_QUERY messages is always
+	// read when it is set.
+	Middleware []MessageMiddleware
+
+	// Events if set receives the events of all the proxies, see Proxy.Events.
+	Events chan<- Event
+
+	// OnClientConnect if set is called with the IP of each accepted client
+	// connection. It is called synchronously from the goroutine serving the
+	// client, before any message is read, so it must not block.
+	OnClientConnect func(remoteIP string)
+
+	// OnClientDisconnect if set is called when a client connection is closed,
+	// with how long it was connected and the number of bytes read from and
+	// written to it. Like OnClientConnect it is called from the goroutine serving
+	// the client and must not block, Stop waits for it to return.
+	OnClientDisconnect func(remoteIP string, dur time.Duration, bytesIn, bytesOut int64)
+
+	// RetryableErrorThreshold if set is the number of replies in a row with a
+	// retryable error, one labelled RetryableWriteError or a network error the
+	// server ran into, after which the backend is handled as if it had stepped
+	// down, once until a reply succeeds again. Servers replying "not master"
+	// are always handled so. The replies are counted as server.reply.retryable.
+	RetryableErrorThreshold uint
+
+	// ReplyErrorStats if true counts the error replies from the servers by
+	// code, as server.reply.error.<code>.
+	ReplyErrorStats bool
+
+	// OnPrimaryStepdown if set is called with the address of a backend which
+	// replied with a "not master" error, or reached the RetryableErrorThreshold,
+	// after its idle connections were closed.
+	// It is meant to trigger resolving the new primary and must not block.
+	OnPrimaryStepdown func(addr string)
+
+	// CaptureFile if set is the path of a file the messages sent by clients are
+	// appended to, with the time they were received at, so they can be replayed
+	// for load testing with Replay.
+	CaptureFile string
+
+	// CaptureMutations if true also captures the messages which modify data.
+	// They are left out by default so that replaying a capture is safe.
+	CaptureMutations bool
+
+	// CaptureBufferBytes is how many bytes of the messages of a client
+	// connection may be waiting to be written to the CaptureFile, or to stdout
+	// when MONGOPROXY_TEE is set, 1MB if zero. Both are written in the
+	// background so a slow disk or terminal doesn't hold up the clients, and
+	// messages which don't fit are dropped and counted as capture.dropped or
+	// tee.dropped.
+	CaptureBufferBytes int
+
 	// Name is the name of the replica set to connect to. Nodes that are not part
 	// of this replica set will be ignored. If this is empty, the first replica set
 	// will be used
 	Name string
 
+	// AdvertisedSetName if set replaces the replica set name in isMaster and
+	// hello responses, for drivers to be configured with the name of the
+	// topology made of the proxies rather than that of the members. The hosts,
+	// passives, primary and me fields are always mapped to the proxies in front
+	// of the members, and arbiters left out.
+	AdvertisedSetName string
+
 	// Username is the username used to connect to the server for retrieving replica state.
 	Username string
 
 	// Password is the password used to connect to the server for retrieving replica state.
 	Password string
 
+	// AuthSource is the database the Username is defined in. It defaults to
+	// "admin" when a Username is given.
+	AuthSource string
+
+	// AuthFailureFlushThreshold if set is the number of new server connections
+	// failing to authenticate in a row after which the credentials are
+	// considered stale: server.auth.mass.failure is counted and the idle
+	// connections of all pools are closed. Otherwise pooled connections keep
+	// working after a credential rotation while new ones fail, until
+	// UpdateCredentials provides the new credentials.
+	AuthFailureFlushThreshold uint
+
 	restarter *sync.Once
+	capture   *captureWriter
 }
 
 func (r *ReplicaSet) Start() error {
@@ -97,17 +458,87 @@ func (r *ReplicaSet) Start() error {
 		return errNoAddrsGiven
 	}
 
+	if r.Username != "" && r.AuthSource == "" {
+		r.AuthSource = defaultAuthSource
+	}
+
 	r.restarter = new(sync.Once)
+	if r.CaptureFile != "" {
+		capture, err := openCaptureWriter(r.CaptureFile, r.CaptureMutations)
+		if err != nil {
+			return err
+		}
+		r.capture = capture
+	}
 	return nil
 }
 
+// Stop closes the CaptureFile, if any.
+func (r *ReplicaSet) Stop() error {
+	if r.capture == nil {
+		return nil
+	}
+	return r.capture.Close()
+}
+
+func (r *ReplicaSet) tcpNoDelay() bool {
+	return r.TCPNoDelay == nil || *r.TCPNoDelay
+}
+
 func (r *ReplicaSet) proxyAddr(l net.Listener) string {
 	return l.Addr().String()
 }
 
+// listenOptions are the socket options of client listeners.
+type listenOptions struct {
+	reusePort bool
+	reuseAddr bool
+	backlog   int
+}
+
+var defaultListenOptions = listenOptions{reuseAddr: true}
+
+func (r *ReplicaSet) listenOptions() listenOptions {
+	return listenOptions{
+		reusePort: r.ReusePort,
+		reuseAddr: r.ReuseAddr == nil || *r.ReuseAddr,
+		backlog:   r.ListenBacklog,
+	}
+}
+
+// listen listens for clients on the address, with the ReusePort, ReuseAddr and
+// ListenBacklog settings.
+func (r *ReplicaSet) listen(addr string) (net.Listener, error) {
+	if o := r.listenOptions(); o != defaultListenOptions {
+		return listenTCP(addr, o)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// clientKeepAlive returns the keep-alive period of client connections, 0 if
+// they get none.
+func (r *ReplicaSet) clientKeepAlive() time.Duration {
+	switch {
+	case r.ClientKeepAlive < 0:
+		return 0
+	case r.ClientKeepAlive == 0:
+		return 2 * time.Minute
+	}
+	return r.ClientKeepAlive
+}
+
+// acceptGoroutines returns the number of goroutines accepting clients on each
+// listener.
+func (r *ReplicaSet) acceptGoroutines() int {
+	if r.AcceptGoroutines == 0 {
+		return 1
+	}
+	return int(r.AcceptGoroutines)
+}
+
 func (r *ReplicaSet) newListener() (net.Listener, error) {
 	for i := r.PortStart; i <= r.PortEnd; i++ {
-		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", r.ListenAddr, i))
+		listener, err := r.listen(fmt.Sprintf("%s:%d", r.ListenAddr, i))
 		if err == nil {
 			return listener, nil
 		}
@@ -132,3 +563,12 @@ func uniq(set []string) []string {
 	}
 	return news
 }
+
+// advertisedSetName returns the replica set name to give clients in place of
+// the real one, if any.
+func (r *ReplicaSet) advertisedSetName() string {
+	if r == nil {
+		return ""
+	}
+	return r.AdvertisedSetName
+}
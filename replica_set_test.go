@@ -64,8 +64,47 @@ func TestNoAddrsGiven(t *testing.T) {
 	}
 }
 
+func TestAuthSourceDefault(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		ReplicaSet ReplicaSet
+		Expected   string
+	}{
+		{ReplicaSet{Addrs: "a", Username: "u"}, "admin"},
+		{ReplicaSet{Addrs: "a", Username: "u", AuthSource: "app"}, "app"},
+		{ReplicaSet{Addrs: "a"}, ""},
+	}
+	for _, c := range cases {
+		if err := c.ReplicaSet.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if c.ReplicaSet.AuthSource != c.Expected {
+			t.Fatalf("expected auth source %q got %q", c.Expected, c.ReplicaSet.AuthSource)
+		}
+	}
+}
+
 func setupReplicaSet() *ReplicaSet {
 	return &ReplicaSet{
 		ReplicaSetStateCreator: &ReplicaSetStateCreator{},
 	}
 }
+
+func TestTCPNoDelayDefault(t *testing.T) {
+	t.Parallel()
+	off, on := false, true
+	cases := []struct {
+		TCPNoDelay *bool
+		Expected   bool
+	}{
+		{nil, true},
+		{&on, true},
+		{&off, false},
+	}
+	for _, c := range cases {
+		r := ReplicaSet{TCPNoDelay: c.TCPNoDelay}
+		if r.tcpNoDelay() != c.Expected {
+			t.Fatalf("expected no delay %v for %v", c.Expected, c.TCPNoDelay)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package dvara
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// retryableErrorLabel is the label servers give errors after which a write may
+// be retried, as the server or its connection to the rest of the replica set
+// is in trouble.
+const retryableErrorLabel = "RetryableWriteError"
+
+// retryableCodes are the error codes drivers retry on besides the
+// notMasterCodes: the server is unavailable, or could not reach another
+// member of the replica set.
+var retryableCodes = map[int]bool{
+	ErrorCodeHostUnreachable: true,
+	7:                        true, // HostNotFound
+	89:                       true, // NetworkTimeout
+	9001:                     true, // SocketException
+	13435:                    true, // NotMasterNoSlaveOk
+}
+
+// replyError is the error a server replies with, as found in the first
+// document of a reply: a command failure with ok 0, a query failure with $err,
+// a write concern error or a legacy getLastError.
+type replyError struct {
+	OK                interface{} `bson:"ok"`
+	QueryErr          string      `bson:"$err"`
+	Err               string      `bson:"err"`
+	Code              int         `bson:"code"`
+	Labels            []string    `bson:"errorLabels"`
+	WriteConcernError *struct {
+		Code int `bson:"code"`
+	} `bson:"writeConcernError"`
+}
+
+// parseReplyError returns the error in the document, if it may have one.
+func parseReplyError(doc []byte) (replyError, bool) {
+	var e replyError
+	if doc == nil || (!bytes.Contains(doc, []byte("code")) && !bytes.Contains(doc, []byte("not master"))) {
+		return e, false
+	}
+	return e, bson.Unmarshal(doc, &e) == nil
+}
+
+// failed tells if the reply is an error rather than a document which happens
+// to have a code field. A legacy getLastError reporting an error has ok 1 and
+// the error in err.
+func (e *replyError) failed() bool {
+	if e.QueryErr != "" || e.Err != "" || e.WriteConcernError != nil {
+		return true
+	}
+	switch ok := e.OK.(type) {
+	case float64:
+		return ok == 0
+	case int:
+		return ok == 0
+	case int64:
+		return ok == 0
+	case bool:
+		return !ok
+	}
+	return false
+}
+
+// codes returns the error codes of the reply, including that of a write
+// concern error.
+func (e *replyError) codes() []int {
+	var codes []int
+	if e.Code != 0 {
+		codes = append(codes, e.Code)
+	}
+	if e.WriteConcernError != nil && e.WriteConcernError.Code != 0 {
+		codes = append(codes, e.WriteConcernError.Code)
+	}
+	return codes
+}
+
+// notMaster tells if the error shows the server is no longer primary.
+func (e *replyError) notMaster() bool {
+	if !e.failed() {
+		return false
+	}
+	if e.Err == "not master" {
+		return true
+	}
+	for _, code := range e.codes() {
+		if notMasterCodes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable tells if the error is one drivers retry on, as it comes from the
+// server being in trouble rather than from the operation.
+func (e *replyError) retryable() bool {
+	if !e.failed() {
+		return false
+	}
+	for _, label := range e.Labels {
+		if label == retryableErrorLabel {
+			return true
+		}
+	}
+	for _, code := range e.codes() {
+		if retryableCodes[code] || notMasterCodes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReplyError acts on the error the server replied with, if any. A server
+// which is no longer primary is handled by primaryStepdown, as is one which
+// replied with RetryableErrorThreshold retryable errors in a row. It returns
+// true if the server connection was retired.
+func (p *Proxy) checkReplyError(server net.Conn, doc []byte) bool {
+	e, ok := parseReplyError(doc)
+	if !ok || !e.failed() {
+		p.replySucceeded()
+		return false
+	}
+	if p.ReplicaSet.ReplyErrorStats {
+		for _, code := range e.codes() {
+			stats.BumpSum(p.stats, "server.reply.error."+strconv.Itoa(code), 1)
+		}
+	}
+	if e.notMaster() {
+		p.primaryStepdown(server)
+		return true
+	}
+	if !e.retryable() {
+		p.replySucceeded()
+		return false
+	}
+	stats.BumpSum(p.stats, "server.reply.retryable", 1)
+	threshold := p.ReplicaSet.RetryableErrorThreshold
+	if threshold == 0 || atomic.AddUint32(&p.retryableErrors, 1) != uint32(threshold) {
+		return false
+	}
+	stats.BumpSum(p.stats, "server.reply.retryable.failover", 1)
+	corelog.LogErrorMessage(fmt.Sprintf(
+		"%d replies in a row from backend %s had retryable errors, the last with codes %v, treating it as stepped down",
+		threshold, backendAddr(server), e.codes()))
+	p.primaryStepdown(server)
+	return true
+}
+
+// replySucceeded resets the count of retryable errors in a row.
+func (p *Proxy) replySucceeded() {
+	if p.ReplicaSet.RetryableErrorThreshold > 0 && atomic.LoadUint32(&p.retryableErrors) != 0 {
+		atomic.StoreUint32(&p.retryableErrors, 0)
+	}
+}
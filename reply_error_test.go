@@ -0,0 +1,90 @@
+package dvara
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestReplyError(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Reply     bson.M
+		Failed    bool
+		NotMaster bool
+		Retryable bool
+	}{
+		{bson.M{"ok": 0, "errmsg": "duplicate", "code": 11000}, true, false, false},
+		{bson.M{"ok": 0, "code": 11000, "errorLabels": []string{"RetryableWriteError"}}, true, false, true},
+		{bson.M{"ok": 0.0, "errmsg": "unreachable", "code": 6}, true, false, true},
+		{bson.M{"$err": "not master and slaveOk=false", "code": 13435}, true, false, true},
+		{bson.M{"ok": false, "errmsg": "stepped down", "code": 189}, true, true, true},
+		{bson.M{"ok": 1, "writeConcernError": bson.M{"code": 91, "errmsg": "shutting down"}}, true, true, true},
+		{bson.M{"ok": 1, "err": "not master", "code": 10058}, true, true, true},
+		// A document which merely has a code field is no error.
+		{bson.M{"_id": 1, "code": 6, "errorLabels": []string{"RetryableWriteError"}}, false, false, false},
+	}
+	for _, c := range cases {
+		doc, err := bson.Marshal(c.Reply)
+		ensure.Nil(t, err)
+		e, ok := parseReplyError(doc)
+		ensure.True(t, ok, c.Reply)
+		ensure.DeepEqual(t, e.failed(), c.Failed, c.Reply)
+		ensure.DeepEqual(t, e.notMaster(), c.NotMaster, c.Reply)
+		ensure.DeepEqual(t, e.retryable(), c.Retryable, c.Reply)
+	}
+	// Documents without a code aren't looked at.
+	_, ok := parseReplyError(nil)
+	ensure.False(t, ok)
+	doc, err := bson.Marshal(bson.M{"ok": 1})
+	ensure.Nil(t, err)
+	_, ok = parseReplyError(doc)
+	ensure.False(t, ok)
+}
+
+func TestCheckReplyError(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	var steppedDown []string
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			RetryableErrorThreshold: 2,
+			ReplyErrorStats:         true,
+			OnPrimaryStepdown: func(addr string) {
+				steppedDown = append(steppedDown, addr)
+			},
+		},
+		Clock: clock.NewMock(),
+		stats: &rec,
+	}
+	p.serverPool = &Pool{Max: 1, IdleTimeout: time.Hour, ClosePoolSize: 1, Clock: clock.New()}
+	defer p.serverPool.Close()
+	marshal := func(m bson.M) []byte {
+		doc, err := bson.Marshal(m)
+		ensure.Nil(t, err)
+		return doc
+	}
+	retryable := marshal(bson.M{"ok": 0, "code": 89, "errmsg": "network timeout"})
+	success := marshal(bson.M{"ok": 1})
+	server := &serverConn{Conn: &bufferConn{}, backend: "mongo:27017"}
+
+	// A success in between starts the count again.
+	for _, doc := range [][]byte{retryable, success, retryable} {
+		ensure.False(t, p.checkReplyError(server, doc))
+	}
+	ensure.DeepEqual(t, len(steppedDown), 0)
+	ensure.True(t, p.checkReplyError(server, retryable))
+	ensure.DeepEqual(t, steppedDown, []string{"mongo:27017"})
+	ensure.True(t, server.stale)
+	// Once until a reply succeeds again.
+	ensure.False(t, p.checkReplyError(server, retryable))
+	ensure.DeepEqual(t, len(steppedDown), 1)
+
+	ensure.DeepEqual(t, rec.sum("server.reply.retryable"), float64(4))
+	ensure.DeepEqual(t, rec.sum("server.reply.retryable.failover"), float64(1))
+	ensure.DeepEqual(t, rec.sum("server.reply.error.89"), float64(4))
+	ensure.DeepEqual(t, rec.sum("server.reply.error.1"), float64(0))
+}
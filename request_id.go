@@ -0,0 +1,113 @@
+package dvara
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// nextRequestID returns the request ID to send the next message to a server
+// with.
+func (p *Proxy) nextRequestID() int32 {
+	return atomic.AddInt32(&p.lastRequestID, 1)
+}
+
+// upstreamConn sends a client message to a server under a request ID of the
+// proxy's choosing, and hands the response back as the response to the client's
+// own request ID. Clients number their requests independently, so forwarding
+// their IDs as is would have requests from different clients share an ID on a
+// pooled server connection, and responses could not be told apart should they
+// ever be pipelined.
+type upstreamConn struct {
+	io.ReadWriter
+	requestID       int32
+	clientRequestID int32
+
+	// The header of the message being written is held until complete, after
+	// which the rest of the message is passed through.
+	writeHeader    [headerLen]byte
+	writeHeaderLen int
+	writeRemaining int
+
+	// The message being read is passed through as it is read, patching the
+	// responseTo field on the way.
+	readHeader    [headerLen]byte
+	readPos       int
+	readRemaining int
+}
+
+func (p *Proxy) upstreamConn(h *messageHeader, server io.ReadWriter) *upstreamConn {
+	return &upstreamConn{
+		ReadWriter:      server,
+		requestID:       p.nextRequestID(),
+		clientRequestID: h.RequestID,
+	}
+}
+
+func (c *upstreamConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		if c.writeRemaining > 0 {
+			n := len(b)
+			if n > c.writeRemaining {
+				n = c.writeRemaining
+			}
+			n, err := c.ReadWriter.Write(b[:n])
+			written += n
+			c.writeRemaining -= n
+			if err != nil {
+				return written, err
+			}
+			b = b[n:]
+			continue
+		}
+
+		n := copy(c.writeHeader[c.writeHeaderLen:], b)
+		c.writeHeaderLen += n
+		b = b[n:]
+		if c.writeHeaderLen < headerLen {
+			written += n
+			break
+		}
+		c.writeHeaderLen = 0
+		setInt32(c.writeHeader[:], 4, c.requestID)
+		if _, err := c.ReadWriter.Write(c.writeHeader[:]); err != nil {
+			return written, err
+		}
+		written += n
+		c.writeRemaining = int(getInt32(c.writeHeader[:], 0)) - headerLen
+	}
+	return written, nil
+}
+
+func (c *upstreamConn) Read(b []byte) (int, error) {
+	n, err := c.ReadWriter.Read(b)
+	var responseTo [4]byte
+	setInt32(responseTo[:], 0, c.clientRequestID)
+	for i := 0; i < n; {
+		if c.readPos < headerLen {
+			for ; i < n && c.readPos < headerLen; i, c.readPos = i+1, c.readPos+1 {
+				c.readHeader[c.readPos] = b[i]
+				if c.readPos >= 8 && c.readPos < 12 {
+					b[i] = responseTo[c.readPos-8]
+				}
+			}
+			if c.readPos == headerLen {
+				c.readRemaining = int(getInt32(c.readHeader[:], 0)) - headerLen
+				if c.readRemaining <= 0 {
+					c.readPos = 0
+				}
+			}
+			continue
+		}
+		k := n - i
+		if k > c.readRemaining {
+			k = c.readRemaining
+		}
+		i += k
+		c.readRemaining -= k
+		if c.readRemaining == 0 {
+			c.readPos = 0
+		}
+	}
+	return n, err
+}
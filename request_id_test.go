@@ -0,0 +1,96 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"testing/iotest"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// responseTo sets the responseTo field of the message.
+func responseTo(msg []byte, requestID int32) []byte {
+	setInt32(msg, 8, requestID)
+	return msg
+}
+
+// recordingConn records what is written to the connection.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+func TestUpstreamConn(t *testing.T) {
+	t.Parallel()
+	query := queryMessage(t, 7, "test.foo", bson.M{"a": 1})
+	reply := responseTo(replyMessage(0, 0), 100)
+	server := &bufferConn{r: bytes.NewReader(append(append([]byte(nil), reply...), reply...))}
+	p := &Proxy{lastRequestID: 99}
+	c := p.upstreamConn(&messageHeader{RequestID: 7}, server)
+
+	// Writes of any size, even splitting the header, go out under the proxy's
+	// request ID.
+	for _, b := range query {
+		n, err := c.Write([]byte{b})
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, n, 1)
+	}
+	_, err := c.Write(query)
+	ensure.Nil(t, err)
+	expected := append([]byte(nil), query...)
+	setInt32(expected, 4, 100)
+	ensure.DeepEqual(t, server.w.Bytes(), append(append([]byte(nil), expected...), expected...))
+
+	// Responses come back to the client's request ID, however they are read.
+	var read bytes.Buffer
+	ensure.Nil(t, copyMessage(&read, iotest.OneByteReader(c)))
+	ensure.Nil(t, copyMessage(&read, c))
+	ensure.DeepEqual(t, read.Bytes(), append(responseTo(reply, 7), reply...))
+}
+
+func TestProxyMessageRequestIDs(t *testing.T) {
+	t.Parallel()
+	p := newLoopbackProxy(t)
+	conn, err := p.newServerConn()
+	ensure.Nil(t, err)
+	defer conn.Close()
+	server := &recordingConn{Conn: conn.(net.Conn)}
+
+	// Two clients using the same request ID on the same server connection.
+	var lastError LastError
+	msgs := [][]byte{
+		queryMessage(t, 1, "test.foo", bson.M{"a": "b"}),
+		queryMessage(t, 1, "admin.$cmd", bson.M{"isMaster": 1}),
+	}
+	getMore := messageHeader{OpCode: OpGetMore, RequestID: 1}
+	body := getMoreBody("test.foo", 5)
+	getMore.MessageLength = int32(headerLen + len(body))
+	msgs = append(msgs, append(getMore.ToWire(), body...))
+	for _, msg := range msgs {
+		var h messageHeader
+		h.FromWire(msg)
+		client := &bufferConn{r: bytes.NewReader(msg[headerLen:])}
+		ensure.Nil(t, p.proxyMessage(&h, nil, client, server, &lastError))
+		reply, err := readHeader(&client.w)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, reply.ResponseTo, int32(1))
+	}
+
+	seen := make(map[int32]bool)
+	for server.written.Len() > 0 {
+		var b bytes.Buffer
+		ensure.Nil(t, copyMessage(&b, &server.written))
+		h, err := readHeader(&b)
+		ensure.Nil(t, err)
+		ensure.False(t, seen[h.RequestID])
+		seen[h.RequestID] = true
+	}
+	ensure.DeepEqual(t, len(seen), len(msgs))
+}
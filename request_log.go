@@ -0,0 +1,78 @@
+package dvara
+
+import (
+	"sync/atomic"
+	"time"
+
+	corelog "github.com/intercom/gocore/log"
+)
+
+// requestLogger picks the requests which are logged, see RequestLogSampling.
+// Sampling is a counter per kind of request, so it costs one atomic add.
+type requestLogger struct {
+	all      sampler
+	commands map[string]*sampler
+	slow     time.Duration
+}
+
+// sampler picks one in every n of the calls to sample. It picks none if every
+// is 0.
+type sampler struct {
+	every uint64
+	seen  uint64 // atomic
+}
+
+func (s *sampler) sample() bool {
+	return s.every > 0 && atomic.AddUint64(&s.seen, 1)%s.every == 0
+}
+
+// newRequestLogger returns the request logger for the ReplicaSet, or nil if
+// no request is to be logged.
+func newRequestLogger(r *ReplicaSet) *requestLogger {
+	if r.RequestLogSampling == 0 && len(r.RequestLogCommandSampling) == 0 && r.SlowRequestThreshold == 0 {
+		return nil
+	}
+	l := &requestLogger{
+		all:      sampler{every: uint64(r.RequestLogSampling)},
+		commands: make(map[string]*sampler, len(r.RequestLogCommandSampling)),
+		slow:     r.SlowRequestThreshold,
+	}
+	for name, every := range r.RequestLogCommandSampling {
+		l.commands[name] = &sampler{every: uint64(every)}
+	}
+	return l
+}
+
+// logs returns why the request is logged, if it is.
+func (l *requestLogger) logs(kind string, dur time.Duration) (string, bool) {
+	if l.slow > 0 && dur >= l.slow {
+		return "slow", true
+	}
+	s, ok := l.commands[kind]
+	if !ok {
+		s = &l.all
+	}
+	return "sampled", s.sample()
+}
+
+// requestKind names a message for RequestLogCommandSampling: the command it
+// runs, "find" for a plain query, or else its opcode.
+func (p *Proxy) requestKind(h *messageHeader, query []byte) string {
+	if h.OpCode == OpQuery && query != nil {
+		if name, ok := p.ReplicaSet.namespaces().operationName(query); ok {
+			return name
+		}
+	}
+	return h.OpCode.String()
+}
+
+// logRequest logs a proxied request if it is sampled or slow. Failed requests
+// are always logged, as they are proxied.
+func (p *Proxy) logRequest(h *messageHeader, query []byte, remoteIP, backend string, dur time.Duration) {
+	kind := p.requestKind(h, query)
+	if why, ok := p.requestLog.logs(kind, dur); ok {
+		corelog.LogInfoMessage("request",
+			"proxy", p.String(), "client", remoteIP, "backend", backend,
+			"kind", kind, "duration", dur, "logged", why)
+	}
+}
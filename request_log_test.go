@@ -0,0 +1,70 @@
+package dvara
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRequestLoggerDisabled(t *testing.T) {
+	t.Parallel()
+	ensure.True(t, newRequestLogger(&ReplicaSet{}) == nil)
+}
+
+func TestRequestLoggerSampling(t *testing.T) {
+	t.Parallel()
+	l := newRequestLogger(&ReplicaSet{
+		RequestLogSampling:        3,
+		RequestLogCommandSampling: map[string]uint{"getMore": 0, "dropIndexes": 1},
+		SlowRequestThreshold:      time.Second,
+	})
+	count := func(kind string, dur time.Duration) (logged int, why string) {
+		for i := 0; i < 9; i++ {
+			if reason, ok := l.logs(kind, dur); ok {
+				logged++
+				why = reason
+			}
+		}
+		return logged, why
+	}
+	cases := []struct {
+		Kind   string
+		Dur    time.Duration
+		Logged int
+		Why    string
+	}{
+		{"find", time.Millisecond, 3, "sampled"},
+		{"getMore", time.Millisecond, 0, ""},
+		{"getMore", time.Second, 9, "slow"},
+		{"dropIndexes", time.Millisecond, 9, "sampled"},
+	}
+	for _, c := range cases {
+		logged, why := count(c.Kind, c.Dur)
+		ensure.DeepEqual(t, logged, c.Logged, c.Kind)
+		ensure.DeepEqual(t, why, c.Why, c.Kind)
+	}
+}
+
+func TestRequestKind(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}}
+	cases := []struct {
+		Msg  []byte
+		Kind string
+	}{
+		{queryMessage(t, 1, "test.$cmd", bson.D{{Name: "count", Value: "foo"}}), "count"},
+		{queryMessage(t, 1, "test.foo", bson.M{"a": 1}), "find"},
+		{legacyWriteMessage(t, OpInsert, "test.foo"), "INSERT"},
+	}
+	for _, c := range cases {
+		var h messageHeader
+		h.FromWire(c.Msg)
+		var query []byte
+		if h.OpCode == OpQuery {
+			query = c.Msg[headerLen:]
+		}
+		ensure.DeepEqual(t, p.requestKind(&h, query), c.Kind)
+	}
+}
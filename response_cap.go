@@ -0,0 +1,97 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+var errResponseCapped = errors.New("dvara: response exceeds MaxResponseBytes")
+
+// responseCap reads the header of a reply ahead of the rest, and fails the read
+// if the reply would take the bytes returned for the cursor over the allowance.
+// Nothing of a capped reply reaches the client, the rest of it is left on the
+// server connection for capResponse to deal with.
+type responseCap struct {
+	net.Conn
+	allowance int
+	header    [headerLen]byte
+	handedOut int
+	full      bool
+}
+
+func (c *responseCap) Read(b []byte) (int, error) {
+	if !c.full {
+		if _, err := io.ReadFull(c.Conn, c.header[:]); err != nil {
+			return 0, err
+		}
+		c.full = true
+		if c.length() > c.allowance {
+			return 0, errResponseCapped
+		}
+	}
+	if c.handedOut < headerLen {
+		n := copy(b, c.header[c.handedOut:])
+		c.handedOut += n
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// length returns the length of the reply, once its header was read.
+func (c *responseCap) length() int {
+	if !c.full {
+		return 0
+	}
+	return int(getInt32(c.header[:], 0))
+}
+
+// capResponseIf wraps the server connection to enforce MaxResponseBytes on the
+// reply to a query or getMore, or returns nil if it doesn't apply.
+func (p *Proxy) capResponseIf(h *messageHeader, server net.Conn, cursorIDs []int64, cursors *cursorAffinity) *responseCap {
+	max := int(p.ReplicaSet.MaxResponseBytes)
+	if max == 0 || (h.OpCode != OpQuery && h.OpCode != OpGetMore) {
+		return nil
+	}
+	allowance := max
+	if len(cursorIDs) > 0 {
+		allowance -= cursors.returned(cursorIDs[0])
+	}
+	return &responseCap{Conn: server, allowance: allowance}
+}
+
+// capResponse handles a reply which responseCap refused. The reply is discarded,
+// the cursor it belongs to killed and the client gets an error instead.
+func (p *Proxy) capResponse(h *messageHeader, client net.Conn, capped *responseCap, cursors *cursorAffinity) error {
+	stats.BumpSum(p.stats, "response.capped", 1)
+	// int32 responseFlags, int64 cursorID, int32 startingFrom,
+	// int32 numberReturned
+	var prefix [20]byte
+	rest := int64(capped.length() - headerLen)
+	var cursorID int64
+	if rest >= int64(len(prefix)) {
+		if _, err := io.ReadFull(capped.Conn, prefix[:]); err != nil {
+			return err
+		}
+		rest -= int64(len(prefix))
+		cursorID = getInt64(prefix[:], 4)
+	}
+	if _, err := io.CopyN(ioutil.Discard, capped.Conn, rest); err != nil {
+		return err
+	}
+	if cursorID != 0 {
+		if _, err := capped.Conn.Write(killCursorsMessage(cursorID)); err != nil {
+			return err
+		}
+		cursors.unpin(cursorID)
+	}
+	corelog.LogInfoMessage("response capped",
+		"proxy", p.String(), "length", capped.length(), "allowance", capped.allowance)
+	msg := fmt.Sprintf("dvara: response exceeds the %d bytes allowed per query", p.ReplicaSet.MaxResponseBytes)
+	return writeErrorResponse(client, h, ErrorCodeResponseCapped, msg)
+}
@@ -0,0 +1,84 @@
+package dvara
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func newCappedProxy(max uint, hc stats.Client) *Proxy {
+	return &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout:   time.Second,
+			MaxResponseBytes: max,
+			ProxyQuery:       &ProxyQuery{},
+		},
+		Clock: clock.NewMock(),
+		stats: hc,
+	}
+}
+
+// errorReplyCode returns the code of the error reply in the message.
+func errorReplyCode(t *testing.T, msg []byte) int {
+	h, err := readHeader(bytes.NewReader(msg))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, int(h.MessageLength), len(msg))
+	ensure.DeepEqual(t, getInt32(msg, headerLen)&replyQueryFailure, int32(replyQueryFailure))
+	doc := bson.M{}
+	ensure.Nil(t, bson.Unmarshal(msg[headerLen+len(emptyPrefix):], &doc))
+	return doc["code"].(int)
+}
+
+func TestMaxResponseBytesGetMore(t *testing.T) {
+	t.Parallel()
+	reply := replyMessage(0, 5)
+	hc := &statsRecorder{}
+	p := newCappedProxy(uint(2*len(reply)-1), hc)
+	server := &bufferConn{r: bytes.NewReader(append(append([]byte(nil), reply...), reply...))}
+	cursors := newCursorAffinity(nil)
+	cursors.pin(5, server)
+
+	// The first batch fits, the second would go over.
+	body := getMoreBody("test.foo", 5)
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), RequestID: 3, OpCode: OpGetMore}
+	var lastError LastError
+	client := &bufferConn{r: bytes.NewReader(body)}
+	ensure.Nil(t, p.proxyCursorMessage(h, nil, client, server, &lastError, []int64{5}, cursors))
+	ensure.DeepEqual(t, client.w.Bytes(), responseTo(replyMessage(0, 5), 3))
+	ensure.DeepEqual(t, cursors.returned(5), len(reply))
+	ensure.DeepEqual(t, hc.sum("response.capped"), float64(0))
+
+	client = &bufferConn{r: bytes.NewReader(body)}
+	ensure.Nil(t, p.proxyCursorMessage(h, nil, client, server, &lastError, []int64{5}, cursors))
+	ensure.DeepEqual(t, errorReplyCode(t, client.w.Bytes()), ErrorCodeResponseCapped)
+	ensure.DeepEqual(t, hc.sum("response.capped"), float64(1))
+	ensure.False(t, cursors.pinned(server))
+	ensure.DeepEqual(t, cursors.returned(5), 0)
+	ensure.True(t, bytes.HasSuffix(server.w.Bytes(), killCursorsMessage(5)))
+	ensure.DeepEqual(t, server.r.Len(), 0)
+}
+
+func TestMaxResponseBytesQuery(t *testing.T) {
+	t.Parallel()
+	hc := &statsRecorder{}
+	p := newCappedProxy(10, hc)
+	body := queryBody(t, "test.foo", bson.M{})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), RequestID: 4, OpCode: OpQuery}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	server := &bufferConn{r: bytes.NewReader(replyMessage(0, 8))}
+	cursors := newCursorAffinity(nil)
+
+	var lastError LastError
+	ensure.Nil(t, p.proxyCursorMessage(h, nil, client, server, &lastError, nil, cursors))
+	ensure.DeepEqual(t, errorReplyCode(t, client.w.Bytes()), ErrorCodeResponseCapped)
+	ensure.DeepEqual(t, getInt32(client.w.Bytes(), 8), int32(4))
+	ensure.DeepEqual(t, hc.sum("response.capped"), float64(1))
+	_, pinned := cursors.owner([]int64{8})
+	ensure.False(t, pinned)
+	ensure.True(t, bytes.HasSuffix(server.w.Bytes(), killCursorsMessage(8)))
+}
@@ -19,9 +19,6 @@ var (
 		false,
 		"if true all queries will be proxied and logger",
 	)
-
-	adminCollectionName = []byte("admin.$cmd\000")
-	cmdCollectionSuffix = []byte(".$cmd\000")
 )
 
 //https: //github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.err#L16
@@ -34,12 +31,14 @@ type ProxyQuery struct {
 	ReplSetGetStatusResponseRewriter *ReplSetGetStatusResponseRewriter `inject:""`
 }
 
-// Proxy proxies an OpQuery and a corresponding response.
+// Proxy proxies an OpQuery and a corresponding response. The ReplicaSet
+// provides the configuration for rewriting queries and may be nil.
 func (p *ProxyQuery) Proxy(
 	h *messageHeader,
 	client io.ReadWriter,
 	server io.ReadWriter,
 	lastError *LastError,
+	replicaSet *ReplicaSet,
 ) error {
 
 	// https://github.com/mongodb/mongo/search?q=lastError.disableForCommand
@@ -48,6 +47,13 @@ func (p *ProxyQuery) Proxy(
 	// layer.
 	resetLastError := true
 
+	// Reads are bounded to the message, so a malformed one fails rather than
+	// running into the next message.
+	client = struct {
+		io.Reader
+		io.Writer
+	}{io.LimitReader(client, int64(h.MessageLength-headerLen)), client}
+
 	parts := [][]byte{h.ToWire()}
 
 	var flags [4]byte
@@ -65,7 +71,9 @@ func (p *ProxyQuery) Proxy(
 	parts = append(parts, fullCollectionName)
 
 	var rewriter responseRewriter
-	if *proxyAllQueries || bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) {
+	ns := replicaSet.namespaces()
+	traced := replicaSet != nil && replicaSet.InjectTraceComment
+	if *proxyAllQueries || traced || ns.isCommandNamespace(fullCollectionName) {
 		var twoInt32 [8]byte
 		if _, err := io.ReadFull(client, twoInt32[:]); err != nil {
 			corelog.LogError("error", err)
@@ -96,10 +104,45 @@ func (p *ProxyQuery) Proxy(
 			)
 		}
 
-		if hasKey(q, "isMaster") {
-			rewriter = p.IsMasterResponseRewriter
+		if newQ, ok := replicaSet.applyWriteConcern(databaseName(fullCollectionName), q); ok {
+			corelog.LogInfoMessage(fmt.Sprintf("rewriting writeConcern for %s: %v", q[0].Value, newQ))
+			if err := replaceQueryDocument(h, parts, len(parts)-1, newQ); err != nil {
+				corelog.LogError("error", err)
+				return err
+			}
+			q = newQ
+		}
+
+		command := ns.isCommandNamespace(fullCollectionName)
+		if field := replicaSet.traceCommentField(command, q); field != "" {
+			traceID := newTraceID()
+			if newQ, ok := injectTraceComment(q, field, traceID); ok {
+				if err := replaceQueryDocument(h, parts, len(parts)-1, newQ); err != nil {
+					corelog.LogError("error", err)
+					return err
+				}
+				corelog.LogInfoMessage("traced query", "trace", traceID,
+					"ns", string(bytes.TrimSuffix(fullCollectionName, []byte{x00})), "first", q[0].Name)
+			}
+		}
+
+		// hello is the newer name of isMaster, the response is the same and
+		// needs its hosts mapped to the proxies too.
+		if hasKey(q, "isMaster") || hasKey(q, "hello") {
+			handshake := &handshakeResponseRewriter{
+				IsMasterResponseRewriter: p.IsMasterResponseRewriter,
+				SetName:                  replicaSet.advertisedSetName(),
+			}
+			if newQ, offered, ok := stripCompression(q); ok {
+				if err := replaceQueryDocument(h, parts, len(parts)-1, newQ); err != nil {
+					corelog.LogError("error", err)
+					return err
+				}
+				handshake.Compression = replicaSet.negotiateCompression(offered)
+			}
+			rewriter = handshake
 		}
-		if bytes.Equal(adminCollectionName, fullCollectionName) && hasKey(q, "replSetGetStatus") {
+		if ns.isAdminCommandNamespace(fullCollectionName) && hasKey(q, "replSetGetStatus") {
 			rewriter = p.ReplSetGetStatusResponseRewriter
 		}
 
@@ -319,6 +362,7 @@ type isMasterResponse struct {
 	Hosts    []string `bson:"hosts,omitempty"`
 	Primary  string   `bson:"primary,omitempty"`
 	Me       string   `bson:"me,omitempty"`
+	SetName  string   `bson:"setName,omitempty"`
 	Extra    bson.M   `bson:",inline"`
 }
 
@@ -330,6 +374,25 @@ type IsMasterResponseRewriter struct {
 
 // Rewrite rewrites the response for the "isMaster" query.
 func (r *IsMasterResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
+	return r.rewrite(client, server, nil, "")
+}
+
+// handshakeResponseRewriter rewrites the response for an "isMaster" query
+// depending on the request and the ReplicaSet: it adds the compressors agreed
+// on with the client, if it offered any, and replaces the replica set name
+// with SetName if set.
+type handshakeResponseRewriter struct {
+	*IsMasterResponseRewriter
+	Compression []string
+	SetName     string
+}
+
+// Rewrite rewrites the response for the "isMaster" query.
+func (r *handshakeResponseRewriter) Rewrite(client io.Writer, server io.Reader) error {
+	return r.rewrite(client, server, r.Compression, r.SetName)
+}
+
+func (r *IsMasterResponseRewriter) rewrite(client io.Writer, server io.Reader, compression []string, setName string) error {
 	var err error
 	var q isMasterResponse
 	h, prefix, docLen, err := r.ReplyRW.ReadOne(server, &q)
@@ -378,6 +441,17 @@ func (r *IsMasterResponseRewriter) Rewrite(client io.Writer, server io.Reader) e
 		}
 	}
 
+	if setName != "" && q.SetName != "" {
+		q.SetName = setName
+	}
+
+	if len(compression) != 0 {
+		if q.Extra == nil {
+			q.Extra = bson.M{}
+		}
+		q.Extra["compression"] = compression
+	}
+
 	return r.ReplyRW.WriteOne(client, h, prefix, docLen, q)
 }
 
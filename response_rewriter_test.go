@@ -83,18 +83,18 @@ func TestResponseRWReadOne(t *testing.T) {
 		},
 		{
 			Name:   "non reply op",
-			Server: bytes.NewReader((messageHeader{OpCode: OpDelete}).ToWire()),
+			Server: bytes.NewReader((messageHeader{MessageLength: headerLen, OpCode: OpDelete}).ToWire()),
 			Error:  "expected op REPLY, got DELETE",
 		},
 		{
 			Name:   "EOF before flags",
-			Server: bytes.NewReader((messageHeader{OpCode: OpReply}).ToWire()),
+			Server: bytes.NewReader((messageHeader{MessageLength: headerLen, OpCode: OpReply}).ToWire()),
 			Error:  "EOF",
 		},
 		{
 			Name: "more than 1 document",
 			Server: fakeReader(
-				messageHeader{OpCode: OpReply},
+				messageHeader{MessageLength: headerLen, OpCode: OpReply},
 				[]byte{
 					0, 0, 0, 0,
 					0, 0, 0, 0, 0, 0, 0, 0,
@@ -107,7 +107,7 @@ func TestResponseRWReadOne(t *testing.T) {
 		{
 			Name: "EOF before document",
 			Server: fakeReader(
-				messageHeader{OpCode: OpReply},
+				messageHeader{MessageLength: headerLen, OpCode: OpReply},
 				[]byte{
 					0, 0, 0, 0,
 					0, 0, 0, 0, 0, 0, 0, 0,
@@ -120,7 +120,7 @@ func TestResponseRWReadOne(t *testing.T) {
 		{
 			Name: "corrupted document",
 			Server: fakeReader(
-				messageHeader{OpCode: OpReply},
+				messageHeader{MessageLength: headerLen, OpCode: OpReply},
 				[]byte{
 					0, 0, 0, 0,
 					0, 0, 0, 0, 0, 0, 0, 0,
@@ -358,6 +358,7 @@ func TestReplSetGetStatusResponseRewriterAuthFailure(t *testing.T) {
 
 func TestProxyQuery(t *testing.T) {
 	t.Parallel()
+	adminCollectionName := []byte("admin.$cmd\000")
 	var p ProxyQuery
 	var log NoopLogger
 	var graph inject.Graph
@@ -424,8 +425,10 @@ func TestProxyQuery(t *testing.T) {
 			Error: "EOF",
 		},
 		{
-			Name:   "error while unmarshaling query document",
-			Header: &messageHeader{},
+			Name: "error while unmarshaling query document",
+			Header: &messageHeader{
+				MessageLength: int32(headerLen + 4 + len(adminCollectionName) + 8 + 5),
+			},
 			Client: fakeReadWriter{
 				Reader: io.MultiReader(
 					bytes.NewReader([]byte{0, 0, 0, 0}), // flags int32 before collection name
@@ -444,9 +447,108 @@ func TestProxyQuery(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		err := p.Proxy(c.Header, c.Client, nil, nil)
+		err := p.Proxy(c.Header, c.Client, nil, nil, nil)
 		if err == nil || !strings.Contains(err.Error(), c.Error) {
 			t.Fatalf("did not find expected error for %s, instead found %s", c.Name, err)
 		}
 	}
 }
+
+func TestProxyQueryRewritesHello(t *testing.T) {
+	t.Parallel()
+	q := newLoopbackProxy(t).ReplicaSet.ProxyQuery
+	for _, command := range []string{"isMaster", "ismaster", "hello"} {
+		msg := queryMessage(t, 1, "admin.$cmd", bson.M{command: 1})
+		h, err := readHeader(bytes.NewReader(msg))
+		ensure.Nil(t, err)
+		client := &bufferConn{r: bytes.NewReader(msg[headerLen:])}
+		reply := loopbackIsMaster("loopback:27017")
+		reply["setName"] = "rs0"
+		server := &bufferConn{r: bytes.NewReader(loopbackReply(t, reply))}
+		ensure.Nil(t, q.Proxy(h, client, server, &LastError{}, &ReplicaSet{AdvertisedSetName: "proxied"}))
+
+		var doc bson.M
+		_, _, _, err = (&ReplyRW{}).ReadOne(&client.w, &doc)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, doc["hosts"], []interface{}{"127.0.0.1:6000"})
+		ensure.DeepEqual(t, doc["primary"], "127.0.0.1:6000")
+		ensure.DeepEqual(t, doc["me"], "127.0.0.1:6000")
+		ensure.DeepEqual(t, doc["setName"], "proxied")
+	}
+}
+
+func TestHandshakeResponseRewriterReplicaSet(t *testing.T) {
+	t.Parallel()
+	r := &handshakeResponseRewriter{
+		IsMasterResponseRewriter: &IsMasterResponseRewriter{
+			ProxyMapper: fakeProxyMapper{m: map[string]string{
+				"db1.internal:27017": "proxy:6000",
+				"db2.internal:27017": "proxy:6001",
+				"db3.internal:27017": "proxy:6002",
+			}},
+			ReplyRW: &ReplyRW{},
+		},
+		SetName: "proxied",
+	}
+	hello := bson.M{
+		"topologyVersion":              bson.M{"counter": int64(6)},
+		"hosts":                        []string{"db1.internal:27017", "db2.internal:27017"},
+		"passives":                     []interface{}{"db3.internal:27017"},
+		"arbiters":                     []string{"arb.internal:27017"},
+		"setName":                      "rs0",
+		"setVersion":                   3,
+		"isWritablePrimary":            true,
+		"secondary":                    false,
+		"primary":                      "db1.internal:27017",
+		"me":                           "db1.internal:27017",
+		"electionId":                   "7fffffff0000000000000004",
+		"maxBsonObjectSize":            16777216,
+		"maxMessageSizeBytes":          48000000,
+		"maxWriteBatchSize":            100000,
+		"logicalSessionTimeoutMinutes": 30,
+		"minWireVersion":               0,
+		"maxWireVersion":               13,
+		"readOnly":                     false,
+		"ok":                           1,
+	}
+	var client bytes.Buffer
+	ensure.Nil(t, r.Rewrite(&client, fakeSingleDocReply(hello)))
+	actual := bson.M{}
+	ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &actual))
+	ensure.DeepEqual(t, actual, bson.M{
+		"topologyVersion":              bson.M{"counter": int64(6)},
+		"hosts":                        []interface{}{"proxy:6000", "proxy:6001"},
+		"passives":                     []interface{}{"proxy:6002"},
+		"setName":                      "proxied",
+		"setVersion":                   3,
+		"isWritablePrimary":            true,
+		"secondary":                    false,
+		"primary":                      "proxy:6000",
+		"me":                           "proxy:6000",
+		"electionId":                   "7fffffff0000000000000004",
+		"maxBsonObjectSize":            16777216,
+		"maxMessageSizeBytes":          48000000,
+		"maxWriteBatchSize":            100000,
+		"logicalSessionTimeoutMinutes": 30,
+		"minWireVersion":               0,
+		"maxWireVersion":               13,
+		"readOnly":                     false,
+		"ok":                           1,
+	})
+}
+
+func TestHandshakeResponseRewriterStandalone(t *testing.T) {
+	t.Parallel()
+	r := &handshakeResponseRewriter{
+		IsMasterResponseRewriter: &IsMasterResponseRewriter{
+			ProxyMapper: fakeProxyMapper{},
+			ReplyRW:     &ReplyRW{},
+		},
+		SetName: "proxied",
+	}
+	var client bytes.Buffer
+	ensure.Nil(t, r.Rewrite(&client, fakeSingleDocReply(bson.M{"ismaster": true, "ok": 1})))
+	actual := bson.M{}
+	ensure.Nil(t, bson.Unmarshal(client.Bytes()[headerLen+len(emptyPrefix):], &actual))
+	ensure.DeepEqual(t, actual, bson.M{"ismaster": true, "ok": 1})
+}
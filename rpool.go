@@ -5,6 +5,7 @@ import (
 	"container/list"
 	"errors"
 	"io"
+	"sort"
 	"sync"
 	"time"
 
@@ -16,10 +17,38 @@ var (
 	errPoolClosed  = errors.New("rpool: pool has been closed")
 	errCloseAgain  = errors.New("rpool: Pool.Close called more than once")
 	errWrongPool   = errors.New("rpool: provided resource was not acquired from this pool")
+	errStaleWaiter = errors.New("rpool: waited longer than the maximum queue age")
 	closedSentinel = sentinelCloser(1)
 	newSentinel    = sentinelCloser(2)
+	staleSentinel  = sentinelCloser(3)
 )
 
+// ConnPool is a pool of server connections. Pool is the built-in
+// implementation, a ReplicaSet can supply another one with NewPool.
+type ConnPool interface {
+	// Acquire returns an idle connection or a new one, blocking while the
+	// maximum number of connections are in use.
+	Acquire() (io.Closer, error)
+
+	// Release returns a connection to the pool for reuse.
+	Release(c io.Closer)
+
+	// Discard closes a connection which shouldn't be reused.
+	Discard(c io.Closer)
+
+	// CloseIdle closes the idle connections, used ones are not affected.
+	CloseIdle()
+
+	// SetMax changes the maximum number of connections in use at once.
+	SetMax(max uint)
+
+	// Snapshot returns the current counts of connections.
+	Snapshot() PoolStats
+
+	// Close closes the pool once all connections are released or discarded.
+	Close() error
+}
+
 // Pool manages the life cycle of resources.
 type Pool struct {
 	// New is used to create a new resource when necessary.
@@ -47,30 +76,93 @@ type Pool struct {
 	// resources.
 	ClosePoolSize uint
 
+	// MaxQueueAge if set is how long an Acquire call may be blocked before it
+	// is considered abandoned by its caller. When a resource becomes available
+	// blocked calls which waited longer fail with errStaleWaiter, and the
+	// resource goes to the next one in line.
+	MaxQueueAge time.Duration
+
+	// Retire if set tells if a resource should be closed rather than reused,
+	// for example because it is too old. It is checked as resources are
+	// released, and every RetireInterval for the idle ones. A blocked Acquire
+	// gets a new resource in place of a retired one.
+	Retire func(c io.Closer, now time.Time) bool
+
+	// RetireInterval is how often the idle resources are checked with Retire,
+	// every minute if zero.
+	RetireInterval time.Duration
+
+	// Probe if set checks an idle resource still works, for example that its
+	// peer did not silently go away. Every ProbeInterval the resources idle for
+	// at least as long are probed in the background, checked out meanwhile,
+	// and those failing are closed rather than handed to an Acquire.
+	Probe func(c io.Closer) bool
+
+	// ProbeInterval is how often idle resources are probed, every minute if
+	// zero.
+	ProbeInterval time.Duration
+
 	// Clock allows for testing timing related functionality. Do not specify this
 	// in production code.
 	Clock clock.Clock
 
 	manageOnce sync.Once
 	acquire    chan chan io.Closer
+	tryAcquire chan chan io.Closer
 	new        chan io.Closer
 	release    chan returnResource
 	discard    chan returnResource
+	closeIdle  chan chan struct{}
+	probed     chan probeResult
+	snapshot   chan chan PoolStats
+	setMax     chan setMax
 	close      chan chan error
+
+	// done is closed once the pool is closed and its resources are, for the
+	// requests which may still come after to not block.
+	done chan struct{}
+}
+
+// PoolStats is a point in time view of the resources managed by a Pool.
+type PoolStats struct {
+	// Total is the number of allocated resources, idle or in use.
+	Total uint
+
+	// Idle is the number of resources sitting in the pool.
+	Idle uint
+
+	// InUse is the number of resources currently acquired.
+	InUse uint
+
+	// Waiting is the number of Acquire calls blocked on a resource.
+	Waiting uint
 }
 
 // Acquire will pull a resource from the pool or create a new one if necessary.
+// When Max resources are in use it blocks, and blocked calls are served in the
+// order they arrived in so none of them is starved while the pool is saturated.
 func (p *Pool) Acquire() (io.Closer, error) {
 	p.manageOnce.Do(p.goManage)
 	r := make(chan io.Closer)
-	p.acquire <- r
-	c := <-r
+	var c io.Closer
+	select {
+	case p.acquire <- r:
+		c = <-r
+	case <-p.done:
+		stats.BumpSum(p.Stats, "acquire.error.closed", 1)
+		c = closedSentinel
+	}
 
 	// sentinel value indicates the pool is closed
 	if c == closedSentinel {
 		return nil, errPoolClosed
 	}
 
+	// sentinel value indicates we waited longer than MaxQueueAge
+	if c == staleSentinel {
+		return nil, errStaleWaiter
+	}
+
 	// need to allocate a new resource
 	if c == newSentinel {
 		c, err := p.New()
@@ -88,6 +180,21 @@ func (p *Pool) Acquire() (io.Closer, error) {
 	return c, nil
 }
 
+// TryAcquire pulls an idle resource from the pool, without waiting for one or
+// creating a new one. It returns false if there is no idle resource or the pool
+// is closed.
+func (p *Pool) TryAcquire() (io.Closer, bool) {
+	p.manageOnce.Do(p.goManage)
+	r := make(chan io.Closer)
+	select {
+	case p.tryAcquire <- r:
+	case <-p.done:
+		return nil, false
+	}
+	c := <-r
+	return c, c != nil
+}
+
 // Release puts the resource back into the pool. It will panic if you try to
 // release a resource that wasn't acquired from this pool.
 func (p *Pool) Release(c io.Closer) {
@@ -116,16 +223,73 @@ func (p *Pool) Discard(c io.Closer) {
 	}
 }
 
+// CloseIdle closes all the idle resources currently in the pool. Acquired
+// resources are not affected and are returned to the pool as usual.
+func (p *Pool) CloseIdle() {
+	p.manageOnce.Do(p.goManage)
+	r := make(chan struct{})
+	select {
+	case p.closeIdle <- r:
+		<-r
+	case <-p.done:
+		// a closed pool has no idle resources left
+	}
+}
+
+// Snapshot returns the current counts of resources in the pool, all zero once
+// the pool is closed.
+func (p *Pool) Snapshot() PoolStats {
+	p.manageOnce.Do(p.goManage)
+	r := make(chan PoolStats)
+	select {
+	case p.snapshot <- r:
+		return <-r
+	case <-p.done:
+		return PoolStats{}
+	}
+}
+
+// InUse returns the number of resources currently acquired from the pool.
+func (p *Pool) InUse() uint {
+	return p.Snapshot().InUse
+}
+
+// Idle returns the number of idle resources in the pool.
+func (p *Pool) Idle() uint {
+	return p.Snapshot().Idle
+}
+
+// SetMax changes the maximum number of concurrently allocated resources. When
+// growing, waiting Acquire calls are served right away. When shrinking, excess
+// resources are closed as they are released. It does nothing once the pool is
+// closed.
+func (p *Pool) SetMax(max uint) {
+	if max == 0 {
+		panic("no max configured")
+	}
+	p.manageOnce.Do(p.goManage)
+	r := make(chan struct{})
+	select {
+	case p.setMax <- setMax{max: max, response: r}:
+		<-r
+	case <-p.done:
+	}
+}
+
 // Close closes the pool and its resources. It waits until all acquired
-// resources are released or discarded. It is an error to call Acquire after
-// closing the pool.
+// resources are released or discarded. Acquire calls after closing the pool
+// fail, and closing it again is an error.
 func (p *Pool) Close() error {
 	elapsedTime := stats.BumpTime(p.Stats, "shutdown.time")
 	defer elapsedTime.End()
 	p.manageOnce.Do(p.goManage)
 	r := make(chan error)
-	p.close <- r
-	return <-r
+	select {
+	case p.close <- r:
+		return <-r
+	case <-p.done:
+		return errCloseAgain
+	}
 }
 
 func (p *Pool) goManage() {
@@ -140,10 +304,16 @@ func (p *Pool) goManage() {
 	}
 
 	p.acquire = make(chan chan io.Closer)
+	p.tryAcquire = make(chan chan io.Closer)
 	p.new = make(chan io.Closer)
 	p.release = make(chan returnResource)
 	p.discard = make(chan returnResource)
+	p.closeIdle = make(chan chan struct{})
+	p.probed = make(chan probeResult)
+	p.snapshot = make(chan chan PoolStats)
+	p.setMax = make(chan setMax)
 	p.close = make(chan chan error)
+	p.done = make(chan struct{})
 	go p.manage()
 }
 
@@ -188,6 +358,60 @@ func (p *Pool) manage() {
 	outResources := map[io.Closer]struct{}{}
 	out := uint(0)
 	waiting := list.New()
+
+	// nextWaiter removes the Acquire call which has been waiting the longest
+	// from the queue, failing those which waited longer than MaxQueueAge.
+	nextWaiter := func() chan io.Closer {
+		for e := waiting.Front(); e != nil; e = waiting.Front() {
+			w := waiting.Remove(e).(waiter)
+			if p.MaxQueueAge > 0 && klock.Now().Sub(w.since) > p.MaxQueueAge {
+				w.r <- staleSentinel
+				stats.BumpSum(p.Stats, "stale.waiter.dropped", 1)
+				continue
+			}
+			return w.r
+		}
+		return nil
+	}
+
+	// replace gives up on a resource which was checked out. A new one is made
+	// for whoever has been waiting the longest, if anyone is.
+	replace := func() {
+		// we can make a new one if someone is waiting. no need to decrement out
+		// in this case since we assume this new one is checked out. Acquire will
+		// discard if creating a new resource fails.
+		if out <= p.Max {
+			if r := nextWaiter(); r != nil {
+				r <- newSentinel
+				return
+			}
+		}
+
+		// otherwise we lost a resource and dont need a new one right away
+		out--
+	}
+
+	// setup a ticker to retire idle resources. if we don't have a Retire
+	// function, we Stop it so it never ticks.
+	retireInterval := p.RetireInterval
+	if retireInterval <= 0 {
+		retireInterval = time.Minute
+	}
+	retireTicker := klock.Ticker(retireInterval)
+	if p.Retire == nil {
+		retireTicker.Stop()
+	}
+
+	// setup a ticker to probe idle resources, stopped if we have no Probe.
+	probeInterval := p.ProbeInterval
+	if probeInterval <= 0 {
+		probeInterval = time.Minute
+	}
+	probeTicker := klock.Ticker(probeInterval)
+	if p.Probe == nil {
+		probeTicker.Stop()
+	}
+
 	idleTicker := klock.Ticker(p.IdleTimeout)
 	closed := false
 	var closeResponse chan error
@@ -196,6 +420,12 @@ func (p *Pool) manage() {
 			if p.Stats != nil {
 				statsTicker.Stop()
 			}
+			if p.Retire != nil {
+				retireTicker.Stop()
+			}
+			if p.Probe != nil {
+				probeTicker.Stop()
+			}
 
 			// all waiting acquires are done, all resources have been released.
 			// now just wait for all resources to close.
@@ -203,11 +433,11 @@ func (p *Pool) manage() {
 			closeWG.Wait()
 
 			// close internal channels.
-			close(p.acquire)
 			close(p.new)
 			close(p.release)
 			close(p.discard)
-			close(p.close)
+			close(p.probed)
+			close(p.done)
 
 			// return a response to the original close.
 			closeResponse <- nil
@@ -234,10 +464,12 @@ func (p *Pool) manage() {
 				continue
 			}
 
-			// max resources already in use, need to block & wait
-			if out == p.Max {
-				waiting.PushBack(r)
+			// max resources already in use, need to block & wait at the back of the
+			// queue
+			if out >= p.Max {
+				waiting.PushBack(waiter{r: r, since: klock.Now()})
 				stats.BumpSum(p.Stats, "acquire.waiting", 1)
+				stats.BumpHistogram(p.Stats, "waiters", float64(waiting.Len()))
 				continue
 			}
 
@@ -246,6 +478,18 @@ func (p *Pool) manage() {
 			// creating a new resource fails.
 			out++
 			r <- newSentinel
+		case r := <-p.tryAcquire:
+			cl := len(resources)
+			if closed || cl == 0 {
+				stats.BumpSum(p.Stats, "acquire.try.none", 1)
+				r <- nil
+				continue
+			}
+			c := resources[cl-1]
+			outResources[c.resource] = struct{}{}
+			r <- c.resource
+			resources = resources[:cl-1]
+			out++
 		case c := <-p.new:
 			outResources[c] = struct{}{}
 		case rr := <-p.release:
@@ -256,9 +500,25 @@ func (p *Pool) manage() {
 			}
 			close(rr.response)
 
-			// pass it to someone who's waiting
-			if e := waiting.Front(); e != nil {
-				r := waiting.Remove(e).(chan io.Closer)
+			// it is not to be reused, so close it and make way for a new one
+			if p.Retire != nil && !closed && p.Retire(rr.resource, klock.Now()) {
+				delete(outResources, rr.resource)
+				closers <- rr.resource
+				stats.BumpSum(p.Stats, "retired", 1)
+				replace()
+				continue
+			}
+
+			// we're over max after it was lowered, so close it
+			if out > p.Max {
+				out--
+				delete(outResources, rr.resource)
+				closers <- rr.resource
+				continue
+			}
+
+			// pass it to whoever has been waiting the longest
+			if r := nextWaiter(); r != nil {
 				r <- rr.resource
 				continue
 			}
@@ -286,18 +546,7 @@ func (p *Pool) manage() {
 				delete(outResources, rr.resource)
 				closers <- rr.resource
 			}
-
-			// we can make a new one if someone is waiting. no need to decrement out
-			// in this case since we assume this new one is checked out. Acquire will
-			// discard if creating a new resource fails.
-			if e := waiting.Front(); e != nil {
-				r := waiting.Remove(e).(chan io.Closer)
-				r <- newSentinel
-				continue
-			}
-
-			// otherwise we lost a resource and dont need a new one right away
-			out--
+			replace()
 		case now := <-idleTicker.C:
 			eligibleOffset := len(resources) - int(p.MinIdle)
 
@@ -322,12 +571,123 @@ func (p *Pool) manage() {
 			resources = resources[:copy(resources, resources[idleLen:])]
 
 			t.End()
+		case now := <-retireTicker.C:
+			// idle resources are already being closed if the pool is closed
+			if closed {
+				continue
+			}
+
+			// retire idle resources, keeping the others in order
+			kept := resources[:0]
+			for _, e := range resources {
+				if p.Retire(e.resource, now) {
+					closers <- e.resource
+					stats.BumpSum(p.Stats, "retired", 1)
+					continue
+				}
+				kept = append(kept, e)
+			}
+			resources = kept
+		case now := <-probeTicker.C:
+			if closed {
+				continue
+			}
+
+			// check out the resources idle for a probe interval, the least
+			// recently used being first, while they are probed
+			probing := 0
+			for _, e := range resources {
+				if now.Sub(e.use) < probeInterval {
+					break
+				}
+				outResources[e.resource] = struct{}{}
+				out++
+				probing++
+				go func(e entry) {
+					p.probed <- probeResult{entry: e, alive: p.Probe(e.resource)}
+				}(e)
+			}
+			resources = resources[:copy(resources, resources[probing:])]
+		case pr := <-p.probed:
+			if !pr.alive {
+				delete(outResources, pr.resource)
+				closers <- pr.resource
+				stats.BumpSum(p.Stats, "probe.dead", 1)
+				replace()
+				continue
+			}
+
+			// pass it to whoever has been waiting the longest
+			if out <= p.Max && !closed {
+				if r := nextWaiter(); r != nil {
+					r <- pr.resource
+					continue
+				}
+			}
+
+			out--
+			delete(outResources, pr.resource)
+			if closed || uint(len(resources))+out >= p.Max {
+				closers <- pr.resource
+				continue
+			}
+
+			// put it back in its place by last use, so it still times out as
+			// idle
+			i := sort.Search(len(resources), func(i int) bool {
+				return resources[i].use.After(pr.use)
+			})
+			resources = append(resources, entry{})
+			copy(resources[i+1:], resources[i:])
+			resources[i] = pr.entry
 		case <-statsTicker.C:
 			// We can assume if we hit this then p.Stats is not nil
 			p.Stats.BumpAvg("waiting", float64(waiting.Len()))
 			p.Stats.BumpAvg("idle", float64(len(resources)))
 			p.Stats.BumpAvg("out", float64(out))
 			p.Stats.BumpAvg("alive", float64(uint(len(resources))+out))
+		case r := <-p.closeIdle:
+			// idle resources are already being closed if the pool is closed
+			if closed {
+				close(r)
+				continue
+			}
+			for _, e := range resources {
+				closers <- e.resource
+			}
+			stats.BumpSum(p.Stats, "idle.closed", float64(len(resources)))
+			resources = resources[:0]
+			close(r)
+		case r := <-p.snapshot:
+			r <- PoolStats{
+				Total:   uint(len(resources)) + out,
+				Idle:    uint(len(resources)),
+				InUse:   out,
+				Waiting: uint(waiting.Len()),
+			}
+		case sm := <-p.setMax:
+			if closed {
+				close(sm.response)
+				continue
+			}
+			p.Max = sm.max
+
+			// close idle resources we no longer have room for
+			for len(resources) > 0 && uint(len(resources))+out > p.Max {
+				closers <- resources[0].resource
+				resources = resources[1:]
+			}
+
+			// make new resources for waiters we now have room for
+			for out < p.Max {
+				r := nextWaiter()
+				if r == nil {
+					break
+				}
+				out++
+				r <- newSentinel
+			}
+			close(sm.response)
 		case r := <-p.close:
 			// cant call close if already closing
 			if closed {
@@ -342,12 +702,30 @@ func (p *Pool) manage() {
 			for _, e := range resources {
 				closers <- e.resource
 			}
+			resources = nil
 
 			closeResponse = r
 		}
 	}
 }
 
+// waiter is a blocked Acquire call.
+type waiter struct {
+	r     chan io.Closer
+	since time.Time
+}
+
+// probeResult is an idle resource which was probed with Probe.
+type probeResult struct {
+	entry
+	alive bool
+}
+
+type setMax struct {
+	max      uint
+	response chan struct{}
+}
+
 type returnResource struct {
 	resource io.Closer
 	response chan error
@@ -110,21 +110,9 @@ func TestMax(t *testing.T) {
 
 func TestUseIdle(t *testing.T) {
 	t.Parallel()
-
-	// expected stats
-	statsDone := make(chan struct{})
-	hc := &stats.HookClient{
-		BumpSumHook: func(key string, val float64) {
-			if key == "acquire.pool" {
-				close(statsDone)
-			}
-		},
-	}
-
 	var cm resourceMaker
 	p := Pool{
 		New:           cm.New,
-		Stats:         hc,
 		Max:           1,
 		MinIdle:       1,
 		IdleTimeout:   time.Hour,
@@ -139,11 +127,9 @@ func TestUseIdle(t *testing.T) {
 	// acquire should use the existing one
 	r2, err := p.Acquire()
 	ensure.Nil(t, err)
-
+	ensure.True(t, r2 == r1)
 	p.Release(r2)
 
-	<-statsDone
-
 	ensure.Nil(t, p.Close())
 	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(1))
 	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(1))
@@ -532,3 +518,529 @@ func contains(set []string, key string) bool {
 	}
 	return false
 }
+
+func TestCloseIdle(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           2,
+		MinIdle:       2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r1)
+
+	// the released resource is closed, so the pool makes a new one
+	p.CloseIdle()
+	r3, err := p.Acquire()
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(3))
+
+	p.Release(r2)
+	p.Release(r3)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(3))
+}
+
+func TestRequestsAfterClose(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r)
+	ensure.Nil(t, p.Close())
+
+	// the pool is gone, requests neither block nor panic
+	p.CloseIdle()
+	p.SetMax(3)
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{})
+	_, err = p.Acquire()
+	ensure.DeepEqual(t, err, errPoolClosed)
+	_, ok := p.TryAcquire()
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, p.Close(), errCloseAgain)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(1))
+}
+
+func TestTryAcquire(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	// Nothing is idle, and no resource is made.
+	_, ok := p.TryAcquire()
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, p.Snapshot().Total, uint(0))
+
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r1)
+	r2, ok := p.TryAcquire()
+	ensure.True(t, ok)
+	ensure.True(t, r2 == r1)
+	_, ok = p.TryAcquire()
+	ensure.False(t, ok)
+	ensure.DeepEqual(t, p.Snapshot().InUse, uint(1))
+	p.Release(r2)
+	ensure.Nil(t, p.Close())
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           2,
+		MinIdle:       2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{})
+
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r1)
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 2, Idle: 1, InUse: 1})
+	ensure.DeepEqual(t, p.InUse(), uint(1))
+	ensure.DeepEqual(t, p.Idle(), uint(1))
+
+	r3, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// a third acquire has to wait
+	acquired := make(chan io.Closer)
+	go func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		acquired <- r
+	}()
+	for p.Snapshot().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 2, InUse: 2, Waiting: 1})
+
+	p.Release(r2)
+	p.Release(r3)
+	p.Release(<-acquired)
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 2, Idle: 2})
+	ensure.Nil(t, p.Close())
+}
+
+func TestSetMaxGrowServesWaiters(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	acquired := make(chan io.Closer)
+	go func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		acquired <- r
+	}()
+	for p.Snapshot().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	p.SetMax(2)
+	r2 := <-acquired
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 2, InUse: 2})
+
+	p.Release(r1)
+	p.Release(r2)
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+}
+
+func TestSetMaxShrinkClosesOnRelease(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           3,
+		MinIdle:       3,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	var resources []io.Closer
+	for i := 0; i < 3; i++ {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		resources = append(resources, r)
+	}
+	p.Release(resources[0])
+
+	// the idle one is closed right away
+	p.SetMax(1)
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 2, InUse: 2})
+
+	// releasing while over max closes the resource
+	p.Release(resources[1])
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 1, InUse: 1})
+	p.Release(resources[2])
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 1, Idle: 1})
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(3))
+}
+
+func TestSetMaxZero(t *testing.T) {
+	t.Parallel()
+	defer ensure.PanicDeepEqual(t, "no max configured")
+	var p Pool
+	p.SetMax(0)
+}
+
+func TestAcquireWaitersServedInOrder(t *testing.T) {
+	t.Parallel()
+	var depths []float64
+	hc := &stats.HookClient{
+		BumpHistogramHook: func(key string, val float64) {
+			if key == "waiters" {
+				depths = append(depths, val)
+			}
+		},
+	}
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Stats:         hc,
+		Max:           1,
+		MinIdle:       1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+
+	// queue up the waiters one at a time so their arrival order is known
+	const waiters = 10
+	served := make(chan int)
+	for i := 0; i < waiters; i++ {
+		go func(i int) {
+			r, err := p.Acquire()
+			ensure.Nil(t, err)
+			served <- i
+			p.Release(r)
+		}(i)
+		for p.Snapshot().Waiting != uint(i+1) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	p.Release(r)
+	for i := 0; i < waiters; i++ {
+		ensure.DeepEqual(t, <-served, i)
+	}
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, depths, []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+}
+
+func TestMaxQueueAgeDropsStaleWaiters(t *testing.T) {
+	t.Parallel()
+	for _, discard := range []bool{false, true} {
+		var dropped float64
+		hc := &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "stale.waiter.dropped" {
+					dropped += val
+				}
+			},
+		}
+		klock := clock.NewMock()
+		var cm resourceMaker
+		p := Pool{
+			New:           cm.New,
+			Stats:         hc,
+			Max:           1,
+			IdleTimeout:   time.Hour,
+			ClosePoolSize: 1,
+			MaxQueueAge:   time.Second,
+			Clock:         klock,
+		}
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+
+		stale := make(chan error)
+		go func() {
+			_, err := p.Acquire()
+			stale <- err
+		}()
+		for p.Snapshot().Waiting != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		klock.Add(2 * time.Second)
+
+		fresh := make(chan io.Closer)
+		go func() {
+			r, err := p.Acquire()
+			ensure.Nil(t, err)
+			fresh <- r
+		}()
+		for p.Snapshot().Waiting != 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		if discard {
+			p.Discard(r)
+		} else {
+			p.Release(r)
+		}
+		ensure.DeepEqual(t, <-stale, errStaleWaiter)
+		p.Release(<-fresh)
+		ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 1, Idle: 1})
+		ensure.Nil(t, p.Close())
+		ensure.DeepEqual(t, dropped, float64(1))
+	}
+}
+
+func TestMaxQueueAgeAllStale(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		MaxQueueAge:   time.Second,
+		Clock:         klock,
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	stale := make(chan error)
+	go func() {
+		_, err := p.Acquire()
+		stale <- err
+	}()
+	for p.Snapshot().Waiting != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	klock.Add(2 * time.Second)
+
+	// with nobody left to serve the resource goes back to the pool
+	p.Release(r)
+	ensure.DeepEqual(t, <-stale, errStaleWaiter)
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 1, Idle: 1})
+	ensure.Nil(t, p.Close())
+}
+
+func TestRetireOnRelease(t *testing.T) {
+	t.Parallel()
+	var cm resourceMaker
+	var retired int32
+	var old io.Closer
+	p := Pool{
+		New:           cm.New,
+		Max:           1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Retire: func(c io.Closer, now time.Time) bool {
+			return c == old
+		},
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "retired" {
+					atomic.AddInt32(&retired, int32(val))
+				}
+			},
+		},
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	old = r
+
+	// the waiter gets a new resource in place of the retired one
+	acquired := make(chan io.Closer)
+	go func() {
+		r, err := p.Acquire()
+		ensure.Nil(t, err)
+		acquired <- r
+	}()
+	for p.Snapshot().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p.Release(r)
+	fresh := <-acquired
+	ensure.True(t, fresh != old)
+	ensure.DeepEqual(t, atomic.LoadInt32(&retired), int32(1))
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 1, InUse: 1})
+
+	// resources which are not retired go back to the pool
+	p.Release(fresh)
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 1, Idle: 1})
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.newCount), int32(2))
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
+
+func TestRetireIdle(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	var old io.Closer
+	var expires time.Time
+	p := Pool{
+		New:            cm.New,
+		Max:            2,
+		MinIdle:        2,
+		IdleTimeout:    time.Hour,
+		ClosePoolSize:  1,
+		RetireInterval: time.Minute,
+		Retire: func(c io.Closer, now time.Time) bool {
+			return c == old && !now.Before(expires)
+		},
+		Clock: klock,
+	}
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+	old, expires = r1, klock.Now().Add(90*time.Second)
+	p.Release(r1)
+	p.Release(r2)
+
+	// not old enough yet
+	klock.Add(time.Minute)
+	ensure.DeepEqual(t, p.Snapshot(), PoolStats{Total: 2, Idle: 2})
+
+	klock.Add(time.Minute)
+	for p.Snapshot().Idle != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	ensure.True(t, r == r2)
+	p.Release(r)
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
+
+func TestProbeIdle(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	var dead io.Closer
+	var probed, reaped int32
+	p := Pool{
+		New:           cm.New,
+		Max:           3,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		ProbeInterval: time.Minute,
+		Probe: func(c io.Closer) bool {
+			atomic.AddInt32(&probed, 1)
+			return c != dead
+		},
+		Stats: &stats.HookClient{
+			BumpSumHook: func(key string, val float64) {
+				if key == "probe.dead" {
+					atomic.AddInt32(&reaped, int32(val))
+				}
+			},
+		},
+		Clock: klock,
+	}
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+	r3, err := p.Acquire()
+	ensure.Nil(t, err)
+	dead = r1
+	p.Release(r1)
+	klock.Add(20 * time.Second)
+	p.Release(r2)
+	klock.Add(10 * time.Second)
+	p.Release(r3)
+
+	// only the resource idle for a probe interval is probed
+	klock.Add(30 * time.Second)
+	for p.Snapshot().Total != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	ensure.DeepEqual(t, atomic.LoadInt32(&probed), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&reaped), int32(1))
+
+	// live resources go back to the pool in the order they were used
+	klock.Add(time.Minute)
+	for atomic.LoadInt32(&probed) != 3 || p.Snapshot().Idle != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	r, err := p.Acquire()
+	ensure.Nil(t, err)
+	ensure.True(t, r == r3)
+	p.Release(r)
+
+	ensure.Nil(t, p.Close())
+	ensure.DeepEqual(t, atomic.LoadInt32(&reaped), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(3))
+}
+
+func TestCloseWithRetirePending(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var cm resourceMaker
+	expires := klock.Now().Add(time.Second)
+	p := Pool{
+		New:            cm.New,
+		Max:            2,
+		IdleTimeout:    time.Hour,
+		ClosePoolSize:  1,
+		RetireInterval: time.Minute,
+		Retire: func(c io.Closer, now time.Time) bool {
+			return !now.Before(expires)
+		},
+		Clock: klock,
+	}
+	r1, err := p.Acquire()
+	ensure.Nil(t, err)
+	r2, err := p.Acquire()
+	ensure.Nil(t, err)
+	p.Release(r2)
+
+	// the pool is closing while r1 is still out, the idle r2 is closed
+	closed := make(chan error)
+	go func() {
+		closed <- p.Close()
+	}()
+	for atomic.LoadInt32(&cm.closeCount) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// neither retiring nor shrinking the pool closes r2 again
+	klock.Add(time.Minute)
+	for i := 0; i < 10; i++ {
+		p.Snapshot()
+	}
+	p.SetMax(1)
+	p.Release(r1)
+	ensure.Nil(t, <-closed)
+	ensure.DeepEqual(t, atomic.LoadInt32(&cm.closeCount), int32(2))
+}
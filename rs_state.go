@@ -27,11 +27,18 @@ type ReplicaSetState struct {
 
 // NewReplicaSetState creates a new ReplicaSetState using the given address.
 func NewReplicaSetState(username, password, addr string) (*ReplicaSetState, error) {
+	return NewReplicaSetStateWithSource(username, password, "", addr)
+}
+
+// NewReplicaSetStateWithSource is like NewReplicaSetState, with the user
+// authenticated against the source database.
+func NewReplicaSetStateWithSource(username, password, source, addr string) (*ReplicaSetState, error) {
 	const TIMEOUT = 500 * time.Millisecond
 	info := &mgo.DialInfo{
 		Addrs:    []string{addr},
 		Username: username,
 		Password: password,
+		Source:   source,
 		Direct:   true,
 		FailFast: true,
 		Timeout:  TIMEOUT,
@@ -124,9 +131,15 @@ type ReplicaSetStateCreator struct {
 // FromAddrs creates a ReplicaSetState from the given set of see addresses. It
 // requires the addresses to be part of the same Replica Set.
 func (c *ReplicaSetStateCreator) FromAddrs(username, password string, addrs []string, replicaSetName string) (*ReplicaSetState, error) {
+	return c.FromAddrsWithSource(username, password, "", addrs, replicaSetName)
+}
+
+// FromAddrsWithSource is like FromAddrs, with the user authenticated against
+// the source database.
+func (c *ReplicaSetStateCreator) FromAddrsWithSource(username, password, source string, addrs []string, replicaSetName string) (*ReplicaSetState, error) {
 	var r *ReplicaSetState
 	for _, addr := range addrs {
-		ar, err := NewReplicaSetState(username, password, addr)
+		ar, err := NewReplicaSetStateWithSource(username, password, source, addr)
 		if err != nil {
 			if err != errNoReachableServers {
 				corelog.LogErrorMessage(fmt.Sprintf("ignoring failure against address %s: %s", addr, err))
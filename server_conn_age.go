@@ -0,0 +1,43 @@
+package dvara
+
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/facebookgo/stats"
+)
+
+// serverConnAgeJitter is the fraction by which the MaxServerConnectionAge of
+// each server connection is randomized, so that connections opened together,
+// such as when a proxy starts, are not all replaced at once.
+const serverConnAgeJitter = 0.2
+
+// serverConnRetireChecks is how many times over the MaxServerConnectionAge
+// the idle server connections are checked for being too old.
+const serverConnRetireChecks = 10
+
+// serverConnExpiry returns when a server connection opened now is to be
+// recycled, or the zero time if they are kept regardless of their age.
+func (p *Proxy) serverConnExpiry() time.Time {
+	age := p.ReplicaSet.MaxServerConnectionAge
+	if age <= 0 {
+		return time.Time{}
+	}
+	random := p.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return p.Clock.Now().Add(jitter(age, serverConnAgeJitter, random()))
+}
+
+// retireServerConn is the Pool.Retire of the server connection pools, telling
+// if a connection exceeded its MaxServerConnectionAge.
+func (p *Proxy) retireServerConn(c io.Closer, now time.Time) bool {
+	sc, ok := c.(*serverConn)
+	if !ok || sc.expires.IsZero() || now.Before(sc.expires) {
+		return false
+	}
+	stats.BumpSum(p.stats, "server.conn.recycled.age", 1)
+	return true
+}
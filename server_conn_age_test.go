@@ -0,0 +1,44 @@
+package dvara
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+)
+
+func TestServerConnExpiry(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	var rec statsRecorder
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{MaxServerConnectionAge: time.Hour},
+		Clock:      klock,
+		stats:      &rec,
+	}
+	cases := []struct {
+		Random  float64
+		Expires time.Duration
+	}{
+		{0, 48 * time.Minute},
+		{0.5, time.Hour},
+		{0.75, 66 * time.Minute},
+	}
+	for _, c := range cases {
+		p.random = func() float64 { return c.Random }
+		sc := &serverConn{expires: p.serverConnExpiry()}
+		ensure.DeepEqual(t, sc.expires, klock.Now().Add(c.Expires), c.Random)
+		ensure.False(t, p.retireServerConn(sc, klock.Now().Add(c.Expires-time.Second)))
+		ensure.True(t, p.retireServerConn(sc, klock.Now().Add(c.Expires)))
+	}
+	ensure.DeepEqual(t, rec.sum("server.conn.recycled.age"), float64(len(cases)))
+
+	// connections opened without an age limit are kept
+	p.ReplicaSet.MaxServerConnectionAge = 0
+	sc := &serverConn{expires: p.serverConnExpiry()}
+	ensure.True(t, sc.expires.IsZero())
+	ensure.False(t, p.retireServerConn(sc, klock.Now().Add(24*time.Hour)))
+	ensure.False(t, p.retireServerConn(&resource{}, klock.Now()))
+	ensure.DeepEqual(t, rec.sum("server.conn.recycled.age"), float64(len(cases)))
+}
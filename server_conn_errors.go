@@ -0,0 +1,90 @@
+package dvara
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultServerConnErrorHistory is how many server connection errors are kept
+// unless ServerConnErrorHistory says otherwise.
+const defaultServerConnErrorHistory = 50
+
+// ServerConnError is a failure to establish a connection to a mongo server.
+type ServerConnError struct {
+	Time    time.Time `json:"time"`
+	Proxy   string    `json:"proxy"`
+	Backend string    `json:"backend"`
+	Error   string    `json:"error"`
+}
+
+// serverConnErrors keeps the most recent server connection errors in a ring
+// buffer.
+type serverConnErrors struct {
+	mu     sync.Mutex
+	errors []ServerConnError
+	next   int
+	full   bool
+}
+
+// add records an error, overwriting the oldest one once size are kept.
+func (s *serverConnErrors) add(e ServerConnError, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.errors == nil {
+		s.errors = make([]ServerConnError, size)
+	}
+	s.errors[s.next] = e
+	s.next = (s.next + 1) % len(s.errors)
+	s.full = s.full || s.next == 0
+}
+
+// snapshot returns the errors kept, oldest first.
+func (s *serverConnErrors) snapshot() []ServerConnError {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.full {
+		return append([]ServerConnError(nil), s.errors[:s.next]...)
+	}
+	return append(append([]ServerConnError(nil), s.errors[s.next:]...), s.errors[:s.next]...)
+}
+
+// recordServerConnError keeps the error for ServerConnErrors.
+func (p *Proxy) recordServerConnError(backend string, err error) {
+	size := int(p.ReplicaSet.ServerConnErrorHistory)
+	if size == 0 {
+		size = defaultServerConnErrorHistory
+	}
+	p.serverConnErrors.add(ServerConnError{
+		Time:    p.Clock.Now(),
+		Proxy:   p.ProxyAddr,
+		Backend: backend,
+		Error:   err.Error(),
+	}, size)
+}
+
+// ServerConnErrors returns the most recent failures to dial or authenticate a
+// server connection, oldest first, to find out what went wrong after the fact.
+// Each retry of newServerConn counts as one.
+func (p *Proxy) ServerConnErrors() []ServerConnError {
+	return p.serverConnErrors.snapshot()
+}
+
+type serverConnErrorsByTime []ServerConnError
+
+func (s serverConnErrorsByTime) Len() int           { return len(s) }
+func (s serverConnErrorsByTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s serverConnErrorsByTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+// ServerConnErrors returns the most recent server connection errors of all the
+// proxies, oldest first.
+func (manager *StateManager) ServerConnErrors() []ServerConnError {
+	manager.RLock()
+	defer manager.RUnlock()
+	var errs []ServerConnError
+	for _, proxy := range manager.proxies {
+		errs = append(errs, proxy.ServerConnErrors()...)
+	}
+	sort.Stable(serverConnErrorsByTime(errs))
+	return errs
+}
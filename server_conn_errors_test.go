@@ -0,0 +1,51 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+)
+
+func TestServerConnErrors(t *testing.T) {
+	t.Parallel()
+	klock := clock.NewMock()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{ServerConnErrorHistory: 3},
+		ProxyAddr:  "127.0.0.1:6000",
+		Clock:      klock,
+	}
+	ensure.DeepEqual(t, len(p.ServerConnErrors()), 0)
+
+	for i := 0; i < 5; i++ {
+		klock.Add(time.Second)
+		p.recordServerConnError("mongo:27017", fmt.Errorf("error %d", i))
+		if i == 1 {
+			errs := p.ServerConnErrors()
+			ensure.DeepEqual(t, len(errs), 2)
+			ensure.DeepEqual(t, errs[1], ServerConnError{
+				Time:    klock.Now(),
+				Proxy:   "127.0.0.1:6000",
+				Backend: "mongo:27017",
+				Error:   "error 1",
+			})
+		}
+	}
+	var messages []string
+	for _, e := range p.ServerConnErrors() {
+		messages = append(messages, e.Error)
+	}
+	ensure.DeepEqual(t, messages, []string{"error 2", "error 3", "error 4"})
+}
+
+func TestServerConnErrorsDefaultHistory(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{ReplicaSet: &ReplicaSet{}, Clock: clock.NewMock()}
+	for i := 0; i < defaultServerConnErrorHistory+1; i++ {
+		p.recordServerConnError("mongo:27017", errors.New("refused"))
+	}
+	ensure.DeepEqual(t, len(p.ServerConnErrors()), defaultServerConnErrorHistory)
+}
@@ -0,0 +1,75 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var errProbeResponse = errors.New("dvara: unexpected response to server connection probe")
+
+// probeDocument is the isMaster sent to probe server connections, as it is
+// cheap and allowed before authentication.
+var probeDocument, _ = bson.Marshal(bson.D{{Name: "isMaster", Value: 1}})
+
+// probeServerConn is the Pool.Probe of the server connection pools. It sends
+// an isMaster on an idle connection and reads the response, so a connection
+// whose server silently went away is found before a client gets it.
+func (p *Proxy) probeServerConn(c io.Closer) bool {
+	conn, ok := c.(net.Conn)
+	if !ok {
+		return true
+	}
+	if err := p.probe(conn); err != nil {
+		stats.BumpSum(p.stats, "server.conn.dead.reaped", 1)
+		corelog.LogErrorMessage(fmt.Sprintf("Closing dead server connection to %s: %s", backendAddr(conn), err))
+		return false
+	}
+	return true
+}
+
+func (p *Proxy) probe(conn net.Conn) error {
+	if err := conn.SetDeadline(p.Clock.Now().Add(serverConnectTimeout)); err != nil {
+		return err
+	}
+	requestID := p.nextRequestID()
+	if _, err := conn.Write(probeMessage(requestID)); err != nil {
+		return err
+	}
+	h, err := readHeader(conn)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(ioutil.Discard, conn, int64(h.MessageLength-headerLen)); err != nil {
+		return err
+	}
+	if h.OpCode != OpReply || h.ResponseTo != requestID {
+		return errProbeResponse
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// probeMessage returns an OP_QUERY of the probeDocument: the header, int32
+// flags, the admin.$cmd collection, int32 numberToSkip, int32 numberToReturn
+// and the document.
+func probeMessage(requestID int32) []byte {
+	const collection = "admin.$cmd"
+	h := messageHeader{
+		MessageLength: int32(headerLen + 4 + len(collection) + 1 + 8 + len(probeDocument)),
+		RequestID:     requestID,
+		OpCode:        OpQuery,
+	}
+	b := h.ToWire()
+	b = addInt32(b, 0)
+	b = addCString(b, collection)
+	b = addInt32(b, 0)
+	b = addInt32(b, -1)
+	return append(b, probeDocument...)
+}
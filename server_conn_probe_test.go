@@ -0,0 +1,60 @@
+package dvara
+
+import (
+	"net"
+	"testing"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+)
+
+func TestProbeServerConn(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := &Proxy{
+		Clock: clock.New(),
+		stats: &rec,
+	}
+	cases := []struct {
+		Name  string
+		Reply func(requestID int32) []byte
+		Alive bool
+	}{
+		{"alive", func(requestID int32) []byte {
+			return replyDocumentMessage(requestID, 0, probeDocument)
+		}, true},
+		{"wrong response", func(requestID int32) []byte {
+			return replyDocumentMessage(requestID+1, 0, probeDocument)
+		}, false},
+		{"gone", nil, false},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func(reply func(int32) []byte) {
+			defer server.Close()
+			h, err := readHeader(server)
+			if err != nil || reply == nil {
+				return
+			}
+			body := make([]byte, h.MessageLength-headerLen)
+			if _, err := server.Read(body); err != nil {
+				return
+			}
+			server.Write(reply(h.RequestID))
+		}(c.Reply)
+		ensure.DeepEqual(t, p.probeServerConn(&serverConn{Conn: client}), c.Alive, c.Name)
+		client.Close()
+	}
+	ensure.DeepEqual(t, rec.sum("server.conn.dead.reaped"), float64(2))
+}
+
+func TestProbeMessage(t *testing.T) {
+	t.Parallel()
+	msg := probeMessage(7)
+	var h messageHeader
+	h.FromWire(msg)
+	ensure.DeepEqual(t, int(h.MessageLength), len(msg))
+	ensure.DeepEqual(t, h.RequestID, int32(7))
+	ensure.DeepEqual(t, h.OpCode, OpQuery)
+	ensure.DeepEqual(t, string(msg[headerLen+4:headerLen+15]), "admin.$cmd\x00")
+}
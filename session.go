@@ -0,0 +1,88 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// msgSession is the logical session a command sent as an OP_MSG runs in, as
+// given by the lsid, txnNumber, startTransaction and autocommit fields of its
+// body, and the command itself.
+type msgSession struct {
+	// LSID is the raw lsid document identifying the session.
+	LSID []byte
+
+	// TxnNumber is set, along with HasTxnNumber, for retryable writes and the
+	// statements of transactions.
+	TxnNumber    int64
+	HasTxnNumber bool
+
+	// StartTransaction is set on the first statement of a transaction.
+	StartTransaction bool
+
+	// Autocommit is false for the statements of a multi-statement
+	// transaction, including commitTransaction and abortTransaction.
+	Autocommit bool
+
+	// EndTransaction is set for commitTransaction and abortTransaction.
+	EndTransaction bool
+}
+
+// parseMsgSession returns the session of the command in an OP_MSG body, and
+// false if it has no lsid or the body is malformed.
+func parseMsgSession(body []byte) (msgSession, bool) {
+	m, err := parseOpMsg(body)
+	if err != nil {
+		return msgSession{}, false
+	}
+	var doc struct {
+		LSID             bson.Raw `bson:"lsid"`
+		TxnNumber        *int64   `bson:"txnNumber"`
+		StartTransaction bool     `bson:"startTransaction"`
+		Autocommit       *bool    `bson:"autocommit"`
+	}
+	if err := bson.Unmarshal(m.Body, &doc); err != nil || doc.LSID.Kind != 0x03 {
+		return msgSession{}, false
+	}
+	s := msgSession{
+		LSID:             doc.LSID.Data,
+		StartTransaction: doc.StartTransaction,
+		Autocommit:       doc.Autocommit == nil || *doc.Autocommit,
+	}
+	if doc.TxnNumber != nil {
+		s.TxnNumber, s.HasTxnNumber = *doc.TxnNumber, true
+	}
+	if name, _, ok := msgCommand(body); ok {
+		s.EndTransaction = name == "commitTransaction" || name == "abortTransaction"
+	}
+	return s, true
+}
+
+// inTransaction returns true if the command is a statement of a
+// multi-statement transaction. Retryable writes have a txnNumber too, but run
+// with autocommit.
+func (s msgSession) inTransaction() bool {
+	return s.HasTxnNumber && !s.Autocommit
+}
+
+// readMsgSession reads the body of an OP_MSG to find the session its command
+// runs in. The returned conn replays the body. Other messages are left
+// untouched.
+func readMsgSession(h *messageHeader, c net.Conn) (net.Conn, msgSession, error) {
+	if h.OpCode != OpMsg {
+		return c, msgSession{}, nil
+	}
+	body := make([]byte, h.MessageLength-headerLen)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return nil, msgSession{}, err
+	}
+	replay := &replayConn{
+		Conn:   c,
+		reader: io.MultiReader(bytes.NewReader(body), c),
+	}
+	session, _ := parseMsgSession(body)
+	return replay, session, nil
+}
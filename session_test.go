@@ -0,0 +1,104 @@
+package dvara
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var testLSID = bson.D{{Name: "id", Value: bson.Binary{Kind: 4, Data: bytes.Repeat([]byte{7}, 16)}}}
+
+func transactionBody(t testing.TB, command bson.D) []byte {
+	return msgBody(t, 0, msgSection{Documents: []interface{}{command}})
+}
+
+func TestParseMsgSession(t *testing.T) {
+	t.Parallel()
+	lsid, err := bson.Marshal(testLSID)
+	ensure.Nil(t, err)
+	cases := []struct {
+		Command       bson.D
+		Session       msgSession
+		OK            bool
+		InTransaction bool
+	}{
+		{
+			Command: bson.D{{Name: "find", Value: "foo"}, {Name: "$db", Value: "test"}},
+		},
+		{
+			Command: bson.D{{Name: "find", Value: "foo"}, {Name: "lsid", Value: testLSID}, {Name: "$db", Value: "test"}},
+			Session: msgSession{LSID: lsid, Autocommit: true},
+			OK:      true,
+		},
+		{
+			Command: bson.D{
+				{Name: "insert", Value: "foo"},
+				{Name: "lsid", Value: testLSID},
+				{Name: "txnNumber", Value: int64(3)},
+				{Name: "$db", Value: "test"},
+			},
+			Session: msgSession{LSID: lsid, TxnNumber: 3, HasTxnNumber: true, Autocommit: true},
+			OK:      true,
+		},
+		{
+			Command: bson.D{
+				{Name: "insert", Value: "foo"},
+				{Name: "lsid", Value: testLSID},
+				{Name: "txnNumber", Value: int64(4)},
+				{Name: "startTransaction", Value: true},
+				{Name: "autocommit", Value: false},
+				{Name: "$db", Value: "test"},
+			},
+			Session:       msgSession{LSID: lsid, TxnNumber: 4, HasTxnNumber: true, StartTransaction: true},
+			OK:            true,
+			InTransaction: true,
+		},
+		{
+			Command: bson.D{
+				{Name: "commitTransaction", Value: 1},
+				{Name: "lsid", Value: testLSID},
+				{Name: "txnNumber", Value: int64(4)},
+				{Name: "autocommit", Value: false},
+				{Name: "$db", Value: "admin"},
+			},
+			Session:       msgSession{LSID: lsid, TxnNumber: 4, HasTxnNumber: true, EndTransaction: true},
+			OK:            true,
+			InTransaction: true,
+		},
+	}
+	for _, c := range cases {
+		s, ok := parseMsgSession(transactionBody(t, c.Command))
+		ensure.DeepEqual(t, ok, c.OK)
+		ensure.DeepEqual(t, s, c.Session)
+		ensure.DeepEqual(t, s.inTransaction(), c.InTransaction)
+	}
+	_, ok := parseMsgSession([]byte{0})
+	ensure.False(t, ok)
+}
+
+func TestReadMsgSession(t *testing.T) {
+	t.Parallel()
+	body := transactionBody(t, bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "lsid", Value: testLSID},
+		{Name: "txnNumber", Value: int64(1)},
+		{Name: "autocommit", Value: false},
+	})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpMsg}
+	client, session, err := readMsgSession(h, &bufferConn{r: bytes.NewReader(body)})
+	ensure.Nil(t, err)
+	ensure.True(t, session.inTransaction())
+	replayed, err := ioutil.ReadAll(client)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, replayed, body)
+
+	c := &bufferConn{r: bytes.NewReader(body)}
+	h.OpCode = OpQuery
+	client, session, err = readMsgSession(h, c)
+	ensure.Nil(t, err)
+	ensure.True(t, client == c)
+	ensure.False(t, session.inTransaction())
+}
@@ -0,0 +1,84 @@
+package dvara
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// shadowQuery returns the entire OP_QUERY message to mirror to the shadow
+// server, or nil if shadowing is disabled, the shadow server is draining or the
+// query may have side effects. Only queries are mirrored, mutations never are,
+// and neither are OP_GET_MORE messages since cursors on the shadow server
+// differ.
+func (p *Proxy) shadowQuery(h *messageHeader, body []byte) []byte {
+	if p.shadowSlots == nil || body == nil || !p.ReplicaSet.namespaces().isReadQuery(body) || p.isDraining(p.ReplicaSet.ShadowMongoAddr) {
+		return nil
+	}
+	return append(h.ToWire(), body...)
+}
+
+// shadowMessage sends a copy of the message to the shadow server in the
+// background and discards the response. The primary response time is used to
+// compare latencies. If too many shadow messages are in flight the message is
+// dropped rather than slowing down the client.
+func (p *Proxy) shadowMessage(msg []byte, primary time.Duration) {
+	select {
+	case p.shadowSlots <- struct{}{}:
+	default:
+		stats.BumpSum(p.stats, "shadow.dropped", 1)
+		return
+	}
+
+	p.shadowWG.Add(1)
+	go func() {
+		defer func() {
+			<-p.shadowSlots
+			p.shadowWG.Done()
+		}()
+
+		stats.BumpSum(p.stats, "shadow.sent", 1)
+		start := p.Clock.Now()
+		if err := p.sendShadowMessage(msg); err != nil {
+			corelog.LogErrorMessage(fmt.Sprintf("Shadow message failed for %s: %s", p.ReplicaSet.ShadowMongoAddr, err))
+			stats.BumpSum(p.stats, "shadow.error", 1)
+			return
+		}
+		shadow := p.Clock.Now().Sub(start)
+		stats.BumpSum(p.stats, "shadow.success", 1)
+		stats.BumpHistogram(p.stats, "shadow.response.time", milliseconds(shadow))
+		stats.BumpHistogram(p.stats, "shadow.primary.response.time", milliseconds(primary))
+		stats.BumpHistogram(p.stats, "shadow.response.time.difference", milliseconds(shadow-primary))
+	}()
+}
+
+// sendShadowMessage sends the message over a connection from the pool of the
+// shadow server. Like for other backends there are no retries, a failed shadow
+// message is simply counted.
+func (p *Proxy) sendShadowMessage(msg []byte) error {
+	pool := p.backendPool(p.ReplicaSet.ShadowMongoAddr)
+	c, err := pool.Acquire()
+	if err != nil {
+		return err
+	}
+	conn := c.(net.Conn)
+	conn.SetDeadline(p.Clock.Now().Add(p.timeouts().Message))
+	if _, err := conn.Write(msg); err != nil {
+		pool.Discard(c)
+		return err
+	}
+	if err := copyMessage(ioutil.Discard, conn); err != nil {
+		pool.Discard(c)
+		return err
+	}
+	pool.Release(c)
+	return nil
+}
+
+func milliseconds(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
@@ -0,0 +1,109 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func queryBody(t testing.TB, ns string, q interface{}) []byte {
+	b := addInt32(nil, 0)
+	b = addCString(b, ns)
+	b = addInt32(b, 0)
+	b = addInt32(b, -1)
+	b, err := addBSON(b, q)
+	ensure.Nil(t, err)
+	return b
+}
+
+func TestShadowQuery(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{
+		ReplicaSet:  &ReplicaSet{ShadowMongoAddr: "shadow:1"},
+		shadowSlots: make(chan struct{}, 1),
+	}
+	body := queryBody(t, "test.foo", bson.M{"a": 1})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+	ensure.DeepEqual(t, p.shadowQuery(h, body), append(h.ToWire(), body...))
+
+	insert := queryBody(t, "test.$cmd", bson.M{"insert": "foo"})
+	ensure.True(t, p.shadowQuery(h, insert) == nil)
+	ensure.True(t, p.shadowQuery(h, nil) == nil)
+
+	p.DrainBackend("shadow:1")
+	ensure.True(t, p.shadowQuery(h, body) == nil)
+}
+
+func TestShadowQueryDisabled(t *testing.T) {
+	t.Parallel()
+	p := &Proxy{}
+	body := queryBody(t, "test.foo", bson.M{})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+	ensure.True(t, p.shadowQuery(h, body) == nil)
+}
+
+func TestShadowMessage(t *testing.T) {
+	t.Parallel()
+	shadow, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer shadow.Close()
+
+	body := queryBody(t, "test.foo", bson.M{})
+	h := messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+	msg := append(h.ToWire(), body...)
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := shadow.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var b bytes.Buffer
+		if err := copyMessage(&b, c); err != nil {
+			return
+		}
+		received <- b.Bytes()
+		c.Write(replyMessage(0, 0))
+	}()
+
+	done := make(chan string, 3)
+	hc := &stats.HookClient{
+		BumpSumHook: func(key string, val float64) {
+			done <- key
+		},
+	}
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			ShadowMongoAddr:     shadow.Addr().String(),
+			MaxConnections:      1,
+			MessageTimeout:      time.Second,
+			ServerIdleTimeout:   time.Hour,
+			ServerClosePoolSize: 1,
+		},
+		Clock:       clock.New(),
+		stats:       hc,
+		shadowSlots: make(chan struct{}, 1),
+	}
+	defer p.backendPool(p.ReplicaSet.ShadowMongoAddr).Close()
+
+	p.shadowMessage(msg, time.Millisecond)
+	ensure.DeepEqual(t, <-received, msg)
+	ensure.DeepEqual(t, <-done, "shadow.sent")
+	ensure.DeepEqual(t, <-done, "shadow.success")
+	p.shadowWG.Wait()
+}
+
+func TestShadowMessageDropsWhenBusy(t *testing.T) {
+	t.Parallel()
+	hc := &statsRecorder{}
+	p := &Proxy{stats: hc, shadowSlots: make(chan struct{}, 1)}
+	p.shadowSlots <- struct{}{}
+	p.shadowMessage(nil, 0)
+	ensure.DeepEqual(t, hc.sum("shadow.dropped"), float64(1))
+}
@@ -0,0 +1,74 @@
+//go:build go1.11 && (386 || amd64 || arm || arm64)
+// +build go1.11
+// +build 386 amd64 arm arm64
+
+package dvara
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package does not define on
+// all architectures.
+const soReusePort = 0xf
+
+const socketOptionsSupported = true
+
+// listenTCP listens on the address with the socket options. SO_REUSEPORT lets
+// other processes listen on it too, the kernel balancing connections between
+// them.
+func listenTCP(addr string, o listenOptions) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = setListenSockopts(int(fd), o)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil || o.backlog == 0 {
+		return l, err
+	}
+	// The backlog is only given to listen, which net calls with the system
+	// maximum. Listening again on a listening socket changes it.
+	if err := setBacklog(l, o.backlog); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func setListenSockopts(fd int, o listenOptions) error {
+	if o.reusePort {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1); err != nil {
+			return err
+		}
+	}
+	if !o.reuseAddr {
+		// net sets SO_REUSEADDR on all listeners.
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 0)
+	}
+	return nil
+}
+
+func setBacklog(l net.Listener, backlog int) error {
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = rc.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
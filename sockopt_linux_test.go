@@ -0,0 +1,49 @@
+//go:build go1.11 && (386 || amd64 || arm || arm64)
+// +build go1.11
+// +build 386 amd64 arm arm64
+
+package dvara
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+)
+
+func getsockopt(t *testing.T, l net.Listener, opt int) int {
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	ensure.Nil(t, err)
+	var value int
+	var optErr error
+	ensure.Nil(t, rc.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+	}))
+	ensure.Nil(t, optErr)
+	return value
+}
+
+func TestListenSockopts(t *testing.T) {
+	t.Parallel()
+	off := false
+	cases := []struct {
+		ReplicaSet ReplicaSet
+		ReuseAddr  int
+		ReusePort  int
+	}{
+		{ReplicaSet{}, 1, 0},
+		{ReplicaSet{ReusePort: true, ListenBacklog: 8}, 1, 1},
+		{ReplicaSet{ReuseAddr: &off}, 0, 0},
+	}
+	for _, c := range cases {
+		l, err := c.ReplicaSet.listen("127.0.0.1:0")
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, getsockopt(t, l, syscall.SO_REUSEADDR), c.ReuseAddr, c.ReplicaSet)
+		ensure.DeepEqual(t, getsockopt(t, l, soReusePort), c.ReusePort, c.ReplicaSet)
+		conn, err := net.Dial("tcp", l.Addr().String())
+		ensure.Nil(t, err)
+		conn.Close()
+		l.Close()
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux || !go1.11 || !(386 || amd64 || arm || arm64)
+// +build !linux !go1.11 !386,!amd64,!arm,!arm64
+
+package dvara
+
+import (
+	"errors"
+	"net"
+)
+
+const socketOptionsSupported = false
+
+var errSocketOptionsUnsupported = errors.New("dvara: listener socket options are not supported on this platform")
+
+// listenTCP listens on the address, which is only possible with the default
+// socket options.
+func listenTCP(addr string, o listenOptions) (net.Listener, error) {
+	if o != defaultListenOptions {
+		return nil, errSocketOptionsUnsupported
+	}
+	return net.Listen("tcp", addr)
+}
@@ -107,6 +107,9 @@ func (manager *StateManager) Synchronize() {
 
 	manager.stopStartProxies(comparison)
 	manager.currentReplicaSetState = newState
+	for _, proxy := range manager.proxies {
+		proxy.InvalidateIsMasterCache()
+	}
 
 	// Add discovered nodes to seed address list. Over time if the original seed
 	// nodes have gone away and new nodes have joined this ensures that we'll
@@ -116,6 +119,38 @@ func (manager *StateManager) Synchronize() {
 	manager.refreshTime = time.Now()
 }
 
+// UpdateCredentials rotates the credentials used for replica state checks and
+// for new server connections on every proxy, without dropping clients.
+func (manager *StateManager) UpdateCredentials(username, password string, recycleIdle bool) {
+	manager.Lock()
+	defer manager.Unlock()
+	manager.replicaSet.Username = username
+	manager.replicaSet.Password = password
+	for _, proxy := range manager.proxies {
+		proxy.UpdateCredentials(username, password, recycleIdle)
+	}
+}
+
+// Reconfigure applies the live settings from the given ReplicaSet, as
+// documented on Proxy.Reconfigure, to the managed ReplicaSet and all running
+// proxies.
+func (manager *StateManager) Reconfigure(r *ReplicaSet) error {
+	manager.Lock()
+	defer manager.Unlock()
+	for _, proxy := range manager.proxies {
+		if err := proxy.Reconfigure(r); err != nil {
+			return err
+		}
+	}
+	manager.replicaSet.MaxConnections = r.MaxConnections
+	manager.replicaSet.MaxPerClientConnections = r.MaxPerClientConnections
+	manager.replicaSet.ClientIdleTimeout = r.ClientIdleTimeout
+	manager.replicaSet.GetLastErrorTimeout = r.GetLastErrorTimeout
+	manager.replicaSet.MessageTimeout = r.MessageTimeout
+	corelog.LogInfoMessage("reconfigured proxies")
+	return nil
+}
+
 func (manager *StateManager) ProxyMembers() []string {
 	manager.RLock()
 	defer manager.RUnlock()
@@ -172,6 +207,9 @@ func (manager *StateManager) generateProxies(addresses ...string) ([]*Proxy, err
 			ProxyAddr:      manager.replicaSet.proxyAddr(listener),
 			Username:       manager.replicaSet.Username,
 			Password:       manager.replicaSet.Password,
+			AuthSource:     manager.replicaSet.AuthSource,
+			ServerDialer:   manager.replicaSet.ServerDialer,
+			Events:         manager.replicaSet.Events,
 			MongoAddr:      address,
 		}
 
@@ -183,7 +221,7 @@ func (manager *StateManager) generateProxies(addresses ...string) ([]*Proxy, err
 func (manager *StateManager) generateReplicaSetState() (*ReplicaSetState, error) {
 	replicaSet := manager.replicaSet
 	addrs := strings.Split(manager.baseAddrs, ",")
-	return replicaSet.ReplicaSetStateCreator.FromAddrs(replicaSet.Username, replicaSet.Password, addrs, replicaSet.Name)
+	return replicaSet.ReplicaSetStateCreator.FromAddrsWithSource(replicaSet.Username, replicaSet.Password, replicaSet.AuthSource, addrs, replicaSet.Name)
 }
 
 func (manager *StateManager) getComparison(oldResp, newResp *replSetGetStatusResponse) (*ReplicaSetComparison, error) {
@@ -277,7 +315,7 @@ func (manager *StateManager) stopStartProxies(comparison *ReplicaSetComparison)
 
 func (manager *StateManager) startProxy(proxy *Proxy) {
 	if err := proxy.Start(); err != nil {
-		corelog.LogErrorMessage(fmt.Sprintf("Failed to start proxy %s", proxy))
+		corelog.LogErrorMessage(fmt.Sprintf("Failed to start proxy %s: %s", proxy, err))
 	}
 }
 
@@ -0,0 +1,193 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// notMasterCodes are the error codes a server replies with once it is no
+// longer primary, or is going away. NotMasterNoSlaveOk (13435) is left out as
+// clients get it from secondaries as a matter of course.
+var notMasterCodes = map[int]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10058: true, // legacy getLastError "not master"
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13436: true, // NotMasterOrSecondary
+}
+
+// maxInspectedDocument is the size above which the first document of a reply
+// isn't inspected, error documents are small.
+const maxInspectedDocument = 16 * 1024
+
+// maxRequestPrefix bounds the start of a request kept by a requestPrefix: the
+// int32 flags or zero of OP_QUERY and OP_GET_MORE and the collection name,
+// which is at most 255 bytes.
+const maxRequestPrefix = 4 + 256
+
+// requestPrefix keeps the start of a request read from the client, up to the
+// end of its collection name, to tell commands from queries.
+type requestPrefix []byte
+
+// record keeps what is missing of the prefix from the next bytes read.
+func (r *requestPrefix) record(b []byte) {
+	if m := maxRequestPrefix - len(*r); m > 0 && !r.hasCollection() {
+		if m > len(b) {
+			m = len(b)
+		}
+		*r = append(*r, b[:m]...)
+	}
+}
+
+// hasCollection tells if the collection name of the request was read.
+func (r requestPrefix) hasCollection() bool {
+	return len(r) > 4 && bytes.IndexByte(r[4:], x00) >= 0
+}
+
+// command tells if the request was sent to the command collection, rather
+// than being a query or getMore against a collection.
+func (r requestPrefix) command(ns namespaces) bool {
+	collection, _, ok := queryCollection(r)
+	return ok && collection == ns.command
+}
+
+// replyInspector keeps a copy of the start of the reply written to the client,
+// up to the end of its first document, so it can be checked for errors after
+// it was proxied. It also keeps the start of the request read from the client,
+// to tell command replies from query results. Replies may be an OP_REPLY, or
+// an OP_MSG whose first section is its body.
+type replyInspector struct {
+	net.Conn
+	request requestPrefix
+	buf     []byte
+	full    bool
+}
+
+func (r *replyInspector) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.request.record(b[:n])
+	return n, err
+}
+
+// opCode returns the opcode of the reply, once its header was written.
+func (r *replyInspector) opCode() OpCode {
+	if len(r.buf) < headerLen {
+		return 0
+	}
+	return OpCode(getInt32(r.buf, 12))
+}
+
+// queryFailure tells if the reply is an OP_REPLY with the QueryFailure flag
+// set.
+func (r *replyInspector) queryFailure() bool {
+	return len(r.buf) >= headerLen+4 && r.opCode() == OpReply &&
+		getInt32(r.buf, headerLen)&replyQueryFailure != 0
+}
+
+// errorDocument returns the first document of the reply if it may be an
+// error: the reply is to a command, or has the QueryFailure flag set. The
+// results of queries are left alone, as they are user documents which may have
+// any field. OP_MSG replies are all to commands.
+func (r *replyInspector) errorDocument(ns namespaces) []byte {
+	if r.opCode() != OpMsg && !r.request.command(ns) && !r.queryFailure() {
+		return nil
+	}
+	return r.firstDocument()
+}
+
+func (r *replyInspector) Write(b []byte) (int, error) {
+	for rest := b; !r.full && len(rest) > 0; {
+		m := r.missing(len(rest))
+		r.buf = append(r.buf, rest[:m]...)
+		rest = rest[m:]
+	}
+	return r.Conn.Write(b)
+}
+
+// documentStart returns where the first document of the reply starts: after
+// the OP_REPLY fields, or after the flagBits and section kind of an OP_MSG.
+func (r *replyInspector) documentStart() int {
+	if r.opCode() == OpMsg {
+		return headerLen + 5
+	}
+	return headerLen + len(emptyPrefix)
+}
+
+// missing returns how many of the next n bytes to keep, up to the header, then
+// the document length and the document itself. It sets full once there is
+// nothing more to keep.
+func (r *replyInspector) missing(n int) int {
+	end := headerLen
+	if len(r.buf) >= headerLen {
+		end = r.documentStart() + 4
+	}
+	if len(r.buf) >= end && end > headerLen {
+		docLen := int(getInt32(r.buf, end-4))
+		if docLen < 5 || docLen > maxInspectedDocument {
+			r.full = true
+			return 0
+		}
+		end += docLen - 4
+		if len(r.buf) == end {
+			r.full = true
+			return 0
+		}
+	}
+	if m := end - len(r.buf); m < n {
+		return m
+	}
+	return n
+}
+
+// firstDocument returns the first document of the reply, or nil if there is
+// none or it was too big to be inspected.
+func (r *replyInspector) firstDocument() []byte {
+	start := r.documentStart()
+	if len(r.buf) < start+4 {
+		return nil
+	}
+	if r.opCode() == OpMsg && r.buf[start-1] != opMsgBodySection {
+		return nil
+	}
+	if int(getInt32(r.buf, start)) != len(r.buf)-start {
+		return nil
+	}
+	return r.buf[start:]
+}
+
+// isNotMasterReply tells if the document is an error returned by a server
+// which is no longer primary.
+func isNotMasterReply(doc []byte) bool {
+	e, ok := parseReplyError(doc)
+	return ok && e.notMaster()
+}
+
+// isStale tells if the server connection was retired by primaryStepdown.
+func isStale(c net.Conn) bool {
+	sc, ok := c.(*serverConn)
+	return ok && sc.stale
+}
+
+// primaryStepdown handles a reply from the server showing it is no longer
+// primary. The server connection is retired, the idle ones to the same
+// backend closed as they would all fail the same way, cached isMaster
+// responses dropped, and
+// ReplicaSet.OnPrimaryStepdown is called so the new primary can be resolved.
+func (p *Proxy) primaryStepdown(server net.Conn) {
+	backend := backendAddr(server)
+	stats.BumpSum(p.stats, "server.primary.stepdown.detected", 1)
+	corelog.LogInfoMessage("primary stepdown detected", "backend", backend)
+	if sc, ok := server.(*serverConn); ok {
+		sc.stale = true
+	}
+	p.poolFor(server).CloseIdle()
+	p.InvalidateIsMasterCache()
+	if p.ReplicaSet.OnPrimaryStepdown != nil {
+		p.ReplicaSet.OnPrimaryStepdown(backend)
+	}
+}
@@ -0,0 +1,215 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestIsNotMasterReply(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Reply     bson.M
+		NotMaster bool
+	}{
+		{bson.M{"ok": 1}, false},
+		{bson.M{"ok": 0, "errmsg": "not master", "code": 10107}, true},
+		{bson.M{"ok": 0, "errmsg": "not master or secondary", "code": 13436}, true},
+		{bson.M{"ok": 0, "errmsg": "stepped down", "code": 11602}, true},
+		{bson.M{"ok": 0, "errmsg": "not master and slaveOk=false", "code": 13435}, false},
+		{bson.M{"ok": 1, "err": "not master"}, true},
+		{bson.M{"ok": 1, "err": nil, "code": 11000}, false},
+		{bson.M{"_id": 1, "comment": "not master"}, false},
+	}
+	for _, c := range cases {
+		doc, err := bson.Marshal(c.Reply)
+		ensure.Nil(t, err)
+		if isNotMasterReply(doc) != c.NotMaster {
+			t.Fatalf("expected not master %v for %v", c.NotMaster, c.Reply)
+		}
+	}
+	ensure.False(t, isNotMasterReply(nil))
+}
+
+func TestReplyInspector(t *testing.T) {
+	t.Parallel()
+	doc, err := bson.Marshal(bson.M{"code": 10107})
+	ensure.Nil(t, err)
+	reply := append(replyMessage(0, 0), doc...)
+	reply = append(reply, doc...)
+	setInt32(reply, 0, int32(len(reply)))
+
+	// The first document is kept however the reply is written.
+	for _, size := range []int{1, 7, len(reply)} {
+		client := &bufferConn{}
+		r := &replyInspector{Conn: client}
+		for b := reply; len(b) > 0; {
+			n := size
+			if n > len(b) {
+				n = len(b)
+			}
+			_, err := r.Write(b[:n])
+			ensure.Nil(t, err)
+			b = b[n:]
+		}
+		ensure.DeepEqual(t, client.w.Bytes(), reply)
+		ensure.DeepEqual(t, r.firstDocument(), doc)
+	}
+
+	// Only the first document of command replies and failed queries is looked
+	// at for errors.
+	for _, c := range []struct {
+		Request []byte
+		Flags   int32
+		Checked bool
+	}{
+		{queryBody(t, "test.$cmd", bson.M{"count": "foo"}), 0, true},
+		{queryBody(t, "test.foo", bson.M{"a": 1}), 0, false},
+		{queryBody(t, "test.foo", bson.M{"a": 1}), replyQueryFailure, true},
+		{getMoreBody("test.foo", 5), 0, false},
+	} {
+		r := &replyInspector{Conn: &bufferConn{r: bytes.NewReader(c.Request)}}
+		_, err := io.Copy(ioutil.Discard, r)
+		ensure.Nil(t, err)
+		ensure.True(t, len(r.request) <= maxRequestPrefix)
+		flagged := append([]byte(nil), reply...)
+		setInt32(flagged, headerLen, c.Flags)
+		_, err = r.Write(flagged)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, r.errorDocument(defaultNamespaces) != nil, c.Checked)
+	}
+
+	// OP_MSG replies are all to commands.
+	msg := msgReply(t, 0, bson.M{"code": 10107})
+	for _, request := range [][]byte{msgBody(t, 0, msgSection{Documents: []interface{}{bson.M{"find": "foo"}}}), nil} {
+		r := &replyInspector{Conn: &bufferConn{r: bytes.NewReader(request)}}
+		_, err = io.Copy(ioutil.Discard, r)
+		ensure.Nil(t, err)
+		_, err = r.Write(msg)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, r.errorDocument(defaultNamespaces), doc)
+	}
+
+	big, err := bson.Marshal(bson.M{"a": string(make([]byte, maxInspectedDocument))})
+	ensure.Nil(t, err)
+	r := &replyInspector{Conn: &bufferConn{}}
+	_, err = r.Write(append(replyMessage(0, 0), big...))
+	ensure.Nil(t, err)
+	ensure.True(t, r.firstDocument() == nil)
+}
+
+// proxyStepdownReply proxies a getMore whose reply is the document, with the
+// reply flags, and returns the server connection and the stepdowns detected.
+func proxyStepdownReply(t *testing.T, doc bson.M, flags int32) (*serverConn, []string) {
+	hc := &statsRecorder{}
+	var steppedDown []string
+	pool := &Pool{
+		New:           func() (io.Closer, error) { return &bufferConn{}, nil },
+		Max:           2,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         clock.New(),
+	}
+	defer pool.Close()
+	idle, err := pool.Acquire()
+	ensure.Nil(t, err)
+	pool.Release(idle)
+
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Second,
+			OnPrimaryStepdown: func(addr string) {
+				steppedDown = append(steppedDown, addr)
+			},
+		},
+		Clock: clock.NewMock(),
+		stats: hc,
+	}
+	b, err := bson.Marshal(doc)
+	ensure.Nil(t, err)
+	reply := append(replyMessage(0, 0), b...)
+	setInt32(reply, 0, int32(len(reply)))
+	setInt32(reply, headerLen, flags)
+	setInt32(reply, headerLen+16, 1)
+
+	body := getMoreBody("test.foo", 5)
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpGetMore}
+	server := &serverConn{
+		Conn:    &bufferConn{r: bytes.NewReader(reply)},
+		backend: "mongo:27017",
+		pool:    pool,
+	}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	var lastError LastError
+	ensure.Nil(t, p.proxyMessage(h, nil, client, server, &lastError))
+	ensure.DeepEqual(t, client.w.Bytes(), reply)
+	ensure.DeepEqual(t, hc.sum("server.primary.stepdown.detected"), float64(len(steppedDown)))
+	if len(steppedDown) != 0 {
+		ensure.DeepEqual(t, pool.Idle(), uint(0))
+	}
+	return server, steppedDown
+}
+
+func TestPrimaryStepdownDetected(t *testing.T) {
+	t.Parallel()
+	server, steppedDown := proxyStepdownReply(t,
+		bson.M{"$err": "not master", "code": 10107}, replyQueryFailure)
+	ensure.DeepEqual(t, steppedDown, []string{"mongo:27017"})
+	ensure.True(t, server.stale)
+}
+
+func TestQueryResultNotStepdown(t *testing.T) {
+	t.Parallel()
+	// Documents returned by a query are the user's, whatever their fields.
+	for _, doc := range []bson.M{
+		{"ok": 0, "errmsg": "not master", "code": 10107},
+		{"err": "not master"},
+	} {
+		server, steppedDown := proxyStepdownReply(t, doc, 0)
+		ensure.DeepEqual(t, len(steppedDown), 0)
+		ensure.False(t, server.stale)
+	}
+}
+
+func TestMsgStepdownDetected(t *testing.T) {
+	t.Parallel()
+	var steppedDown []string
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			MessageTimeout: time.Second,
+			OnPrimaryStepdown: func(addr string) {
+				steppedDown = append(steppedDown, addr)
+			},
+		},
+		Clock: clock.NewMock(),
+		stats: &stats.HookClient{},
+	}
+	pool := &Pool{
+		New:           func() (io.Closer, error) { return &bufferConn{}, nil },
+		Max:           1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         clock.New(),
+	}
+	defer pool.Close()
+	body := msgBody(t, 0, msgSection{Documents: []interface{}{
+		bson.D{{Name: "insert", Value: "foo"}, {Name: "$db", Value: "test"}},
+	}})
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpMsg}
+	server := &serverConn{
+		Conn:    &bufferConn{r: bytes.NewReader(msgReply(t, 0, bson.M{"ok": 0, "code": 10107}))},
+		backend: "mongo:27017",
+		pool:    pool,
+	}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	ensure.Nil(t, p.proxyMessage(h, nil, client, server, &LastError{}))
+	ensure.DeepEqual(t, steppedDown, []string{"mongo:27017"})
+	ensure.True(t, server.stale)
+}
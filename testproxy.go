@@ -0,0 +1,64 @@
+package dvara
+
+import (
+	"net"
+	"time"
+)
+
+// StartTestProxy starts a proxy to the mongo at mongoAddr for use in tests,
+// such as those of programs embedding dvara, and returns the address clients
+// should connect to. The proxy listens on a random port on the loopback
+// interface, with small pools and timeouts suited to tests. Addresses in
+// isMaster and replSetGetStatus responses are all rewritten to that of the
+// proxy, so drivers keep using it even if mongoAddr is a replica set member.
+func StartTestProxy(mongoAddr string) (*Proxy, string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	addr := l.Addr().String()
+	mapper := testProxyMapper(addr)
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{
+			ProxyQuery: &ProxyQuery{
+				GetLastErrorRewriter: &GetLastErrorRewriter{},
+				IsMasterResponseRewriter: &IsMasterResponseRewriter{
+					ProxyMapper: mapper,
+					ReplyRW:     &ReplyRW{},
+				},
+				ReplSetGetStatusResponseRewriter: &ReplSetGetStatusResponseRewriter{
+					ProxyMapper: mapper,
+					ReplyRW:     &ReplyRW{},
+				},
+			},
+			MaxConnections:          5,
+			MaxPerClientConnections: 100,
+			ServerIdleTimeout:       time.Minute,
+			ServerClosePoolSize:     1,
+			ClientIdleTimeout:       time.Minute,
+			GetLastErrorTimeout:     time.Minute,
+			MessageTimeout:          10 * time.Second,
+		},
+		ClientListener: l,
+		ProxyAddr:      addr,
+		MongoAddr:      mongoAddr,
+	}
+	if err := p.Start(); err != nil {
+		l.Close()
+		return nil, "", err
+	}
+	return p, addr, nil
+}
+
+// StopTestProxy stops a proxy started with StartTestProxy. It waits for the
+// clients to finish the message they are on and closes all server connections.
+func StopTestProxy(p *Proxy) error {
+	return p.Stop()
+}
+
+// testProxyMapper maps every mongo address to the one test proxy.
+type testProxyMapper string
+
+func (m testProxyMapper) Proxy(string) (string, error) {
+	return string(m), nil
+}
@@ -0,0 +1,55 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestStartTestProxy(t *testing.T) {
+	t.Parallel()
+	mongo, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	defer mongo.Close()
+	m := newLoopbackMongo(t)
+	go func() {
+		for {
+			c, err := mongo.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(c)
+		}
+	}()
+
+	p, addr, err := StartTestProxy(mongo.Addr().String())
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, addr, p.Addr().String())
+	c, err := net.Dial("tcp", addr)
+	ensure.Nil(t, err)
+	defer c.Close()
+
+	cases := []struct {
+		Query    []byte
+		Expected bson.M
+	}{
+		{queryMessage(t, 1, "admin.$cmd", bson.M{"isMaster": 1}), loopbackIsMaster(addr)},
+		{queryMessage(t, 2, "test.foo", bson.M{"a": "b"}), bson.M{"_id": 1, "a": "b"}},
+	}
+	for _, k := range cases {
+		_, err := c.Write(k.Query)
+		ensure.Nil(t, err)
+		var reply bytes.Buffer
+		ensure.Nil(t, copyMessage(&reply, c))
+		actual := bson.M{}
+		ensure.Nil(t, bson.Unmarshal(reply.Bytes()[headerLen+len(emptyPrefix):], &actual))
+		ensure.DeepEqual(t, actual, k.Expected)
+	}
+
+	ensure.Nil(t, StopTestProxy(p))
+	_, err = net.Dial("tcp", addr)
+	ensure.NotNil(t, err)
+}
@@ -0,0 +1,139 @@
+package dvara
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/stats"
+)
+
+// tokenBucket limits a rate of bytes. It holds up to a second worth of tokens,
+// so short bursts go through unthrottled. Taking more tokens than available
+// puts the bucket in debt, which is paid back by waiting.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens and returns how long to wait before using them.
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// byteRateLimiter hands out a token bucket per client IP, shared by all the
+// connections from that client.
+type byteRateLimiter struct {
+	rate    float64
+	rates   map[string]float64 // rates of specific client IPs, see ClientLimits
+	mutex   sync.Mutex
+	buckets map[string]*clientBucket
+}
+
+type clientBucket struct {
+	tokenBucket
+	conns uint
+}
+
+func newByteRateLimiter(bytesPerSecond uint) *byteRateLimiter {
+	return &byteRateLimiter{
+		rate:    float64(bytesPerSecond),
+		buckets: make(map[string]*clientBucket),
+	}
+}
+
+// rateFor returns the rate of the client IP, 0 if it is not limited.
+func (l *byteRateLimiter) rateFor(remoteIP string) float64 {
+	if rate, ok := l.rates[remoteIP]; ok {
+		return rate
+	}
+	return l.rate
+}
+
+// acquire returns the bucket of the client for one of its connections.
+func (l *byteRateLimiter) acquire(remoteIP string) *tokenBucket {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[remoteIP]
+	if !ok {
+		b = &clientBucket{tokenBucket: tokenBucket{rate: l.rateFor(remoteIP)}}
+		l.buckets[remoteIP] = b
+	}
+	b.conns++
+	return &b.tokenBucket
+}
+
+// release forgets the bucket of the client once its last connection is gone.
+func (l *byteRateLimiter) release(remoteIP string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[remoteIP]
+	if !ok {
+		return
+	}
+	b.conns--
+	if b.conns == 0 {
+		delete(l.buckets, remoteIP)
+	}
+}
+
+// throttledConn slows down reads and writes to the rate of its bucket, rather
+// than failing them.
+type throttledConn struct {
+	net.Conn
+	bucket *tokenBucket
+	clock  clock.Clock
+	stats  stats.Client
+}
+
+func (t *throttledConn) wait(n int) {
+	if d := t.bucket.take(n, t.clock.Now()); d > 0 {
+		stats.BumpSum(t.stats, "client.throttled.bytes", float64(n))
+		t.clock.Sleep(d)
+	}
+}
+
+func (t *throttledConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	t.wait(n)
+	return n, err
+}
+
+func (t *throttledConn) Write(b []byte) (int, error) {
+	t.wait(len(b))
+	return t.Conn.Write(b)
+}
+
+// throttleIf wraps the client connection in a throttledConn if
+// MaxBytesPerSecondPerClient, or the ClientLimits of the client IP, set a rate.
+// The returned function must be called once the connection is closed.
+func (p *Proxy) throttleIf(c net.Conn, remoteIP string) (net.Conn, func()) {
+	if p.byteRateLimiter == nil || p.byteRateLimiter.rateFor(remoteIP) == 0 {
+		return c, func() {}
+	}
+	t := &throttledConn{
+		Conn:   c,
+		bucket: p.byteRateLimiter.acquire(remoteIP),
+		clock:  p.Clock,
+		stats:  p.stats,
+	}
+	return t, func() { p.byteRateLimiter.release(remoteIP) }
+}
@@ -0,0 +1,78 @@
+package dvara
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(0, 0)
+	b := &tokenBucket{rate: 100}
+	cases := []struct {
+		Elapsed time.Duration
+		Bytes   int
+		Wait    time.Duration
+	}{
+		{0, 100, 0},
+		{0, 50, 500 * time.Millisecond},
+		{time.Second, 50, 0},
+		{10 * time.Second, 150, 500 * time.Millisecond},
+	}
+	for _, c := range cases {
+		start = start.Add(c.Elapsed)
+		ensure.DeepEqual(t, b.take(c.Bytes, start), c.Wait)
+	}
+}
+
+func TestByteRateLimiterSharesBuckets(t *testing.T) {
+	t.Parallel()
+	l := newByteRateLimiter(10)
+	a := l.acquire("1.2.3.4")
+	ensure.True(t, l.acquire("1.2.3.4") == a)
+	ensure.True(t, l.acquire("5.6.7.8") != a)
+	l.release("1.2.3.4")
+	ensure.DeepEqual(t, len(l.buckets), 2)
+	l.release("1.2.3.4")
+	l.release("5.6.7.8")
+	l.release("5.6.7.8")
+	ensure.DeepEqual(t, len(l.buckets), 0)
+}
+
+func TestThrottledConn(t *testing.T) {
+	t.Parallel()
+	hc := &statsRecorder{}
+	klock := &sleepRecorder{Clock: clock.NewMock()}
+	p := &Proxy{
+		Clock:           klock,
+		stats:           hc,
+		byteRateLimiter: newByteRateLimiter(10),
+	}
+	raw := &pipeConn{r: bytes.NewReader(make([]byte, 15))}
+	c, release := p.throttleIf(raw, "1.2.3.4")
+	defer release()
+
+	// The connection is slowed down but the bytes all go through.
+	b := make([]byte, 15)
+	n, err := c.Read(b)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, 15)
+	n, err = c.Write(b[:5])
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, n, 5)
+	ensure.DeepEqual(t, raw.w.Len(), 5)
+	ensure.DeepEqual(t, klock.sleeps, []time.Duration{500 * time.Millisecond, time.Second})
+	ensure.DeepEqual(t, hc.sum("client.throttled.bytes"), float64(20))
+}
+
+func TestThrottleIfDisabled(t *testing.T) {
+	t.Parallel()
+	raw := &pipeConn{}
+	c, release := (&Proxy{}).throttleIf(raw, "1.2.3.4")
+	release()
+	ensure.True(t, c == raw)
+}
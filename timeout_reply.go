@@ -0,0 +1,48 @@
+package dvara
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/facebookgo/stats"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// timeoutReplyWriteTimeout bounds how long writing the error reply for a
+// message which timed out may take, as the message deadline has passed.
+const timeoutReplyWriteTimeout = time.Second
+
+// isTimeout tells if the error is a network timeout, such as the message
+// deadline passing.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// replyTimedOut tells the client its message timed out, when the proxy gave up
+// waiting for the server's response. Without it the client would only see its
+// connection being closed. The reply can only be sent if none of the response
+// was written to the client yet.
+func (p *Proxy) replyTimedOut(h *messageHeader, client *replyInspector) {
+	if len(client.buf) > 0 {
+		return
+	}
+	client.Conn.SetWriteDeadline(p.Clock.Now().Add(timeoutReplyWriteTimeout))
+	if err := writeErrorResponse(client.Conn, h, ErrorCodeExceededTimeLimit,
+		"dvara: operation exceeded the proxy message timeout"); err == nil {
+		stats.BumpSum(p.stats, "message.proxy.timeout.replied", 1)
+	}
+}
+
+// isTimeLimitReply tells if the document is an error returned by a server for
+// an operation which exceeded its maxTimeMS.
+func isTimeLimitReply(doc []byte) bool {
+	if doc == nil || !bytes.Contains(doc, []byte("code")) {
+		return false
+	}
+	var reply struct {
+		Code int `bson:"code"`
+	}
+	return bson.Unmarshal(doc, &reply) == nil && reply.Code == ErrorCodeExceededTimeLimit
+}
@@ -0,0 +1,89 @@
+package dvara
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// slowServerConn is a server connection which times out once it has sent
+// what it has of the response.
+type slowServerConn struct {
+	bufferConn
+}
+
+func (s *slowServerConn) Read(b []byte) (int, error) {
+	if s.r.Len() == 0 {
+		return 0, timeoutError{}
+	}
+	return s.r.Read(b)
+}
+
+// deadlineConn is a client connection which accepts write deadlines.
+type deadlineConn struct {
+	bufferConn
+}
+
+func (d *deadlineConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestProxyMessageTimeoutReply(t *testing.T) {
+	t.Parallel()
+	var h messageHeader
+	msg := queryMessage(t, 7, "test.foo", bson.M{"a": 1})
+	h.FromWire(msg)
+	// Responses are written to the client as the copy buffer fills up.
+	large := messageHeader{MessageLength: int32(2 * CopyBufferSize), OpCode: OpReply}
+	partial := append(large.ToWire(), make([]byte, CopyBufferSize-headerLen)...)
+	cases := []struct {
+		Name     string
+		Response []byte
+		Replied  bool
+	}{
+		{"no response", nil, true},
+		{"header only", partial[:headerLen], true},
+		{"partial response", partial, false},
+	}
+	for _, c := range cases {
+		var rec statsRecorder
+		p := &Proxy{
+			ReplicaSet: &ReplicaSet{MessageTimeout: time.Second, ProxyQuery: &ProxyQuery{}},
+			Clock:      clock.NewMock(),
+			stats:      &rec,
+		}
+		client := &deadlineConn{bufferConn{r: bytes.NewReader(msg[headerLen:])}}
+		server := &slowServerConn{bufferConn{r: bytes.NewReader(c.Response)}}
+		err := p.proxyMessage(&h, nil, client, server, &LastError{})
+		ensure.True(t, isTimeout(err), c.Name)
+		if !c.Replied {
+			ensure.DeepEqual(t, rec.sum("message.proxy.timeout.replied"), float64(0), c.Name)
+			ensure.DeepEqual(t, client.w.Len(), len(c.Response), c.Name)
+			continue
+		}
+		ensure.DeepEqual(t, rec.sum("message.proxy.timeout.replied"), float64(1), c.Name)
+		ensure.DeepEqual(t, errorReplyCode(t, client.w.Bytes()), ErrorCodeExceededTimeLimit, c.Name)
+		ensure.DeepEqual(t, getInt32(client.w.Bytes(), 8), int32(7), c.Name)
+	}
+}
+
+func TestIsTimeLimitReply(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Doc       interface{}
+		TimeLimit bool
+	}{
+		{bson.M{"ok": 0, "code": 50, "errmsg": "operation exceeded time limit"}, true},
+		{bson.M{"$err": "operation exceeded time limit", "code": 50}, true},
+		{bson.M{"ok": 0, "code": 10107}, false},
+		{bson.M{"ok": 1}, false},
+	}
+	for _, c := range cases {
+		doc, err := bson.Marshal(c.Doc)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, isTimeLimitReply(doc), c.TimeLimit, c.Doc)
+	}
+	ensure.False(t, isTimeLimitReply(nil))
+}
@@ -0,0 +1,157 @@
+package dvara
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+var (
+	errPartialRequest = errors.New("dvara: request partially written to the server")
+	errExhaustRequest = errors.New("dvara: server may have streamed replies to an exhaust request")
+)
+
+// queryExhaust is the OP_QUERY flag letting the server stream all the batches
+// of a cursor in reply.
+const queryExhaust = 1 << 6
+
+// messageFraming follows the message boundaries in one direction of a server
+// connection, from the length in each header.
+type messageFraming struct {
+	header    [headerLen + 4]byte
+	headerN   int   // bytes of the current prefix seen so far
+	remaining int64 // bytes of the current message left after its header
+	messages  int64 // complete messages
+	expecting int64 // messages the server responds to
+	exhaust   bool  // a message let the server respond more than once
+}
+
+// observe follows the bytes passing through.
+func (f *messageFraming) observe(b []byte) {
+	for len(b) > 0 {
+		if f.remaining > 0 {
+			n := int64(len(b))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			f.remaining -= n
+			b = b[n:]
+			if f.remaining == 0 {
+				f.messages++
+			}
+			continue
+		}
+		n := copy(f.header[f.headerN:f.prefixLen()], b)
+		f.headerN += n
+		b = b[n:]
+		if f.headerN < f.prefixLen() {
+			continue
+		}
+		prefix := f.headerN
+		f.headerN = 0
+		if expectsResponse(f.header[:prefix]) {
+			f.expecting++
+		}
+		if allowsExhaust(f.header[:prefix]) {
+			f.exhaust = true
+		}
+		if f.remaining = int64(getInt32(f.header[:], 0)) - int64(prefix); f.remaining <= 0 {
+			f.remaining = 0
+			f.messages++
+		}
+	}
+}
+
+// prefixLen returns the length of the start of the current message which is
+// kept: its header, followed by the flags of an OP_QUERY or OP_MSG as they tell
+// if the server responds to it, and how many times.
+func (f *messageFraming) prefixLen() int {
+	if f.headerN < headerLen || getInt32(f.header[:], 0) < headerLen+4 {
+		return headerLen
+	}
+	switch OpCode(getInt32(f.header[:], 12)) {
+	case OpQuery, OpMsg:
+		return headerLen + 4
+	}
+	return headerLen
+}
+
+// allowsExhaust returns true if the message starting with the header and flags
+// lets the server stream several responses to it.
+func allowsExhaust(b []byte) bool {
+	if len(b) < headerLen+4 {
+		return false
+	}
+	switch OpCode(getInt32(b, 12)) {
+	case OpQuery:
+		return getInt32(b, headerLen)&queryExhaust != 0
+	case OpMsg:
+		return uint32(getInt32(b, headerLen))&opMsgExhaustAllowed != 0
+	}
+	return false
+}
+
+// inMessage returns true if the current message is partially through.
+func (f *messageFraming) inMessage() bool {
+	return f.headerN > 0 || f.remaining > 0
+}
+
+// needed returns how many bytes complete the current header or message.
+func (f *messageFraming) needed() int64 {
+	if f.remaining > 0 {
+		return f.remaining
+	}
+	return int64(f.prefixLen() - f.headerN)
+}
+
+// resetTimedOut tries to bring a server connection whose message timed out
+// back in step with the protocol, so it can go back to the pool rather than
+// be discarded. The rest of the responses the server owes are read and
+// dropped for up to the TimeoutResetGrace. A request only partially written to
+// the server cannot be recovered, nor can a connection which had an exhaust
+// request, as the responses streamed to it don't tell how many are owed. It
+// returns true if the connection is usable.
+func (p *Proxy) resetTimedOut(c net.Conn) bool {
+	grace := p.ReplicaSet.TimeoutResetGrace
+	sc, ok := c.(*serverConn)
+	if grace <= 0 || !ok || sc.stale || sc.reset {
+		return false
+	}
+	if err := sc.drain(p.Clock.Now().Add(grace)); err != nil {
+		stats.BumpSum(p.stats, "server.timeout.reset.failed", 1)
+		corelog.LogErrorMessage(fmt.Sprintf("Could not reset server connection to backend %s after timeout: %s", sc.backend, err))
+		return false
+	}
+	stats.BumpSum(p.stats, "server.timeout.reset", 1)
+	return true
+}
+
+// drain reads and drops the responses the server still owes, until the
+// deadline.
+func (s *serverConn) drain(deadline time.Time) error {
+	if s.sent.inMessage() {
+		return errPartialRequest
+	}
+	if s.sent.exhaust {
+		return errExhaustRequest
+	}
+	if err := s.SetDeadline(deadline); err != nil {
+		return err
+	}
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	for s.received.inMessage() || s.received.messages < s.sent.expecting {
+		n := s.received.needed()
+		if n > int64(len(*buf)) {
+			n = int64(len(*buf))
+		}
+		if _, err := s.Read((*buf)[:n]); err != nil {
+			return err
+		}
+	}
+	return s.SetDeadline(time.Time{})
+}
@@ -0,0 +1,125 @@
+package dvara
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMessageFraming(t *testing.T) {
+	t.Parallel()
+	query := queryMessage(t, 1, "test.foo", bson.M{"a": 1})
+	insert := messageHeader{MessageLength: headerLen + 4, OpCode: OpInsert}
+	stream := append(append([]byte(nil), query...), append(insert.ToWire(), 0, 0, 0, 0)...)
+	var f messageFraming
+	// Split within the first header, and within both bodies.
+	for _, chunk := range [][]byte{stream[:5], stream[5:20], stream[20 : len(query)+headerLen+2]} {
+		f.observe(chunk)
+		ensure.True(t, f.inMessage())
+	}
+	ensure.DeepEqual(t, f.messages, int64(1))
+	ensure.DeepEqual(t, f.expecting, int64(1))
+	ensure.DeepEqual(t, f.needed(), int64(2))
+	f.observe(stream[len(query)+headerLen+2:])
+	ensure.False(t, f.inMessage())
+	ensure.DeepEqual(t, f.messages, int64(2))
+	ensure.DeepEqual(t, f.expecting, int64(1))
+	ensure.DeepEqual(t, f.needed(), int64(headerLen))
+}
+
+func TestMessageFramingMsg(t *testing.T) {
+	t.Parallel()
+	// An OP_MSG with moreToCome gets no response, whichever way its flagBits
+	// arrive.
+	msg := msgMessage(t, 1, msgSection{Documents: []interface{}{bson.M{"ping": 1}}})
+	quiet := append([]byte(nil), msg...)
+	setInt32(quiet, headerLen, opMsgMoreToCome)
+	stream := append(append([]byte(nil), msg...), quiet...)
+	var f messageFraming
+	for _, chunk := range [][]byte{stream[:headerLen+2], stream[headerLen+2 : len(msg)+headerLen+1], stream[len(msg)+headerLen+1:]} {
+		f.observe(chunk)
+	}
+	ensure.False(t, f.inMessage())
+	ensure.DeepEqual(t, f.messages, int64(2))
+	ensure.DeepEqual(t, f.expecting, int64(1))
+	ensure.False(t, f.exhaust)
+
+	// Either exhaust flag lets the server respond more than once.
+	query := queryMessage(t, 2, "test.foo", bson.M{"a": 1})
+	setInt32(query, headerLen, queryExhaust)
+	setInt32(msg, headerLen, opMsgExhaustAllowed)
+	for _, m := range [][]byte{query, msg} {
+		var f messageFraming
+		f.observe(m)
+		ensure.True(t, f.exhaust)
+		ensure.DeepEqual(t, f.expecting, int64(1))
+	}
+}
+
+func TestResetTimedOut(t *testing.T) {
+	t.Parallel()
+	var h messageHeader
+	msg := queryMessage(t, 7, "test.foo", bson.M{"a": 1})
+	h.FromWire(msg)
+	response := replyMessage(0, 0)
+	exhaust := msgMessage(t, 8, msgSection{Documents: []interface{}{
+		bson.D{{Name: "getMore", Value: int64(5)}, {Name: "collection", Value: "foo"}, {Name: "$db", Value: "test"}},
+	}})
+	setInt32(exhaust, headerLen, opMsgExhaustAllowed)
+	cases := []struct {
+		Name   string
+		Grace  time.Duration
+		Sent   []byte // the request as written to the server
+		Late   []byte // the response the server sends after the timeout
+		Reset  bool
+		Failed int
+	}{
+		{"response late", time.Second, nil, response, true, 0},
+		{"response partially late", time.Second, nil, response[headerLen:], true, 0},
+		{"response too late", time.Second, nil, nil, false, 1},
+		{"request partially sent", time.Second, msg[:headerLen+3], nil, false, 1},
+		{"exhaust request", time.Second, exhaust, response, false, 1},
+		{"disabled", 0, nil, response, false, 0},
+	}
+	for _, c := range cases {
+		var rec statsRecorder
+		p := &Proxy{
+			ReplicaSet: &ReplicaSet{
+				MessageTimeout:    time.Second,
+				TimeoutResetGrace: c.Grace,
+				ProxyQuery:        &ProxyQuery{},
+			},
+			Clock: clock.NewMock(),
+			stats: &rec,
+		}
+		early := response[:headerLen]
+		if len(c.Late) == len(response) {
+			early = nil
+		}
+		slow := &slowServerConn{bufferConn{r: bytes.NewReader(early)}}
+		sc := &serverConn{Conn: slow, backend: "mongo"}
+		if c.Sent != nil {
+			sc.sent.observe(c.Sent)
+		} else {
+			client := &deadlineConn{bufferConn{r: bytes.NewReader(msg[headerLen:])}}
+			err := p.proxyMessage(&h, nil, client, sc, &LastError{})
+			ensure.True(t, isTimeout(err), c.Name)
+		}
+
+		slow.r = bytes.NewReader(c.Late)
+		ensure.DeepEqual(t, p.resetTimedOut(sc), c.Reset, c.Name)
+		if !c.Reset {
+			ensure.DeepEqual(t, rec.sum("server.timeout.reset"), float64(0), c.Name)
+			ensure.DeepEqual(t, rec.sum("server.timeout.reset.failed"), float64(c.Failed), c.Name)
+			continue
+		}
+		ensure.DeepEqual(t, rec.sum("server.timeout.reset"), float64(1), c.Name)
+		ensure.False(t, sc.received.inMessage(), c.Name)
+		ensure.DeepEqual(t, sc.received.messages, sc.sent.expecting, c.Name)
+		ensure.DeepEqual(t, slow.r.Len(), 0, c.Name)
+	}
+}
@@ -0,0 +1,58 @@
+package dvara
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// traceCommentPrefix precedes the trace ID in the comment of queries, so it can
+// be told apart from comments set by the client.
+const traceCommentPrefix = "dvara:"
+
+// newTraceID returns a new trace ID. ObjectIds are unique across proxies and
+// sort by time, which helps when searching logs.
+func newTraceID() string {
+	return bson.NewObjectId().Hex()
+}
+
+// injectTraceComment returns the query document with the trace ID added to the
+// given comment field. An existing string comment is kept with the trace ID
+// appended to it, other comments are left alone and false is returned.
+func injectTraceComment(q bson.D, field, traceID string) (bson.D, bool) {
+	comment := traceCommentPrefix + traceID
+	for i, e := range q {
+		if e.Name != field {
+			continue
+		}
+		existing, ok := e.Value.(string)
+		if !ok {
+			return q, false
+		}
+		newQ := make(bson.D, len(q))
+		copy(newQ, q)
+		newQ[i].Value = existing + " " + comment
+		return newQ, true
+	}
+	newQ := make(bson.D, len(q), len(q)+1)
+	copy(newQ, q)
+	return append(newQ, bson.DocElem{Name: field, Value: comment}), true
+}
+
+// traceCommentField returns the field of the query document the trace comment
+// goes in, or "" if the query is not traced. Queries of a collection, and
+// queries wrapped in $query like commands sent with a read preference, take a
+// $comment. The find command takes its comment option. Other commands, writes
+// in particular, are left alone as they don't all accept a comment.
+func (r *ReplicaSet) traceCommentField(command bool, q bson.D) string {
+	if r == nil || !r.InjectTraceComment || len(q) == 0 {
+		return ""
+	}
+	switch {
+	case !command || q[0].Name == "$query":
+		return "$comment"
+	case strings.EqualFold(q[0].Name, "find"):
+		return "comment"
+	}
+	return ""
+}
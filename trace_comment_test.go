@@ -0,0 +1,109 @@
+package dvara
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestInjectTraceComment(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Query    bson.D
+		Field    string
+		Expected bson.D
+		OK       bool
+	}{
+		{
+			bson.D{{Name: "a", Value: 1}},
+			"$comment",
+			bson.D{{Name: "a", Value: 1}, {Name: "$comment", Value: "dvara:42"}},
+			true,
+		},
+		{
+			bson.D{{Name: "$query", Value: bson.D{{Name: "count", Value: "foo"}}}, {Name: "$comment", Value: "report"}},
+			"$comment",
+			bson.D{{Name: "$query", Value: bson.D{{Name: "count", Value: "foo"}}}, {Name: "$comment", Value: "report dvara:42"}},
+			true,
+		},
+		{
+			bson.D{{Name: "find", Value: "foo"}, {Name: "comment", Value: bson.D{{Name: "a", Value: 1}}}},
+			"comment",
+			bson.D{{Name: "find", Value: "foo"}, {Name: "comment", Value: bson.D{{Name: "a", Value: 1}}}},
+			false,
+		},
+	}
+	for _, c := range cases {
+		original := append(bson.D(nil), c.Query...)
+		q, ok := injectTraceComment(c.Query, c.Field, "42")
+		ensure.DeepEqual(t, q, c.Expected)
+		ensure.DeepEqual(t, ok, c.OK)
+		ensure.DeepEqual(t, c.Query, original)
+	}
+}
+
+func TestTraceCommentField(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{InjectTraceComment: true}
+	ensure.DeepEqual(t, r.traceCommentField(false, bson.D{{Name: "a", Value: 1}}), "$comment")
+	ensure.DeepEqual(t, r.traceCommentField(true, bson.D{{Name: "find", Value: "foo"}}), "comment")
+	ensure.DeepEqual(t, r.traceCommentField(true, bson.D{{Name: "$query", Value: bson.D{{Name: "count", Value: "foo"}}}}), "$comment")
+	ensure.DeepEqual(t, r.traceCommentField(true, bson.D{{Name: "insert", Value: "foo"}}), "")
+	ensure.DeepEqual(t, r.traceCommentField(true, bson.D{{Name: "findAndModify", Value: "foo"}}), "")
+	ensure.DeepEqual(t, r.traceCommentField(true, bson.D{{Name: "getlasterror", Value: 1}}), "")
+	ensure.DeepEqual(t, r.traceCommentField(true, bson.D{{Name: "isMaster", Value: 1}}), "")
+	ensure.DeepEqual(t, r.traceCommentField(false, nil), "")
+	ensure.DeepEqual(t, (&ReplicaSet{}).traceCommentField(false, bson.D{{Name: "a", Value: 1}}), "")
+}
+
+// sentTraceQuery proxies the query of the namespace with InjectTraceComment
+// set and returns the query document sent to the server.
+func sentTraceQuery(t *testing.T, ns string, query bson.D) bson.D {
+	body := queryBody(t, ns, query)
+	h := &messageHeader{MessageLength: int32(headerLen + len(body)), OpCode: OpQuery}
+	client := &bufferConn{r: bytes.NewReader(body)}
+	server := &bufferConn{r: bytes.NewReader(replyMessage(0, 0))}
+	r := &ReplicaSet{InjectTraceComment: true}
+	ensure.Nil(t, (&ProxyQuery{}).Proxy(h, client, server, &LastError{}, r))
+
+	sent := server.w.Bytes()
+	ensure.DeepEqual(t, int(getInt32(sent, 0)), len(sent))
+	_, end, ok := queryCollection(sent[headerLen:])
+	ensure.True(t, ok)
+	var q bson.D
+	ensure.Nil(t, bson.Unmarshal(sent[headerLen+end+8:], &q))
+	return q
+}
+
+func TestProxyQueryInjectsTraceComment(t *testing.T) {
+	t.Parallel()
+	q := sentTraceQuery(t, "test.foo", bson.D{{Name: "a", Value: 1}})
+	ensure.DeepEqual(t, len(q), 2)
+	ensure.DeepEqual(t, q[1].Name, "$comment")
+	ensure.True(t, strings.HasPrefix(q[1].Value.(string), traceCommentPrefix))
+
+	q = sentTraceQuery(t, "test.$cmd", bson.D{
+		{Name: "find", Value: "foo"},
+		{Name: "filter", Value: bson.D{{Name: "a", Value: 1}}},
+	})
+	ensure.DeepEqual(t, len(q), 3)
+	ensure.DeepEqual(t, q[2].Name, "comment")
+	ensure.True(t, strings.HasPrefix(q[2].Value.(string), traceCommentPrefix))
+}
+
+func TestProxyQueryDoesNotTraceWrites(t *testing.T) {
+	t.Parallel()
+	insert := bson.D{
+		{Name: "insert", Value: "foo"},
+		{Name: "documents", Value: []bson.D{{{Name: "a", Value: 1}}}},
+		{Name: "ordered", Value: true},
+	}
+	q := sentTraceQuery(t, "test.$cmd", insert)
+	ensure.DeepEqual(t, len(q), len(insert))
+	for i, e := range insert {
+		ensure.DeepEqual(t, q[i].Name, e.Name)
+	}
+}
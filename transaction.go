@@ -0,0 +1,193 @@
+package dvara
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/stats"
+	corelog "github.com/intercom/gocore/log"
+)
+
+// defaultTransactionTimeout is how long a transaction may go without a
+// statement before its connection is reclaimed, unless TransactionTimeout says
+// otherwise. It matches the transactionLifetimeLimitSeconds of mongo.
+const defaultTransactionTimeout = time.Minute
+
+// transactionAffinity pins server connections to the multi-statement
+// transactions running on them, keyed by the lsid of their session and their
+// txnNumber. Every statement of a transaction must run on the connection its
+// first one ran on, from startTransaction until commitTransaction or
+// abortTransaction, whichever client connection it comes from. Connections
+// pinned to a transaction are kept out of the pool, and marked in use while a
+// statement runs on them. A session has one transaction at a time, a new
+// txnNumber replaces the pin of the previous one. It is safe for concurrent
+// use.
+type transactionAffinity struct {
+	mutex sync.Mutex
+	pins  map[string]*transactionPin // by lsid
+}
+
+// transactionPin is the server connection a transaction runs on.
+type transactionPin struct {
+	txnNumber int64
+	conn      net.Conn
+	inUse     bool
+	lastUsed  time.Time
+}
+
+// take returns the server connection pinned to the transaction of a statement
+// past its first, and marks it in use. It returns false if the transaction is
+// not pinned, or its connection is in use by another statement, in which case
+// the statement runs on any connection and mongo has the final say.
+func (a *transactionAffinity) take(s msgSession) (net.Conn, bool) {
+	if !s.inTransaction() || s.StartTransaction {
+		return nil, false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	pin, ok := a.pins[string(s.LSID)]
+	if !ok || pin.txnNumber != s.TxnNumber || pin.inUse {
+		return nil, false
+	}
+	pin.inUse = true
+	return pin.conn, true
+}
+
+// release records that a statement of a transaction ran on the server
+// connection. The first statement pins the connection to the transaction,
+// commitTransaction and abortTransaction unpin it, and the others give it back
+// to the transaction. It returns whether the connection stays pinned, and the
+// connection of an earlier transaction of the session it replaced, which is no
+// longer pinned.
+func (a *transactionAffinity) release(s msgSession, conn net.Conn, now time.Time) (bool, net.Conn) {
+	if !s.inTransaction() {
+		return false, nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	lsid := string(s.LSID)
+	pin, ok := a.pins[lsid]
+	if s.StartTransaction {
+		var replaced net.Conn
+		if ok && !pin.inUse && pin.conn != conn {
+			replaced = pin.conn
+		}
+		if a.pins == nil {
+			a.pins = make(map[string]*transactionPin)
+		}
+		a.pins[lsid] = &transactionPin{txnNumber: s.TxnNumber, conn: conn, lastUsed: now}
+		return true, replaced
+	}
+	if !ok || pin.txnNumber != s.TxnNumber || pin.conn != conn {
+		return false, nil
+	}
+	if s.EndTransaction {
+		delete(a.pins, lsid)
+		return false, nil
+	}
+	pin.inUse = false
+	pin.lastUsed = now
+	return true, nil
+}
+
+// drop forgets the transaction pinned to the server connection, if any. This
+// is used when the connection is discarded.
+func (a *transactionAffinity) drop(conn net.Conn) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for lsid, pin := range a.pins {
+		if pin.conn == conn {
+			delete(a.pins, lsid)
+		}
+	}
+}
+
+// expire unpins the transactions without a statement since the given time and
+// returns their connections.
+func (a *transactionAffinity) expire(since time.Time) []net.Conn {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var conns []net.Conn
+	for lsid, pin := range a.pins {
+		if !pin.inUse && pin.lastUsed.Before(since) {
+			delete(a.pins, lsid)
+			conns = append(conns, pin.conn)
+		}
+	}
+	return conns
+}
+
+// releaseAll unpins all the transactions whose connections are not in use and
+// returns their connections, once the clients are gone.
+func (a *transactionAffinity) releaseAll() []net.Conn {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var conns []net.Conn
+	for lsid, pin := range a.pins {
+		if !pin.inUse {
+			delete(a.pins, lsid)
+			conns = append(conns, pin.conn)
+		}
+	}
+	return conns
+}
+
+// active returns the number of pinned transactions.
+func (a *transactionAffinity) active() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.pins)
+}
+
+// transactionTimeout returns how long a transaction may go without a statement
+// before its connection is reclaimed.
+func (r *ReplicaSet) transactionTimeout() time.Duration {
+	if r.TransactionTimeout == 0 {
+		return defaultTransactionTimeout
+	}
+	return r.TransactionTimeout
+}
+
+// keepTransactionConn records that a statement ran on the server connection,
+// and returns true if the connection stays pinned to its transaction rather
+// than being released.
+func (p *Proxy) keepTransactionConn(s msgSession, serverConn net.Conn) bool {
+	pinned, replaced := p.transactions.release(s, serverConn, p.Clock.Now())
+	switch {
+	case s.StartTransaction && pinned:
+		stats.BumpSum(p.stats, "transaction.pinned", 1)
+	case s.EndTransaction:
+		stats.BumpSum(p.stats, "transaction.ended", 1)
+	}
+	if replaced != nil {
+		stats.BumpSum(p.stats, "transaction.replaced", 1)
+		p.returnServerConn(replaced)
+	}
+	return pinned
+}
+
+// reclaimTransactions returns the connections of the transactions without a
+// statement for the TransactionTimeout to the pool, until the proxy is
+// stopped. Their clients most likely went away without ending them, and mongo
+// aborts them after as long. The number of pinned transactions is reported as
+// it goes.
+func (p *Proxy) reclaimTransactions() {
+	defer p.wg.Done()
+	timeout := p.ReplicaSet.transactionTimeout()
+	ticker := p.Clock.Ticker(timeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case now := <-ticker.C:
+			for _, c := range p.transactions.expire(now.Add(-timeout)) {
+				stats.BumpSum(p.stats, "transaction.leaked", 1)
+				corelog.LogInfoMessage("reclaimed the connection of a leaked transaction", "backend", backendAddr(c))
+				p.returnServerConn(c)
+			}
+			stats.BumpAvg(p.stats, "transaction.active", float64(p.transactions.active()))
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package dvara
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/clock"
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// transactionSession returns the session of a statement of a transaction of
+// testLSID, the command being the first of the fields.
+func transactionSession(t testing.TB, txnNumber int64, fields ...bson.DocElem) msgSession {
+	command := append(bson.D(fields),
+		bson.DocElem{Name: "lsid", Value: testLSID},
+		bson.DocElem{Name: "txnNumber", Value: txnNumber},
+		bson.DocElem{Name: "autocommit", Value: false},
+	)
+	s, ok := parseMsgSession(transactionBody(t, command))
+	ensure.True(t, ok)
+	return s
+}
+
+func TestTransactionAffinity(t *testing.T) {
+	t.Parallel()
+	start := transactionSession(t, 1, bson.DocElem{Name: "startTransaction", Value: true})
+	statement := transactionSession(t, 1)
+	commit := transactionSession(t, 1, bson.DocElem{Name: "commitTransaction", Value: 1})
+	a, b := &bufferConn{}, &bufferConn{}
+	now := time.Now()
+	var affinity transactionAffinity
+
+	// The first statement runs on any connection, which is then pinned.
+	_, ok := affinity.take(start)
+	ensure.False(t, ok)
+	pinned, replaced := affinity.release(start, a, now)
+	ensure.True(t, pinned)
+	ensure.True(t, replaced == nil)
+
+	conn, ok := affinity.take(statement)
+	ensure.True(t, ok)
+	ensure.True(t, conn == a)
+	// A statement running concurrently gets no connection, and doesn't change
+	// the pin once done.
+	_, ok = affinity.take(statement)
+	ensure.False(t, ok)
+	pinned, _ = affinity.release(statement, b, now)
+	ensure.False(t, pinned)
+	pinned, _ = affinity.release(statement, a, now)
+	ensure.True(t, pinned)
+
+	// Other transactions and sessions don't get the connection.
+	_, ok = affinity.take(transactionSession(t, 2))
+	ensure.False(t, ok)
+	_, ok = affinity.take(msgSession{LSID: []byte("other"), TxnNumber: 1, HasTxnNumber: true})
+	ensure.False(t, ok)
+
+	conn, ok = affinity.take(commit)
+	ensure.True(t, ok)
+	pinned, _ = affinity.release(commit, conn, now)
+	ensure.False(t, pinned)
+	ensure.DeepEqual(t, affinity.active(), 0)
+
+	// A new transaction of the session replaces the pin of the previous one.
+	affinity.release(start, a, now)
+	next := transactionSession(t, 2, bson.DocElem{Name: "startTransaction", Value: true})
+	pinned, replaced = affinity.release(next, b, now)
+	ensure.True(t, pinned)
+	ensure.True(t, replaced == a)
+	ensure.DeepEqual(t, affinity.active(), 1)
+
+	// Pins idle for too long expire, unless they are in use.
+	ensure.DeepEqual(t, len(affinity.expire(now)), 0)
+	_, ok = affinity.take(transactionSession(t, 2))
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, len(affinity.expire(now.Add(time.Second))), 0)
+	affinity.release(transactionSession(t, 2), b, now)
+	ensure.DeepEqual(t, affinity.expire(now.Add(time.Second)), []net.Conn{b})
+
+	affinity.release(start, a, now)
+	affinity.drop(a)
+	ensure.DeepEqual(t, affinity.active(), 0)
+}
+
+func TestReclaimTransactions(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	mock := clock.NewMock()
+	p := &Proxy{
+		ReplicaSet: &ReplicaSet{},
+		Clock:      mock,
+		closed:     make(chan struct{}),
+		stats:      &rec,
+	}
+	var pool *Pool
+	pool = &Pool{
+		New: func() (io.Closer, error) {
+			return &serverConn{Conn: &bufferConn{r: bytes.NewReader(nil)}, pool: pool}, nil
+		},
+		Max:           1,
+		IdleTimeout:   time.Hour,
+		ClosePoolSize: 1,
+		Clock:         clock.New(),
+	}
+	defer pool.Close()
+	c, err := pool.Acquire()
+	ensure.Nil(t, err)
+	start := transactionSession(t, 1, bson.DocElem{Name: "startTransaction", Value: true})
+	ensure.True(t, p.keepTransactionConn(start, c.(net.Conn)))
+
+	p.wg.Add(1)
+	go p.reclaimTransactions()
+	for i := 0; p.transactions.active() > 0; i++ {
+		ensure.True(t, i < 100)
+		mock.Add(defaultTransactionTimeout)
+	}
+	close(p.closed)
+	p.wg.Wait()
+	ensure.DeepEqual(t, rec.sum("transaction.leaked"), float64(1))
+	ensure.DeepEqual(t, pool.Idle(), uint(1))
+}
+
+func TestProxyPinsTransaction(t *testing.T) {
+	t.Parallel()
+	p := startLoopbackProxy(t, func(p *Proxy) {
+		p.ReplicaSet.MaxConnections = 2
+		p.ReplicaSet.MaxPerClientConnections = 2
+	})
+	defer p.Stop()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", p.Addr().String())
+		ensure.Nil(t, err)
+		return c
+	}
+	// run sends the command and returns the server connection it ran on.
+	run := func(c net.Conn, command bson.D) int {
+		_, err := c.Write(msgMessage(t, 1, msgSection{Documents: []interface{}{command}}))
+		ensure.Nil(t, err)
+		var reply bytes.Buffer
+		ensure.Nil(t, copyMessage(&reply, c))
+		m, err := parseOpMsg(reply.Bytes()[headerLen:])
+		ensure.Nil(t, err)
+		var doc struct {
+			ConnectionID int `bson:"connectionId"`
+		}
+		ensure.Nil(t, bson.Unmarshal(m.Body, &doc))
+		return doc.ConnectionID
+	}
+	statement := func(command string, fields ...bson.DocElem) bson.D {
+		return append(bson.D{
+			{Name: command, Value: "foo"},
+			{Name: "lsid", Value: testLSID},
+			{Name: "txnNumber", Value: int64(1)},
+			{Name: "autocommit", Value: false},
+			{Name: "$db", Value: "test"},
+		}, fields...)
+	}
+	ping := bson.D{{Name: "ping", Value: 1}, {Name: "$db", Value: "admin"}}
+
+	a, b := dial(), dial()
+	defer a.Close()
+	defer b.Close()
+	pinned := run(a, statement("insert", bson.DocElem{Name: "startTransaction", Value: true}))
+	// Other commands get another connection, while the statements of the
+	// transaction get the pinned one whichever client connection they come
+	// from.
+	ensure.NotDeepEqual(t, run(b, ping), pinned)
+	ensure.DeepEqual(t, run(b, statement("update")), pinned)
+	ensure.DeepEqual(t, run(a, statement("commitTransaction")), pinned)
+	ensure.DeepEqual(t, p.transactions.active(), 0)
+}
+
+func TestMutationFollowupJoinsTransaction(t *testing.T) {
+	t.Parallel()
+	var rec statsRecorder
+	p := startLoopbackProxy(t, func(p *Proxy) {
+		p.ReplicaSet.MaxConnections = 2
+		p.ReplicaSet.MaxPerClientConnections = 2
+		p.ReplicaSet.Stats = &rec
+	})
+	defer p.Stop()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", p.Addr().String())
+		ensure.Nil(t, err)
+		return c
+	}
+	run := func(c net.Conn, command bson.D) int {
+		_, err := c.Write(msgMessage(t, 1, msgSection{Documents: []interface{}{command}}))
+		ensure.Nil(t, err)
+		var reply bytes.Buffer
+		ensure.Nil(t, copyMessage(&reply, c))
+		m, err := parseOpMsg(reply.Bytes()[headerLen:])
+		ensure.Nil(t, err)
+		var doc struct {
+			ConnectionID int `bson:"connectionId"`
+		}
+		ensure.Nil(t, bson.Unmarshal(m.Body, &doc))
+		return doc.ConnectionID
+	}
+	statement := func(command string, fields ...bson.DocElem) bson.D {
+		return append(bson.D{
+			{Name: command, Value: "foo"},
+			{Name: "lsid", Value: testLSID},
+			{Name: "txnNumber", Value: int64(1)},
+			{Name: "autocommit", Value: false},
+			{Name: "$db", Value: "test"},
+		}, fields...)
+	}
+
+	a, b := dial(), dial()
+	defer a.Close()
+	defer b.Close()
+	pinned := run(a, statement("insert", bson.DocElem{Name: "startTransaction", Value: true}))
+	// The statement following a legacy write on another connection goes to the
+	// connection of its transaction rather than the one of the write.
+	_, err := b.Write(legacyWriteMessage(t, OpInsert, "test.foo"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, run(b, statement("update")), pinned)
+	ensure.DeepEqual(t, rec.sum("mongoproxy.message.mutation.followup.routed"), float64(1))
+	ensure.DeepEqual(t, run(b, statement("commitTransaction")), pinned)
+	ensure.DeepEqual(t, p.transactions.active(), 0)
+}
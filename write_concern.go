@@ -0,0 +1,115 @@
+package dvara
+
+import (
+	"bytes"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// writeCommands are the commands whose writeConcern may be rewritten.
+var writeCommands = []string{"insert", "update", "delete", "findAndModify"}
+
+// applyWriteConcern adjusts the writeConcern of a write command sent to the
+// given database according to MinWriteConcern and WriteConcernCaps. It returns
+// the possibly modified command and whether it was changed.
+//
+// Only write commands sent as an OpQuery can be rewritten. Legacy OpInsert,
+// OpUpdate and OpDelete messages carry no write concern, it's up to the client
+// to follow them up with a getLastError.
+func (r *ReplicaSet) applyWriteConcern(db string, q bson.D) (bson.D, bool) {
+	if r == nil || len(q) == 0 || (r.MinWriteConcern == 0 && len(r.WriteConcernCaps) == 0) {
+		return q, false
+	}
+	if !isWriteCommand(q[0].Name) {
+		return q, false
+	}
+	collection, _ := q[0].Value.(string)
+
+	wcIndex := -1
+	var wc bson.D
+	for i, e := range q {
+		if e.Name == "writeConcern" {
+			wcIndex = i
+			wc, _ = e.Value.(bson.D)
+			break
+		}
+	}
+
+	wIndex := -1
+	var w interface{}
+	for i, e := range wc {
+		if e.Name == "w" {
+			wIndex = i
+			w = e.Value
+			break
+		}
+	}
+
+	newW := w
+	if n, ok := writeConcernNumber(w); ok && wIndex != -1 && n < r.MinWriteConcern {
+		newW = r.MinWriteConcern
+	}
+	if max, ok := r.WriteConcernCaps[db+"."+collection]; ok && wIndex != -1 {
+		if n, ok := writeConcernNumber(newW); !ok || n > max {
+			newW = max
+		}
+	}
+	if newW == w {
+		return q, false
+	}
+
+	newWC := make(bson.D, len(wc))
+	copy(newWC, wc)
+	newWC[wIndex].Value = newW
+	newQ := make(bson.D, len(q))
+	copy(newQ, q)
+	newQ[wcIndex].Value = newWC
+	return newQ, true
+}
+
+// writeConcernNumber returns the numeric value of w, if it's a number. Tag
+// sets and "majority" are not numbers.
+func writeConcernNumber(w interface{}) (int, bool) {
+	switch n := w.(type) {
+	case int:
+		return n, true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+func isWriteCommand(name string) bool {
+	for _, c := range writeCommands {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// databaseName returns the database from a null terminated full collection
+// name like "db.$cmd\x00".
+func databaseName(fullCollectionName []byte) string {
+	if i := bytes.IndexByte(fullCollectionName, '.'); i >= 0 {
+		return string(fullCollectionName[:i])
+	}
+	return string(bytes.TrimSuffix(fullCollectionName, []byte{x00}))
+}
+
+// replaceQueryDocument replaces the query document in the parts of an OpQuery
+// message, adjusting the message length in the header accordingly.
+func replaceQueryDocument(h *messageHeader, parts [][]byte, index int, q bson.D) error {
+	doc, err := bson.Marshal(q)
+	if err != nil {
+		return err
+	}
+	h.MessageLength += int32(len(doc) - len(parts[index]))
+	parts[index] = doc
+	parts[0] = h.ToWire()
+	return nil
+}
@@ -0,0 +1,92 @@
+package dvara
+
+import (
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func insertCommand(collection string, w interface{}) bson.D {
+	return bson.D{
+		{Name: "insert", Value: collection},
+		{Name: "documents", Value: []interface{}{bson.D{{Name: "a", Value: 1}}}},
+		{Name: "writeConcern", Value: bson.D{{Name: "w", Value: w}, {Name: "j", Value: true}}},
+	}
+}
+
+func TestApplyWriteConcern(t *testing.T) {
+	t.Parallel()
+	r := &ReplicaSet{
+		MinWriteConcern:  1,
+		WriteConcernCaps: map[string]int{"test.logs": 1},
+	}
+	cases := []struct {
+		Name     string
+		DB       string
+		Query    bson.D
+		Expected bson.D
+		Changed  bool
+	}{
+		{"raise w:0", "test", insertCommand("foo", 0), insertCommand("foo", 1), true},
+		{"keep w:1", "test", insertCommand("foo", 1), insertCommand("foo", 1), false},
+		{"keep majority", "test", insertCommand("foo", "majority"), insertCommand("foo", "majority"), false},
+		{"cap majority", "test", insertCommand("logs", "majority"), insertCommand("logs", 1), true},
+		{"cap w:3", "test", insertCommand("logs", 3), insertCommand("logs", 1), true},
+		{"raise then cap", "test", insertCommand("logs", 0), insertCommand("logs", 1), true},
+		{"other db", "prod", insertCommand("logs", "majority"), insertCommand("logs", "majority"), false},
+		{
+			"not a write",
+			"test",
+			bson.D{{Name: "find", Value: "foo"}},
+			bson.D{{Name: "find", Value: "foo"}},
+			false,
+		},
+		{
+			"no write concern",
+			"test",
+			bson.D{{Name: "insert", Value: "foo"}},
+			bson.D{{Name: "insert", Value: "foo"}},
+			false,
+		},
+	}
+	for _, c := range cases {
+		q, changed := r.applyWriteConcern(c.DB, c.Query)
+		if changed != c.Changed {
+			t.Fatalf("%s: expected changed %v", c.Name, c.Changed)
+		}
+		ensure.DeepEqual(t, q, c.Expected, c.Name)
+	}
+}
+
+func TestApplyWriteConcernNotConfigured(t *testing.T) {
+	t.Parallel()
+	var r *ReplicaSet
+	q, changed := r.applyWriteConcern("test", insertCommand("foo", 0))
+	ensure.False(t, changed)
+	ensure.DeepEqual(t, q, insertCommand("foo", 0))
+	_, changed = (&ReplicaSet{}).applyWriteConcern("test", insertCommand("foo", 0))
+	ensure.False(t, changed)
+}
+
+func TestDatabaseName(t *testing.T) {
+	t.Parallel()
+	ensure.DeepEqual(t, databaseName([]byte("admin.$cmd\000")), "admin")
+	ensure.DeepEqual(t, databaseName([]byte("test.foo.bar\000")), "test")
+	ensure.DeepEqual(t, databaseName([]byte("test\000")), "test")
+}
+
+func TestReplaceQueryDocument(t *testing.T) {
+	t.Parallel()
+	oldDoc, err := bson.Marshal(insertCommand("foo", 0))
+	ensure.Nil(t, err)
+	h := &messageHeader{MessageLength: int32(headerLen + 4 + len(oldDoc)), OpCode: OpQuery}
+	parts := [][]byte{h.ToWire(), []byte{0, 0, 0, 0}, oldDoc}
+
+	ensure.Nil(t, replaceQueryDocument(h, parts, 2, insertCommand("foo", "majority")))
+	newDoc, err := bson.Marshal(insertCommand("foo", "majority"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, parts[2], newDoc)
+	ensure.DeepEqual(t, h.MessageLength, int32(headerLen+4+len(newDoc)))
+	ensure.DeepEqual(t, parts[0], h.ToWire())
+}